@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Agent runs prompts against a model with the built-in tools plus any extra
+// tools given to New. It works in Config.Dir, or the process's current
+// directory like the CLI, and keeps one Session across calls to Run.
+type Agent struct {
+	Config   Config
+	Provider Provider
+	Session  *Session
+
+	toolMap        map[string]Tool
+	anthropicTools []anthropic.ToolUnionParam
+}
+
+// Result summarizes one call to Run.
+type Result struct {
+	// Text is the assistant text of the turn.
+	Text         string  `json:"text"`
+	APICalls     int     `json:"api_calls"`
+	ToolCalls    int     `json:"tool_calls"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	// Artifacts are those saved with save_artifact during the turn.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+}
+
+// Event types reported to Session.OnEvent.
+const (
+	EventTextDelta  = "text_delta"
+	EventText       = "text"
+	EventToolCall   = "tool_call"
+	EventToolResult = "tool_result"
+	EventDiff       = "diff"
+	EventUsage      = "usage"
+	EventError      = "error"
+)
+
+// Event is one step of a turn: assistant text as it streams and once it is
+// complete, a tool call starting or finishing, a file change, the turn's token
+// usage, or an API error.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Turn int       `json:"turn"`
+	// Text is the next piece of assistant text, the whole assistant text,
+	// the tool result, the unified diff, or the error message.
+	Text       string          `json:"text,omitempty"`
+	Path       string          `json:"path,omitempty"`
+	ToolID     string          `json:"tool_id,omitempty"`
+	Tool       string          `json:"tool,omitempty"`
+	Input      json.RawMessage `json:"input,omitempty"`
+	IsError    bool            `json:"is_error,omitempty"`
+	ErrorCode  string          `json:"error_code,omitempty"`
+	DurationMs int64           `json:"duration_ms,omitempty"`
+
+	InputTokens  int64   `json:"input_tokens,omitempty"`
+	OutputTokens int64   `json:"output_tokens,omitempty"`
+	CostUSD      float64 `json:"cost_usd,omitempty"`
+}
+
+// New returns an Agent for cfg. Only the provider settings and ModelID are
+// required; the rest default as they do on the command line. Confirmation
+// prompts are declined, since there is no terminal to ask on.
+func New(cfg Config, tools ...Tool) (*Agent, error) {
+	if cfg.Provider == "" {
+		cfg.Provider = providerAnthropic
+	}
+	if cfg.ModelID == "" {
+		cfg.ModelID = defaultModelID
+	}
+	if cfg.ModelName == "" {
+		cfg.ModelName = modelDisplayName(cfg.ModelID)
+	}
+	if cfg.AssistantName == "" {
+		cfg.AssistantName = "Assistant"
+	}
+	if cfg.OllamaURL == "" {
+		cfg.OllamaURL = defaultOllamaURL
+	}
+	if cfg.OpenAIBaseURL == "" {
+		cfg.OpenAIBaseURL = defaultOpenAIBaseURL
+	}
+	if cfg.Project.Symlinks == "" {
+		cfg.Project.Symlinks = symlinkDenyEscape
+	}
+	if cfg.Dir != "" {
+		dir, err := filepath.Abs(cfg.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace directory %q: %w", cfg.Dir, err)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid workspace directory %q: not a directory", cfg.Dir)
+		}
+		cfg.Dir = dir
+	}
+	addDirs, err := resolveAddedDirs(cfg.AddDirs)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AddDirs = addDirs
+	if cfg.SystemPrompt == "" {
+		cfg.SystemPrompt = buildSystemPrompt(cfg)
+	}
+
+	session := newSession(cfg)
+	session.input = bufio.NewScanner(strings.NewReader(""))
+	toolMap, anthropicTools, err := buildToolRegistry(append(registeredTools(session), tools...), cfg.Project.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	provider := newProvider(cfg)
+	session.provider, session.tools = provider, anthropicTools
+	return &Agent{
+		Config:         cfg,
+		Provider:       provider,
+		Session:        session,
+		toolMap:        toolMap,
+		anthropicTools: anthropicTools,
+	}, nil
+}
+
+// Run sends prompt as the next user message and runs tools until the model
+// replies without calling any. Cancelling ctx stops the turn and the tool call
+// in progress.
+func (a *Agent) Run(ctx context.Context, prompt string) (*Result, error) {
+	saved := len(a.Session.artifacts)
+	stats := runTurn(ctx, a.Config, a.Session, a.Provider, a.toolMap, a.anthropicTools, prompt)
+	result := &Result{
+		Text:         a.Session.lastResponse,
+		APICalls:     stats.APICalls,
+		ToolCalls:    stats.ToolCalls,
+		InputTokens:  stats.Usage.InputTokens,
+		OutputTokens: stats.Usage.OutputTokens,
+		CostUSD:      stats.Usage.Cost,
+	}
+	if len(a.Session.artifacts) > saved {
+		result.Artifacts = append(result.Artifacts, a.Session.artifacts[saved:]...)
+	}
+	return result, stats.Err
+}
+
+// Close stops background processes and removes containers started by the
+// agent's tools, and deletes its scratch directory.
+func (a *Agent) Close() {
+	a.Session.cleanup()
+}
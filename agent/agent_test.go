@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewWorkspaceDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("in the workspace\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	a, err := New(Config{Dir: dir, Stdout: &out})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer a.Close()
+
+	abs, display, err := a.Session.resolveToolPath("notes.txt", false)
+	if err != nil {
+		t.Fatalf("resolveToolPath: %v", err)
+	}
+	if abs != filepath.Join(dir, "notes.txt") || display != "notes.txt" {
+		t.Errorf("resolveToolPath = %q, %q; want the file in %s", abs, display, dir)
+	}
+	if _, _, err := a.Session.resolveToolPath("../outside.txt", false); err == nil {
+		t.Error("resolveToolPath allowed a path outside the workspace")
+	}
+
+	input, _ := json.Marshal(map[string]any{"paths": []string{"notes.txt"}})
+	result, err := a.Session.readFiles(input)
+	if err != nil {
+		t.Fatalf("readFiles: %v", err)
+	}
+	if !strings.Contains(result, "in the workspace") {
+		t.Errorf("readFiles = %q, want the workspace file", result)
+	}
+	if out.Len() == 0 {
+		t.Error("tool progress was not written to Config.Stdout")
+	}
+}
+
+func TestNewRejectsMissingDir(t *testing.T) {
+	if _, err := New(Config{Dir: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("New accepted a workspace directory that does not exist")
+	}
+}
+
+func TestSessionsCommandUsesWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	record := SessionRecord{ID: "20260101-120000-abcd", Title: "fix the flaky test", Turns: 2}
+	data, _ := json.Marshal(record)
+	if err := os.MkdirAll(sessionsDir(dir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	saved := filepath.Join(sessionsDir(dir), record.ID+".json")
+	if err := os.WriteFile(saved, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	a, err := New(Config{Dir: dir, Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Session.Approve = func(string) bool { return true }
+
+	// The process works elsewhere; the listing must come from the workspace.
+	if err := sessionsCommand(a.Session, ""); err != nil {
+		t.Fatalf("/sessions: %v", err)
+	}
+	if !strings.Contains(out.String(), record.Title) {
+		t.Errorf("/sessions printed %q, want the workspace's session", out.String())
+	}
+	if err := sessionsCommand(a.Session, "delete 1"); err != nil {
+		t.Fatalf("/sessions delete: %v", err)
+	}
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Errorf("the deleted session's file still exists: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	artifactsDirName = "artifacts"
+	maxArtifactBytes = 50 << 20
+)
+
+// artifactName is a relative path of plain names, such as report.md or
+// diagrams/architecture.svg.
+var artifactName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(/[A-Za-z0-9_][A-Za-z0-9_.-]*)*$`)
+
+// Artifact is a deliverable the agent saved with save_artifact, such as a
+// report or a generated diagram. Path is relative to the workspace.
+type Artifact struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Bytes       int    `json:"bytes"`
+	Description string `json:"description,omitempty"`
+}
+
+type SaveArtifactInput struct {
+	Name        *string `json:"name"`
+	Content     *string `json:"content,omitempty"`
+	Path        string  `json:"path,omitempty"`
+	Description string  `json:"description,omitempty"`
+}
+
+func saveArtifactInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"name": map[string]any{
+				"type":        "string",
+				"description": "File name for the artifact, optionally under subdirectories, such as report.md or diagrams/architecture.svg.",
+			},
+			"content": map[string]any{
+				"type":        "string",
+				"description": "Text of the artifact. Give content or path, not both.",
+			},
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Workspace file to save a copy of, such as scratch/coverage.html. Give content or path, not both.",
+			},
+			"description": map[string]any{
+				"type":        "string",
+				"description": "One line on what the artifact is, shown in the list at the end of the run.",
+			},
+		},
+		Required: []string{"name"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// saveArtifact stores a deliverable under .coder/artifacts/<session>/, where
+// it outlives the run and the session's scratch directory. Saving a name
+// again replaces it.
+func (s *Session) saveArtifact(input json.RawMessage) (string, error) {
+	const expected = `{"name":"report.md","content":"# Flaky tests\n...","description":"Flaky test investigation"}`
+
+	args := SaveArtifactInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("save_artifact", err.Error(), expected)
+	}
+	name, err := requireToolString("save_artifact", "name", args.Name, false, expected)
+	if err != nil {
+		return "", err
+	}
+	name = strings.TrimSpace(name)
+	if !artifactName.MatchString(name) || len(name) > 200 {
+		return "", toolInputValidationError("save_artifact", fmt.Sprintf("invalid name %q; use a relative path of letters, digits, '.', '-', and '_', such as reports/summary.md", name), expected)
+	}
+	sourcePath := strings.TrimSpace(args.Path)
+	if (args.Content == nil) == (sourcePath == "") {
+		return "", toolInputValidationError("save_artifact", "give either content or path", expected)
+	}
+
+	var data []byte
+	if args.Content != nil {
+		data = []byte(*args.Content)
+	} else {
+		absFile, displayPath, err := s.resolveWorkspaceFile(sourcePath)
+		if err != nil {
+			return "", err
+		}
+		if workspaceIgnore(s.root).Ignored(displayPath, false) {
+			return "", newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+		}
+		file, err := os.Open(absFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+		}
+		data, err = io.ReadAll(io.LimitReader(file, maxArtifactBytes+1))
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+		}
+	}
+	if len(data) > maxArtifactBytes {
+		return "", newToolError(ToolErrorValidation, "artifact %s is larger than %s", name, formatByteSize(maxArtifactBytes))
+	}
+
+	rel := filepath.Join(coderDirName, artifactsDirName, s.ID, filepath.FromSlash(name))
+	dest := filepath.Join(s.root, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+	if err := os.WriteFile(dest, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write artifact %s: %w", name, err)
+	}
+
+	artifact := Artifact{Name: name, Path: filepath.ToSlash(rel), Bytes: len(data), Description: strings.TrimSpace(args.Description)}
+	replaced := false
+	for i := range s.artifacts {
+		if s.artifacts[i].Name == name {
+			if artifact.Description == "" {
+				artifact.Description = s.artifacts[i].Description
+			}
+			s.artifacts[i], replaced = artifact, true
+		}
+	}
+	if !replaced {
+		s.artifacts = append(s.artifacts, artifact)
+	}
+	s.audit.record(AuditEntry{Tool: "save_artifact", Path: artifact.Path, Existed: replaced, BytesAfter: len(data), AfterSHA256: hashContent(data)})
+	debugf("save_artifact name=%q bytes=%d replaced=%t", name, len(data), replaced)
+	fmt.Fprintf(s.out, "%s: %s (%d bytes)\n", colorLabel("artifact", commentColor, s.cfg.ColorOutput), artifact.Path, len(data))
+	return fmt.Sprintf("saved artifact %s to %s", name, artifact.Path), nil
+}
+
+// printArtifacts lists the session's artifacts at the end of a run.
+func (s *Session) printArtifacts(w io.Writer) {
+	if len(s.artifacts) == 0 {
+		return
+	}
+	fmt.Fprintln(w, colorLabel(fmt.Sprintf("Artifacts (%d):", len(s.artifacts)), commentColor, s.cfg.ColorOutput))
+	for _, artifact := range s.artifacts {
+		line := fmt.Sprintf("  %s  %s", artifact.Path, formatByteSize(int64(artifact.Bytes)))
+		if artifact.Description != "" {
+			line += "  " + artifact.Description
+		}
+		fmt.Fprintln(w, line)
+	}
+}
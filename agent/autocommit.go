@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxAutoCommitSubject is the longest subject line an auto-commit gets from
+// the prompt that started the turn.
+const maxAutoCommitSubject = 72
+
+// autoCommitTurn commits the files a successful turn changed, with the turn's
+// prompt as the message, so each turn can be reviewed or reverted on its own.
+// Only the paths the turn touched are committed: other uncommitted work in the
+// workspace stays as it was.
+func (s *Session) autoCommitTurn(turn int, prompt string) {
+	root := s.workspaceGitRoot()
+	if root == "" {
+		return
+	}
+	changes, err := s.turnFileChanges(turn)
+	if err != nil {
+		s.reportAutoCommitFailure(turn, err)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+
+	message := autoCommitMessage(prompt, turn, s.ID)
+	literal := []string{"GIT_LITERAL_PATHSPECS=1"}
+	if _, err := runGit(root, literal, append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		s.reportAutoCommitFailure(turn, err)
+		return
+	}
+	if _, err := runGit(root, literal, append([]string{"commit", "-q", "-m", message, "--"}, paths...)...); err != nil {
+		s.reportAutoCommitFailure(turn, err)
+		return
+	}
+	hash, err := runGit(root, nil, "rev-parse", "--short", "HEAD")
+	if err != nil {
+		s.reportAutoCommitFailure(turn, err)
+		return
+	}
+	s.audit.record(AuditEntry{Tool: "auto_commit", Command: "git commit " + hash})
+	debugf("auto_commit turn=%d commit=%q files=%d", turn, hash, len(paths))
+	fmt.Fprintf(s.out, "%s %d file(s) as %s\n", colorLabel("Committed", commentColor, s.cfg.ColorOutput), len(paths), hash)
+}
+
+func (s *Session) reportAutoCommitFailure(turn int, err error) {
+	debugf("auto_commit_failed turn=%d error=%q", turn, err.Error())
+	fmt.Fprintf(s.out, "%s: could not commit this turn's changes: %v\n", colorLabel("warning", warnColor, s.cfg.ColorOutput), err)
+}
+
+// autoCommitMessage uses the first line of the prompt as the subject and
+// names the session and turn in the body, so git log leads back to the
+// conversation.
+func autoCommitMessage(prompt string, turn int, sessionID string) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	subject = previewText(subject, maxAutoCommitSubject)
+	if subject == "" {
+		subject = fmt.Sprintf("coder turn %d", turn)
+	}
+	return fmt.Sprintf("%s\n\nTurn %d of coder session %s.", subject, turn, sessionID)
+}
@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat names the per-write directories under .coder/backups; it
+// sorts in time order and is safe in file names.
+const backupTimeFormat = "20060102-150405.000"
+
+// backupFile copies the current content of a file about to be overwritten to
+// .coder/backups/<timestamp>/<path>, so it can be recovered even after the
+// session and its undo history are gone. It returns the backup's path
+// relative to the workspace.
+func (s *Session) backupFile(displayPath string, data []byte) (string, error) {
+	// Files in added directories are shown by absolute path; keep that path
+	// under the backup directory.
+	rel := strings.TrimLeft(filepath.ToSlash(filepath.Clean(displayPath)), "/")
+	rel = strings.ReplaceAll(rel, "../", "")
+	backup := filepath.Join(coderDirName, backupsDirName, time.Now().Format(backupTimeFormat), filepath.FromSlash(rel))
+	abs := filepath.Join(s.root, backup)
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", displayPath, err)
+	}
+	if err := os.WriteFile(abs, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", displayPath, err)
+	}
+	debugf("backup path=%q backup=%q bytes=%d", displayPath, backup, len(data))
+	return filepath.ToSlash(backup), nil
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// workBranchPrefix starts the name of every branch -branch creates.
+const workBranchPrefix = "agent/"
+
+// ensureWorkBranch switches the workspace to a new agent/<slug> branch off the
+// current HEAD before the session first changes anything, so the agent's work
+// never lands on the branch the user was on. The slug comes from the prompt of
+// the turn. Uncommitted changes carry over to the new branch. A session that
+// is already on an agent/ branch, such as a resumed one, stays there.
+func (s *Session) ensureWorkBranch() error {
+	if !s.cfg.WorkBranch || s.workBranchReady {
+		return nil
+	}
+	root := s.workspaceGitRoot()
+	if root == "" {
+		s.workBranchReady = true
+		return nil
+	}
+	current, _ := runGit(root, nil, "symbolic-ref", "--short", "-q", "HEAD")
+	if strings.HasPrefix(current, workBranchPrefix) {
+		s.workBranchReady = true
+		debugf("work_branch_kept branch=%q", current)
+		return nil
+	}
+
+	prompt := ""
+	if len(s.checkpoints) > 0 {
+		prompt = s.checkpoints[len(s.checkpoints)-1].Prompt
+	}
+	base := workBranchPrefix + branchSlug(prompt)
+	name := base
+	for i := 2; ; i++ {
+		if _, err := runGit(root, nil, "rev-parse", "--verify", "-q", "refs/heads/"+name); err != nil {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	if _, err := runGit(root, nil, "checkout", "-q", "-b", name); err != nil {
+		return err
+	}
+	s.workBranchReady = true
+	if current == "" {
+		current = "a detached HEAD"
+	}
+	s.audit.record(AuditEntry{Tool: "work_branch", Command: "git checkout -b " + name})
+	debugf("work_branch_created branch=%q from=%q", name, current)
+	fmt.Fprintf(s.out, "%s %s (from %s)\n", colorLabel("Switched to new branch", commentColor, s.cfg.ColorOutput), name, current)
+	return nil
+}
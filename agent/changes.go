@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fileChange is one file a turn created, modified, or deleted, with its
+// added and removed line counts. Binary files have no counts.
+type fileChange struct {
+	Status  string
+	Path    string
+	Added   int
+	Removed int
+	Binary  bool
+}
+
+// printTurnChanges prints what a turn did to the workspace: the files it
+// changed since the turn's checkpoint, with line counts, and how many commands
+// it ran. Workspaces outside git have no checkpoint, so only the commands are
+// counted there.
+func (s *Session) printTurnChanges(turn, commands int) {
+	changes, err := s.turnFileChanges(turn)
+	if err != nil {
+		debugf("turn_changes_failed turn=%d error=%q", turn, err.Error())
+	}
+	if len(changes) == 0 && commands == 0 {
+		return
+	}
+
+	added, removed := 0, 0
+	width := 0
+	for _, change := range changes {
+		added += change.Added
+		removed += change.Removed
+		width = max(width, len(change.Path))
+	}
+	summary := fmt.Sprintf("%d file(s) changed (+%d -%d)", len(changes), added, removed)
+	if commands > 0 {
+		summary += fmt.Sprintf(", %d command(s) run", commands)
+	}
+	fmt.Fprintln(s.out, colorLabel("Changes this turn: "+summary, commentColor, s.cfg.ColorOutput))
+	for _, change := range changes {
+		counts := fmt.Sprintf("+%d -%d", change.Added, change.Removed)
+		if change.Binary {
+			counts = "binary"
+		}
+		fmt.Fprintf(s.out, "  %s  %-*s  %s\n", change.Status, width, change.Path, counts)
+	}
+	debugf("turn_changes turn=%d files=%d added=%d removed=%d commands=%d", turn, len(changes), added, removed, commands)
+}
+
+// turnFileChanges diffs the workspace against the checkpoint taken at the
+// start of turn.
+func (s *Session) turnFileChanges(turn int) ([]fileChange, error) {
+	root := s.workspaceGitRoot()
+	from := ""
+	for _, cp := range s.checkpoints {
+		if cp.Turn == turn {
+			from = cp.Commit
+		}
+	}
+	if root == "" || from == "" {
+		return nil, nil
+	}
+	now, err := snapshotWorkspace(root, s.coderDirInRepo(root), "coder turn summary snapshot")
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := runGit(root, nil, "diff", "--name-status", "--no-renames", "-z", from, now)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := runGit(root, nil, "diff", "--numstat", "--no-renames", "-z", from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []fileChange
+	fields := strings.Split(strings.TrimSuffix(statuses, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes = append(changes, fileChange{Status: fields[i], Path: fields[i+1]})
+	}
+	lineCounts := map[string][2]int{}
+	binary := map[string]bool{}
+	for _, record := range strings.Split(counts, "\x00") {
+		parts := strings.SplitN(record, "\t", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "-" {
+			binary[parts[2]] = true
+			continue
+		}
+		added, _ := strconv.Atoi(parts[0])
+		removed, _ := strconv.Atoi(parts[1])
+		lineCounts[parts[2]] = [2]int{added, removed}
+	}
+	for i := range changes {
+		changes[i].Added, changes[i].Removed = lineCounts[changes[i].Path][0], lineCounts[changes[i].Path][1]
+		changes[i].Binary = binary[changes[i].Path]
+	}
+	return changes, nil
+}
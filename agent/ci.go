@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ciResultName        = "ci-result.json"
+	ciTestTimeout       = 30 * time.Minute
+	maxCITestOutputTail = 8_000
+)
+
+// CIConfig holds the -ci settings.
+type CIConfig struct {
+	Enabled     bool
+	Prompt      string
+	MaxDuration time.Duration
+	ResultPath  string
+	TestCommand string
+}
+
+// CIResult is the JSON artifact written at the end of a -ci run.
+type CIResult struct {
+	Success      bool          `json:"success"`
+	Outcome      string        `json:"outcome"`
+	ExitCode     int           `json:"exit_code"`
+	Error        string        `json:"error,omitempty"`
+	Model        string        `json:"model"`
+	Session      string        `json:"session"`
+	ChangedFiles []string      `json:"changed_files"`
+	Artifacts    []Artifact    `json:"artifacts"`
+	Tests        *CITestResult `json:"tests,omitempty"`
+	APICalls     int           `json:"api_calls"`
+	ToolCalls    int           `json:"tool_calls"`
+	InputTokens  int64         `json:"input_tokens"`
+	OutputTokens int64         `json:"output_tokens"`
+	CostUSD      float64       `json:"cost_usd"`
+	DurationMs   int64         `json:"duration_ms"`
+	FinalMessage string        `json:"final_message,omitempty"`
+}
+
+// CITestResult records the -ci-test command run after the agent finished.
+type CITestResult struct {
+	Command  string `json:"command"`
+	Passed   bool   `json:"passed"`
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// runCI runs one prompt without a terminal and returns the process exit code,
+// one of the headless codes, so a task ends with the same status whichever
+// way it was run. Confirmation prompts are declined; the run stops at the
+// -max-duration and -max-cost budgets.
+func runCI(cfg Config) int {
+	start := time.Now()
+	result := CIResult{Model: cfg.ModelID, ChangedFiles: []string{}, Artifacts: []Artifact{}}
+	finish := func(outcome string, code int, err error) int {
+		result.Outcome, result.ExitCode, result.Success = outcome, code, code == exitHeadlessSuccess
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.DurationMs = time.Since(start).Milliseconds()
+		if writeErr := writeCIResult(cfg.CI.ResultPath, result); writeErr != nil {
+			fmt.Fprintln(os.Stderr, "Error:", writeErr)
+		}
+		for _, artifact := range result.Artifacts {
+			fmt.Fprintf(os.Stdout, "ci: artifact %s\n", artifact.Path)
+		}
+		fmt.Fprintf(os.Stdout, "ci: %s (exit %d)\n", outcome, code)
+		return code
+	}
+
+	prompt := cfg.CI.Prompt
+	if prompt == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return finish("error", exitHeadlessError, fmt.Errorf("failed to read prompt from stdin: %w", err))
+		}
+		prompt = strings.TrimSpace(string(data))
+	}
+	if prompt == "" {
+		return finish("error", exitHeadlessError, errors.New("-ci needs a prompt as arguments or on stdin"))
+	}
+
+	session := newSession(cfg)
+	session.input = bufio.NewScanner(strings.NewReader(""))
+	result.Session = session.ID
+	toolMap, anthropicTools, err := buildToolRegistry(registeredTools(session), cfg.Project.Permissions)
+	if err != nil {
+		return finish("error", exitHeadlessError, err)
+	}
+	if cfg.MetricsAddr != "" {
+		startMetricsServer(cfg.MetricsAddr)
+	}
+	provider := newProvider(cfg)
+	session.provider, session.tools = provider, anthropicTools
+
+	ctx := context.Background()
+	if cfg.CI.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.CI.MaxDuration)
+		defer cancel()
+	}
+	stats := runTurn(ctx, cfg, session, provider, toolMap, anthropicTools, prompt)
+	session.cleanup()
+
+	result.APICalls = stats.APICalls
+	result.ToolCalls = stats.ToolCalls
+	result.InputTokens = stats.Usage.InputTokens
+	result.OutputTokens = stats.Usage.OutputTokens
+	result.CostUSD = stats.Usage.Cost
+	result.FinalMessage = session.lastResponse
+	result.Artifacts = append(result.Artifacts, session.artifacts...)
+	if root := session.workspaceGitRoot(); root != "" {
+		if paths, err := session.sessionChangedPaths(root); err == nil {
+			result.ChangedFiles = append(result.ChangedFiles, paths...)
+		}
+	}
+
+	switch {
+	case errors.Is(stats.Err, context.DeadlineExceeded):
+		return finish("budget_exceeded", exitHeadlessLimit, fmt.Errorf("time budget of %s exceeded", cfg.CI.MaxDuration))
+	case errors.Is(stats.Err, errCostBudgetExceeded), errors.Is(stats.Err, errContextWindowExceeded):
+		return finish("budget_exceeded", exitHeadlessLimit, stats.Err)
+	case stats.Err != nil:
+		return finish("agent_failed", exitHeadlessError, stats.Err)
+	case stats.Stopped == stopConditionStopped:
+		return finish("budget_exceeded", exitHeadlessLimit, fmt.Errorf("stopped: %s", stats.StopReason))
+	case stats.Stopped == "max_tool_rounds":
+		return finish("incomplete", exitHeadlessLimit, fmt.Errorf("stopped after %d tool rounds", maxToolRoundsPerTurn))
+	case stats.Stopped != "":
+		return finish("incomplete", exitHeadlessTaskFailed, fmt.Errorf("tool loop stopped: %s", stats.Stopped))
+	}
+
+	if cfg.CI.TestCommand != "" {
+		fmt.Fprintf(os.Stdout, "ci: running %s\n", cfg.CI.TestCommand)
+		result.Tests = runCITests(ctx, cfg.CI.TestCommand)
+		if !result.Tests.Passed {
+			return finish("tests_failed", exitHeadlessTaskFailed, fmt.Errorf("%q exited with status %d", cfg.CI.TestCommand, result.Tests.ExitCode))
+		}
+	}
+	return finish("success", exitHeadlessSuccess, nil)
+}
+
+func runCITests(ctx context.Context, command string) *CITestResult {
+	ctx, cancel := context.WithTimeout(ctx, ciTestTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-lc", command)
+	output, err := cmd.CombinedOutput()
+	test := &CITestResult{Command: command, Passed: err == nil}
+	if err != nil {
+		test.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			test.ExitCode = exitErr.ExitCode()
+		}
+	}
+	if len(output) > maxCITestOutputTail {
+		output = output[len(output)-maxCITestOutputTail:]
+	}
+	test.Output = strings.ToValidUTF8(string(output), "")
+	return test
+}
+
+func writeCIResult(path string, result CIResult) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to write CI result: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write CI result: %w", err)
+	}
+	return nil
+}
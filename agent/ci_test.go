@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCIUsesHeadlessExitCodes(t *testing.T) {
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no model here", http.StatusBadRequest)
+	}))
+	defer model.Close()
+	dir := t.TempDir()
+	resultPath := filepath.Join(dir, "ci-result.json")
+	cfg := Config{
+		Provider:  providerOllama,
+		OllamaURL: model.URL,
+		ModelID:   "test",
+		Dir:       dir,
+		Stdout:    io.Discard,
+		CI:        CIConfig{Enabled: true, Prompt: "fix the build", ResultPath: resultPath},
+	}
+
+	// A failed model request is an error in headless runs too.
+	if code := runCI(cfg); code != exitHeadlessError {
+		t.Errorf("runCI after a failed request = %d, want %d", code, exitHeadlessError)
+	}
+	data, err := os.ReadFile(resultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result CIResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != "agent_failed" || result.ExitCode != exitHeadlessError {
+		t.Errorf("CI result = %s with exit %d, want agent_failed with %d", result.Outcome, result.ExitCode, exitHeadlessError)
+	}
+}
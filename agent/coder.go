@@ -0,0 +1,7750 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+const (
+	defaultModelID   = "claude-sonnet-4-6"
+	defaultModelName = "Sonnet 4.6"
+	defaultMaxTokens = int64(8192)
+	defaultTemp      = 0.2
+
+	providerAnthropic    = "anthropic"
+	providerOllama       = "ollama"
+	providerOpenAI       = "openai"
+	defaultOllamaModelID = "llama3.1"
+	defaultOllamaURL     = "http://localhost:11434"
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+	defaultListFilesMaxEntries = 500
+	hardListFilesMaxEntries    = 2000
+	defaultReadFilesMaxBytes   = 32_000
+	hardReadFilesMaxBytes      = 256_000
+	maxReadFilesPaths          = 20
+	defaultBashTimeoutSeconds  = 30
+	hardBashTimeoutSeconds     = 120
+	defaultBashMaxOutputBytes  = 32_000
+	hardBashMaxOutputBytes     = 256_000
+	maxDiffBytes               = 16 << 10
+	maxEditResultDiffBytes     = 4 << 10
+	maxDiffCells               = 4_000_000
+	maxBackgroundProcesses     = 8
+	maxProcessBufferBytes      = 1 << 20
+	processKillGracePeriod     = 3 * time.Second
+	maxToolRoundsPerTurn       = 16
+	maxRepeatedToolFailures    = 2
+	maxMemoryNoteBytes         = 16_000
+	maxMemoryPromptBytes       = 8_000
+
+	coderDirName        = ".coder"
+	memoryDirName       = "memory"
+	promptsDirName      = "prompts"
+	commandsDirName     = "commands"
+	projectConfigName   = "config.json"
+	auditLogName        = "audit.jsonl"
+	coderIgnoreName     = ".coderignore"
+	trashDirName        = "trash"
+	backupsDirName      = "backups"
+	sessionsDirName     = "sessions"
+	maxListedSessions   = 20
+	compactKeepMessages = 4
+	compactPrompt       = `Summarize our conversation so far so it can replace the full history. Include the user's goals and constraints, decisions made, files created or changed (with paths), commands run and their outcomes, open problems, and what remains to be done. Be specific and concise; do not call tools.`
+	defaultHookTimeout  = 30
+	maxHookOutputBytes  = 16_000
+
+	profileDefault   = "default"
+	profileReadOnly  = "read-only"
+	profileOps       = "ops"
+	permissionAllow  = "allow"
+	permissionAsk    = "ask"
+	permissionDeny   = "deny"
+	permissionHidden = "disabled"
+
+	toolUseSystemPrompt = `You are a coding agent that can use filesystem and shell tools.
+Use tools with strict JSON inputs that match each schema exactly.
+- For creating a new file or replacing an entire file, use write_file.
+- For targeted edits, use edit_file or edit_files with path, old_str, and new_str.
+- Never call bash without a non-empty "command" field.
+- If a tool returns an input-validation error, fix the JSON and retry with corrected arguments.`
+
+	userColor   = "\x1b[38;2;102;178;255m"
+	claudeColor = "\x1b[38;2;217;119;6m"
+	toolColor   = "\x1b[96m"
+	resultColor = "\x1b[92m"
+	errorColor  = "\x1b[91m"
+	warnColor   = "\x1b[93m"
+	colorReset  = "\x1b[0m"
+
+	keywordColor = "\x1b[95m"
+	stringColor  = "\x1b[32m"
+	commentColor = "\x1b[90m"
+	numberColor  = "\x1b[36m"
+	boldOn       = "\x1b[1m"
+	boldOff      = "\x1b[22m"
+	italicOn     = "\x1b[3m"
+	italicOff    = "\x1b[23m"
+	underlineOn  = "\x1b[4m"
+	underlineOff = "\x1b[24m"
+	defaultFg    = "\x1b[39m"
+)
+
+var errListLimitReached = errors.New("list_files entry limit reached")
+
+type Config struct {
+	APIKey        string
+	Provider      string
+	OllamaURL     string
+	OpenAIBaseURL string
+	OpenAIAPIKey  string
+	ModelID       string
+	ModelName     string
+	AssistantName string
+	Verbose       bool
+	ColorOutput   bool
+	MemoryContext bool
+	SystemPrompt  string
+	MetricsAddr   string
+	ListSessions  bool
+	FallbackModel string
+	TraceDir      string
+	Resume        string
+	Highlight     bool
+	Markdown      bool
+	// MaxCost stops a turn before the next request once the session has
+	// spent this many dollars. Zero means no limit.
+	MaxCost float64
+	// AutoApprove answers every confirmation prompt with yes. The workspace
+	// boundary, the command denylist, and MaxCost still apply.
+	AutoApprove bool
+	// Dir is the workspace: file tools resolve paths in it and commands run
+	// in it. Empty means the current directory.
+	Dir string
+	// Stdout receives what the session prints while it works, such as
+	// replies and tool progress. Nil means os.Stdout.
+	Stdout io.Writer
+	// AddDirs are directories outside the workspace that file tools may
+	// read, and write when marked so.
+	AddDirs []AddedDir
+	// RepoMapTokens is the approximate size of the repository map added to
+	// the system prompt. Zero leaves the map out.
+	RepoMapTokens int
+	// BaseSystemPrompt replaces the built-in instructions at the start of the
+	// system prompt; AppendSystemPrompt is added at its end.
+	BaseSystemPrompt   string
+	AppendSystemPrompt string
+	// Env adds variables to the environment of bash commands for this
+	// session, over the project config's env.set.
+	Env map[string]string
+	// DiskQuota is how many bytes the session may grow the workspace by
+	// before writes and commands are blocked. Zero means no quota.
+	DiskQuota int64
+	// Prompt, from -p, is run as a single turn instead of the chat loop.
+	Prompt string
+	// Quiet, for -p runs, prints only the final reply.
+	Quiet bool
+	// Headless is set for -p and -script runs and for prompts piped to
+	// stdin: no chat loop, and an exit code for the outcome.
+	Headless bool
+	// ScriptPath, from -script, is a file of prompts run as consecutive
+	// headless turns.
+	ScriptPath string
+	// VerifyCommand, with -verify, is run after a headless turn; its exit
+	// status decides whether the task succeeded.
+	VerifyCommand string
+	// AutoCommit, from -auto-commit or the project config, commits the
+	// files each successful turn changed with the prompt as the message.
+	AutoCommit bool
+	// CompileCheck, from -compile-check or the project config, checks that
+	// source files compile after each write or edit.
+	CompileCheck bool
+	// WorkBranch, from -branch or the project config, switches to a new
+	// agent/<slug> branch before the session first changes the workspace.
+	WorkBranch bool
+	// Review is set for coder review runs, which offer submit_review.
+	Review bool
+	// Docker, from -docker or the project config, offers docker_build and
+	// docker_run.
+	Docker bool
+	// Embedder, when set, turns on retrieval: each prompt is sent with the
+	// RetrievalK workspace snippets most similar to it.
+	Embedder   Embedder
+	RetrievalK int
+	CI         CIConfig
+	Project    ProjectConfig
+}
+
+// workspaceRoot returns Dir, or the current directory when it is unset.
+func (cfg Config) workspaceRoot() string {
+	if cfg.Dir != "" {
+		return cfg.Dir
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return cwd
+}
+
+// AddedDir is a directory outside the workspace registered with -add-dir or
+// add_dirs in the project config. It is read-only unless Write is set.
+type AddedDir struct {
+	Path  string `json:"path"`
+	Write bool   `json:"write"`
+}
+
+// addDirFlag collects repeated -add-dir values of the form path[:rw].
+type addDirFlag []AddedDir
+
+func (f *addDirFlag) String() string {
+	var parts []string
+	for _, dir := range *f {
+		parts = append(parts, dir.Path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *addDirFlag) Set(value string) error {
+	dir := AddedDir{Path: value}
+	if path, ok := strings.CutSuffix(value, ":rw"); ok {
+		dir = AddedDir{Path: path, Write: true}
+	} else if path, ok := strings.CutSuffix(value, ":ro"); ok {
+		dir.Path = path
+	}
+	if strings.TrimSpace(dir.Path) == "" {
+		return errors.New("directory is required")
+	}
+	*f = append(*f, dir)
+	return nil
+}
+
+// ProjectConfig is read from .coder/config.json in the workspace (or the file
+// given by -config).
+type ProjectConfig struct {
+	Hooks       HooksConfig       `json:"hooks"`
+	Permissions PermissionsConfig `json:"permissions"`
+	Audit       AuditConfig       `json:"audit"`
+	// Symlinks is "deny-escape" (default) to reject paths that resolve
+	// outside the workspace through a symlink, or "allow" to follow them.
+	Symlinks string `json:"symlinks"`
+	// UsageFooter controls the token/context/cost line printed after each
+	// turn. It defaults to on.
+	UsageFooter *bool `json:"usage_footer,omitempty"`
+	// FallbackModel is used for the rest of a turn after the primary model
+	// fails with an overloaded or server error.
+	FallbackModel string `json:"fallback_model,omitempty"`
+	// AddDirs registers directories outside the workspace, as -add-dir does.
+	// Relative paths are resolved against the workspace.
+	AddDirs []AddedDir `json:"add_dirs,omitempty"`
+	// LineEndings is "preserve" (default) to keep an existing file's LF or
+	// CRLF style when the model rewrites it, or "lf"/"crlf" to force one.
+	LineEndings string `json:"line_endings,omitempty"`
+	// FinalNewline is "preserve" (default) to keep whether an existing file
+	// ends with a newline, or "always"/"never".
+	FinalNewline string `json:"final_newline,omitempty"`
+	// Env controls which variables bash commands see.
+	Env EnvConfig `json:"env"`
+	// MaxWriteBytes is the largest a write or edit may make a file. Zero
+	// means the default of 1 MiB.
+	MaxWriteBytes int `json:"max_write_bytes,omitempty"`
+	// DiskQuota is a size such as "500M" that the session may grow the
+	// workspace by; -disk-quota overrides it.
+	DiskQuota string `json:"disk_quota,omitempty"`
+	// RequestTimeouts maps a model id prefix to how long a request to it may
+	// take, such as "10m", over the built-in per-model timeouts.
+	RequestTimeouts map[string]string `json:"request_timeouts,omitempty"`
+	// Retention limits what the history keeps from older turns.
+	Retention RetentionConfig `json:"retention"`
+	// ChangeSummary controls the list of files changed and commands run
+	// printed after each turn that used tools. It defaults to on.
+	ChangeSummary *bool `json:"change_summary,omitempty"`
+	// SessionTitles has a cheap model title each interactive session after
+	// its first exchange. It defaults to on.
+	SessionTitles *bool `json:"session_titles,omitempty"`
+	// AutoCommit commits the files each successful turn changed, as
+	// -auto-commit does.
+	AutoCommit bool `json:"auto_commit,omitempty"`
+	// AutoBranch moves the session to a new agent/ branch before its first
+	// change, as -branch does.
+	AutoBranch bool `json:"auto_branch,omitempty"`
+	// Feedback runs a check after the model changes files and sends it
+	// the failures.
+	Feedback FeedbackConfig `json:"feedback"`
+	// CompileCheck compiles or syntax-checks each source file a write or
+	// edit touches and adds the errors to its result, as -compile-check
+	// does.
+	CompileCheck bool `json:"compile_check,omitempty"`
+	// Stop holds conditions that end the tool loop, such as a time limit or
+	// a path the agent must not change unattended.
+	Stop StopConfig `json:"stop"`
+	// Docker offers the container tools and sets their limits.
+	Docker DockerConfig `json:"docker"`
+	// Database points db_query at a database to read.
+	Database DatabaseConfig `json:"database"`
+	// HTTP lets http_request reach local hosts.
+	HTTP HTTPConfig `json:"http"`
+}
+
+// AuditConfig controls the append-only log of workspace mutations. The log is
+// written to .coder/audit.jsonl unless Path overrides it.
+type AuditConfig struct {
+	Disabled bool   `json:"disabled"`
+	Path     string `json:"path"`
+}
+
+// PermissionsConfig controls which tools are offered to the model and whether
+// calls need approval. Profile "read-only" disables every tool that can modify
+// the workspace; "ops" does the same and adds ops_command. Tools maps a tool
+// name to "allow", "ask", or "deny".
+type PermissionsConfig struct {
+	Profile  string            `json:"profile"`
+	Disabled []string          `json:"disabled"`
+	Tools    map[string]string `json:"tools"`
+	// Protected adds .coderignore-style patterns to the paths that file
+	// tools change only with the user's approval.
+	Protected []string `json:"protected,omitempty"`
+	// DenyCommands are regular expressions; bash refuses commands matching
+	// any of them, or the built-in denylist, even under -yes.
+	DenyCommands []string `json:"deny_commands,omitempty"`
+
+	// askWrites makes every tool that is not ReadOnly ask unless Tools sets
+	// its permission; coder slack sets it.
+	askWrites bool
+}
+
+type HooksConfig struct {
+	PreTool  []HookConfig `json:"pre_tool"`
+	PostTool []HookConfig `json:"post_tool"`
+}
+
+// HookConfig is a shell command run before or after matching tool calls. A
+// pre_tool hook that exits non-zero blocks the call.
+type HookConfig struct {
+	Tools          []string `json:"tools"`
+	Command        string   `json:"command"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+	AttachOutput   bool     `json:"attach_output"`
+}
+
+type Tool struct {
+	Name        string
+	Description string
+	InputSchema anthropic.ToolInputSchemaParam
+	Function    func(input json.RawMessage) (string, error)
+	// ReadOnly marks tools that never modify the workspace or project state.
+	ReadOnly bool
+	// AskByDefault makes calls need approval unless permissions.tools sets
+	// a mode for the tool.
+	AskByDefault bool
+	// InputAliases maps alternative input field names the tool accepts to the
+	// schema field each stands for, so input validation allows them.
+	InputAliases map[string]string
+	// Native, if set, is the Anthropic-defined tool sent to the model in
+	// place of Description and InputSchema, which then only validate input.
+	Native *anthropic.ToolUnionParam
+}
+
+type ToolUse struct {
+	ID    string
+	Name  string
+	Input json.RawMessage
+}
+
+type ListFilesInput struct {
+	Path       string `json:"path,omitempty"`
+	Recursive  *bool  `json:"recursive,omitempty"`
+	MaxEntries int    `json:"max_entries,omitempty"`
+}
+
+type ReadFilesInput struct {
+	Path      *string  `json:"path"`
+	Paths     []string `json:"paths,omitempty"`
+	MaxBytes  int      `json:"max_bytes,omitempty"`
+	Offset    int      `json:"offset,omitempty"`
+	StartLine int      `json:"start_line,omitempty"`
+}
+
+type BashInput struct {
+	Command        *string `json:"command"`
+	Cmd            *string `json:"cmd,omitempty"`
+	TimeoutSeconds int     `json:"timeout_seconds,omitempty"`
+	MaxOutputBytes int     `json:"max_output_bytes,omitempty"`
+	Background     bool    `json:"run_in_background,omitempty"`
+	Cwd            string  `json:"cwd,omitempty"`
+}
+
+type ProcessIDInput struct {
+	ID *int `json:"id"`
+}
+
+type ReadProcessOutputInput struct {
+	ID       *int `json:"id"`
+	MaxBytes int  `json:"max_bytes,omitempty"`
+}
+
+type EditFilesInput struct {
+	Path   *string `json:"path"`
+	OldStr *string `json:"old_str"`
+	NewStr *string `json:"new_str"`
+}
+
+type MemoryWriteInput struct {
+	Name    *string `json:"name"`
+	Content *string `json:"content"`
+	Append  *bool   `json:"append,omitempty"`
+}
+
+type MemoryReadInput struct {
+	Name string `json:"name,omitempty"`
+}
+
+type TodoItem struct {
+	Content string `json:"content"`
+	Status  string `json:"status"`
+}
+
+type TodoWriteInput struct {
+	Todos []TodoItem `json:"todos"`
+}
+
+type DeletePathInput struct {
+	Path *string `json:"path"`
+}
+
+type StatFileInput struct {
+	Path *string `json:"path"`
+}
+
+type MoveFileInput struct {
+	Source      *string `json:"source"`
+	Destination *string `json:"destination"`
+	Overwrite   *bool   `json:"overwrite,omitempty"`
+}
+
+type WriteFileInput struct {
+	Path      *string `json:"path"`
+	Content   *string `json:"content"`
+	Text      *string `json:"text,omitempty"`
+	Body      *string `json:"body,omitempty"`
+	NewStr    *string `json:"new_str,omitempty"`
+	Overwrite *bool   `json:"overwrite,omitempty"`
+}
+
+// Session holds state that lives for the duration of one chat session and is
+// shared by the tools invoked during it.
+type Session struct {
+	ID          string
+	title       string
+	created     time.Time
+	started     time.Time
+	history     []anthropic.MessageParam
+	turn        int
+	cfg         Config
+	provider    Provider
+	tools       []anthropic.ToolUnionParam
+	colorOutput bool
+	files       *fileTracker
+	notes       []string
+	todos       []TodoItem
+	checkpoints []checkpoint
+	trash       []trashEntry
+	processes   *processTable
+	usage       sessionUsage
+	toolStats   map[string]*ToolStats
+	retrieval   *retriever
+	codeIndex   *codeIndex
+	// lastResponse is the assistant text of the most recent turn, for /copy.
+	lastResponse string
+	// pendingPrompt is a prompt a slash command such as /prompt queued to be
+	// sent as the next turn.
+	pendingPrompt *queuedPrompt
+	// customCommands are the slash commands defined in .coder/commands.
+	customCommands []customCommand
+	// outcome is what the model reported with report_outcome in a headless
+	// run.
+	outcome *taskOutcome
+	// titleGenerated is set once generateTitle has run.
+	titleGenerated bool
+	// workBranchReady is set once ensureWorkBranch has put the session on
+	// its work branch, or found it does not need one.
+	workBranchReady bool
+	// edited holds the absolute paths of the files the session's tools have
+	// written or deleted, and writes counts those writes and deletes.
+	edited map[string]bool
+	writes int
+	// callWrites holds the files the running tool call has written, for the
+	// compile check.
+	callWrites []string
+	// coverage holds the counts of the last test_coverage run, for deltas.
+	coverage map[string]coverageCount
+	// containers counts the containers docker_run has started, to name
+	// them and to know whether any need removing at the end.
+	containers int
+	// scratch is the session's scratch directory, or "" if it has none.
+	scratch string
+	// artifacts are the deliverables saved with save_artifact, listed when
+	// the run ends.
+	artifacts []Artifact
+	// review is what the model submitted with submit_review in a coder
+	// review run, and reviewDiff the diff it reviewed.
+	review     *codeReview
+	reviewDiff string
+	// root is the absolute path of the workspace, and out where the session
+	// prints while it works.
+	root string
+	out  io.Writer
+	// symlinks is the file tools' symlink policy, and addedDirs the
+	// directories outside the workspace they may use.
+	symlinks  string
+	addedDirs []AddedDir
+
+	// turnCtx is the context of the turn in progress; tool calls derive
+	// their contexts from it. cancelTurn cancels it.
+	turnCtx     context.Context
+	cancelTurn  context.CancelFunc
+	toolMu      sync.Mutex
+	toolCtx     context.Context
+	cancelTool  context.CancelFunc
+	cancelled   bool
+	cache       *toolCache
+	hooks       HooksConfig
+	permissions PermissionsConfig
+	protected   *ignoreMatcher
+	stopPaths   *ignoreMatcher
+	quota       *diskQuota
+	shell       *shellState
+	input       *bufio.Scanner
+	audit       *auditLog
+	gitRoot     string
+	gitChecked  bool
+
+	// OnEvent, if set, is called with each event of a turn as it happens.
+	OnEvent func(Event)
+	// Approve, if set, answers confirmation prompts in place of the terminal.
+	Approve func(question string) bool
+}
+
+func (s *Session) emit(event Event) {
+	if s.OnEvent == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Turn = s.turn
+	s.OnEvent(event)
+}
+
+func newSession(cfg Config) *Session {
+	id := newSessionID()
+	root := cfg.workspaceRoot()
+	out := cfg.Stdout
+	if out == nil {
+		out = os.Stdout
+	}
+	session := &Session{
+		ID:          id,
+		created:     time.Now(),
+		started:     time.Now(),
+		cfg:         cfg,
+		root:        root,
+		out:         out,
+		symlinks:    cfg.Project.Symlinks,
+		addedDirs:   cfg.AddDirs,
+		colorOutput: cfg.ColorOutput,
+		files:       newFileTracker(),
+		processes:   newProcessTable(),
+		cache:       newToolCache(),
+		toolStats:   make(map[string]*ToolStats),
+		edited:      make(map[string]bool),
+		hooks:       cfg.Project.Hooks,
+		permissions: cfg.Project.Permissions,
+		protected:   newProtectedMatcher(cfg.Project.Permissions.Protected),
+		stopPaths:   parseStopPaths(cfg.Project.Stop.Paths),
+		quota:       newDiskQuota(root, cfg.DiskQuota),
+		input:       bufio.NewScanner(os.Stdin),
+		audit:       newAuditLog(root, cfg.Project.Audit, id),
+		scratch:     scratchDirFor(root, id),
+	}
+	if cfg.Embedder != nil {
+		session.retrieval = newRetriever(root, cfg.Embedder, cfg.RetrievalK)
+	}
+	return session
+}
+
+// cleanup stops the background processes and containers the session's tools
+// started and removes its scratch directory. Every way a session ends calls
+// it.
+func (s *Session) cleanup() {
+	s.processes.killAll()
+	s.removeContainers()
+	s.removeScratch()
+}
+
+// confirm asks the user a yes/no question on the terminal, or through Approve
+// when it is set. Anything other than an explicit yes, including end of input,
+// is treated as no. Under -yes every question is approved without asking.
+func (s *Session) confirm(question string) bool {
+	if s.cfg.AutoApprove {
+		fmt.Fprintf(s.out, "%s %s [auto-approved]\n", colorLabel("approve", warnColor, s.colorOutput), question)
+		debugf("approval_prompt question=%q approved=true auto=true", question)
+		return true
+	}
+	if s.Approve != nil {
+		approved := s.Approve(question)
+		debugf("approval_prompt question=%q approved=%t", question, approved)
+		return approved
+	}
+	fmt.Fprintf(s.out, "%s %s [y/N]: ", colorLabel("approve", warnColor, s.colorOutput), question)
+	if !s.input.Scan() {
+		fmt.Fprintln(s.out)
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(s.input.Text()))
+	approved := answer == "y" || answer == "yes"
+	debugf("approval_prompt question=%q approved=%t", question, approved)
+	return approved
+}
+
+func newSessionID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return time.Now().Format("20060102-150405")
+	}
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(buf)
+}
+
+// toolContext returns the context of the tool call in progress, which is
+// cancelled when the user presses Ctrl-C.
+func (s *Session) toolContext() context.Context {
+	s.toolMu.Lock()
+	defer s.toolMu.Unlock()
+	if s.toolCtx == nil {
+		return context.Background()
+	}
+	return s.toolCtx
+}
+
+// cancelRunningTool cancels the tool call in progress, if any, and reports
+// whether there was one.
+func (s *Session) cancelRunningTool() bool {
+	s.toolMu.Lock()
+	defer s.toolMu.Unlock()
+	if s.cancelTool == nil {
+		return false
+	}
+	s.cancelTool()
+	s.cancelled = true
+	return true
+}
+
+// cancelRunningTurn cancels the turn in progress, if any, and reports whether
+// there was one.
+func (s *Session) cancelRunningTurn() bool {
+	s.toolMu.Lock()
+	defer s.toolMu.Unlock()
+	if s.cancelTurn == nil {
+		return false
+	}
+	s.cancelTurn()
+	return true
+}
+
+// handleInterrupts makes Ctrl-C cancel the running tool call, or the model
+// request when no tool is running, instead of the whole agent. Between turns
+// it exits as usual.
+func handleInterrupts(s *Session) {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			if s.cancelRunningTool() {
+				fmt.Fprintf(s.out, "\n%s: cancelling the running tool (press Ctrl-C again to stop the turn)\n", colorLabel("interrupt", warnColor, s.colorOutput))
+				continue
+			}
+			if s.cancelRunningTurn() {
+				fmt.Fprintf(s.out, "\n%s: stopping the turn (press Ctrl-C again at the prompt to quit)\n", colorLabel("interrupt", warnColor, s.colorOutput))
+				continue
+			}
+			fmt.Fprintln(s.out)
+			s.cleanup()
+			os.Exit(130)
+		}
+	}()
+}
+
+// addNote queues a message for the model that is attached to the next batch of
+// tool results, or to the next user message if no tools run first.
+func (s *Session) addNote(note string) {
+	s.notes = append(s.notes, note)
+}
+
+func (s *Session) takeNotes() []string {
+	notes := s.notes
+	s.notes = nil
+	return notes
+}
+
+// Main runs the coder command line: the interactive chat, or the replay, eval,
+// serve, slack, search, review, index, new, and fix subcommands.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if err := runServe(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "slack" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if err := runSlack(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "search" {
+		if err := runSearch(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "review" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if err := runReview(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		if err := runIndex(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "new" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		code, err := runNew()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(code)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fix" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		code, err := runFix()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(code)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		passed, err := runEval()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	if cfg.ListSessions {
+		if err := printSessions(os.Stdout, cfg.workspaceRoot()); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	configureLogging(cfg.Verbose)
+	if cfg.CI.Enabled {
+		os.Exit(runCI(cfg))
+	}
+	piped, err := readPipedInput()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	cfg.Headless = cfg.Prompt != "" || cfg.ScriptPath != "" || piped != ""
+	errorCode := 1
+	if cfg.Headless {
+		errorCode = exitHeadlessError
+	}
+	if (cfg.Quiet || cfg.VerifyCommand != "") && !cfg.Headless {
+		fmt.Fprintln(os.Stderr, "Error: -quiet and -verify need -p, -script, or a prompt piped to stdin")
+		os.Exit(1)
+	}
+	session := newSession(cfg)
+	if cfg.Resume != "" {
+		if err := session.resume(cfg.Resume); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(errorCode)
+		}
+	}
+	toolDefs := registeredTools(session)
+	toolMap, anthropicTools, err := buildToolRegistry(toolDefs, cfg.Project.Permissions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(errorCode)
+	}
+
+	debugf(
+		"startup init provider=%q model_id=%q model_name=%q api_key_present=%t color_output=%t tool_count=%d system_prompt_chars=%d",
+		cfg.Provider,
+		cfg.ModelID,
+		cfg.ModelName,
+		cfg.APIKey != "",
+		cfg.ColorOutput,
+		len(toolDefs),
+		len(cfg.SystemPrompt),
+	)
+
+	if cfg.MetricsAddr != "" {
+		startMetricsServer(cfg.MetricsAddr)
+	}
+
+	provider := newProvider(cfg)
+	handleInterrupts(session)
+	if cfg.Headless {
+		code := runHeadless(cfg, session, provider, toolMap, anthropicTools, piped)
+		if cfg.Quiet {
+			// Stdout holds only the final reply under -quiet.
+			session.printArtifacts(os.Stderr)
+		} else {
+			session.printArtifacts(os.Stdout)
+		}
+		session.cleanup()
+		os.Exit(code)
+	}
+	err = runChatLoop(cfg, session, provider, toolMap, anthropicTools)
+	session.printArtifacts(os.Stdout)
+	session.cleanup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func loadConfig() (Config, error) {
+	verbose := flag.Bool("verbose", false, "Enable verbose debug logs")
+	modelID := flag.String("model", defaultModelID, "Model ID")
+	providerName := flag.String("provider", providerAnthropic, "Model provider: anthropic, ollama, or openai (any OpenAI-compatible API)")
+	ollamaURL := flag.String("ollama-url", "", "Ollama server URL (defaults to $OLLAMA_HOST or "+defaultOllamaURL+")")
+	openAIBaseURL := flag.String("base-url", "", "Base URL for -provider openai (defaults to $OPENAI_BASE_URL or "+defaultOpenAIBaseURL+")")
+	memoryContext := flag.Bool("memory-context", true, "Include notes saved under .coder/memory in the system prompt")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at http://<addr>/metrics (e.g. :9464)")
+	configPath := flag.String("config", "", "Project config file (defaults to .coder/config.json in the workspace)")
+	noHighlight := flag.Bool("no-highlight", false, "Print code blocks in assistant replies without syntax highlighting")
+	noMarkdown := flag.Bool("no-markdown", false, "Print assistant replies as raw markdown instead of formatting them")
+	listSessions := flag.Bool("list-sessions", false, "List saved sessions for this workspace and exit")
+	resume := flag.String("resume", "", "Resume a saved session by id or by its number in -list-sessions")
+	traceDir := flag.String("trace-dir", "", "Write every model API request and response body to numbered files in this directory")
+	feedback := flag.String("feedback", "", "Shell command run after each round of tool calls that changes files, with failures sent back to the model (e.g. \"go build ./... && go test ./...\"; overrides feedback.command in the project config)")
+	fallbackModel := flag.String("fallback-model", "", "Model to retry with when the primary model keeps failing with overloaded or 5xx errors (overrides fallback_model in the project config)")
+	quiet := flag.Bool("quiet", false, "With -p, print only the final reply, without tool activity or status lines; errors go to stderr")
+	verify := flag.String("verify", "", "With -p, shell command run after the turn whose exit status decides whether the task succeeded (e.g. \"go test ./...\")")
+	script := flag.String("script", "", "Run the prompts in this YAML or JSON file as consecutive turns of one session, each with an optional verify command, and exit")
+	workBranch := flag.Bool("branch", false, "Before the first change, create and switch to an agent/<slug> branch off the current HEAD, named after the prompt")
+	docker := flag.Bool("docker", false, "Offer docker_build and docker_run, which build images and run containers with the limits in the project config's docker section")
+	compileCheck := flag.Bool("compile-check", false, "After a write or edit touches a Go, Python, TypeScript, or JavaScript file, compile or syntax-check it and add any errors to the tool result")
+	autoCommit := flag.Bool("auto-commit", false, "Commit the files each successful turn changes, with the prompt as the commit message (git workspaces only)")
+	prompt := flag.String("p", "", "Run this prompt as a single turn, print the reply, and exit; content piped to stdin is attached to it")
+	ci := flag.Bool("ci", false, "Run the prompt given as arguments (or on stdin) non-interactively, write a result file, and exit with a code for the outcome")
+	maxDuration := flag.Duration("max-duration", 0, "With -ci, stop the run after this long (e.g. 20m)")
+	maxCost := flag.Float64("max-cost", 0, fmt.Sprintf("Stop before the next model request once the session has cost this many dollars (with -yes, defaults to %g)", defaultAutoApproveMaxCost))
+	autoApprove := flag.Bool("yes", false, "Approve every tool call and confirmation without asking, for sandboxed runs; the workspace boundary, command denylist, and -max-cost still apply")
+	ciResult := flag.String("ci-result", filepath.Join(coderDirName, ciResultName), "With -ci, where to write the JSON result")
+	ciTest := flag.String("ci-test", "", "With -ci, shell command whose exit status decides whether the agent's changes pass (e.g. \"go test ./...\")")
+	repoMapTokens := flag.Int("repo-map-tokens", defaultRepoMapTokens, "Approximate token budget for the repository map in the system prompt (0 disables it)")
+	embeddings := flag.String("embeddings", "", "Embedding model for retrieving relevant code with each prompt, as provider:model (e.g. ollama:nomic-embed-text, openai:text-embedding-3-small, voyage:voyage-code-3)")
+	retrievalK := flag.Int("retrieval-k", defaultRetrievalK, "Number of snippets retrieved per prompt with -embeddings")
+	systemPromptFile := flag.String("system-prompt-file", "", "Replace the built-in system prompt instructions with the contents of this file")
+	diskQuota := flag.String("disk-quota", "", "Block writes and commands once the session has grown the workspace by this much, e.g. 500M (overrides disk_quota in the project config)")
+	appendSystemPrompt := flag.String("append-system-prompt", "", "Text to add at the end of the system prompt, e.g. coding standards")
+	env := envFlag{}
+	flag.Var(env, "env", "Set a variable in the environment of bash commands, as NAME=VALUE (repeatable)")
+	var addDirs addDirFlag
+	flag.Var(&addDirs, "add-dir", "Let file tools read another directory outside the workspace; append :rw to allow writes (repeatable)")
+	flag.Parse()
+
+	if *listSessions {
+		return Config{ListSessions: true}, nil
+	}
+
+	modelFlagSet, maxCostFlagSet := false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "model":
+			modelFlagSet = true
+		case "max-cost":
+			maxCostFlagSet = true
+		}
+	})
+
+	provider := strings.ToLower(strings.TrimSpace(*providerName))
+	apiKey := strings.TrimSpace(os.Getenv("ANTHROPIC_API_KEY"))
+	assistantName := "Claude"
+	selectedModel := strings.TrimSpace(*modelID)
+	switch provider {
+	case providerAnthropic:
+		if apiKey == "" {
+			return Config{}, errors.New("ANTHROPIC_API_KEY is not set")
+		}
+		if selectedModel == "" {
+			selectedModel = defaultModelID
+		}
+	case providerOllama:
+		assistantName = "Ollama"
+		if selectedModel == "" || !modelFlagSet {
+			selectedModel = defaultOllamaModelID
+		}
+	case providerOpenAI:
+		assistantName = "Assistant"
+		if selectedModel == "" || !modelFlagSet {
+			return Config{}, errors.New("-provider openai requires -model (for example -model gpt-4o or -model qwen/qwen-2.5-coder-32b-instruct)")
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown provider %q (expected anthropic, ollama, or openai)", *providerName)
+	}
+
+	cfg := Config{
+		APIKey:        apiKey,
+		Provider:      provider,
+		OllamaURL:     resolveOllamaURL(*ollamaURL),
+		OpenAIBaseURL: resolveOpenAIBaseURL(*openAIBaseURL),
+		OpenAIAPIKey:  strings.TrimSpace(os.Getenv("OPENAI_API_KEY")),
+		ModelID:       selectedModel,
+		ModelName:     modelDisplayName(selectedModel),
+		AssistantName: assistantName,
+		Verbose:       *verbose,
+		ColorOutput:   supportsColor(os.Stdout),
+		MemoryContext: *memoryContext,
+		MetricsAddr:   strings.TrimSpace(*metricsAddr),
+		Resume:        strings.TrimSpace(*resume),
+		TraceDir:      strings.TrimSpace(*traceDir),
+	}
+	cfg.Highlight = cfg.ColorOutput && !*noHighlight
+	cfg.Markdown = cfg.ColorOutput && !*noMarkdown
+	cfg.MaxCost = *maxCost
+	cfg.AutoApprove = *autoApprove
+	if cfg.AutoApprove && !maxCostFlagSet {
+		cfg.MaxCost = defaultAutoApproveMaxCost
+	}
+	cfg.RepoMapTokens = *repoMapTokens
+	cfg.RetrievalK = *retrievalK
+	cfg.AppendSystemPrompt = strings.TrimSpace(*appendSystemPrompt)
+	cfg.Prompt = strings.TrimSpace(*prompt)
+	cfg.Quiet = *quiet
+	cfg.VerifyCommand = strings.TrimSpace(*verify)
+	cfg.ScriptPath = strings.TrimSpace(*script)
+	if cfg.ScriptPath != "" && cfg.Prompt != "" {
+		return Config{}, errors.New("-p and -script cannot be used together")
+	}
+	if cfg.Quiet {
+		cfg.ColorOutput, cfg.Highlight, cfg.Markdown = false, false, false
+	}
+	cfg.Env = env
+	if path := strings.TrimSpace(*systemPromptFile); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read -system-prompt-file: %w", err)
+		}
+		if cfg.BaseSystemPrompt = strings.TrimSpace(string(data)); cfg.BaseSystemPrompt == "" {
+			return Config{}, fmt.Errorf("-system-prompt-file %s is empty", path)
+		}
+	}
+	if spec := strings.TrimSpace(*embeddings); spec != "" {
+		embedder, err := newEmbedder(spec, cfg)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.Embedder = embedder
+	}
+	if *ci {
+		cfg.CI = CIConfig{
+			Enabled:     true,
+			Prompt:      strings.TrimSpace(strings.Join(flag.Args(), " ")),
+			MaxDuration: *maxDuration,
+			ResultPath:  strings.TrimSpace(*ciResult),
+			TestCommand: strings.TrimSpace(*ciTest),
+		}
+		// CI logs are not terminals; keep replies plain.
+		cfg.ColorOutput, cfg.Highlight, cfg.Markdown = false, false, false
+	}
+	project, err := loadProjectConfig(strings.TrimSpace(*configPath))
+	if err != nil {
+		return Config{}, err
+	}
+	if command := strings.TrimSpace(*feedback); command != "" {
+		project.Feedback.Command = command
+	}
+	cfg.Project = project
+	if !maxCostFlagSet && project.Stop.MaxCost > 0 {
+		cfg.MaxCost = project.Stop.MaxCost
+	}
+	cfg.AutoCommit = *autoCommit || project.AutoCommit
+	cfg.CompileCheck = *compileCheck || project.CompileCheck
+	cfg.WorkBranch = *workBranch || project.AutoBranch
+	cfg.Docker = *docker || project.Docker.Enabled
+	cfg.FallbackModel = strings.TrimSpace(*fallbackModel)
+	if cfg.FallbackModel == "" {
+		cfg.FallbackModel = project.FallbackModel
+	}
+	quota := strings.TrimSpace(*diskQuota)
+	if quota == "" {
+		quota = project.DiskQuota
+	}
+	if quota != "" {
+		if cfg.DiskQuota, err = parseByteSize(quota); err != nil {
+			return Config{}, fmt.Errorf("invalid -disk-quota %q: %w", quota, err)
+		}
+	}
+	if cfg.AddDirs, err = resolveAddedDirs(append(project.AddDirs, addDirs...)); err != nil {
+		return Config{}, err
+	}
+	cfg.SystemPrompt = buildSystemPrompt(cfg)
+	return cfg, nil
+}
+
+// resolveOllamaURL applies the $OLLAMA_HOST and default fallbacks to an
+// -ollama-url value.
+func resolveOllamaURL(value string) string {
+	baseURL := strings.TrimSpace(value)
+	if baseURL == "" {
+		baseURL = strings.TrimSpace(os.Getenv("OLLAMA_HOST"))
+	}
+	if baseURL == "" {
+		baseURL = defaultOllamaURL
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return strings.TrimRight(baseURL, "/")
+}
+
+// resolveOpenAIBaseURL applies the $OPENAI_BASE_URL and default fallbacks to a
+// -base-url value.
+func resolveOpenAIBaseURL(value string) string {
+	openAIURL := strings.TrimSpace(value)
+	if openAIURL == "" {
+		openAIURL = strings.TrimSpace(os.Getenv("OPENAI_BASE_URL"))
+	}
+	if openAIURL == "" {
+		openAIURL = defaultOpenAIBaseURL
+	}
+	return strings.TrimRight(openAIURL, "/")
+}
+
+// loadProjectConfig reads the project config. A missing default file yields
+// an empty config; a missing explicit file or unknown keys are errors.
+func loadProjectConfig(path string) (ProjectConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(coderDirName, projectConfigName)
+	}
+
+	project := ProjectConfig{Symlinks: symlinkDenyEscape}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return project, nil
+		}
+		return project, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&project); err != nil {
+		return project, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	switch project.Symlinks {
+	case "":
+		project.Symlinks = symlinkDenyEscape
+	case symlinkDenyEscape, symlinkAllow:
+	default:
+		return project, fmt.Errorf("invalid config %s: symlinks must be %q or %q", path, symlinkDenyEscape, symlinkAllow)
+	}
+	switch project.LineEndings {
+	case "", lineEndingsPreserve, lineEndingsLF, lineEndingsCRLF:
+	default:
+		return project, fmt.Errorf("invalid config %s: line_endings must be %q, %q, or %q", path, lineEndingsPreserve, lineEndingsLF, lineEndingsCRLF)
+	}
+	switch project.FinalNewline {
+	case "", finalNewlinePreserve, finalNewlineAlways, finalNewlineNever:
+	default:
+		return project, fmt.Errorf("invalid config %s: final_newline must be %q, %q, or %q", path, finalNewlinePreserve, finalNewlineAlways, finalNewlineNever)
+	}
+	switch project.Permissions.Profile {
+	case "", profileDefault, profileReadOnly, profileOps:
+	default:
+		return project, fmt.Errorf("invalid config %s: unknown permissions profile %q (expected %q, %q, or %q)", path, project.Permissions.Profile, profileDefault, profileReadOnly, profileOps)
+	}
+	for name, mode := range project.Permissions.Tools {
+		switch mode {
+		case permissionAllow, permissionAsk, permissionDeny:
+		default:
+			return project, fmt.Errorf("invalid config %s: permission for %s must be %q, %q, or %q", path, name, permissionAllow, permissionAsk, permissionDeny)
+		}
+	}
+	for _, pattern := range project.Permissions.DenyCommands {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return project, fmt.Errorf("invalid config %s: deny_commands pattern %q: %w", path, pattern, err)
+		}
+	}
+	if project.DiskQuota != "" {
+		if _, err := parseByteSize(project.DiskQuota); err != nil {
+			return project, fmt.Errorf("invalid config %s: disk_quota: %w", path, err)
+		}
+	}
+	for prefix, value := range project.RequestTimeouts {
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			return project, fmt.Errorf("invalid config %s: request_timeouts[%q] must be a positive duration such as \"5m\"", path, prefix)
+		}
+	}
+	if project.Retention.ToolResultTurns < 0 || project.Retention.MaxTokens < 0 {
+		return project, fmt.Errorf("invalid config %s: retention limits must not be negative", path)
+	}
+	if project.MaxWriteBytes < 0 {
+		return project, fmt.Errorf("invalid config %s: max_write_bytes must not be negative", path)
+	}
+	if project.Feedback.MaxRounds < 0 {
+		return project, fmt.Errorf("invalid config %s: feedback.max_rounds must not be negative", path)
+	}
+	if err := project.Stop.validate(); err != nil {
+		return project, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if project.Docker.Memory != "" {
+		if _, ok := dockerMemoryBytes(project.Docker.Memory); !ok {
+			return project, fmt.Errorf("invalid config %s: docker.memory must be a size such as \"2g\"", path)
+		}
+	}
+	if project.Docker.CPUs < 0 || project.Docker.PidsLimit < 0 {
+		return project, fmt.Errorf("invalid config %s: docker limits must not be negative", path)
+	}
+	if project.Database.MaxRows < 0 || project.Database.MaxBytes < 0 || project.Database.TimeoutSeconds < 0 {
+		return project, fmt.Errorf("invalid config %s: database limits must not be negative", path)
+	}
+	if project.Database.DSN != "" && project.Database.DSNEnv != "" {
+		return project, fmt.Errorf("invalid config %s: set database.dsn or database.dsn_env, not both", path)
+	}
+	for name := range project.Env.Set {
+		if !validEnvName(name) {
+			return project, fmt.Errorf("invalid config %s: env.set has invalid variable name %q", path, name)
+		}
+	}
+	for _, hook := range append(append([]HookConfig(nil), project.Hooks.PreTool...), project.Hooks.PostTool...) {
+		if strings.TrimSpace(hook.Command) == "" {
+			return project, fmt.Errorf("invalid config %s: every hook needs a non-empty command", path)
+		}
+	}
+	return project, nil
+}
+
+func buildSystemPrompt(cfg Config) string {
+	root := cfg.workspaceRoot()
+	prompt := toolUseSystemPrompt
+	if cfg.BaseSystemPrompt != "" {
+		prompt = cfg.BaseSystemPrompt
+	}
+	if cfg.MemoryContext {
+		if summary := memorySummary(root, maxMemoryPromptBytes); summary != "" {
+			prompt += "\n\nNotes saved in project memory from earlier sessions (use memory_read for full text):\n" + summary
+		}
+	}
+	if repoMap := buildRepoMap(root, cfg.RepoMapTokens); repoMap != "" {
+		prompt += "\n\nRepository map (files with their main definitions, most referenced first when cut):\n" + repoMap
+	}
+	if len(cfg.AddDirs) > 0 {
+		prompt += "\n\nBesides the workspace, file tools accept paths in these directories (relative to the workspace or absolute):"
+		for _, dir := range cfg.AddDirs {
+			access := "read-only"
+			if dir.Write {
+				access = "read-write"
+			}
+			prompt += fmt.Sprintf("\n- %s (%s)", dir.Path, access)
+		}
+	}
+	if !workspaceHasScratch(root) {
+		prompt += "\n\nUse scratch/ for throwaway scripts and intermediate files. File tools write there without asking, it stays out of diffs and checkpoints, and it is deleted when the session ends; in bash its path is $" + scratchEnvName + "."
+	}
+	if cfg.AppendSystemPrompt != "" {
+		prompt += "\n\n" + cfg.AppendSystemPrompt
+	}
+	return prompt
+}
+
+// resolveAddedDirs makes each added directory absolute with symlinks
+// resolved, so tool paths can be matched against it. A directory given twice
+// is writable if either entry is.
+func resolveAddedDirs(dirs []AddedDir) ([]AddedDir, error) {
+	var resolved []AddedDir
+	seen := make(map[string]int)
+	for _, dir := range dirs {
+		path, err := filepath.Abs(strings.TrimSpace(dir.Path))
+		if err == nil {
+			path, err = filepath.EvalSymlinks(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid added directory %q: %w", dir.Path, err)
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid added directory %q: not a directory", dir.Path)
+		}
+		if i, ok := seen[path]; ok {
+			resolved[i].Write = resolved[i].Write || dir.Write
+			continue
+		}
+		seen[path] = len(resolved)
+		resolved = append(resolved, AddedDir{Path: path, Write: dir.Write})
+	}
+	return resolved, nil
+}
+
+func configureLogging(verbose bool) {
+	if !verbose {
+		log.SetOutput(io.Discard)
+		return
+	}
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetPrefix("DEBUG ")
+}
+
+// debugf writes a debug log line, with credentials redacted.
+func debugf(format string, args ...any) {
+	if log.Writer() == io.Discard {
+		return
+	}
+	_ = log.Output(2, redactCredentials(fmt.Sprintf(format, args...)))
+}
+
+func runChatLoop(cfg Config, session *Session, provider Provider, toolMap map[string]Tool, anthropicTools []anthropic.ToolUnionParam) error {
+	scanner := session.input
+	session.provider, session.tools = provider, anthropicTools
+	session.customCommands = loadCustomCommands()
+
+	for {
+		fmt.Fprint(session.out, userPrefix(cfg.ColorOutput))
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("failed to read input: %w", err)
+			}
+			fmt.Fprintln(session.out)
+			debugf("shutdown end_of_loop reason=%q", "stdin_eof")
+			return nil
+		}
+
+		prompt := strings.TrimSpace(scanner.Text())
+		if prompt == "" {
+			continue
+		}
+		if prompt == editKey {
+			prompt = "/edit"
+		}
+		if prompt == "/quit" || prompt == "/exit" {
+			debugf("shutdown end_of_loop reason=%q command=%q", "user_command", prompt)
+			return nil
+		}
+		if strings.HasPrefix(prompt, "/") {
+			runSlashCommand(session, prompt)
+			queued := session.takePendingPrompt()
+			if queued == nil {
+				continue
+			}
+			turnCfg, turnToolMap, turnTools, err := queued.turnSetup(cfg, toolMap, anthropicTools)
+			if err != nil {
+				fmt.Fprintf(session.out, "%s: %v\n", colorLabel("error", errorColor, cfg.ColorOutput), err)
+				continue
+			}
+			runTurn(context.Background(), turnCfg, session, provider, turnToolMap, turnTools, queued.Prompt)
+			session.generateTitle()
+			continue
+		}
+
+		runTurn(context.Background(), cfg, session, provider, toolMap, anthropicTools, prompt)
+		session.generateTitle()
+	}
+}
+
+// turnStats summarizes one turn for headless callers such as eval.
+type turnStats struct {
+	APICalls  int
+	ToolCalls int
+	Usage     sessionUsage
+	// Commands counts the bash and start_process calls among ToolCalls.
+	Commands int
+	// Err is the last API error, if the turn ended because a request failed,
+	// or the reason a budget or ctx cut it short.
+	Err error
+	// Stopped names the guard that ended the tool loop early, if any:
+	// "max_tool_rounds", "repeated_tool_failures", or "stop_condition".
+	Stopped string
+	// StopReason explains which stop condition was met.
+	StopReason string
+	// FinalText is the text of the turn's last model reply that had any.
+	FinalText string
+}
+
+var errCostBudgetExceeded = errors.New("cost budget exceeded")
+
+// runTurn sends one user prompt and runs the tool loop until the model stops
+// calling tools, a request fails, ctx is done, or the round limit is reached.
+// Cancelling ctx also cancels the tool call in progress.
+func runTurn(ctx context.Context, cfg Config, session *Session, provider Provider, toolMap map[string]Tool, anthropicTools []anthropic.ToolUnionParam, prompt string) turnStats {
+	session.turn++
+	session.cache.clear()
+	session.lastResponse = ""
+	session.createCheckpoint(session.turn, prompt)
+	userBlocks := []anthropic.ContentBlockParamUnion{anthropic.NewTextBlock(prompt)}
+	for _, note := range session.takeNotes() {
+		userBlocks = append(userBlocks, anthropic.NewTextBlock(note))
+	}
+	if snippets := session.retrieveContext(ctx, prompt); snippets != "" {
+		userBlocks = append(userBlocks, anthropic.NewTextBlock(snippets))
+	}
+	session.history = append(session.history, anthropic.NewUserMessage(userBlocks...))
+	debugf("user_input_received turn=%d prompt_chars=%d conversation_len=%d", session.turn, len(prompt), len(session.history))
+	ctx, cancelTurn := context.WithCancel(ctx)
+	session.toolMu.Lock()
+	session.turnCtx, session.cancelTurn = ctx, cancelTurn
+	session.toolMu.Unlock()
+	defer func() {
+		session.toolMu.Lock()
+		session.turnCtx, session.cancelTurn = nil, nil
+		session.toolMu.Unlock()
+		cancelTurn()
+	}()
+
+	stats := turnStats{}
+	call := 0
+	turnUsage := sessionUsage{}
+	modelID := cfg.ModelID
+	lastFailureSignature := ""
+	repeatedFailureCount := 0
+	recoveryRound := false
+	feedbackFailures := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			stats.Err = err
+			debugf("tool_loop_stop turn=%d reason=%q call=%d", session.turn, "context_done", call)
+			break
+		}
+		if cfg.MaxCost > 0 && session.usage.Cost+turnUsage.Cost >= cfg.MaxCost {
+			stats.Err = fmt.Errorf("%w: $%.2f spent of $%.2f", errCostBudgetExceeded, session.usage.Cost+turnUsage.Cost, cfg.MaxCost)
+			fmt.Fprintf(session.out, "%s: stopping; %v\n", colorLabel("notice", warnColor, cfg.ColorOutput), stats.Err)
+			debugf("tool_loop_stop turn=%d reason=%q call=%d", session.turn, "cost_budget", call)
+			break
+		}
+		if reason := session.stopCondition(); reason != "" {
+			stats.Stopped, stats.StopReason = stopConditionStopped, reason
+			fmt.Fprintf(session.out, "%s: stopping; %s\n", colorLabel("notice", warnColor, cfg.ColorOutput), reason)
+			debugf("tool_loop_stop turn=%d reason=%q call=%d detail=%q", session.turn, stopConditionStopped, call, reason)
+			break
+		}
+		if call >= maxToolRoundsPerTurn {
+			stats.Stopped = "max_tool_rounds"
+			stopMsg := fmt.Sprintf("Stopped after %d tool rounds in this turn to prevent a tool loop. Please provide corrected instructions and try again.", maxToolRoundsPerTurn)
+			fmt.Fprintf(session.out, "%s%s\n", assistantPrefix(cfg.AssistantName, cfg.ModelName, cfg.ColorOutput), stopMsg)
+			debugf("tool_loop_stop turn=%d reason=%q call=%d", session.turn, "max_tool_rounds", call)
+			break
+		}
+
+		if err := session.checkContextWindow(ctx, provider, modelID, anthropicTools); err != nil {
+			stats.Err = err
+			fmt.Fprintf(session.out, "%s: stopping; %v\n", colorLabel("notice", warnColor, cfg.ColorOutput), err)
+			debugf("tool_loop_stop turn=%d reason=%q call=%d", session.turn, "context_window", call)
+			break
+		}
+
+		call++
+		start := time.Now()
+		debugf(
+			"api_call_start turn=%d call=%d provider=%q model_id=%q conversation_len=%d tool_count=%d",
+			session.turn,
+			call,
+			provider.Name(),
+			modelID,
+			len(session.history),
+			len(anthropicTools),
+		)
+
+		request := ProviderRequest{
+			ModelID:      modelID,
+			SystemPrompt: cfg.SystemPrompt,
+			History:      session.history,
+			Tools:        anthropicTools,
+		}
+		streamed := false
+		if session.OnEvent != nil {
+			request.OnText = func(text string) {
+				streamed = true
+				session.emit(Event{Type: EventTextDelta, Text: text})
+			}
+		}
+		requestCtx, cancel := context.WithTimeout(ctx, requestTimeout(cfg, modelID, defaultMaxTokens))
+		message, requestID, err := provider.Send(requestCtx, request)
+		cancel()
+		latencyMs := time.Since(start).Milliseconds()
+		metrics.observeAPICall(modelID, time.Since(start), message, err)
+
+		if err != nil && ctx.Err() != nil {
+			// The turn was cancelled, usually by Ctrl-C, while the request
+			// was in flight.
+			stats.Err = ctx.Err()
+			debugf("tool_loop_stop turn=%d reason=%q call=%d", session.turn, "context_done", call)
+			break
+		}
+		if err != nil {
+			debugf("api_call_result turn=%d call=%d ok=false latency_ms=%d request_id=%q error=%q", session.turn, call, latencyMs, requestID, err.Error())
+			fmt.Fprintf(os.Stderr, "API error: %v\n", err)
+			stats.Err = err
+			session.emit(Event{Type: EventError, Text: err.Error()})
+			if cfg.FallbackModel != "" && modelID != cfg.FallbackModel && isOverloadedError(err) {
+				// The client has already retried the primary model, so switch
+				// for the rest of this turn rather than give up on it.
+				modelID = cfg.FallbackModel
+				fmt.Fprintf(session.out, "%s: %s is unavailable; retrying this turn with fallback model %s\n", colorLabel("notice", warnColor, cfg.ColorOutput), cfg.ModelID, modelID)
+				debugf("model_fallback turn=%d call=%d fallback_model=%q", session.turn, call, modelID)
+				call--
+				continue
+			}
+			break
+		}
+
+		stats.Err = nil
+		session.history = append(session.history, message.ToParam())
+		text, toolUses := parseContent(message.Content)
+		turnUsage.add(modelID, message.Usage)
+
+		debugf(
+			"api_call_result turn=%d call=%d ok=true latency_ms=%d request_id=%q message_id=%q response_model=%q stop_reason=%q input_tokens=%d output_tokens=%d tool_use_count=%d",
+			session.turn,
+			call,
+			latencyMs,
+			requestID,
+			message.ID,
+			message.Model,
+			message.StopReason,
+			message.Usage.InputTokens,
+			message.Usage.OutputTokens,
+			len(toolUses),
+		)
+
+		if text != "" {
+			stats.FinalText = text
+			session.lastResponse = strings.TrimSpace(session.lastResponse + "\n\n" + text)
+			if !streamed {
+				// Providers that do not stream send the whole text as one
+				// delta, so clients can follow deltas alone.
+				session.emit(Event{Type: EventTextDelta, Text: text})
+			}
+			session.emit(Event{Type: EventText, Text: text})
+			fmt.Fprintf(session.out, "%s%s\n", assistantPrefix(cfg.AssistantName, cfg.ModelName, cfg.ColorOutput), formatAssistantText(text, cfg))
+		}
+
+		if len(toolUses) == 0 {
+			if text == "" {
+				fmt.Fprintf(session.out, "%s%s\n", assistantPrefix(cfg.AssistantName, cfg.ModelName, cfg.ColorOutput), "(no text content returned)")
+			}
+			debugf("api_response_tool_use_none turn=%d call=%d", session.turn, call)
+			break
+		}
+
+		toolResults := make([]anthropic.ContentBlockParamUnion, 0, len(toolUses))
+		writesBefore := session.writes
+		allToolsFailed := true
+		failureSig := make([]string, 0, len(toolUses))
+		var failures []failedToolCall
+		hasValidationError := false
+		cancelled := false
+		for i, tool := range toolUses {
+			debugf("api_response_tool_use turn=%d call=%d index=%d tool_id=%q tool_name=%q tool_input=%q", session.turn, call, i, tool.ID, tool.Name, string(tool.Input))
+			failureSig = append(failureSig, tool.Name+"="+strings.TrimSpace(string(tool.Input)))
+			if cancelled {
+				toolResults = append(toolResults, anthropic.NewToolResultBlock(tool.ID, "skipped: the user cancelled an earlier tool call in this batch", true))
+				continue
+			}
+
+			fmt.Fprintf(session.out, "%s: %s(%s)\n", colorLabel("tool", toolColor, cfg.ColorOutput), tool.Name, redactCredentials(string(tool.Input)))
+			stats.ToolCalls++
+			if tool.Name == "bash" || tool.Name == "start_process" {
+				stats.Commands++
+			}
+			session.emit(Event{Type: EventToolCall, ToolID: tool.ID, Tool: tool.Name, Input: tool.Input})
+			toolStart := time.Now()
+			resultText, toolErr := session.runTool(toolMap, tool)
+			isError, errCode := toolErr != nil, ""
+			if isError {
+				errCode = toolErr.Code
+			}
+			toolDuration := time.Since(toolStart)
+			session.emit(Event{Type: EventToolResult, ToolID: tool.ID, Tool: tool.Name, Text: resultText, IsError: isError, ErrorCode: errCode, DurationMs: toolDuration.Milliseconds()})
+			cancelled = session.cancelled
+			if !isError {
+				allToolsFailed = false
+			}
+			if errCode == ToolErrorValidation {
+				hasValidationError = true
+			}
+			if isError {
+				fmt.Fprintf(session.out, "%s: [%s] %s\n", colorLabel("error", errorColor, cfg.ColorOutput), errCode, resultText)
+				failures = append(failures, failedToolCall{name: tool.Name, message: resultText})
+				resultText = formatToolError(toolErr)
+			} else {
+				fmt.Fprintf(session.out, "%s: %s\n", colorLabel("result", resultColor, cfg.ColorOutput), resultText)
+			}
+			session.recordToolStats(tool.Name, toolDuration, len(resultText), isError)
+			toolResults = append(toolResults, anthropic.NewToolResultBlock(tool.ID, resultText, isError))
+		}
+
+		if hasValidationError {
+			toolResults = append(toolResults, anthropic.NewTextBlock(
+				"One or more tool calls had invalid JSON input. Retry with exact required fields from each error message. For full file contents, use write_file with path and content. Do not call bash unless command is non-empty.",
+			))
+		}
+		if session.writes > writesBefore && !cancelled {
+			if note := session.runFeedbackCheck(ctx, &feedbackFailures); note != "" {
+				toolResults = append(toolResults, anthropic.NewTextBlock(note))
+			}
+		}
+		for _, note := range session.takeNotes() {
+			toolResults = append(toolResults, anthropic.NewTextBlock(note))
+		}
+
+		stop := false
+		if allToolsFailed {
+			signature := strings.Join(failureSig, "|")
+			if signature == lastFailureSignature {
+				repeatedFailureCount++
+			} else {
+				lastFailureSignature = signature
+				repeatedFailureCount = 1
+			}
+			switch {
+			case recoveryRound:
+				stop = true
+			case repeatedFailureCount >= maxRepeatedToolFailures:
+				// Give the model one more round with the schemas and errors
+				// spelled out before giving up on the turn.
+				recoveryRound = true
+				toolResults = append(toolResults, anthropic.NewTextBlock(failureRecoveryMessage(toolMap, failures)))
+				fmt.Fprintf(session.out, "%s: repeated tool failures; giving the model one recovery round\n", colorLabel("warning", warnColor, cfg.ColorOutput))
+				debugf("tool_loop_recovery turn=%d call=%d repeat_count=%d signature=%q", session.turn, call, repeatedFailureCount, signature)
+			}
+		} else {
+			lastFailureSignature = ""
+			repeatedFailureCount = 0
+			recoveryRound = false
+		}
+
+		session.history = append(session.history, anthropic.NewUserMessage(toolResults...))
+		debugf("tool_results_submitted turn=%d call=%d result_count=%d conversation_len=%d", session.turn, call, len(toolResults), len(session.history))
+
+		if stop {
+			stats.Stopped = "repeated_tool_failures"
+			stopMsg := "Stopping tool loop after repeated tool failures, including a recovery round. I need corrected tool inputs to continue."
+			fmt.Fprintf(session.out, "%s%s\n", assistantPrefix(cfg.AssistantName, cfg.ModelName, cfg.ColorOutput), stopMsg)
+			debugf("tool_loop_stop turn=%d reason=%q call=%d repeat_count=%d signature=%q", session.turn, "repeated_tool_failures", call, repeatedFailureCount, lastFailureSignature)
+			break
+		}
+	}
+
+	session.usage.merge(turnUsage)
+	session.emit(Event{Type: EventUsage, InputTokens: turnUsage.InputTokens, OutputTokens: turnUsage.OutputTokens, CostUSD: turnUsage.Cost})
+	if stats.ToolCalls > 0 && (cfg.Project.ChangeSummary == nil || *cfg.Project.ChangeSummary) {
+		session.printTurnChanges(session.turn, stats.Commands)
+	}
+	if cfg.AutoCommit && stats.ToolCalls > 0 && stats.Err == nil && stats.Stopped == "" && (session.outcome == nil || session.outcome.Success) {
+		session.autoCommitTurn(session.turn, prompt)
+	}
+	if turnUsage.Calls > 0 && (cfg.Project.UsageFooter == nil || *cfg.Project.UsageFooter) {
+		fmt.Fprintln(session.out, colorLabel(turnUsage.footer(modelID), commentColor, cfg.ColorOutput))
+	}
+	session.applyRetention()
+	session.save(cfg.ModelID)
+	stats.APICalls = call
+	stats.Usage = turnUsage
+	return stats
+}
+
+// failedToolCall is a failed call from the latest round, for the recovery
+// message.
+type failedToolCall struct {
+	name    string
+	message string
+}
+
+// failureRecoveryMessage tells the model its tool calls keep failing and gives
+// it, for each failed tool, the last error and the exact input schema.
+func failureRecoveryMessage(toolMap map[string]Tool, failures []failedToolCall) string {
+	var b strings.Builder
+	b.WriteString("Your tool calls have failed the same way repeatedly. This is your last attempt before the turn stops. Check each call against its error and input schema below, and send input that matches the schema exactly, or take a different approach.\n")
+	seen := make(map[string]bool)
+	for _, failure := range failures {
+		fmt.Fprintf(&b, "\n%s failed with: %s\n", failure.name, previewText(failure.message, 1000))
+		tool, ok := toolMap[failure.name]
+		if !ok || seen[failure.name] {
+			continue
+		}
+		seen[failure.name] = true
+		if schema, err := json.Marshal(tool.InputSchema); err == nil {
+			fmt.Fprintf(&b, "%s input schema: %s\n", failure.name, schema)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+type slashCommand struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(s *Session, args string) error
+}
+
+func slashCommands() []slashCommand {
+	return []slashCommand{
+		{Name: "help", Usage: "/help", Description: "Show available commands", Run: helpCommand},
+		{Name: "checkpoints", Usage: "/checkpoints", Description: "List workspace checkpoints taken at the start of each turn", Run: checkpointsCommand},
+		{Name: "restore", Usage: "/restore <n>", Description: "Roll the working tree back to checkpoint n", Run: restoreCommand},
+		{Name: "undo-file", Usage: "/undo-file [path]", Description: "Restore the most recently deleted file or directory (or path) from the trash", Run: undoFileCommand},
+		{Name: "sessions", Usage: "/sessions [show|resume|delete <n>]", Description: "List saved sessions, preview one, resume it, or delete it", Run: sessionsCommand},
+		{Name: "search", Usage: "/search <query>", Description: "Find saved sessions whose prompts, replies, or tool calls mention every word of the query", Run: searchCommand},
+		{Name: "save", Usage: "/save <file>", Description: "Write the whole conversation, tool calls included, to a portable JSON file", Run: saveCommand},
+		{Name: "load", Usage: "/load <file>", Description: "Continue a conversation saved with /save, replacing the current one", Run: loadCommand},
+		{Name: "undo", Usage: "/undo [files]", Description: "Drop the last prompt and everything done in reply; with files, also restore that turn's checkpoint", Run: undoCommand},
+		{Name: "stats", Usage: "/stats", Description: "Show per-tool call counts, failure rates, latency, and result sizes for this session", Run: statsCommand},
+		{Name: "compact", Usage: "/compact", Description: "Replace older history with a model-written summary to free context", Run: compactCommand},
+		{Name: "edit", Usage: "/edit [draft]", Description: "Compose the next prompt in $EDITOR (also Ctrl-E then Enter) and send it when the editor exits", Run: editCommand},
+		{Name: "prompt", Usage: "/prompt [name] [args]", Description: "Send the prompt template .coder/prompts/<name>.md with its {{placeholders}} filled from args; without a name, list templates", Run: promptCommand},
+		{Name: "copy", Usage: "/copy [all]", Description: "Copy the last code block (or the whole last response) to the clipboard", Run: copyCommand},
+		{Name: "pr", Usage: "/pr [base]", Description: "Commit this session's changes to a new branch, push it, and open a GitHub pull request", Run: prCommand},
+		{Name: "quit", Usage: "/quit, /exit", Description: "Exit the session"},
+	}
+}
+
+func runSlashCommand(s *Session, line string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	args = strings.TrimSpace(args)
+	debugf("slash_command name=%q args=%q", name, args)
+
+	for _, cmd := range slashCommands() {
+		if cmd.Name != name || cmd.Run == nil {
+			continue
+		}
+		if err := cmd.Run(s, args); err != nil {
+			fmt.Fprintf(s.out, "%s: %v\n", colorLabel("error", errorColor, s.colorOutput), err)
+		}
+		return
+	}
+	for _, cmd := range s.customCommands {
+		if cmd.Name != name {
+			continue
+		}
+		if err := cmd.run(s, args); err != nil {
+			fmt.Fprintf(s.out, "%s: %v\n", colorLabel("error", errorColor, s.colorOutput), err)
+		}
+		return
+	}
+	fmt.Fprintf(s.out, "%s: unknown command /%s (try /help)\n", colorLabel("error", errorColor, s.colorOutput), name)
+}
+
+func helpCommand(s *Session, args string) error {
+	for _, cmd := range slashCommands() {
+		fmt.Fprintf(s.out, "  %-22s %s\n", cmd.Usage, cmd.Description)
+	}
+	if len(s.customCommands) > 0 {
+		fmt.Fprintf(s.out, "\nCustom commands (%s):\n", filepath.Join(coderDirName, commandsDirName))
+		for _, cmd := range s.customCommands {
+			fmt.Fprintf(s.out, "  %-22s %s\n", cmd.usage(), cmd.Description)
+		}
+	}
+	return nil
+}
+
+func checkpointsCommand(s *Session, args string) error {
+	if len(s.checkpoints) == 0 {
+		fmt.Fprintln(s.out, "No checkpoints yet. A checkpoint is taken at the start of each turn inside a git repository.")
+		return nil
+	}
+	for _, cp := range s.checkpoints {
+		fmt.Fprintf(s.out, "  %3d  %s  %s  %s\n", cp.Turn, cp.Created.Format("15:04:05"), cp.Commit[:12], previewText(cp.Prompt, 60))
+	}
+	return nil
+}
+
+func restoreCommand(s *Session, args string) error {
+	n, err := strconv.Atoi(args)
+	if err != nil {
+		return errors.New("usage: /restore <n> (see /checkpoints)")
+	}
+	return s.restoreCheckpoint(n)
+}
+
+func undoFileCommand(s *Session, args string) error {
+	return s.restoreFromTrash(args)
+}
+
+func sessionsCommand(s *Session, args string) error {
+	action, target, _ := strings.Cut(args, " ")
+	target = strings.TrimSpace(target)
+	if action == "" {
+		return printSessions(s.out, s.root)
+	}
+	if target == "" {
+		return errors.New("usage: /sessions [show|resume|delete <n>] (n is the number shown by /sessions, or a session id)")
+	}
+	switch action {
+	case "show":
+		record, err := findSession(s.root, target)
+		if err != nil {
+			return err
+		}
+		printSessionPreview(s.out, record)
+		return nil
+	case "resume":
+		return s.resume(target)
+	case "delete":
+		record, err := findSession(s.root, target)
+		if err != nil {
+			return err
+		}
+		if record.ID == s.ID {
+			return errors.New("cannot delete the session in progress")
+		}
+		if !s.confirm(fmt.Sprintf("Delete session %q (%s)?", record.Title, record.ID)) {
+			return nil
+		}
+		if err := os.Remove(filepath.Join(sessionsDir(s.root), record.ID+".json")); err != nil {
+			return fmt.Errorf("failed to delete session: %w", err)
+		}
+		fmt.Fprintf(s.out, "Deleted session %s\n", record.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown /sessions action %q (expected show, resume, or delete)", action)
+	}
+}
+
+func undoCommand(s *Session, args string) error {
+	switch args {
+	case "":
+		return s.undoTurn(false)
+	case "files":
+		return s.undoTurn(true)
+	default:
+		return errors.New("usage: /undo [files]")
+	}
+}
+
+func compactCommand(s *Session, args string) error {
+	return s.compact()
+}
+
+func copyCommand(s *Session, args string) error {
+	if s.lastResponse == "" {
+		return errors.New("nothing to copy yet; the last turn had no assistant text")
+	}
+	text, what := s.lastResponse, "last response"
+	switch args {
+	case "all":
+	case "":
+		blocks := fencedCodeBlocks(s.lastResponse)
+		if len(blocks) == 0 {
+			return errors.New("the last response has no code block (use /copy all for the whole response)")
+		}
+		text, what = blocks[len(blocks)-1], "last code block"
+	default:
+		return errors.New("usage: /copy [all]")
+	}
+	method, err := copyToClipboard(text)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Copied %s (%d bytes) via %s\n", what, len(text), method)
+	return nil
+}
+
+// fencedCodeBlocks returns the contents of the fenced code blocks in text.
+func fencedCodeBlocks(text string) []string {
+	var blocks, code []string
+	fence := ""
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if fence == "" {
+			if marker := fenceMarker(trimmed); marker != "" {
+				fence, code = marker, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])) == "" {
+			blocks = append(blocks, strings.Join(code, "\n"))
+			fence = ""
+			continue
+		}
+		code = append(code, line)
+	}
+	if fence != "" {
+		blocks = append(blocks, strings.Join(code, "\n"))
+	}
+	return blocks
+}
+
+// copyToClipboard hands text to the first available platform clipboard
+// utility, falling back to the OSC 52 escape sequence, which most terminals
+// (including over SSH) forward to the local clipboard.
+func copyToClipboard(text string) (string, error) {
+	candidates := [][]string{
+		{"pbcopy"},
+		{"wl-copy"},
+		{"xclip", "-selection", "clipboard"},
+		{"xsel", "--clipboard", "--input"},
+		{"clip.exe"},
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err != nil {
+			continue
+		}
+		if candidate[0] == "wl-copy" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			continue
+		}
+		if strings.HasPrefix(candidate[0], "x") && os.Getenv("DISPLAY") == "" {
+			continue
+		}
+		cmd := exec.Command(candidate[0], candidate[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			debugf("clipboard_command_failed command=%q error=%q", candidate[0], err.Error())
+			continue
+		}
+		return candidate[0], nil
+	}
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return "", errors.New("no clipboard utility found and stdout is not a terminal")
+	}
+	fmt.Fprintf(os.Stdout, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return "OSC 52", nil
+}
+
+// compactSummaryHeader starts the message that holds the summary written by
+// compact.
+const compactSummaryHeader = "Summary of our conversation so far (earlier messages were compacted):\n\n"
+
+// compact asks the model to summarize everything but the last few messages
+// and replaces that part of the history with the summary. The kept tail always
+// starts at a user prompt so no tool result loses its tool call.
+func (s *Session) compact() error {
+	split := -1
+	for i := len(s.history) - compactKeepMessages; i > 0; i-- {
+		if isUserPrompt(s.history[i]) {
+			split = i
+			break
+		}
+	}
+	if split <= 1 {
+		return errors.New("the conversation is too short to compact")
+	}
+
+	if s.history[split-1].Role == anthropic.MessageParamRoleUser {
+		return errors.New("the conversation cannot be compacted right after a failed request; send another prompt first")
+	}
+	request := append(append([]anthropic.MessageParam(nil), s.history[:split]...), anthropic.NewUserMessage(anthropic.NewTextBlock(compactPrompt)))
+	fmt.Fprintln(s.out, "Summarizing earlier conversation...")
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout(s.cfg, s.cfg.ModelID, defaultMaxTokens))
+	defer cancel()
+	start := time.Now()
+	message, _, err := s.provider.Send(ctx, ProviderRequest{
+		ModelID:      s.cfg.ModelID,
+		SystemPrompt: s.cfg.SystemPrompt,
+		History:      request,
+		Tools:        s.tools,
+	})
+	metrics.observeAPICall(s.cfg.ModelID, time.Since(start), message, err)
+	if err != nil {
+		return fmt.Errorf("summary request failed: %w", err)
+	}
+	summary, _ := parseContent(message.Content)
+	if strings.TrimSpace(summary) == "" {
+		return errors.New("the model returned an empty summary; history left unchanged")
+	}
+
+	before := estimateTokens(s.history)
+	compacted := []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock(compactSummaryHeader + summary)),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock("Understood. I'll continue from this summary.")),
+	}
+	s.history = append(compacted, s.history[split:]...)
+	// Cached calls point at results that may now only exist in the summary.
+	s.cache.clear()
+	after := estimateTokens(s.history)
+	s.save(s.cfg.ModelID)
+
+	debugf("history_compacted messages_summarized=%d tokens_before=%d tokens_after=%d", split, before, after)
+	fmt.Fprintf(s.out, "Compacted %d messages into a summary; about %d tokens reclaimed (%d -> %d).\n", split, before-after, before, after)
+	return nil
+}
+
+// undoTurn removes the most recent user prompt and every message after it.
+// With restoreFiles, the workspace is also rolled back to the checkpoint taken
+// when that prompt was sent.
+func (s *Session) undoTurn(restoreFiles bool) error {
+	last := -1
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if isUserPrompt(s.history[i]) {
+			last = i
+			break
+		}
+	}
+	if last < 0 || s.turn == 0 {
+		return errors.New("nothing to undo")
+	}
+	undone := s.turn
+	prompt := previewText(firstUserText(s.history[last:]), 60)
+
+	if restoreFiles {
+		if err := s.restoreCheckpoint(undone); err != nil {
+			return err
+		}
+		// restoreCheckpoint tells the model about the rollback, but the turn
+		// it refers to is being removed.
+		s.notes = nil
+	} else if last < len(s.history)-1 {
+		s.addNote("Note: the user withdrew their previous request and your reply to it. Any file changes made while handling it were kept; re-read files before relying on their contents.")
+	}
+
+	s.history = s.history[:last]
+	s.turn--
+	kept := s.checkpoints[:0]
+	for _, cp := range s.checkpoints {
+		if cp.Turn < undone {
+			kept = append(kept, cp)
+		}
+	}
+	s.checkpoints = kept
+	s.save(s.cfg.ModelID)
+
+	debugf("turn_undone turn=%d restore_files=%t messages_left=%d", undone, restoreFiles, len(s.history))
+	fmt.Fprintf(s.out, "Undid turn %d (%q).\n", undone, prompt)
+	return nil
+}
+
+// isUserPrompt reports whether msg is a user message typed by the user rather
+// than a batch of tool results or a summary standing in for dropped history.
+func isUserPrompt(msg anthropic.MessageParam) bool {
+	if msg.Role != anthropic.MessageParamRoleUser {
+		return false
+	}
+	for _, block := range msg.Content {
+		if block.OfToolResult != nil {
+			return false
+		}
+	}
+	text := firstUserText([]anthropic.MessageParam{msg})
+	return !strings.HasPrefix(text, compactSummaryHeader) && !strings.HasPrefix(text, retainedPromptsHeader)
+}
+
+// estimateTokens approximates the token count of history at four bytes of
+// serialized JSON per token.
+func estimateTokens(history []anthropic.MessageParam) int {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return 0
+	}
+	return len(data) / 4
+}
+
+// SessionRecord is a conversation saved under .coder/sessions/<id>.json after
+// every turn so it can be listed and resumed later.
+type SessionRecord struct {
+	ID        string                   `json:"id"`
+	Title     string                   `json:"title"`
+	Model     string                   `json:"model"`
+	Created   time.Time                `json:"created"`
+	Updated   time.Time                `json:"updated"`
+	Turns     int                      `json:"turns"`
+	History   []anthropic.MessageParam `json:"history"`
+	ToolStats map[string]*ToolStats    `json:"tool_stats,omitempty"`
+}
+
+func sessionsDir(root string) string {
+	return filepath.Join(root, coderDirName, sessionsDirName)
+}
+
+// save writes the session to disk. Failures are reported but do not interrupt
+// the chat.
+func (s *Session) save(modelID string) {
+	if len(s.history) == 0 && s.title == "" {
+		return
+	}
+	if s.title == "" {
+		s.title = previewText(firstUserText(s.history), 60)
+	}
+	record := SessionRecord{
+		ID:        s.ID,
+		Title:     s.title,
+		Model:     modelID,
+		Created:   s.created,
+		Updated:   time.Now(),
+		Turns:     s.turn,
+		History:   s.history,
+		ToolStats: s.toolStats,
+	}
+	err := func() error {
+		dir := sessionsDir(s.root)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		tmp := filepath.Join(dir, s.ID+".json.tmp")
+		if err := os.WriteFile(tmp, data, 0o600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, filepath.Join(dir, s.ID+".json"))
+	}()
+	if err != nil {
+		debugf("session_save_failed session=%q error=%q", s.ID, err.Error())
+		fmt.Fprintf(os.Stderr, "Failed to save session: %v\n", err)
+	}
+}
+
+func firstUserText(history []anthropic.MessageParam) string {
+	for _, msg := range history {
+		if msg.Role != anthropic.MessageParamRoleUser {
+			continue
+		}
+		for _, block := range msg.Content {
+			if block.OfText != nil {
+				return block.OfText.Text
+			}
+		}
+	}
+	return ""
+}
+
+// loadSessions returns the sessions saved in the current directory, most
+// recently updated first.
+func loadSessions(root string) ([]SessionRecord, error) {
+	dir := sessionsDir(root)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions directory: %w", err)
+	}
+	var records []SessionRecord
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var record SessionRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			debugf("session_load_failed file=%q error=%q", entry.Name(), err.Error())
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Updated.After(records[j].Updated) })
+	return records, nil
+}
+
+// findSession looks a session up by its number in the listing or by id.
+func findSession(root, target string) (SessionRecord, error) {
+	records, err := loadSessions(root)
+	if err != nil {
+		return SessionRecord{}, err
+	}
+	if n, err := strconv.Atoi(target); err == nil && n >= 1 && n <= len(records) {
+		return records[n-1], nil
+	}
+	for _, record := range records {
+		if record.ID == target {
+			return record, nil
+		}
+	}
+	return SessionRecord{}, fmt.Errorf("no saved session %q (see /sessions)", target)
+}
+
+func printSessions(w io.Writer, root string) error {
+	records, err := loadSessions(root)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No saved sessions in this workspace.")
+		return nil
+	}
+	for i, record := range records {
+		if i == maxListedSessions {
+			fmt.Fprintf(w, "  ... and %d older\n", len(records)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %2d  %s  %3d turn(s)  %-60s  %s\n", i+1, record.Updated.Local().Format("2006-01-02 15:04"), record.Turns, record.Title, record.ID)
+	}
+	return nil
+}
+
+func printSessionPreview(w io.Writer, record SessionRecord) {
+	fmt.Fprintf(w, "%s\n  id %s, model %s, %d turn(s), started %s\n", record.Title, record.ID, record.Model, record.Turns, record.Created.Local().Format("2006-01-02 15:04"))
+	var lines []string
+	for i := len(record.History) - 1; i >= 0 && len(lines) < 6; i-- {
+		msg := record.History[i]
+		for _, block := range msg.Content {
+			if block.OfText == nil || strings.TrimSpace(block.OfText.Text) == "" {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("  %-10s %s", string(msg.Role)+":", previewText(block.OfText.Text, 100)))
+			break
+		}
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		fmt.Fprintln(w, lines[i])
+	}
+}
+
+// resume replaces the current conversation with a saved one and continues
+// saving under its id.
+func (s *Session) resume(target string) error {
+	record, err := findSession(s.root, target)
+	if err != nil {
+		return err
+	}
+	s.ID = record.ID
+	s.title = record.Title
+	s.created = record.Created
+	s.history = record.History
+	s.turn = record.Turns
+	s.toolStats = record.ToolStats
+	if s.toolStats == nil {
+		s.toolStats = make(map[string]*ToolStats)
+	}
+	s.checkpoints = nil
+	s.cache.clear()
+	if s.audit != nil {
+		s.audit.sessionID = record.ID
+	}
+	debugf("session_resumed session=%q turns=%d messages=%d", record.ID, record.Turns, len(record.History))
+	fmt.Fprintf(s.out, "Resumed session %q (%d turn(s))\n", record.Title, record.Turns)
+	return nil
+}
+
+// modelInfo describes a model's context window, list price in dollars per
+// million tokens, and how long a request may take before it is abandoned.
+type modelInfo struct {
+	ContextWindow  int64
+	InputPerMTok   float64
+	OutputPerMTok  float64
+	RequestTimeout time.Duration
+}
+
+// knownModels is keyed by model id prefix; the longest matching prefix wins so
+// dated snapshots resolve to their family.
+var knownModels = map[string]modelInfo{
+	"claude-opus-4-5":   {ContextWindow: 200_000, InputPerMTok: 5, OutputPerMTok: 25, RequestTimeout: 5 * time.Minute},
+	"claude-opus-4":     {ContextWindow: 200_000, InputPerMTok: 15, OutputPerMTok: 75, RequestTimeout: 5 * time.Minute},
+	"claude-sonnet-4":   {ContextWindow: 200_000, InputPerMTok: 3, OutputPerMTok: 15, RequestTimeout: 3 * time.Minute},
+	"claude-3-7-sonnet": {ContextWindow: 200_000, InputPerMTok: 3, OutputPerMTok: 15, RequestTimeout: 3 * time.Minute},
+	"claude-haiku-4":    {ContextWindow: 200_000, InputPerMTok: 1, OutputPerMTok: 5, RequestTimeout: 90 * time.Second},
+	"claude-3-5-haiku":  {ContextWindow: 200_000, InputPerMTok: 0.8, OutputPerMTok: 4, RequestTimeout: 90 * time.Second},
+}
+
+func lookupModel(modelID string) (modelInfo, bool) {
+	best := ""
+	for prefix := range knownModels {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return modelInfo{}, false
+	}
+	return knownModels[best], true
+}
+
+// sessionUsage accumulates token counts and cost over API calls.
+type sessionUsage struct {
+	Calls         int
+	InputTokens   int64
+	OutputTokens  int64
+	Cost          float64
+	LastCallInput int64
+}
+
+func (u *sessionUsage) add(modelID string, usage anthropic.Usage) {
+	input := usage.InputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+	u.Calls++
+	u.InputTokens += input
+	u.OutputTokens += usage.OutputTokens
+	u.LastCallInput = input + usage.OutputTokens
+	if info, ok := lookupModel(modelID); ok {
+		// Cache reads bill at a tenth of the input price, cache writes at 1.25x.
+		billedInput := float64(usage.InputTokens) + 0.1*float64(usage.CacheReadInputTokens) + 1.25*float64(usage.CacheCreationInputTokens)
+		u.Cost += (billedInput*info.InputPerMTok + float64(usage.OutputTokens)*info.OutputPerMTok) / 1e6
+	}
+}
+
+func (u *sessionUsage) merge(other sessionUsage) {
+	u.Calls += other.Calls
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.Cost += other.Cost
+	if other.Calls > 0 {
+		u.LastCallInput = other.LastCallInput
+	}
+}
+
+// footer renders usage as "↑ 12.3k ↓ 1.1k • ctx 38% • $0.07". Context and
+// cost are left out for models without registry data.
+func (u sessionUsage) footer(modelID string) string {
+	parts := []string{fmt.Sprintf("↑ %s ↓ %s", formatTokenCount(u.InputTokens), formatTokenCount(u.OutputTokens))}
+	if info, ok := lookupModel(modelID); ok {
+		parts = append(parts,
+			fmt.Sprintf("ctx %d%%", u.LastCallInput*100/info.ContextWindow),
+			fmt.Sprintf("$%.2f", u.Cost),
+		)
+	}
+	return strings.Join(parts, " • ")
+}
+
+// ToolStats is how one tool has been used over a session.
+type ToolStats struct {
+	Calls       int   `json:"calls"`
+	Failures    int   `json:"failures"`
+	TotalMs     int64 `json:"total_ms"`
+	ResultBytes int64 `json:"result_bytes"`
+}
+
+func (s *Session) recordToolStats(name string, duration time.Duration, resultBytes int, failed bool) {
+	stats := s.toolStats[name]
+	if stats == nil {
+		stats = &ToolStats{}
+		s.toolStats[name] = stats
+	}
+	stats.Calls++
+	if failed {
+		stats.Failures++
+	}
+	stats.TotalMs += duration.Milliseconds()
+	stats.ResultBytes += int64(resultBytes)
+}
+
+// statsCommand prints the session's tool usage, busiest tools first, so tools
+// that fail often or return a lot of text stand out.
+func statsCommand(s *Session, args string) error {
+	if len(s.toolStats) == 0 {
+		fmt.Fprintln(s.out, "No tool calls yet.")
+		return nil
+	}
+	names := make([]string, 0, len(s.toolStats))
+	for name := range s.toolStats {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := s.toolStats[names[i]], s.toolStats[names[j]]
+		if a.Calls != b.Calls {
+			return a.Calls > b.Calls
+		}
+		return names[i] < names[j]
+	})
+
+	fmt.Fprintf(s.out, "  %-20s %6s %8s %10s %10s %10s\n", "tool", "calls", "failed", "avg time", "returned", "avg size")
+	var total ToolStats
+	for _, name := range names {
+		stats := s.toolStats[name]
+		fmt.Fprintln(s.out, stats.row(name))
+		total.Calls += stats.Calls
+		total.Failures += stats.Failures
+		total.TotalMs += stats.TotalMs
+		total.ResultBytes += stats.ResultBytes
+	}
+	fmt.Fprintln(s.out, total.row("total"))
+	if s.usage.Calls > 0 {
+		fmt.Fprintf(s.out, "\n  %d API call(s): %s\n", s.usage.Calls, s.usage.footer(s.cfg.ModelID))
+	}
+	return nil
+}
+
+func (t ToolStats) row(name string) string {
+	return fmt.Sprintf("  %-20s %6d %7.0f%% %10s %10s %10s",
+		name,
+		t.Calls,
+		100*float64(t.Failures)/float64(t.Calls),
+		(time.Duration(t.TotalMs/int64(t.Calls)) * time.Millisecond).String(),
+		formatTokenCount(t.ResultBytes)+"B",
+		formatTokenCount(t.ResultBytes/int64(t.Calls))+"B",
+	)
+}
+
+func formatTokenCount(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+}
+
+// statusError is returned by the HTTP providers for non-success responses so
+// callers can tell server-side failures from bad requests.
+type statusError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+func statusErrorf(statusCode int, format string, args ...any) error {
+	return &statusError{StatusCode: statusCode, msg: fmt.Sprintf(format, args...)}
+}
+
+// isOverloadedError reports whether err is an overloaded (529) or other 5xx
+// response from any provider.
+func isOverloadedError(err error) bool {
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return false
+}
+
+// runReplay implements "coder replay [-execute] [-workspace dir] <session>".
+// It prints a saved session as it appeared in the terminal. With -execute the
+// recorded tool calls are run again, in order, inside a fresh workspace and
+// each new result is compared with the recorded one.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	execute := fs.Bool("execute", false, "Re-run the recorded tool calls and compare their results")
+	workspace := fs.String("workspace", "", "Directory to run tool calls in with -execute (defaults to a new temporary directory)")
+	force := fs.Bool("force", false, "With -execute, run tool calls in a -workspace that is not empty")
+	verbose := fs.Bool("verbose", false, "Enable verbose debug logs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: coder replay [-execute] [-workspace dir [-force]] <session file | id | number>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// Allow flags after the session argument too.
+	target := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[min(1, fs.NArg()):]); err != nil {
+		return err
+	}
+	if target == "" {
+		fs.Usage()
+		return errors.New("missing session to replay")
+	}
+	configureLogging(*verbose)
+
+	record, err := loadSessionRecord(Config{}.workspaceRoot(), target)
+	if err != nil {
+		return err
+	}
+
+	cfg := Config{
+		AssistantName: "Claude",
+		ModelID:       record.Model,
+		ModelName:     modelDisplayName(record.Model),
+		ColorOutput:   supportsColor(os.Stdout),
+	}
+	cfg.Highlight, cfg.Markdown = cfg.ColorOutput, cfg.ColorOutput
+
+	var session *Session
+	var toolMap map[string]Tool
+	if *execute {
+		// The recorded calls run under the project's permissions, so a
+		// replay asks before whatever the session would have asked before.
+		cfg.Project, err = loadProjectConfig("")
+		if err != nil {
+			return err
+		}
+		cfg.Project.Audit.Disabled = true
+		dir := *workspace
+		if dir == "" {
+			dir, err = os.MkdirTemp("", "coder-replay-")
+			if err != nil {
+				return fmt.Errorf("failed to create replay workspace: %w", err)
+			}
+			defer os.RemoveAll(dir)
+		} else {
+			if dir, err = filepath.Abs(dir); err != nil {
+				return err
+			}
+			// Replayed writes, moves, and deletes would land on whatever
+			// is already there.
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 && !*force {
+				return fmt.Errorf("replay workspace %s is not empty; the replayed tool calls may change or delete its files (add -force to use it anyway)", dir)
+			}
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return fmt.Errorf("failed to create replay workspace: %w", err)
+			}
+		}
+		cfg.Dir = dir
+		session = newSession(cfg)
+		toolMap, _, err = buildToolRegistry(registeredTools(session), cfg.Project.Permissions)
+		if err != nil {
+			return err
+		}
+		defer session.cleanup()
+		fmt.Fprintf(os.Stdout, "Replaying %q in %s\n\n", record.Title, dir)
+	} else {
+		fmt.Fprintf(os.Stdout, "Session %q (%s, %d turn(s))\n\n", record.Title, record.ID, record.Turns)
+	}
+
+	matched, differed := 0, 0
+	for _, msg := range record.History {
+		for _, block := range msg.Content {
+			switch {
+			case block.OfText != nil && msg.Role == anthropic.MessageParamRoleUser:
+				fmt.Fprintf(os.Stdout, "%s%s\n", userPrefix(cfg.ColorOutput), block.OfText.Text)
+			case block.OfText != nil:
+				fmt.Fprintf(os.Stdout, "%s%s\n", assistantPrefix(cfg.AssistantName, cfg.ModelName, cfg.ColorOutput), formatAssistantText(block.OfText.Text, cfg))
+			case block.OfToolUse != nil:
+				input, _ := json.Marshal(block.OfToolUse.Input)
+				fmt.Fprintf(os.Stdout, "%s: %s(%s)\n", colorLabel("tool", toolColor, cfg.ColorOutput), block.OfToolUse.Name, input)
+				if session == nil {
+					continue
+				}
+				result, toolErr := session.runTool(toolMap, ToolUse{ID: block.OfToolUse.ID, Name: block.OfToolUse.Name, Input: input})
+				recorded := recordedToolResult(record.History, block.OfToolUse.ID)
+				label, color := "replayed", resultColor
+				if toolErr != nil {
+					label, color = "replayed error", errorColor
+					result = formatToolError(toolErr)
+				}
+				fmt.Fprintf(os.Stdout, "%s: %s\n", colorLabel(label, color, cfg.ColorOutput), result)
+				if strings.TrimSpace(result) == strings.TrimSpace(recorded) {
+					matched++
+					fmt.Fprintln(os.Stdout, colorLabel("(matches the recorded result)", commentColor, cfg.ColorOutput))
+				} else {
+					differed++
+					fmt.Fprintf(os.Stdout, "%s\n%s\n", colorLabel("(differs; recorded result was:)", warnColor, cfg.ColorOutput), recorded)
+				}
+			case block.OfToolResult != nil && session == nil:
+				label, color := "result", resultColor
+				if block.OfToolResult.IsError.Value {
+					label, color = "error", errorColor
+				}
+				fmt.Fprintf(os.Stdout, "%s: %s\n", colorLabel(label, color, cfg.ColorOutput), toolResultText(block.OfToolResult))
+			}
+		}
+	}
+	if session != nil {
+		fmt.Fprintf(os.Stdout, "\nReplayed %d tool call(s): %d matched, %d differed.\n", matched+differed, matched, differed)
+	}
+	return nil
+}
+
+// EvalTask is the task.json of one eval task directory. The task's
+// workspace/ subdirectory, if any, is copied into a fresh temporary directory
+// where the agent runs Prompt; Verify (or the task's verify.sh) then decides
+// pass or fail by its exit status.
+type EvalTask struct {
+	Prompt         string `json:"prompt"`
+	Verify         string `json:"verify,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// EvalResult is one task's entry in the eval report.
+type EvalResult struct {
+	Task         string  `json:"task"`
+	Passed       bool    `json:"passed"`
+	Error        string  `json:"error,omitempty"`
+	APICalls     int     `json:"api_calls"`
+	ToolCalls    int     `json:"tool_calls"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	DurationMs   int64   `json:"duration_ms"`
+	Workspace    string  `json:"workspace"`
+	Transcript   string  `json:"transcript"`
+	VerifyOutput string  `json:"verify_output,omitempty"`
+}
+
+// EvalReport is written by "coder eval -report".
+type EvalReport struct {
+	Model   string       `json:"model"`
+	Started time.Time    `json:"started"`
+	Passed  int          `json:"passed"`
+	Total   int          `json:"total"`
+	CostUSD float64      `json:"cost_usd"`
+	Results []EvalResult `json:"results"`
+}
+
+const defaultEvalVerifyTimeout = 120
+
+// runEval implements "coder eval [flags] <tasks dir>". Each subdirectory with a
+// task.json is run headlessly with the usual model flags; the report lists
+// pass/fail, tokens, cost, and tool rounds per task. It reports whether every
+// task passed.
+func runEval() (bool, error) {
+	reportPath := flag.String("report", "", "Write the eval report as JSON to this file")
+	filter := flag.String("run", "", "Only run tasks whose name contains this string")
+	cfg, err := loadConfig()
+	if err != nil {
+		return false, err
+	}
+	configureLogging(cfg.Verbose)
+	tasksDir := flag.Arg(0)
+	if tasksDir == "" {
+		return false, errors.New("usage: coder eval [flags] <tasks dir>")
+	}
+	tasksDir, err = filepath.Abs(tasksDir)
+	if err != nil {
+		return false, err
+	}
+	entries, err := os.ReadDir(tasksDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read tasks directory: %w", err)
+	}
+
+	// Tasks run without a terminal: nothing can be approved interactively and
+	// the per-turn footer would only clutter transcripts.
+	cfg.ColorOutput, cfg.Highlight, cfg.Markdown = false, false, false
+	cfg.Project.Audit.Disabled = true
+	footer := false
+	cfg.Project.UsageFooter = &footer
+	provider := newProvider(cfg)
+
+	report := EvalReport{Model: cfg.ModelID, Started: time.Now()}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.Contains(entry.Name(), *filter) {
+			continue
+		}
+		taskDir := filepath.Join(tasksDir, entry.Name())
+		if _, err := os.Stat(filepath.Join(taskDir, "task.json")); err != nil {
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%-40s ", entry.Name())
+		result := runEvalTask(cfg, provider, entry.Name(), taskDir)
+		report.Results = append(report.Results, result)
+		report.Total++
+		report.CostUSD += result.CostUSD
+		status := "FAIL"
+		if result.Passed {
+			report.Passed++
+			status = "PASS"
+		}
+		fmt.Fprintf(os.Stdout, "%s  %2d rounds  %3d tools  ↑%s ↓%s  $%.3f  %.1fs", status, result.APICalls, result.ToolCalls,
+			formatTokenCount(result.InputTokens), formatTokenCount(result.OutputTokens), result.CostUSD, float64(result.DurationMs)/1000)
+		if result.Error != "" {
+			fmt.Fprintf(os.Stdout, "  (%s)", result.Error)
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+	if report.Total == 0 {
+		return false, fmt.Errorf("no tasks found in %s (each task needs a task.json)", tasksDir)
+	}
+	fmt.Fprintf(os.Stdout, "\n%d/%d passed, $%.2f total\n", report.Passed, report.Total, report.CostUSD)
+
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		if err := os.WriteFile(*reportPath, data, 0o644); err != nil {
+			return false, fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+	return report.Passed == report.Total, nil
+}
+
+func runEvalTask(cfg Config, provider Provider, name, taskDir string) (result EvalResult) {
+	result.Task = name
+	start := time.Now()
+	defer func() { result.DurationMs = time.Since(start).Milliseconds() }()
+
+	var task EvalTask
+	data, err := os.ReadFile(filepath.Join(taskDir, "task.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &task)
+	}
+	if err != nil || strings.TrimSpace(task.Prompt) == "" {
+		result.Error = "invalid task.json: needs a prompt"
+		return result
+	}
+
+	workspace, err := os.MkdirTemp("", "coder-eval-"+name+"-")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Workspace = workspace
+	result.Transcript = workspace + ".log"
+	if err := copyTree(filepath.Join(taskDir, "workspace"), workspace); err != nil && !os.IsNotExist(err) {
+		result.Error = "failed to copy workspace: " + err.Error()
+		return result
+	}
+
+	transcript, err := os.Create(result.Transcript)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	cfg.Dir, cfg.Stdout = workspace, transcript
+
+	session := newSession(cfg)
+	session.input = bufio.NewScanner(strings.NewReader(""))
+	toolMap, anthropicTools, err := buildToolRegistry(registeredTools(session), cfg.Project.Permissions)
+	var stats turnStats
+	if err == nil {
+		session.provider, session.tools = provider, anthropicTools
+		stats = runTurn(context.Background(), cfg, session, provider, toolMap, anthropicTools, task.Prompt)
+		err = stats.Err
+	}
+	session.cleanup()
+	transcript.Close()
+
+	result.APICalls = stats.APICalls
+	result.ToolCalls = stats.ToolCalls
+	result.InputTokens = stats.Usage.InputTokens
+	result.OutputTokens = stats.Usage.OutputTokens
+	result.CostUSD = stats.Usage.Cost
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	verify := task.Verify
+	if verify == "" {
+		if _, statErr := os.Stat(filepath.Join(taskDir, "verify.sh")); statErr == nil {
+			verify = "bash " + strconv.Quote(filepath.Join(taskDir, "verify.sh"))
+		}
+	}
+	if verify == "" {
+		result.Error = "task has no verify command or verify.sh"
+		return result
+	}
+	timeout := task.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultEvalVerifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-lc", verify)
+	cmd.Dir = workspace
+	output, verifyErr := cmd.CombinedOutput()
+	result.VerifyOutput, _ = truncateOutput(output, 4_000)
+	// A turn that ended on an API error counts as a failure even if the
+	// fixture happens to satisfy the verifier already.
+	result.Passed = verifyErr == nil && result.Error == ""
+	if verifyErr != nil && result.Error == "" {
+		result.Error = "verify failed: " + verifyErr.Error()
+	}
+	return result
+}
+
+// copyTree copies the directory src into dst, preserving file modes and
+// symlinks.
+func copyTree(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, data, info.Mode().Perm())
+		}
+	})
+}
+
+// loadSessionRecord reads a session from a file path, or from the saved
+// sessions of the workspace at root by id or listing number.
+func loadSessionRecord(root, target string) (SessionRecord, error) {
+	data, err := os.ReadFile(target)
+	if os.IsNotExist(err) {
+		return findSession(root, target)
+	}
+	if err != nil {
+		return SessionRecord{}, fmt.Errorf("failed to read session file: %w", err)
+	}
+	var record SessionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return SessionRecord{}, fmt.Errorf("invalid session file %s: %w", target, err)
+	}
+	return record, nil
+}
+
+func recordedToolResult(history []anthropic.MessageParam, toolUseID string) string {
+	for _, msg := range history {
+		for _, block := range msg.Content {
+			if block.OfToolResult != nil && block.OfToolResult.ToolUseID == toolUseID {
+				return toolResultText(block.OfToolResult)
+			}
+		}
+	}
+	return ""
+}
+
+// Provider sends a conversation to a model backend. Conversations are kept in
+// the Anthropic message shape; providers for other APIs translate history and
+// tool schemas on the way out and map replies back into an anthropic.Message so
+// the tool loop does not depend on the backend.
+type Provider interface {
+	Name() string
+	Send(ctx context.Context, req ProviderRequest) (*anthropic.Message, string, error)
+}
+
+type ProviderRequest struct {
+	ModelID      string
+	SystemPrompt string
+	History      []anthropic.MessageParam
+	Tools        []anthropic.ToolUnionParam
+	// OnText, if set, is called with each piece of assistant text as the
+	// response streams in. Providers that do not stream never call it.
+	OnText func(text string)
+}
+
+func newProvider(cfg Config) Provider {
+	httpClient := &http.Client{}
+	if cfg.TraceDir != "" {
+		tracer, err := newTraceTransport(cfg.TraceDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Tracing disabled: %v\n", err)
+		} else {
+			httpClient.Transport = tracer
+		}
+	}
+	switch cfg.Provider {
+	case providerOllama:
+		return &ollamaProvider{baseURL: cfg.OllamaURL, httpClient: httpClient}
+	case providerOpenAI:
+		return &openAIProvider{baseURL: cfg.OpenAIBaseURL, apiKey: cfg.OpenAIAPIKey, httpClient: httpClient}
+	default:
+		client := anthropic.NewClient(option.WithAPIKey(cfg.APIKey), option.WithHTTPClient(httpClient), option.WithMiddleware(countRetries))
+		return &anthropicProvider{client: &client}
+	}
+}
+
+// traceTransport writes every request and response passing through it to
+// numbered JSON files (0001-request.json, 0001-response.json, ...) so the
+// exact payloads exchanged with a provider can be inspected.
+type traceTransport struct {
+	dir  string
+	base http.RoundTripper
+	mu   sync.Mutex
+	seq  int
+}
+
+// TraceRecord is the content of one trace file. Body holds the payload as JSON
+// when it parses, otherwise as a string.
+type TraceRecord struct {
+	Time    time.Time         `json:"time"`
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Body    any               `json:"body,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+func newTraceTransport(dir string) (*traceTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create trace directory: %w", err)
+	}
+	// Continue numbering after the highest trace already in the directory,
+	// so a gap left by a deleted file cannot lead to overwriting another.
+	existing, _ := filepath.Glob(filepath.Join(dir, "*-request.json"))
+	seq := 0
+	for _, path := range existing {
+		if n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), "-request.json")); err == nil && n > seq {
+			seq = n
+		}
+	}
+	return &traceTransport{dir: dir, base: http.DefaultTransport, seq: seq}, nil
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.seq++
+	seq := t.seq
+	t.mu.Unlock()
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	t.write(seq, "request", TraceRecord{Time: time.Now(), Method: req.Method, URL: req.URL.String(), Headers: traceHeaders(req.Header), Body: traceBody(reqBody)})
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.write(seq, "response", TraceRecord{Time: time.Now(), Headers: map[string]string{}, Error: err.Error()})
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	record := TraceRecord{Time: time.Now(), Status: resp.StatusCode, Headers: traceHeaders(resp.Header), Body: traceBody(respBody)}
+	if err != nil {
+		record.Error = err.Error()
+		t.write(seq, "response", record)
+		return nil, err
+	}
+	t.write(seq, "response", record)
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (t *traceTransport) write(seq int, kind string, record TraceRecord) {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(t.dir, fmt.Sprintf("%04d-%s.json", seq, kind)), data, 0o600)
+	}
+	if err != nil {
+		debugf("trace_write_failed seq=%d kind=%q error=%q", seq, kind, err.Error())
+	}
+}
+
+// traceHeaders flattens headers for a trace file, masking credentials.
+func traceHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		switch strings.ToLower(name) {
+		case "authorization", "x-api-key", "api-key":
+			value = "[redacted]"
+		}
+		flat[name] = value
+	}
+	return flat
+}
+
+func traceBody(body []byte) any {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
+
+type anthropicProvider struct {
+	client *anthropic.Client
+}
+
+func (p *anthropicProvider) Name() string { return providerAnthropic }
+
+func (p *anthropicProvider) Send(ctx context.Context, req ProviderRequest) (*anthropic.Message, string, error) {
+	return sendAnthropicMessage(ctx, p.client, req.ModelID, req.SystemPrompt, req.History, req.Tools, req.OnText)
+}
+
+func sendAnthropicMessage(
+	ctx context.Context,
+	client *anthropic.Client,
+	modelID string,
+	systemPrompt string,
+	history []anthropic.MessageParam,
+	tools []anthropic.ToolUnionParam,
+	onText func(string),
+) (*anthropic.Message, string, error) {
+	var rawResp *http.Response
+	params := anthropic.MessageNewParams{
+		Model:       anthropic.Model(modelID),
+		MaxTokens:   defaultMaxTokens,
+		Temperature: anthropic.Float(defaultTemp),
+		Messages:    history,
+		System:      []anthropic.TextBlockParam{{Text: systemPrompt}},
+		Tools:       tools,
+	}
+	var message *anthropic.Message
+	var err error
+	if onText == nil {
+		message, err = client.Messages.New(ctx, params, option.WithResponseInto(&rawResp))
+	} else {
+		message, err = streamAnthropicMessage(ctx, client, params, onText, option.WithResponseInto(&rawResp))
+	}
+
+	requestID := ""
+	if rawResp != nil {
+		requestID = rawResp.Header.Get("request-id")
+	}
+	if err != nil {
+		if requestID != "" {
+			return nil, requestID, fmt.Errorf("%w (request_id=%s)", err, requestID)
+		}
+		return nil, requestID, err
+	}
+	return message, requestID, nil
+}
+
+// streamAnthropicMessage sends params as a streaming request, passing each
+// text delta to onText, and returns the message the stream adds up to.
+func streamAnthropicMessage(ctx context.Context, client *anthropic.Client, params anthropic.MessageNewParams, onText func(string), opts ...option.RequestOption) (*anthropic.Message, error) {
+	stream := client.Messages.NewStreaming(ctx, params, opts...)
+	defer stream.Close()
+	message := &anthropic.Message{}
+	for stream.Next() {
+		event := stream.Current()
+		if err := message.Accumulate(event); err != nil {
+			return nil, err
+		}
+		if delta, ok := event.AsAny().(anthropic.ContentBlockDeltaEvent); ok {
+			if text, ok := delta.Delta.AsAny().(anthropic.TextDelta); ok && text.Text != "" {
+				onText(text.Text)
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// ollamaProvider talks to a local Ollama server through its /api/chat endpoint.
+type ollamaProvider struct {
+	baseURL    string
+	httpClient *http.Client
+	calls      int
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int64         `json:"prompt_eval_count"`
+	EvalCount       int64         `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (p *ollamaProvider) Name() string { return providerOllama }
+
+func (p *ollamaProvider) Send(ctx context.Context, req ProviderRequest) (*anthropic.Message, string, error) {
+	messages := []ollamaMessage{{Role: "system", Content: req.SystemPrompt}}
+	toolNames := make(map[string]string)
+	for _, msg := range req.History {
+		var text strings.Builder
+		var calls []ollamaToolCall
+		var results []ollamaMessage
+		for _, block := range msg.Content {
+			switch {
+			case block.OfText != nil:
+				if text.Len() > 0 {
+					text.WriteString("\n\n")
+				}
+				text.WriteString(block.OfText.Text)
+			case block.OfToolUse != nil:
+				toolNames[block.OfToolUse.ID] = block.OfToolUse.Name
+				args, err := toolUseArguments(block.OfToolUse)
+				if err != nil {
+					return nil, "", err
+				}
+				call := ollamaToolCall{}
+				call.Function.Name = block.OfToolUse.Name
+				call.Function.Arguments = args
+				calls = append(calls, call)
+			case block.OfToolResult != nil:
+				results = append(results, ollamaMessage{
+					Role:     "tool",
+					Content:  toolResultText(block.OfToolResult),
+					ToolName: toolNames[block.OfToolResult.ToolUseID],
+				})
+			}
+		}
+		messages = append(messages, results...)
+		if text.Len() > 0 || len(calls) > 0 {
+			messages = append(messages, ollamaMessage{Role: string(msg.Role), Content: text.String(), ToolCalls: calls})
+		}
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"model":    req.ModelID,
+		"messages": messages,
+		"tools":    functionTools(req.Tools),
+		"stream":   false,
+		"options": map[string]any{
+			"temperature": defaultTemp,
+			"num_predict": defaultMaxTokens,
+		},
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode ollama request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/chat", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, "", fmt.Errorf("ollama request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read ollama response: %w", err)
+	}
+	var chat ollamaChatResponse
+	if err := json.Unmarshal(respBody, &chat); err != nil {
+		return nil, "", statusErrorf(resp.StatusCode, "ollama returned %s with unparseable body: %s", resp.Status, previewText(string(respBody), 200))
+	}
+	if resp.StatusCode != http.StatusOK || chat.Error != "" {
+		return nil, "", statusErrorf(resp.StatusCode, "ollama returned %s: %s", resp.Status, chat.Error)
+	}
+
+	p.calls++
+	content := make([]map[string]any, 0, 1+len(chat.Message.ToolCalls))
+	if chat.Message.Content != "" {
+		content = append(content, map[string]any{"type": "text", "text": chat.Message.Content})
+	}
+	for i, call := range chat.Message.ToolCalls {
+		args := call.Function.Arguments
+		if len(args) == 0 || string(args) == "null" {
+			args = json.RawMessage("{}")
+		}
+		content = append(content, map[string]any{
+			"type":  "tool_use",
+			"id":    fmt.Sprintf("ollama_call_%d_%d", p.calls, i),
+			"name":  call.Function.Name,
+			"input": args,
+		})
+	}
+	stopReason := "end_turn"
+	switch {
+	case len(chat.Message.ToolCalls) > 0:
+		stopReason = "tool_use"
+	case chat.DoneReason == "length":
+		stopReason = "max_tokens"
+	}
+
+	message, err := messageFromParts(fmt.Sprintf("ollama_msg_%d", p.calls), chat.Model, content, stopReason, chat.PromptEvalCount, chat.EvalCount)
+	return message, "", err
+}
+
+// openAIProvider talks to any OpenAI-compatible Chat Completions API, such as
+// OpenAI itself, OpenRouter, or a vLLM server.
+type openAIProvider struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    *string          `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIChatResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *openAIProvider) Name() string { return providerOpenAI }
+
+func (p *openAIProvider) Send(ctx context.Context, req ProviderRequest) (*anthropic.Message, string, error) {
+	system := req.SystemPrompt
+	messages := []openAIMessage{{Role: "system", Content: &system}}
+	for _, msg := range req.History {
+		var text strings.Builder
+		var calls []openAIToolCall
+		var results []openAIMessage
+		for _, block := range msg.Content {
+			switch {
+			case block.OfText != nil:
+				if text.Len() > 0 {
+					text.WriteString("\n\n")
+				}
+				text.WriteString(block.OfText.Text)
+			case block.OfToolUse != nil:
+				args, err := toolUseArguments(block.OfToolUse)
+				if err != nil {
+					return nil, "", err
+				}
+				call := openAIToolCall{ID: block.OfToolUse.ID, Type: "function"}
+				call.Function.Name = block.OfToolUse.Name
+				call.Function.Arguments = string(args)
+				calls = append(calls, call)
+			case block.OfToolResult != nil:
+				content := toolResultText(block.OfToolResult)
+				results = append(results, openAIMessage{Role: "tool", Content: &content, ToolCallID: block.OfToolResult.ToolUseID})
+			}
+		}
+		messages = append(messages, results...)
+		if text.Len() > 0 || len(calls) > 0 {
+			out := openAIMessage{Role: string(msg.Role), ToolCalls: calls}
+			if text.Len() > 0 {
+				content := text.String()
+				out.Content = &content
+			}
+			messages = append(messages, out)
+		}
+	}
+
+	payload := map[string]any{
+		"model":       req.ModelID,
+		"messages":    messages,
+		"max_tokens":  defaultMaxTokens,
+		"temperature": defaultTemp,
+	}
+	if tools := functionTools(req.Tools); len(tools) > 0 {
+		payload["tools"] = tools
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode chat completions request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, "", fmt.Errorf("chat completions request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	requestID := resp.Header.Get("x-request-id")
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, requestID, fmt.Errorf("failed to read chat completions response: %w", err)
+	}
+	var chat openAIChatResponse
+	if err := json.Unmarshal(respBody, &chat); err != nil {
+		return nil, requestID, statusErrorf(resp.StatusCode, "chat completions returned %s with unparseable body: %s", resp.Status, previewText(string(respBody), 200))
+	}
+	if chat.Error != nil {
+		return nil, requestID, statusErrorf(resp.StatusCode, "chat completions returned %s: %s", resp.Status, chat.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK || len(chat.Choices) == 0 {
+		return nil, requestID, statusErrorf(resp.StatusCode, "chat completions returned %s with no choices", resp.Status)
+	}
+
+	choice := chat.Choices[0]
+	content := make([]map[string]any, 0, 1+len(choice.Message.ToolCalls))
+	if choice.Message.Content != nil && *choice.Message.Content != "" {
+		content = append(content, map[string]any{"type": "text", "text": *choice.Message.Content})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		args := json.RawMessage(call.Function.Arguments)
+		if strings.TrimSpace(call.Function.Arguments) == "" || !json.Valid(args) {
+			// Keep malformed arguments visible to the tool so it reports a
+			// validation error instead of failing the whole response.
+			encoded, _ := json.Marshal(map[string]string{"_raw_arguments": call.Function.Arguments})
+			args = encoded
+		}
+		content = append(content, map[string]any{
+			"type":  "tool_use",
+			"id":    call.ID,
+			"name":  call.Function.Name,
+			"input": args,
+		})
+	}
+	stopReason := "end_turn"
+	switch {
+	case len(choice.Message.ToolCalls) > 0:
+		stopReason = "tool_use"
+	case choice.FinishReason == "length":
+		stopReason = "max_tokens"
+	}
+
+	message, err := messageFromParts(chat.ID, chat.Model, content, stopReason, chat.Usage.PromptTokens, chat.Usage.CompletionTokens)
+	return message, requestID, err
+}
+
+// functionTools translates custom tool definitions into the "function" tool
+// format shared by OpenAI-style APIs.
+func functionTools(tools []anthropic.ToolUnionParam) []map[string]any {
+	out := make([]map[string]any, 0, len(tools))
+	for _, tool := range tools {
+		if tool.OfTool == nil {
+			continue
+		}
+		out = append(out, map[string]any{
+			"type": "function",
+			"function": map[string]any{
+				"name":        tool.OfTool.Name,
+				"description": tool.OfTool.Description.Value,
+				"parameters":  tool.OfTool.InputSchema,
+			},
+		})
+	}
+	return out
+}
+
+// messageFromParts builds an anthropic.Message from provider-neutral pieces by
+// round-tripping through the Messages API JSON shape, so the result behaves
+// exactly like a decoded API response (including ToParam).
+func messageFromParts(id, model string, content []map[string]any, stopReason string, inputTokens, outputTokens int64) (*anthropic.Message, error) {
+	raw, err := json.Marshal(map[string]any{
+		"id":          id,
+		"type":        "message",
+		"role":        "assistant",
+		"model":       model,
+		"content":     content,
+		"stop_reason": stopReason,
+		"usage": map[string]any{
+			"input_tokens":  inputTokens,
+			"output_tokens": outputTokens,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode provider message: %w", err)
+	}
+	var message anthropic.Message
+	if err := json.Unmarshal(raw, &message); err != nil {
+		return nil, fmt.Errorf("failed to decode provider message: %w", err)
+	}
+	return &message, nil
+}
+
+func toolUseArguments(block *anthropic.ToolUseBlockParam) (json.RawMessage, error) {
+	if raw, ok := block.Input.(json.RawMessage); ok {
+		return raw, nil
+	}
+	raw, err := json.Marshal(block.Input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode tool input for %s: %w", block.Name, err)
+	}
+	return raw, nil
+}
+
+func toolResultText(block *anthropic.ToolResultBlockParam) string {
+	var b strings.Builder
+	for _, part := range block.Content {
+		if part.OfText != nil {
+			b.WriteString(part.OfText.Text)
+		}
+	}
+	if block.IsError.Valid() && block.IsError.Value {
+		return "Error: " + b.String()
+	}
+	return b.String()
+}
+
+func parseContent(blocks []anthropic.ContentBlockUnion) (string, []ToolUse) {
+	var text strings.Builder
+	tools := make([]ToolUse, 0)
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			input := json.RawMessage(append([]byte(nil), block.Input...))
+			if strings.TrimSpace(string(input)) == "" {
+				input = json.RawMessage([]byte("{}"))
+			}
+			tools = append(tools, ToolUse{ID: block.ID, Name: block.Name, Input: input})
+		}
+	}
+
+	return strings.TrimSpace(text.String()), tools
+}
+
+// runTool runs one tool call and returns its result text. On failure it also
+// returns the classified error, whose message is the text.
+func (s *Session) runTool(toolMap map[string]Tool, toolUse ToolUse) (string, *ToolError) {
+	tool, ok := toolMap[toolUse.Name]
+	if !ok {
+		errMsg := fmt.Sprintf("unknown tool: %s", toolUse.Name)
+		metrics.observeToolCall(toolUse.Name, 0, true)
+		debugf("tool_call_result tool_name=%q ok=false error=%q", toolUse.Name, errMsg)
+		return errMsg, &ToolError{Code: ToolErrorNotFound, Message: errMsg}
+	}
+
+	mode := s.permissions.mode(tool)
+	if mode == permissionHidden || mode == permissionDeny {
+		errMsg := fmt.Sprintf("tool %s is not permitted by the workspace configuration", toolUse.Name)
+		metrics.observeToolCall(toolUse.Name, 0, true)
+		debugf("tool_call_result tool_name=%q ok=false error=%q", toolUse.Name, errMsg)
+		return errMsg, &ToolError{Code: ToolErrorPermission, Message: errMsg}
+	}
+	if violations := validateToolInput(tool, toolUse.Input); len(violations) > 0 {
+		toolErr := toolSchemaError(toolUse.Name, violations)
+		metrics.observeToolCall(toolUse.Name, 0, true)
+		debugf("tool_call_result tool_name=%q ok=false error=%q", toolUse.Name, toolErr.Message)
+		return toolErr.Message, toolErr
+	}
+	scratchOnly := s.scratchOnlyCall(toolUse.Name, toolUse.Input)
+	if mode == permissionAsk && !scratchOnly {
+		if !s.confirm(fmt.Sprintf("Allow %s(%s)?", toolUse.Name, previewText(string(toolUse.Input), 200))) {
+			errMsg := fmt.Sprintf("the user declined to run %s; ask what they would like to do instead", toolUse.Name)
+			metrics.observeToolCall(toolUse.Name, 0, true)
+			debugf("tool_call_result tool_name=%q ok=false error=%q", toolUse.Name, errMsg)
+			return errMsg, &ToolError{Code: ToolErrorPermission, Message: errMsg}
+		}
+	}
+
+	var attached []string
+	for _, hook := range s.hooks.PreTool {
+		if !hook.matches(toolUse.Name) {
+			continue
+		}
+		output, exitCode, err := s.runHook("pre_tool", hook, toolUse, "", false)
+		if err != nil || exitCode != 0 {
+			errMsg := fmt.Sprintf("blocked by pre_tool hook %q", hook.Command)
+			if err != nil {
+				errMsg += ": " + err.Error()
+			} else {
+				errMsg += fmt.Sprintf(" (exit code %d)", exitCode)
+			}
+			if output != "" {
+				errMsg += "\n\nHook output:\n" + output
+			}
+			metrics.observeToolCall(toolUse.Name, 0, true)
+			debugf("tool_call_result tool_name=%q ok=false error=%q", toolUse.Name, errMsg)
+			return errMsg, &ToolError{Code: ToolErrorPermission, Message: errMsg}
+		}
+		if hook.AttachOutput && output != "" {
+			attached = append(attached, fmt.Sprintf("[pre_tool hook %q]\n%s", hook.Command, output))
+		}
+	}
+
+	if !tool.ReadOnly && !scratchOnly {
+		if err := s.ensureWorkBranch(); err != nil {
+			errMsg := fmt.Sprintf("could not switch to a work branch, so %s was not run: %v", toolUse.Name, err)
+			metrics.observeToolCall(toolUse.Name, 0, true)
+			debugf("tool_call_result tool_name=%q ok=false error=%q", toolUse.Name, errMsg)
+			return errMsg, &ToolError{Code: ToolErrorFailed, Message: errMsg}
+		}
+	}
+
+	debugf("tool_call_start tool_name=%q", toolUse.Name)
+	parent := s.turnCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	s.toolMu.Lock()
+	s.toolCtx, s.cancelTool, s.cancelled = ctx, cancel, false
+	s.toolMu.Unlock()
+	start := time.Now()
+	s.callWrites = nil
+	result, err := tool.Function(toolUse.Input)
+	s.toolMu.Lock()
+	s.toolCtx, s.cancelTool = nil, nil
+	s.toolMu.Unlock()
+	cancel()
+	metrics.observeToolCall(toolUse.Name, time.Since(start), err != nil || s.cancelled)
+	var toolErr *ToolError
+	if err != nil {
+		toolErr = asToolError(err)
+		result = toolErr.Message
+	}
+	if s.cancelled {
+		debugf("tool_call_cancelled tool_name=%q", toolUse.Name)
+		result = "cancelled by user: the user interrupted this tool call before it finished. Any partial effects remain; do not retry it unless the user asks.\n\n" + result
+		toolErr = &ToolError{Code: ToolErrorCancelled}
+	}
+	isError := toolErr != nil
+	if s.cfg.CompileCheck && !isError && len(s.callWrites) > 0 {
+		result += s.runCompileChecks(parent, s.callWrites)
+	}
+
+	for _, hook := range s.hooks.PostTool {
+		if !hook.matches(toolUse.Name) {
+			continue
+		}
+		output, exitCode, hookErr := s.runHook("post_tool", hook, toolUse, result, isError)
+		if hookErr != nil {
+			output = strings.TrimSpace(output + "\n" + hookErr.Error())
+		}
+		if hook.AttachOutput && (output != "" || exitCode != 0) {
+			attached = append(attached, fmt.Sprintf("[post_tool hook %q exited %d]\n%s", hook.Command, exitCode, output))
+		}
+	}
+	if len(attached) > 0 {
+		result = strings.TrimSpace(result + "\n\n" + strings.Join(attached, "\n\n"))
+	}
+	// Files and command output can hold credentials; the model, the session
+	// file, and traces never need them.
+	result = redactCredentials(s.redactSecrets(result))
+
+	if isError {
+		toolErr.Message = result
+		debugf("tool_call_result tool_name=%q ok=false code=%q error=%q", toolUse.Name, toolErr.Code, result)
+		return result, toolErr
+	}
+	debugf("tool_call_result tool_name=%q ok=true result_chars=%d", toolUse.Name, len(result))
+	return result, nil
+}
+
+// mode returns the permission for a tool: permissionHidden for tools that are
+// not offered to the model at all, otherwise allow, ask, or deny.
+func (p PermissionsConfig) mode(def Tool) string {
+	for _, name := range p.Disabled {
+		if name == def.Name {
+			return permissionHidden
+		}
+	}
+	if (p.Profile == profileReadOnly || p.Profile == profileOps) && !def.ReadOnly {
+		return permissionHidden
+	}
+	if mode, ok := p.Tools[def.Name]; ok {
+		return mode
+	}
+	if def.AskByDefault || (p.askWrites && !def.ReadOnly) {
+		return permissionAsk
+	}
+	return permissionAllow
+}
+
+func (h HookConfig) matches(toolName string) bool {
+	if len(h.Tools) == 0 {
+		return true
+	}
+	for _, name := range h.Tools {
+		if name == toolName || name == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// runHook executes a hook command in the workspace. The tool input is passed
+// on stdin and in CODER_TOOL_INPUT; post_tool hooks also receive the tool
+// result in CODER_TOOL_RESULT and CODER_TOOL_IS_ERROR.
+func (s *Session) runHook(stage string, hook HookConfig, toolUse ToolUse, result string, isError bool) (string, int, error) {
+	timeout := hook.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "bash", "-lc", hook.Command)
+	cmd.Dir = s.root
+	cmd.Stdin = strings.NewReader(string(toolUse.Input))
+	// Hooks come from the workspace's config, so they get bash's
+	// environment rather than the agent's secrets.
+	cmd.Env = append(s.commandEnv(),
+		"CODER_HOOK_STAGE="+stage,
+		"CODER_TOOL_NAME="+toolUse.Name,
+		"CODER_TOOL_INPUT="+string(toolUse.Input),
+	)
+	if stage == "post_tool" {
+		truncatedResult, _ := truncateOutput([]byte(result), maxHookOutputBytes)
+		cmd.Env = append(cmd.Env,
+			"CODER_TOOL_RESULT="+truncatedResult,
+			"CODER_TOOL_IS_ERROR="+strconv.FormatBool(isError),
+		)
+	}
+
+	start := time.Now()
+	output, runErr := cmd.CombinedOutput()
+	truncated, wasTruncated := truncateOutput(output, maxHookOutputBytes)
+	text := strings.TrimSpace(truncated)
+	if wasTruncated {
+		text += fmt.Sprintf("\n(hook output truncated at %d bytes)", maxHookOutputBytes)
+	}
+
+	exitCode := 0
+	var err error
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		exitCode = -1
+		err = fmt.Errorf("hook timed out after %d seconds", timeout)
+	case runErr != nil:
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else {
+			exitCode = -1
+			err = fmt.Errorf("failed to run hook: %w", runErr)
+		}
+	}
+
+	debugf("hook_run stage=%q tool_name=%q command=%q exit_code=%d latency_ms=%d", stage, toolUse.Name, hook.Command, exitCode, time.Since(start).Milliseconds())
+	label := colorLabel("hook", toolColor, s.colorOutput)
+	if exitCode != 0 {
+		label = colorLabel("hook", errorColor, s.colorOutput)
+	}
+	fmt.Fprintf(s.out, "%s: %s %s (exit %d)\n", label, stage, hook.Command, exitCode)
+	return text, exitCode, err
+}
+
+func registeredTools(s *Session) []Tool {
+	tools := []Tool{
+		{
+			Name:        "write_file",
+			Description: "Create or overwrite a text file in the current workspace. Use this to write full file contents in one call.",
+			InputSchema: writeFileInputSchema(),
+			Function:    s.writeFile,
+			InputAliases: map[string]string{
+				"text":    "content",
+				"body":    "content",
+				"new_str": "content",
+			},
+		},
+		{
+			Name: "edit_file",
+			Description: `Apply a targeted edit to an existing text file.
+If old_str is empty and the file exists, new_str is appended.
+If old_str is non-empty, it must match exactly once and will be replaced by new_str.
+If old_str is not found exactly, whole lines that match it apart from whitespace, or nearly match it, are replaced instead when only one place qualifies; the result names the lines.`,
+			InputSchema: editFilesInputSchema(),
+			Function:    s.editFiles,
+		},
+		{
+			Name: "edit_files",
+			Description: `Apply a targeted edit to an existing text file.
+If old_str is empty and the file exists, new_str is appended.
+If old_str is non-empty, it must match exactly once and will be replaced by new_str.
+If old_str is not found exactly, whole lines that match it apart from whitespace, or nearly match it, are replaced instead when only one place qualifies; the result names the lines.`,
+			InputSchema: editFilesInputSchema(),
+			Function:    s.editFiles,
+		},
+		{
+			Name:        "apply_edits",
+			Description: "Apply several edits, usually across files, as one transaction: every edit is checked first and either all are written or none are. Use it for refactors and renames that must not be left half done. Each edit works like edit_files.",
+			InputSchema: applyEditsInputSchema(),
+			Function:    s.applyEdits,
+		},
+		{
+			Name:        "regex_replace",
+			Description: "Replace matches of a regular expression in one file, for systematic changes such as renaming an identifier. Use preview first to see the matches; applying more than a few dozen replacements requires confirm.",
+			InputSchema: regexReplaceInputSchema(),
+			Function:    s.regexReplace,
+		},
+		{
+			Name:        "insert_at_line",
+			Description: "Insert lines into a file before a 1-based line number, as numbered by read_files start_line. Use it for positional edits where a unique old_str is awkward to write. The result includes a diff of the change.",
+			InputSchema: insertAtLineInputSchema(),
+			Function:    s.insertAtLine,
+		},
+		{
+			Name:        "replace_lines",
+			Description: "Replace a 1-based, inclusive range of lines in a file with new text, or delete them with empty text. The result says how later lines moved and includes a diff of the change.",
+			InputSchema: replaceLinesInputSchema(),
+			Function:    s.replaceLines,
+		},
+		{
+			Name:        "delete_file",
+			Description: "Delete a single file from the current workspace. The file is moved to a session trash under .coder/trash, from which the user can restore it with /undo-file. Glob patterns are not expanded; the path is taken literally.",
+			InputSchema: deletePathInputSchema("Relative path of the file to delete."),
+			Function:    s.deleteFile,
+		},
+		{
+			Name:        "delete_directory",
+			Description: "Delete a directory and everything in it from the current workspace. The user must approve each call; the directory is moved to the session trash and can be restored with /undo-file. Glob patterns are not expanded; the path is taken literally.",
+			InputSchema: deletePathInputSchema("Relative path of the directory to delete."),
+			Function:    s.deleteDirectory,
+		},
+		{
+			Name:        "move_file",
+			Description: "Move or rename a file or directory within the current workspace. Missing parent directories of the destination are created. An existing destination file is only replaced when overwrite is true.",
+			InputSchema: moveFileInputSchema(),
+			Function:    s.moveFile,
+		},
+		{
+			Name:         "bash",
+			Description:  "Execute a bash command in the current workspace, or in the subdirectory given by cwd, and return combined stdout/stderr output. Always include a non-empty command field.",
+			InputSchema:  bashInputSchema(),
+			Function:     s.bashTool,
+			InputAliases: map[string]string{"cmd": "command"},
+		},
+		{
+			Name:        "fetch_issue",
+			Description: "Fetch a GitHub or GitLab issue (title, state, labels, description, and comments) by URL, owner/repo#number, or a number in this repository.",
+			InputSchema: fetchIssueInputSchema(),
+			Function:    s.fetchIssue,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "create_pr",
+			Description: "Commit the files changed in this session to a new branch, push it to origin, and open a GitHub pull request. Use only when the user asks for a pull request. Write the body as a summary of what changed and why.",
+			InputSchema: createPRInputSchema(),
+			Function:    s.createPRTool,
+		},
+		{
+			Name:        "list_processes",
+			Description: "List background processes started with bash run_in_background, with their status and how much unread output each has.",
+			InputSchema: emptyInputSchema(),
+			Function:    s.listProcesses,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "read_process_output",
+			Description: "Return output a background process has produced since the last read_process_output call for it, plus its status.",
+			InputSchema: readProcessOutputInputSchema(),
+			Function:    s.readProcessOutput,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "kill_process",
+			Description: "Stop a background process and everything it started.",
+			InputSchema: processIDInputSchema(),
+			Function:    s.killProcess,
+		},
+		{
+			Name:        "read_file",
+			Description: "Read a file in the current workspace. Use this to inspect exact file contents.",
+			InputSchema: readFilesInputSchema(),
+			Function:    s.readFiles,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "read_files",
+			Description: "Read the contents of one or more files in the current workspace. Pass paths to read several related files in one call; max_bytes is then a combined budget and each file is preceded by a \"==> path <==\" header.",
+			InputSchema: readMultipleFilesInputSchema(),
+			Function:    s.readFiles,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "stat_file",
+			Description: "Return metadata for a path in the current workspace: type, size, permissions, modification time, and for files the line count, detected language, and whether it looks binary. Use this to decide whether (and how much of) a file to read.",
+			InputSchema: statFileInputSchema(),
+			Function:    s.statFile,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "list_files",
+			Description: "List files and directories in the current workspace. Use this to inspect the filesystem before reading or editing files.",
+			InputSchema: listFilesInputSchema(),
+			Function:    s.listFiles,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "doc_lookup",
+			Description: "Show the documentation of a dependency's package or symbol using the language's own tooling: go doc for Go, pydoc for Python, or the installed package's type declarations (or README) for Node. Use it to check real signatures instead of guessing them.",
+			InputSchema: docLookupInputSchema(),
+			Function:    s.docLookup,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "run_lint",
+			Description: "Run the project's linter (golangci-lint, eslint, or ruff) and return its findings as JSON: file, line, rule, and message for each, with those in files you edited this session first and marked edited. Use it after changing code instead of running the linter with bash.",
+			InputSchema: runLintInputSchema(),
+			Function:    s.runLint,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "test_coverage",
+			Description: "Run the tests with coverage (go test -coverprofile, or pytest under coverage.py) and return JSON with the coverage of the run, each package, and each file, each with its change since the previous test_coverage call. Use it to measure progress on coverage goals.",
+			InputSchema: testCoverageInputSchema(),
+			Function:    s.testCoverage,
+		},
+		{
+			Name:        "profile",
+			Description: "Profile a command and list its hottest functions: a go test command, usually a benchmark, under pprof (cpu or memory), or a Python command under py-spy. Returns the end of the command's output and a compact table of the top functions. Use it to find a hotspot before optimizing, and again to confirm a fix.",
+			InputSchema: profileInputSchema(),
+			Function:    s.profile,
+		},
+		{
+			Name:        "dependency_graph",
+			Description: "Inspect the dependency graph (go mod graph, npm ls, or pipdeptree) as JSON. Without package, lists the direct dependencies; with package, such as golang.org/x/net or lodash@4, lists each matching version with the packages that require it and the shortest chain from the project to it. Use it to find what pulls in a library before planning an upgrade.",
+			InputSchema: dependencyGraphInputSchema(),
+			Function:    s.dependencyGraph,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "query_file",
+			Description: "Evaluate a jq-style expression over a workspace JSON or YAML file and return only the matching values, one per line as JSON, such as .packages[\"node_modules/lodash\"].version in a package-lock.json or .ingress.hosts[].host in Helm values. Use it instead of read_file to check a few keys of a large structured file.",
+			InputSchema: queryFileInputSchema(),
+			Function:    s.queryFile,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "save_artifact",
+			Description: "Save a deliverable of the run, such as a report, summary, or generated diagram, under .coder/artifacts/<session>/ so it survives the run; the saved artifacts are listed when it ends. Give the text as content, or the path of a workspace file to copy, such as one in scratch/. Use it for outputs the user asked for that are not changes to the project.",
+			InputSchema: saveArtifactInputSchema(),
+			Function:    s.saveArtifact,
+		},
+		{
+			Name:        "semantic_search",
+			Description: "Search the codebase index for the code most relevant to a question, such as \"where is JWT validation implemented?\". Returns ranked files with the best-matching definition and a short preview. Prefer this over guessing paths or listing directories when you do not know where something lives.",
+			InputSchema: semanticSearchInputSchema(),
+			Function:    s.semanticSearch,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "memory_write",
+			Description: "Save a durable project note (facts, decisions, gotchas) under .coder/memory so it is available in future sessions. Notes are keyed by name; set append=true to add to an existing note instead of replacing it.",
+			InputSchema: memoryWriteInputSchema(),
+			Function:    s.memoryWrite,
+		},
+		{
+			Name:        "memory_read",
+			Description: "Read project memory notes saved in earlier sessions. Omit name to list all notes with their first line.",
+			InputSchema: memoryReadInputSchema(),
+			Function:    s.memoryRead,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "todo_write",
+			Description: "Replace the task checklist for the current multi-step request. Send the full list every time, marking items pending, in_progress, or completed as work proceeds. The list is shown to the user.",
+			InputSchema: todoWriteInputSchema(),
+			Function:    s.todoWrite,
+			ReadOnly:    true,
+		},
+		{
+			Name:        "todo_read",
+			Description: "Return the current task checklist.",
+			InputSchema: emptyInputSchema(),
+			Function:    s.todoRead,
+			ReadOnly:    true,
+		},
+	}
+	// Claude models are trained on Anthropic's bash tool. Its input has no
+	// run_in_background, so start_process takes over background commands.
+	if supportsNativeBash(s.cfg) {
+		for i := range tools {
+			if tools[i].Name == "bash" {
+				tools[i] = Tool{
+					Name:        "bash",
+					InputSchema: nativeBashInputSchema(),
+					Function:    s.nativeBash,
+					Native: &anthropic.ToolUnionParam{
+						OfBashTool20250124: &anthropic.ToolBash20250124Param{},
+					},
+				}
+			}
+		}
+		tools = append(tools, Tool{
+			Name:        "start_process",
+			Description: "Start a long-running command, such as a dev server or watcher, in the background and return its process id immediately. Poll it with read_process_output and stop it with kill_process. Use bash for commands that finish.",
+			InputSchema: startProcessInputSchema(),
+			Function:    s.startProcess,
+		})
+	}
+	if s.cfg.Headless {
+		tools = append(tools, Tool{
+			Name:        "report_outcome",
+			Description: "Report whether the task succeeded, once the work is done or cannot be finished. This run has no user to reply to; its exit status follows the report. Say success false if the task could not be completed or its checks fail.",
+			InputSchema: reportOutcomeInputSchema(),
+			Function:    s.reportOutcome,
+			ReadOnly:    true,
+		})
+	}
+	if s.cfg.Project.Permissions.Profile == profileOps {
+		tools = append(tools, Tool{
+			Name:        "ops_command",
+			Description: "Run a read-only kubectl, aws, or gcloud command to inspect a cluster or cloud account: kubectl get, describe, logs, and top; aws describe-, get-, and list- operations; gcloud list and describe. Commands that change anything, or print secrets or credentials, are refused.",
+			InputSchema: opsCommandInputSchema(),
+			Function:    s.opsCommand,
+			ReadOnly:    true,
+		})
+	}
+	tools = append(tools, Tool{
+		Name:        "http_request",
+		Description: "Send one HTTP request and return the status line, response headers, and the start of the body. Use it to debug APIs instead of building curl commands in bash. Write secrets in headers as ${ENV_VAR}; only variables the project makes available can be used. Loopback and private addresses are refused unless the project allows them.",
+		InputSchema: httpRequestInputSchema(),
+		Function:    s.httpRequest,
+		// Any request can carry workspace contents off the machine.
+		AskByDefault: true,
+	})
+	if s.cfg.Project.Database.dsn() != "" {
+		tools = append(tools, Tool{
+			Name:        "db_query",
+			Description: "Run one read-only SQL query (SELECT, WITH ... SELECT, or EXPLAIN) against the project's configured database and return the rows as CSV, capped in rows and bytes. Use it to inspect the schema and data while debugging database code. Anything that could write is refused.",
+			InputSchema: dbQueryInputSchema(),
+			Function:    s.dbQuery,
+			ReadOnly:    true,
+		})
+	}
+	if s.cfg.Docker {
+		tools = append(tools, Tool{
+			Name:        "docker_build",
+			Description: "Build a Docker image from a Dockerfile in the workspace and return the end of the build output. Use it to check that a Dockerfile you wrote or changed builds, instead of guessing.",
+			InputSchema: dockerBuildInputSchema(),
+			Function:    s.dockerBuild,
+		}, Tool{
+			Name:        "docker_run",
+			Description: "Run a container from an image, with the configured memory, cpu, process, and network limits, and return its exit code and output. Use detach for servers. Containers are removed when they exit or, if detached, when the session ends.",
+			InputSchema: dockerRunInputSchema(),
+			Function:    s.dockerRun,
+		})
+	}
+	if s.cfg.Review {
+		tools = append(tools, Tool{
+			Name:        "submit_review",
+			Description: "Submit the finished code review: a short summary and every comment, each anchored to a file and line of the new version in the diff, with a severity and an optional suggested fix. Call it once, after reading enough of the code to be sure of each comment.",
+			InputSchema: submitReviewInputSchema(),
+			Function:    s.submitReview,
+			ReadOnly:    true,
+		})
+	}
+	// Claude models are trained on Anthropic's text editor tool and call it
+	// more reliably than the custom edit tools above.
+	if supportsNativeTextEditor(s.cfg) {
+		tools = append(tools, Tool{
+			Name:        nativeTextEditorName,
+			InputSchema: textEditorInputSchema(),
+			Function:    s.textEditor,
+			Native: &anthropic.ToolUnionParam{
+				OfTextEditor20250429: &anthropic.ToolUnionTextEditor20250429Param{},
+			},
+		})
+	}
+	return tools
+}
+
+func buildToolRegistry(defs []Tool, perms PermissionsConfig) (map[string]Tool, []anthropic.ToolUnionParam, error) {
+	toolMap := make(map[string]Tool, len(defs))
+	anthropicTools := make([]anthropic.ToolUnionParam, 0, len(defs))
+
+	known := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		known[def.Name] = true
+	}
+	for _, name := range perms.Disabled {
+		if !known[name] {
+			return nil, nil, fmt.Errorf("permissions.disabled names unknown tool: %s", name)
+		}
+	}
+	for name := range perms.Tools {
+		if !known[name] {
+			return nil, nil, fmt.Errorf("permissions.tools names unknown tool: %s", name)
+		}
+	}
+
+	for _, def := range defs {
+		if strings.TrimSpace(def.Name) == "" {
+			return nil, nil, errors.New("tool name cannot be empty")
+		}
+		if _, exists := toolMap[def.Name]; exists {
+			return nil, nil, fmt.Errorf("duplicate tool name: %s", def.Name)
+		}
+		if perms.mode(def) == permissionHidden {
+			debugf("tool_disabled tool_name=%q", def.Name)
+			continue
+		}
+
+		toolMap[def.Name] = def
+		if def.Native != nil {
+			anthropicTools = append(anthropicTools, *def.Native)
+			continue
+		}
+		anthropicTools = append(anthropicTools, anthropic.ToolUnionParam{
+			OfTool: &anthropic.ToolParam{
+				Name:        def.Name,
+				Description: anthropic.String(def.Description),
+				InputSchema: def.InputSchema,
+			},
+		})
+	}
+
+	return toolMap, anthropicTools, nil
+}
+
+func writeFileInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace.",
+			},
+			"content": map[string]any{
+				"type":        "string",
+				"description": "Full text content to write to the file.",
+			},
+			"overwrite": map[string]any{
+				"type":        "boolean",
+				"description": "Whether to overwrite an existing file. Defaults to false.",
+			},
+		},
+		Required: []string{"path", "content"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func editFilesInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace.",
+			},
+			"old_str": map[string]any{
+				"type":        "string",
+				"description": "Text to replace. Use an empty string to create a new file or append to an existing file.",
+			},
+			"new_str": map[string]any{
+				"type":        "string",
+				"description": "Replacement text, or content to create/append when old_str is empty.",
+			},
+		},
+		Required: []string{"path", "old_str", "new_str"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func bashInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"command": map[string]any{
+				"type":        "string",
+				"description": "The bash command to execute.",
+			},
+			"cmd": map[string]any{
+				"type":        "string",
+				"description": "Alias of command. Prefer command.",
+			},
+			"timeout_seconds": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Optional timeout in seconds. Defaults to %d, capped at %d.", defaultBashTimeoutSeconds, hardBashTimeoutSeconds),
+				"minimum":     1,
+				"maximum":     hardBashTimeoutSeconds,
+			},
+			"max_output_bytes": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Maximum bytes of command output to return. Defaults to %d, capped at %d.", defaultBashMaxOutputBytes, hardBashMaxOutputBytes),
+				"minimum":     1,
+				"maximum":     hardBashMaxOutputBytes,
+			},
+			"run_in_background": map[string]any{
+				"type":        "boolean",
+				"description": "Start the command in the background and return its process id immediately instead of waiting. Use for dev servers and other long-running commands; poll with read_process_output and stop with kill_process.",
+			},
+			"cwd": map[string]any{
+				"type":        "string",
+				"description": "Optional directory to run the command in, relative to the workspace root. Defaults to the workspace root. Use this instead of starting the command with cd.",
+			},
+		},
+		Required: []string{"command"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func processIDInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"id": map[string]any{
+				"type":        "integer",
+				"description": "Background process id returned by bash with run_in_background.",
+			},
+		},
+		Required: []string{"id"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func readProcessOutputInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"id": map[string]any{
+				"type":        "integer",
+				"description": "Background process id returned by bash with run_in_background.",
+			},
+			"max_bytes": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Maximum bytes of new output to return. Defaults to %d, capped at %d.", defaultBashMaxOutputBytes, hardBashMaxOutputBytes),
+				"minimum":     1,
+				"maximum":     hardBashMaxOutputBytes,
+			},
+		},
+		Required: []string{"id"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func readFilesInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace.",
+			},
+			"max_bytes": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Maximum bytes to read from the file. Defaults to %d, capped at %d.", defaultReadFilesMaxBytes, hardReadFilesMaxBytes),
+				"minimum":     1,
+				"maximum":     hardReadFilesMaxBytes,
+			},
+			"offset":     readOffsetSchema(),
+			"start_line": readStartLineSchema(),
+		},
+		Required: []string{"path"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func readOffsetSchema() map[string]any {
+	return map[string]any{
+		"type":        "integer",
+		"description": "Byte offset to start reading from, for paging through large files. Truncated reads report the offset to continue from.",
+		"minimum":     0,
+	}
+}
+
+func readStartLineSchema() map[string]any {
+	return map[string]any{
+		"type":        "integer",
+		"description": "1-based line number to start reading from. Cannot be combined with offset.",
+		"minimum":     1,
+	}
+}
+
+func readMultipleFilesInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace. Use paths instead to read several files.",
+			},
+			"paths": map[string]any{
+				"type":        "array",
+				"description": fmt.Sprintf("Relative file paths to read in order, up to %d.", maxReadFilesPaths),
+				"items":       map[string]any{"type": "string"},
+				"minItems":    1,
+				"maxItems":    maxReadFilesPaths,
+			},
+			"max_bytes": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Maximum bytes to read, shared across all paths. Defaults to %d, capped at %d.", defaultReadFilesMaxBytes, hardReadFilesMaxBytes),
+				"minimum":     1,
+				"maximum":     hardReadFilesMaxBytes,
+			},
+			"offset":     readOffsetSchema(),
+			"start_line": readStartLineSchema(),
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func listFilesInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Optional relative directory path. Defaults to current directory.",
+			},
+			"recursive": map[string]any{
+				"type":        "boolean",
+				"description": "Whether to recursively include nested files and directories. Defaults to true.",
+			},
+			"max_entries": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Maximum number of entries to return. Defaults to %d, capped at %d.", defaultListFilesMaxEntries, hardListFilesMaxEntries),
+				"minimum":     1,
+				"maximum":     hardListFilesMaxEntries,
+			},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func memoryWriteInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"name": map[string]any{
+				"type":        "string",
+				"description": "Short note name using letters, digits, '-' or '_', e.g. \"build-commands\".",
+			},
+			"content": map[string]any{
+				"type":        "string",
+				"description": "Markdown text of the note.",
+			},
+			"append": map[string]any{
+				"type":        "boolean",
+				"description": "Append to an existing note instead of replacing it. Defaults to false.",
+			},
+		},
+		Required: []string{"name", "content"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func memoryReadInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"name": map[string]any{
+				"type":        "string",
+				"description": "Optional note name. Omit to list all notes.",
+			},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func todoWriteInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"todos": map[string]any{
+				"type":        "array",
+				"description": "The complete checklist, in order.",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"content": map[string]any{
+							"type":        "string",
+							"description": "Short imperative description of the task.",
+						},
+						"status": map[string]any{
+							"type": "string",
+							"enum": []string{todoPending, todoInProgress, todoCompleted},
+						},
+					},
+					"required":             []string{"content", "status"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		Required: []string{"todos"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func statFileInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file or directory path within the current workspace.",
+			},
+		},
+		Required: []string{"path"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func moveFileInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"source": map[string]any{
+				"type":        "string",
+				"description": "Relative path of the file or directory to move.",
+			},
+			"destination": map[string]any{
+				"type":        "string",
+				"description": "Relative path it should have afterwards.",
+			},
+			"overwrite": map[string]any{
+				"type":        "boolean",
+				"description": "Whether to replace an existing destination file. Defaults to false.",
+			},
+		},
+		Required: []string{"source", "destination"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func deletePathInputSchema(description string) anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": description,
+			},
+		},
+		Required: []string{"path"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func emptyInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func toolInputValidationError(toolName, reason, expected string) error {
+	if expected == "" {
+		return newToolError(ToolErrorValidation, "invalid %s input: %s", toolName, reason)
+	}
+	return newToolError(ToolErrorValidation, "invalid %s input: %s. expected input like %s", toolName, reason, expected)
+}
+
+func requireToolString(toolName, fieldName string, value *string, allowEmpty bool, expected string) (string, error) {
+	if value == nil {
+		return "", toolInputValidationError(toolName, fmt.Sprintf("missing required field %q", fieldName), expected)
+	}
+	if !allowEmpty && strings.TrimSpace(*value) == "" {
+		return "", toolInputValidationError(toolName, fmt.Sprintf("field %q cannot be empty", fieldName), expected)
+	}
+	return *value, nil
+}
+
+func (s *Session) writeFile(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/main.py","content":"print(\"hello\")","overwrite":true}`
+
+	args := WriteFileInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("write_file", err.Error(), expected)
+	}
+
+	pathValue, err := requireToolString("write_file", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	contentSource := args.Content
+	if contentSource == nil {
+		contentSource = args.Text
+	}
+	if contentSource == nil {
+		contentSource = args.Body
+	}
+	if contentSource == nil {
+		contentSource = args.NewStr
+	}
+	if contentSource == nil {
+		return "", toolInputValidationError(
+			"write_file",
+			`missing required field "content" (accepted aliases: "text", "body", "new_str"); include the full file contents`,
+			expected,
+		)
+	}
+	content, err := requireToolString("write_file", "content", contentSource, true, expected)
+	if err != nil {
+		return "", err
+	}
+	pathValue = strings.TrimSpace(pathValue)
+
+	overwrite := false
+	if args.Overwrite != nil {
+		overwrite = *args.Overwrite
+	}
+
+	absFile, displayPath, err := s.resolveWorkspaceFileForWrite(pathValue)
+	if err != nil {
+		return "", err
+	}
+	if workspaceIgnore(s.root).Ignored(displayPath, false) {
+		return "", newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+	if err := s.checkProtected("write_file", displayPath, false); err != nil {
+		return "", err
+	}
+
+	exists := false
+	info, statErr := os.Stat(absFile)
+	if statErr == nil {
+		exists = true
+		if info.IsDir() {
+			return "", fmt.Errorf("path is a directory: %s", displayPath)
+		}
+	} else if !os.IsNotExist(statErr) {
+		return "", fmt.Errorf("failed to access path %q: %w", displayPath, statErr)
+	}
+
+	if exists && !overwrite {
+		return "", toolInputValidationError("write_file", fmt.Sprintf("file already exists: %s (set overwrite=true to replace it)", displayPath), expected)
+	}
+	var previous []byte
+	previousText, encoding := "", encodingUTF8
+	if exists {
+		if err := s.checkStaleRead(absFile, displayPath); err != nil {
+			return "", err
+		}
+		previous, err = os.ReadFile(absFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+		}
+		previousText, encoding = decodeFileText(previous)
+	}
+	if err := checkRedactionMarkers(displayPath, previousText, content); err != nil {
+		return "", err
+	}
+	if err := s.checkWriteSize(displayPath, len(previous), len(content)); err != nil {
+		return "", err
+	}
+	if err := s.checkDiskQuota("write_file"); err != nil {
+		return "", err
+	}
+	if exists {
+		if err := s.checkShrink(displayPath, len(previous), len(content)); err != nil {
+			return "", err
+		}
+	}
+	backup := ""
+	if exists {
+		if backup, err = s.backupFile(displayPath, previous); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(absFile), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create parent directory for %q: %w", displayPath, err)
+	}
+	text, conventions := s.applyTextConventions([]byte(previousText), exists, []byte(content))
+	data, err := encodeText(string(text), encoding)
+	if err != nil {
+		return "", fmt.Errorf("failed to write file %q: %w", displayPath, err)
+	}
+	conventions = withEncodingNote(conventions, encoding)
+	if err := os.WriteFile(absFile, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write file %q: %w", displayPath, err)
+	}
+	s.recordWrite(absFile, data)
+	s.auditFileWrite("write_file", displayPath, previous, exists, data)
+	s.emitDiff(displayPath, []byte(previousText), text)
+
+	debugf("file_write tool=%q path=%q existed=%t bytes_before=%d bytes_after=%d", "write_file", displayPath, exists, len(previous), len(data))
+	if exists {
+		fmt.Fprintf(s.out, "Overwrote %s (%s)\n", displayPath, byteDelta(len(previous), len(data)))
+	} else {
+		fmt.Fprintf(s.out, "Created %s (%d bytes)\n", displayPath, len(data))
+	}
+	result := fmt.Sprintf("wrote file %s", displayPath)
+	if conventions != "" {
+		result += " (" + conventions + ")"
+	}
+	if backup != "" {
+		result += "; the previous version is saved in " + backup
+	}
+	// A new file's content is what the model just sent; only changes to an
+	// existing one are worth showing back.
+	if exists {
+		result += editResultDiff(displayPath, []byte(previousText), text)
+	}
+	return result, nil
+}
+
+func (s *Session) editFiles(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/main.py","old_str":"before","new_str":"after"}`
+
+	args := EditFilesInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("edit_files", err.Error(), expected)
+	}
+
+	pathValue, err := requireToolString("edit_files", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	oldStr, err := requireToolString("edit_files", "old_str", args.OldStr, true, expected)
+	if err != nil {
+		return "", err
+	}
+	newStr, err := requireToolString("edit_files", "new_str", args.NewStr, true, expected)
+	if err != nil {
+		return "", err
+	}
+	pathValue = strings.TrimSpace(pathValue)
+
+	if oldStr == newStr {
+		return "", toolInputValidationError("edit_files", `"old_str" and "new_str" must be different`, expected)
+	}
+
+	target, err := s.openEditTarget("edit_files", pathValue)
+	if err != nil {
+		return "", err
+	}
+	if err := target.apply(oldStr, newStr); err != nil {
+		return "", err
+	}
+	return s.commitEdit(target, "edit_files")
+}
+
+// editTarget is a file being changed by edit_files or apply_edits: its state
+// on disk and the new text built up so far. CRLF files are edited in LF form
+// and converted back when written.
+type editTarget struct {
+	absFile      string
+	displayPath  string
+	existed      bool
+	previous     []byte
+	previousText string
+	encoding     string
+	crlf         bool
+	present      bool
+	text         string
+	// notes describe edits that needed a loose match, for the tool result.
+	notes []string
+}
+
+// openEditTarget resolves a file for editing by tool and loads its current
+// content, refusing directories, paths .coderignore excludes, and files
+// changed since they were last read, and asking before protected paths are
+// touched.
+func (s *Session) openEditTarget(tool, pathValue string) (*editTarget, error) {
+	absFile, displayPath, err := s.resolveWorkspaceFileForWrite(pathValue)
+	if err != nil {
+		return nil, err
+	}
+	// Edit results, previews, and diffs quote the file, so an excluded one
+	// would leak through them.
+	if workspaceIgnore(s.root).Ignored(displayPath, false) {
+		return nil, newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+	target := &editTarget{absFile: absFile, displayPath: displayPath, encoding: encodingUTF8}
+
+	info, statErr := os.Stat(absFile)
+	if statErr != nil {
+		if !os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("failed to access path %q: %w", displayPath, statErr)
+		}
+		if err := s.checkProtected(tool, displayPath, false); err != nil {
+			return nil, err
+		}
+		if err := s.checkStaleRead(absFile, displayPath); err != nil {
+			return nil, err
+		}
+		return target, nil
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("path is a directory: %s", displayPath)
+	}
+	if err := s.checkProtected(tool, displayPath, false); err != nil {
+		return nil, err
+	}
+	if err := s.checkStaleRead(absFile, displayPath); err != nil {
+		return nil, err
+	}
+
+	target.previous, err = os.ReadFile(absFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %q: %w", displayPath, err)
+	}
+	target.existed, target.present = true, true
+	target.previousText, target.encoding = decodeFileText(target.previous)
+	target.text = target.previousText
+	// Models usually send LF text; match and edit a CRLF file in LF form and
+	// convert back when writing.
+	if detectLineEnding([]byte(target.text)) == "\r\n" {
+		target.crlf = true
+		target.text = strings.ReplaceAll(target.text, "\r\n", "\n")
+	}
+	return target, nil
+}
+
+// apply replaces the single occurrence of oldStr with newStr in the target's
+// text, or appends newStr when oldStr is empty. A missing file can only be
+// created, with an empty oldStr.
+func (t *editTarget) apply(oldStr, newStr string) error {
+	if !t.present {
+		if oldStr != "" {
+			return newToolError(ToolErrorNotFound, "file does not exist: %s (old_str must be empty to create it; otherwise use write_file)", t.displayPath)
+		}
+		t.present, t.text = true, newStr
+		return nil
+	}
+	if t.crlf {
+		oldStr = strings.ReplaceAll(oldStr, "\r\n", "\n")
+		newStr = strings.ReplaceAll(newStr, "\r\n", "\n")
+	}
+	switch {
+	case oldStr == "":
+		t.text += newStr
+	case strings.Count(t.text, oldStr) == 0:
+		note, err := t.applyFuzzy(oldStr, newStr)
+		if err != nil {
+			return err
+		}
+		t.notes = append(t.notes, note)
+	case strings.Count(t.text, oldStr) > 1:
+		return newToolError(ToolErrorValidation, "old_str appears multiple times in file: %s; provide more specific text", t.displayPath)
+	default:
+		t.text = strings.Replace(t.text, oldStr, newStr, 1)
+	}
+	return nil
+}
+
+// encodeEditTarget returns the text and bytes to write for the target, in the file's
+// line-ending convention and encoding, and a note describing any adjustment.
+func (s *Session) encodeEditTarget(t *editTarget) ([]byte, []byte, string, error) {
+	if err := checkRedactionMarkers(t.displayPath, t.previousText, t.text); err != nil {
+		return nil, nil, "", err
+	}
+	if err := s.checkWriteSize(t.displayPath, len(t.previous), len(t.text)); err != nil {
+		return nil, nil, "", err
+	}
+	if err := s.checkDiskQuota("editing " + t.displayPath); err != nil {
+		return nil, nil, "", err
+	}
+	text, conventions := s.applyTextConventions([]byte(t.previousText), t.existed, []byte(t.text))
+	data, err := encodeText(string(text), t.encoding)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to write file %q: %w", t.displayPath, err)
+	}
+	return text, data, withEncodingNote(conventions, t.encoding), nil
+}
+
+// commitEdit writes an edited target and reports the change.
+func (s *Session) commitEdit(t *editTarget, tool string) (string, error) {
+	text, data, conventions, err := s.encodeEditTarget(t)
+	if err != nil {
+		return "", err
+	}
+	if err := writeEditTarget(t, data); err != nil {
+		return "", err
+	}
+	return s.reportEdit(t, tool, text, data, conventions), nil
+}
+
+func writeEditTarget(t *editTarget, data []byte) error {
+	if !t.existed {
+		if err := os.MkdirAll(filepath.Dir(t.absFile), 0o755); err != nil {
+			return fmt.Errorf("failed to create parent directory for %q: %w", t.displayPath, err)
+		}
+	}
+	if err := os.WriteFile(t.absFile, data, 0o644); err != nil {
+		if !t.existed {
+			return fmt.Errorf("failed to create file %q: %w", t.displayPath, err)
+		}
+		return fmt.Errorf("failed to write file %q: %w", t.displayPath, err)
+	}
+	return nil
+}
+
+// reportEdit records, audits, and announces a written target and returns the
+// tool result line for it.
+func (s *Session) reportEdit(t *editTarget, tool string, text, data []byte, conventions string) string {
+	s.recordWrite(t.absFile, data)
+	s.auditFileWrite(tool, t.displayPath, t.previous, t.existed, data)
+	s.emitDiff(t.displayPath, []byte(t.previousText), text)
+
+	debugf("file_write tool=%q path=%q existed=%t bytes_before=%d bytes_after=%d", tool, t.displayPath, t.existed, len(t.previous), len(data))
+	verb := "edited"
+	if t.existed {
+		fmt.Fprintf(s.out, "Edited %s (%s)\n", t.displayPath, byteDelta(len(t.previous), len(data)))
+	} else {
+		verb = "created"
+		fmt.Fprintf(s.out, "Created %s (%d bytes)\n", t.displayPath, len(data))
+	}
+	result := fmt.Sprintf("%s file %s", verb, t.displayPath)
+	if conventions != "" {
+		result += " (" + conventions + ")"
+	}
+	for _, note := range t.notes {
+		result += "; " + note
+	}
+	if t.existed {
+		result += editResultDiff(t.displayPath, []byte(t.previousText), text)
+	}
+	return result
+}
+
+const (
+	lineEndingsPreserve  = "preserve"
+	lineEndingsLF        = "lf"
+	lineEndingsCRLF      = "crlf"
+	finalNewlinePreserve = "preserve"
+	finalNewlineAlways   = "always"
+	finalNewlineNever    = "never"
+)
+
+// detectLineEnding returns "\r\n" or "\n" when content uses one style
+// throughout, and "" when it has no line breaks or mixes them.
+func detectLineEnding(content []byte) string {
+	crlf := bytes.Count(content, []byte("\r\n"))
+	lf := bytes.Count(content, []byte("\n")) - crlf
+	switch {
+	case crlf > 0 && lf == 0:
+		return "\r\n"
+	case lf > 0 && crlf == 0:
+		return "\n"
+	}
+	return ""
+}
+
+// applyTextConventions re-applies the line-ending style and final-newline
+// convention of previous (when the file existed) or the project's forced
+// settings to content about to be written. It returns the content to write
+// and a note for the model when it changed anything.
+func (s *Session) applyTextConventions(previous []byte, existed bool, content []byte) ([]byte, string) {
+	if bytes.IndexByte(content, 0) >= 0 || (existed && bytes.IndexByte(previous, 0) >= 0) {
+		return content, ""
+	}
+	project := s.cfg.Project
+	eol := ""
+	switch project.LineEndings {
+	case lineEndingsLF:
+		eol = "\n"
+	case lineEndingsCRLF:
+		eol = "\r\n"
+	default:
+		if existed {
+			eol = detectLineEnding(previous)
+		}
+	}
+
+	out := content
+	var notes []string
+	if eol != "" && detectLineEnding(content) != eol && bytes.Contains(content, []byte("\n")) {
+		out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+		if eol == "\r\n" {
+			out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+		}
+		notes = append(notes, "line endings converted to "+map[string]string{"\n": "LF", "\r\n": "CRLF"}[eol])
+	}
+
+	wantNewline := -1
+	switch project.FinalNewline {
+	case finalNewlineAlways:
+		wantNewline = 1
+	case finalNewlineNever:
+		wantNewline = 0
+	default:
+		if existed && len(previous) > 0 {
+			wantNewline = 0
+			if bytes.HasSuffix(previous, []byte("\n")) {
+				wantNewline = 1
+			}
+		}
+	}
+	if eol == "" {
+		eol = "\n"
+		if bytes.HasSuffix(previous, []byte("\r\n")) || detectLineEnding(out) == "\r\n" {
+			eol = "\r\n"
+		}
+	}
+	switch {
+	case len(out) == 0:
+	case wantNewline == 1 && !bytes.HasSuffix(out, []byte("\n")):
+		out = append(append([]byte(nil), out...), eol...)
+		notes = append(notes, "final newline added")
+	case wantNewline == 0 && bytes.HasSuffix(out, []byte("\n")):
+		out = bytes.TrimSuffix(bytes.TrimSuffix(out, []byte("\n")), []byte("\r"))
+		notes = append(notes, "final newline removed")
+	}
+	if len(notes) == 0 {
+		return content, ""
+	}
+	reason := "to match the file"
+	if !existed {
+		reason = "per the project config"
+	}
+	return out, strings.Join(notes, ", ") + " " + reason
+}
+
+func (s *Session) moveFile(input json.RawMessage) (string, error) {
+	const expected = `{"source":"src/old_name.py","destination":"src/new_name.py"}`
+
+	args := MoveFileInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("move_file", err.Error(), expected)
+	}
+	sourceValue, err := requireToolString("move_file", "source", args.Source, false, expected)
+	if err != nil {
+		return "", err
+	}
+	destValue, err := requireToolString("move_file", "destination", args.Destination, false, expected)
+	if err != nil {
+		return "", err
+	}
+	overwrite := args.Overwrite != nil && *args.Overwrite
+
+	absSource, displaySource, err := s.resolveWorkspaceFileForWrite(sourceValue)
+	if err != nil {
+		return "", err
+	}
+	absDest, displayDest, err := s.resolveWorkspaceFileForWrite(destValue)
+	if err != nil {
+		return "", err
+	}
+	if absSource == absDest {
+		return "", toolInputValidationError("move_file", "source and destination are the same path", expected)
+	}
+	if err := s.checkDeletable(absSource, displaySource); err != nil {
+		return "", err
+	}
+	if err := s.checkDeletable(absDest, displayDest); err != nil {
+		return "", err
+	}
+
+	sourceInfo, err := os.Lstat(absSource)
+	if err != nil {
+		return "", fmt.Errorf("failed to access path %q: %w", displaySource, err)
+	}
+	// Moving an excluded file to a path that is not excluded would let the
+	// model read it, and the reverse would hide a file behind the exclusion.
+	if err := s.checkNotIgnored(absSource, displaySource, sourceInfo.IsDir()); err != nil {
+		return "", err
+	}
+	if err := s.checkNotIgnored(absDest, displayDest, sourceInfo.IsDir()); err != nil {
+		return "", err
+	}
+	if sourceInfo.IsDir() && strings.HasPrefix(absDest, absSource+string(filepath.Separator)) {
+		return "", fmt.Errorf("cannot move %s into itself", displaySource)
+	}
+	destInfo, err := os.Lstat(absDest)
+	switch {
+	case err == nil && destInfo.IsDir():
+		return "", fmt.Errorf("destination is an existing directory: %s", displayDest)
+	case err == nil && sourceInfo.IsDir():
+		return "", fmt.Errorf("destination already exists: %s", displayDest)
+	case err == nil && !overwrite:
+		return "", toolInputValidationError("move_file", fmt.Sprintf("destination already exists: %s (set overwrite=true to replace it)", displayDest), expected)
+	case err != nil && !os.IsNotExist(err):
+		return "", fmt.Errorf("failed to access path %q: %w", displayDest, err)
+	}
+	replaced := err == nil
+	if sourceInfo.IsDir() {
+		err = s.checkProtectedTree("move_file", absSource, displaySource)
+	} else {
+		err = s.checkProtected("move_file", displaySource, false)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkProtected("move_file", displayDest, sourceInfo.IsDir()); err != nil {
+		return "", err
+	}
+
+	if !sourceInfo.IsDir() {
+		s.checkExternalChange(absSource, displaySource)
+	}
+	backup := ""
+	if replaced && destInfo.Mode().IsRegular() {
+		previous, err := os.ReadFile(absDest)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %q: %w", displayDest, err)
+		}
+		if backup, err = s.backupFile(displayDest, previous); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(absDest), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create parent directory for %q: %w", displayDest, err)
+	}
+	if err := os.Rename(absSource, absDest); err != nil {
+		return "", fmt.Errorf("failed to move %s to %s: %w", displaySource, displayDest, err)
+	}
+	s.files.record(absSource, nil)
+	if !sourceInfo.IsDir() {
+		if content, err := os.ReadFile(absDest); err == nil {
+			s.files.record(absDest, content)
+		}
+	}
+	s.cache.clear()
+	s.audit.record(AuditEntry{Tool: "move_file", Path: displaySource, Destination: displayDest, Existed: replaced})
+
+	fmt.Fprintf(s.out, "Moved %s -> %s\n", displaySource, displayDest)
+	if replaced {
+		if backup == "" {
+			return fmt.Sprintf("moved %s to %s, replacing the previous file", displaySource, displayDest), nil
+		}
+		return fmt.Sprintf("moved %s to %s, replacing the previous file, which is saved in %s", displaySource, displayDest, backup), nil
+	}
+	return fmt.Sprintf("moved %s to %s", displaySource, displayDest), nil
+}
+
+// backgroundProcess is a command started with bash run_in_background. Its
+// combined output is kept in a buffer holding the most recent
+// maxProcessBufferBytes; read tracks how much of it the model has seen.
+type backgroundProcess struct {
+	ID      int
+	Command string
+	Started time.Time
+	cmd     *exec.Cmd
+	done    chan struct{}
+
+	mu      sync.Mutex
+	buf     []byte
+	written int64
+	read    int64
+	exitErr error
+}
+
+func (p *backgroundProcess) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, data...)
+	if over := len(p.buf) - maxProcessBufferBytes; over > 0 {
+		p.buf = append(p.buf[:0], p.buf[over:]...)
+	}
+	p.written += int64(len(data))
+	return len(data), nil
+}
+
+func (p *backgroundProcess) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *backgroundProcess) status() string {
+	if p.running() {
+		return "running"
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var exitErr *exec.ExitError
+	switch {
+	case p.exitErr == nil:
+		return "exited with code 0"
+	case errors.As(p.exitErr, &exitErr) && exitErr.ExitCode() >= 0:
+		return fmt.Sprintf("exited with code %d", exitErr.ExitCode())
+	default:
+		return "terminated: " + p.exitErr.Error()
+	}
+}
+
+// unread returns up to maxBytes of output not yet returned to the model and
+// how many earlier bytes were dropped from the buffer before being read.
+func (p *backgroundProcess) unread(maxBytes int) (string, int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.written - int64(len(p.buf))
+	dropped := int64(0)
+	if p.read < start {
+		dropped = start - p.read
+		p.read = start
+	}
+	pending := p.buf[p.read-start:]
+	more := false
+	if len(pending) > maxBytes {
+		pending = pending[:maxBytes]
+		more = true
+	}
+	p.read += int64(len(pending))
+	return string(pending), dropped, more
+}
+
+func (p *backgroundProcess) pendingBytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.written - p.read
+}
+
+// processTable tracks the session's background processes.
+type processTable struct {
+	mu     sync.Mutex
+	nextID int
+	procs  map[int]*backgroundProcess
+}
+
+func newProcessTable() *processTable {
+	return &processTable{procs: make(map[int]*backgroundProcess)}
+}
+
+func (t *processTable) get(id int) (*backgroundProcess, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	proc, ok := t.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("no background process with id %d (see list_processes)", id)
+	}
+	return proc, nil
+}
+
+func (t *processTable) list() []*backgroundProcess {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	procs := make([]*backgroundProcess, 0, len(t.procs))
+	for _, id := range sortedIntKeys(t.procs) {
+		procs = append(procs, t.procs[id])
+	}
+	return procs
+}
+
+func sortedIntKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// killAll stops every process still running, used when the session ends so
+// dev servers do not outlive the agent.
+func (t *processTable) killAll() {
+	for _, proc := range t.list() {
+		if proc.running() {
+			stopProcessGroup(proc)
+		}
+	}
+}
+
+// stopProcessGroup asks the process group to exit, then kills it if it has
+// not exited within processKillGracePeriod.
+func stopProcessGroup(proc *backgroundProcess) {
+	_ = terminateProcessGroup(proc.cmd)
+	select {
+	case <-proc.done:
+	case <-time.After(processKillGracePeriod):
+		_ = killProcessGroup(proc.cmd)
+		<-proc.done
+	}
+}
+
+// startBackgroundProcess runs command in cwd without waiting for it. dir is
+// cwd relative to the workspace, empty for the workspace root.
+func (s *Session) startBackgroundProcess(command, cwd, dir string) (string, error) {
+	t := s.processes
+	running := 0
+	for _, proc := range t.list() {
+		if proc.running() {
+			running++
+		}
+	}
+	if running >= maxBackgroundProcesses {
+		return "", fmt.Errorf("already running %d background processes; stop one with kill_process first", running)
+	}
+
+	t.mu.Lock()
+	t.nextID++
+	proc := &backgroundProcess{ID: t.nextID, Command: command, Started: time.Now(), done: make(chan struct{})}
+	t.mu.Unlock()
+
+	cmd := exec.Command("bash", "-lc", command)
+	cmd.Dir = cwd
+	cmd.Env = s.commandEnv()
+	cmd.Stdout = proc
+	cmd.Stderr = proc
+	// A separate process group lets kill_process stop the command's children,
+	// such as the server a package script launches.
+	startProcessGroup(cmd)
+	proc.cmd = cmd
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start command: %w", err)
+	}
+	go func() {
+		err := cmd.Wait()
+		proc.mu.Lock()
+		proc.exitErr = err
+		proc.mu.Unlock()
+		close(proc.done)
+		debugf("background_process_exit id=%d status=%q", proc.ID, proc.status())
+	}()
+
+	t.mu.Lock()
+	t.procs[proc.ID] = proc
+	t.mu.Unlock()
+
+	s.audit.record(AuditEntry{Tool: "bash", Path: dir, Command: command, Background: true})
+	debugf("background_process_start id=%d pid=%d command=%q", proc.ID, cmd.Process.Pid, command)
+	fmt.Fprintf(s.out, "Started background process %d: %s\n", proc.ID, previewText(command, 80))
+	return fmt.Sprintf("Started background process %d (pid %d). Use read_process_output with id %d to see its output and kill_process to stop it.", proc.ID, cmd.Process.Pid, proc.ID), nil
+}
+
+func (s *Session) listProcesses(input json.RawMessage) (string, error) {
+	procs := s.processes.list()
+	if len(procs) == 0 {
+		return "No background processes.", nil
+	}
+	var b strings.Builder
+	for _, proc := range procs {
+		fmt.Fprintf(&b, "%d  %s  started %s  unread %d bytes  %s\n", proc.ID, proc.status(), proc.Started.Format("15:04:05"), proc.pendingBytes(), proc.Command)
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+func (s *Session) readProcessOutput(input json.RawMessage) (string, error) {
+	const expected = `{"id":1}`
+
+	args := ReadProcessOutputInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("read_process_output", err.Error(), expected)
+	}
+	if args.ID == nil {
+		return "", toolInputValidationError("read_process_output", `missing required field "id"`, expected)
+	}
+	maxBytes := defaultBashMaxOutputBytes
+	if args.MaxBytes > 0 {
+		maxBytes = min(args.MaxBytes, hardBashMaxOutputBytes)
+	}
+
+	proc, err := s.processes.get(*args.ID)
+	if err != nil {
+		return "", err
+	}
+	output, dropped, more := proc.unread(maxBytes)
+	output = s.redactSecrets(output)
+	fmt.Fprintf(s.out, "Read output of background process %d (%d bytes)\n", proc.ID, len(output))
+
+	msg := fmt.Sprintf("Process %d %s.", proc.ID, proc.status())
+	if dropped > 0 {
+		msg += fmt.Sprintf(" (%d earlier bytes were discarded before being read.)", dropped)
+	}
+	if strings.TrimSpace(output) == "" {
+		msg += " No new output."
+	} else {
+		msg += "\n\n" + output
+	}
+	if more {
+		msg += "\n\n(more output pending; call read_process_output again)"
+	}
+	return msg, nil
+}
+
+func (s *Session) killProcess(input json.RawMessage) (string, error) {
+	const expected = `{"id":1}`
+
+	args := ProcessIDInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("kill_process", err.Error(), expected)
+	}
+	if args.ID == nil {
+		return "", toolInputValidationError("kill_process", `missing required field "id"`, expected)
+	}
+	proc, err := s.processes.get(*args.ID)
+	if err != nil {
+		return "", err
+	}
+	if !proc.running() {
+		return fmt.Sprintf("Process %d already %s.", proc.ID, proc.status()), nil
+	}
+	stopProcessGroup(proc)
+	s.audit.record(AuditEntry{Tool: "kill_process", Command: proc.Command})
+	fmt.Fprintf(s.out, "Stopped background process %d\n", proc.ID)
+	return fmt.Sprintf("Stopped process %d; it %s.", proc.ID, proc.status()), nil
+}
+
+// trashEntry is a file or directory removed by delete_file or
+// delete_directory. Deleted paths are moved under .coder/trash/<session>/ so
+// /undo-file can put them back.
+type trashEntry struct {
+	Path      string
+	AbsPath   string
+	TrashPath string
+	IsDir     bool
+	Deleted   time.Time
+}
+
+func (s *Session) deleteFile(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/old_module.py"}`
+
+	pathValue, err := parseDeletePath("delete_file", input, expected)
+	if err != nil {
+		return "", err
+	}
+	absFile, displayPath, err := s.resolveWorkspaceFile(pathValue)
+	if err != nil {
+		return "", deletePathError("delete_file", pathValue, expected, err)
+	}
+	// The deleted content goes out in the diff event.
+	if err := s.checkNotIgnored(absFile, displayPath, false); err != nil {
+		return "", err
+	}
+	if err := s.checkDeletable(absFile, displayPath); err != nil {
+		return "", err
+	}
+	if err := s.checkProtected("delete_file", displayPath, false); err != nil {
+		return "", err
+	}
+
+	s.checkExternalChange(absFile, displayPath)
+	previous, err := os.ReadFile(absFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+	}
+	trashed, err := s.discard(absFile, displayPath, false)
+	if err != nil {
+		return "", err
+	}
+	s.recordWrite(absFile, nil)
+	s.auditFileWrite("delete_file", displayPath, previous, true, nil)
+	s.emitDiff(displayPath, previous, nil)
+
+	if !trashed {
+		fmt.Fprintf(s.out, "Deleted %s\n", displayPath)
+		return fmt.Sprintf("deleted file %s", displayPath), nil
+	}
+	fmt.Fprintf(s.out, "Deleted %s (moved to trash)\n", displayPath)
+	return fmt.Sprintf("deleted file %s (the user can restore it with /undo-file)", displayPath), nil
+}
+
+func (s *Session) deleteDirectory(input json.RawMessage) (string, error) {
+	const expected = `{"path":"build/tmp"}`
+
+	pathValue, err := parseDeletePath("delete_directory", input, expected)
+	if err != nil {
+		return "", err
+	}
+	absDir, displayPath, err := s.resolveWorkspaceDir(pathValue)
+	if err != nil {
+		return "", deletePathError("delete_directory", pathValue, expected, err)
+	}
+	if displayPath == "." {
+		return "", newToolError(ToolErrorPermission, "refusing to delete the workspace root")
+	}
+	if err := s.checkDeletable(absDir, displayPath); err != nil {
+		return "", err
+	}
+	if err := s.checkProtectedTree("delete_directory", absDir, displayPath); err != nil {
+		return "", err
+	}
+
+	files := 0
+	filepath.WalkDir(absDir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if !s.inScratch(displayPath) && !s.confirm(fmt.Sprintf("Delete directory %s (%d file(s))?", displayPath, files)) {
+		return "", fmt.Errorf("user declined to delete directory %s", displayPath)
+	}
+	trashed, err := s.discard(absDir, displayPath, true)
+	if err != nil {
+		return "", err
+	}
+	s.cache.clear()
+	s.audit.record(AuditEntry{Tool: "delete_directory", Path: displayPath, Existed: true, FilesRemoved: files})
+	if !trashed {
+		fmt.Fprintf(s.out, "Deleted %s/ (%d file(s))\n", displayPath, files)
+		return fmt.Sprintf("deleted directory %s containing %d file(s)", displayPath, files), nil
+	}
+
+	fmt.Fprintf(s.out, "Deleted %s/ (%d file(s), moved to trash)\n", displayPath, files)
+	return fmt.Sprintf("deleted directory %s containing %d file(s) (the user can restore it with /undo-file)", displayPath, files), nil
+}
+
+func parseDeletePath(toolName string, input json.RawMessage, expected string) (string, error) {
+	args := DeletePathInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError(toolName, err.Error(), expected)
+	}
+	pathValue, err := requireToolString(toolName, "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(pathValue), nil
+}
+
+// deletePathError explains a delete_file or delete_directory path that does
+// not resolve. Paths such as pages/[id].tsx are real, so glob characters are
+// taken literally, and a pattern that names nothing gets a hint instead.
+func deletePathError(toolName, pathValue, expected string, err error) error {
+	if strings.ContainsAny(pathValue, "*?[") && errors.Is(err, fs.ErrNotExist) {
+		return toolInputValidationError(toolName, fmt.Sprintf("nothing is named %s; glob patterns are not expanded, so delete one path per call", pathValue), expected)
+	}
+	return err
+}
+
+// checkNotIgnored refuses a path excluded by .coderignore. For a directory it
+// also refuses when anything inside is excluded, since moving the directory
+// would carry those files to a path the model can read.
+func (s *Session) checkNotIgnored(absPath, displayPath string, isDir bool) error {
+	ignore := workspaceIgnore(s.root)
+	if ignore.Ignored(displayPath, isDir) {
+		return newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+	if ignore == nil || !isDir {
+		return nil
+	}
+	excluded := ""
+	filepath.WalkDir(absPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == absPath {
+			return nil
+		}
+		rel, relErr := filepath.Rel(absPath, path)
+		if relErr != nil {
+			return nil
+		}
+		if inner := joinDisplayPath(displayPath, filepath.ToSlash(rel)); ignore.Ignored(inner, d.IsDir()) {
+			excluded = inner
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if excluded != "" {
+		return newToolError(ToolErrorPermission, "%s contains %s, which is excluded by %s", displayPath, excluded, coderIgnoreName)
+	}
+	return nil
+}
+
+// checkDeletable keeps the agent's own state directory out of reach of the
+// delete and move tools.
+func (s *Session) checkDeletable(absPath, displayPath string) error {
+	if s.scratch != "" && absPath == s.scratch {
+		return newToolError(ToolErrorPermission, "refusing to touch %s: it is the scratch directory itself", displayPath)
+	}
+	coderDir := filepath.Join(s.root, coderDirName)
+	// The scratch directory is the one part of .coder the model manages.
+	if !s.inScratch(displayPath) && (absPath == coderDir || strings.HasPrefix(absPath, coderDir+string(filepath.Separator))) {
+		return newToolError(ToolErrorPermission, "refusing to touch %s: it is inside the %s directory", displayPath, coderDirName)
+	}
+	if err := s.checkAddedDirRoot(absPath, displayPath); err != nil {
+		return err
+	}
+	// Deleting resolves paths for reading; added directories must also allow
+	// writes.
+	_, _, err := s.resolveToolPath(displayPath, true)
+	return err
+}
+
+// discard deletes a path for delete_file or delete_directory and reports
+// whether it went to the trash. Scratch paths are removed outright, since the
+// trash outlives the session and they are throwaway by definition.
+func (s *Session) discard(absPath, displayPath string, isDir bool) (bool, error) {
+	if !s.inScratch(displayPath) {
+		return true, s.moveToTrash(absPath, displayPath, isDir)
+	}
+	if err := os.RemoveAll(absPath); err != nil {
+		return false, fmt.Errorf("failed to delete %s: %w", displayPath, err)
+	}
+	return false, nil
+}
+
+func (s *Session) moveToTrash(absPath, displayPath string, isDir bool) error {
+	base := filepath.Join(s.root, coderDirName, trashDirName, s.ID)
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	slot, err := os.MkdirTemp(base, "")
+	if err != nil {
+		return fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	trashPath := filepath.Join(slot, filepath.Base(absPath))
+	if err := os.Rename(absPath, trashPath); err != nil {
+		return fmt.Errorf("failed to move %s to trash: %w", displayPath, err)
+	}
+	s.trash = append(s.trash, trashEntry{Path: displayPath, AbsPath: absPath, TrashPath: trashPath, IsDir: isDir, Deleted: time.Now()})
+	debugf("trashed path=%q trash_path=%q dir=%t", displayPath, trashPath, isDir)
+	return nil
+}
+
+// restoreFromTrash moves the most recently deleted entry, or the most recent
+// one for displayPath, back to where it was.
+func (s *Session) restoreFromTrash(displayPath string) error {
+	if len(s.trash) == 0 {
+		return errors.New("nothing to restore; no files were deleted in this session")
+	}
+	index := len(s.trash) - 1
+	if displayPath != "" {
+		want := filepath.ToSlash(filepath.Clean(displayPath))
+		index = -1
+		for i := len(s.trash) - 1; i >= 0; i-- {
+			if s.trash[i].Path == want {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("%s was not deleted in this session", want)
+		}
+	}
+	entry := s.trash[index]
+
+	if _, err := os.Lstat(entry.AbsPath); err == nil {
+		return fmt.Errorf("%s exists again; move it aside before restoring", entry.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.AbsPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create parent directory for %s: %w", entry.Path, err)
+	}
+	if err := os.Rename(entry.TrashPath, entry.AbsPath); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", entry.Path, err)
+	}
+	s.trash = append(s.trash[:index], s.trash[index+1:]...)
+	s.cache.clear()
+	s.audit.record(AuditEntry{Tool: "undo-file", Path: entry.Path, Command: "/undo-file " + entry.Path})
+
+	fmt.Fprintf(s.out, "Restored %s\n", entry.Path)
+	s.addNote(fmt.Sprintf("Note: the user restored %s from the trash; it exists again.", entry.Path))
+	return nil
+}
+
+func (s *Session) bashTool(input json.RawMessage) (string, error) {
+	const expected = `{"command":"python3 app.py","timeout_seconds":30}`
+
+	args := BashInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("bash", err.Error(), expected)
+	}
+
+	command := ""
+	if args.Command != nil {
+		command = *args.Command
+	}
+	if strings.TrimSpace(command) == "" && args.Cmd != nil {
+		command = *args.Cmd
+	}
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return "", toolInputValidationError("bash", `missing required field "command"`, expected)
+	}
+
+	timeoutSeconds := defaultBashTimeoutSeconds
+	if args.TimeoutSeconds > 0 {
+		timeoutSeconds = args.TimeoutSeconds
+	}
+	if timeoutSeconds > hardBashTimeoutSeconds {
+		timeoutSeconds = hardBashTimeoutSeconds
+	}
+
+	maxOutputBytes := defaultBashMaxOutputBytes
+	if args.MaxOutputBytes > 0 {
+		maxOutputBytes = args.MaxOutputBytes
+	}
+	if maxOutputBytes > hardBashMaxOutputBytes {
+		maxOutputBytes = hardBashMaxOutputBytes
+	}
+
+	cwd := s.root
+	dir := ""
+	if strings.TrimSpace(args.Cwd) != "" {
+		absDir, displayPath, err := s.resolveWorkspaceDir(args.Cwd)
+		if err != nil {
+			return "", fmt.Errorf("invalid cwd: %w", err)
+		}
+		cwd = absDir
+		if displayPath != "." {
+			dir = displayPath
+		}
+	}
+
+	if err := s.checkCommand(command); err != nil {
+		return "", err
+	}
+
+	// Commands can change any file, so nothing read earlier can be reused.
+	s.cache.clear()
+	if args.Background {
+		return s.startBackgroundProcess(command, cwd, dir)
+	}
+	return s.runCommand(command, command, cwd, dir, timeoutSeconds, maxOutputBytes)
+}
+
+// checkCommand refuses commands matching the denylist, and any command once
+// the disk quota is exceeded.
+func (s *Session) checkCommand(command string) error {
+	if pattern := s.deniedCommandPattern(command); pattern != "" {
+		return newToolError(ToolErrorPermission, "command refused: it matches the denylist pattern %s; ask the user to run it themselves if it is really needed", pattern)
+	}
+	return s.checkDiskQuota("bash")
+}
+
+// checkToolCommand applies bash's rules to a command another tool runs on
+// the model's behalf, such as tests or a linter, which can execute code the
+// model wrote: the denylist, the disk quota, and bash's permission mode.
+func (s *Session) checkToolCommand(tool, command string) error {
+	if err := s.checkCommand(command); err != nil {
+		return err
+	}
+	switch s.permissions.mode(Tool{Name: "bash"}) {
+	case permissionHidden, permissionDeny:
+		return newToolError(ToolErrorPermission, "%s runs %s, which needs bash, and bash is not permitted by the workspace configuration", tool, command)
+	case permissionAsk:
+		if !s.confirm(fmt.Sprintf("Allow %s to run %s?", tool, previewText(command, 200))) {
+			return newToolError(ToolErrorPermission, "the user declined to let %s run %s; ask what they would like to do instead", tool, command)
+		}
+	}
+	return nil
+}
+
+// runCommand runs script with bash in cwd and formats its outcome for the
+// model. command is the model's command, which script runs possibly wrapped;
+// it is what the log and audit show.
+func (s *Session) runCommand(command, script, cwd, dir string, timeoutSeconds, maxOutputBytes int) (string, error) {
+	debugf("bash_tool_start command=%q cwd=%q timeout_seconds=%d max_output_bytes=%d", command, dir, timeoutSeconds, maxOutputBytes)
+
+	ctx, cancel := context.WithTimeout(s.toolContext(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "bash", "-lc", script)
+	cmd.Dir = cwd
+	cmd.Env = s.commandEnv()
+	// Run in its own process group so a timeout or cancellation stops
+	// everything the command started, not just bash.
+	startProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = processKillGracePeriod
+	start := time.Now()
+	output, runErr := cmd.CombinedOutput()
+	s.auditCommand(command, dir, runErr, ctx.Err() == context.DeadlineExceeded, len(output), time.Since(start))
+
+	truncatedOutput, wasTruncated := truncateOutput([]byte(s.redactSecrets(string(output))), maxOutputBytes)
+	trimmedOutput := strings.TrimSpace(truncatedOutput)
+
+	if ctx.Err() == context.Canceled {
+		msg := "Command was cancelled by the user."
+		if trimmedOutput != "" {
+			msg += "\n\nPartial output:\n" + trimmedOutput
+		}
+		return msg, nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		msg := fmt.Sprintf("Command timed out after %d seconds.", timeoutSeconds)
+		if trimmedOutput != "" {
+			msg += "\n\nPartial output:\n" + trimmedOutput
+		}
+		if wasTruncated {
+			msg += fmt.Sprintf("\n\n(output truncated at max_output_bytes=%d)", maxOutputBytes)
+		}
+		return msg, nil
+	}
+
+	if runErr != nil {
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			msg := fmt.Sprintf("Command exited with code %d.", exitErr.ExitCode())
+			if trimmedOutput != "" {
+				msg += "\n\nOutput:\n" + trimmedOutput
+			}
+			if wasTruncated {
+				msg += fmt.Sprintf("\n\n(output truncated at max_output_bytes=%d)", maxOutputBytes)
+			}
+			return msg, nil
+		}
+		return "", fmt.Errorf("failed to execute command: %w", runErr)
+	}
+
+	if trimmedOutput == "" {
+		return "Command completed successfully with no output.", nil
+	}
+	if wasTruncated {
+		return trimmedOutput + fmt.Sprintf("\n\n(output truncated at max_output_bytes=%d)", maxOutputBytes), nil
+	}
+	return trimmedOutput, nil
+}
+
+func (s *Session) readFiles(input json.RawMessage) (string, error) {
+	const expected = `{"path":"main.py","max_bytes":32000}`
+
+	args := ReadFilesInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("read_files", err.Error(), expected)
+	}
+
+	maxBytes := defaultReadFilesMaxBytes
+	if args.MaxBytes > 0 {
+		maxBytes = args.MaxBytes
+	}
+	if maxBytes > hardReadFilesMaxBytes {
+		maxBytes = hardReadFilesMaxBytes
+	}
+
+	if args.Offset < 0 || args.StartLine < 0 {
+		return "", toolInputValidationError("read_files", `"offset" and "start_line" cannot be negative`, expected)
+	}
+	if args.Offset > 0 && args.StartLine > 0 {
+		return "", toolInputValidationError("read_files", `use either "offset" or "start_line", not both`, `{"path":"main.py","offset":32000}`)
+	}
+
+	if len(args.Paths) > 0 {
+		if args.Path != nil {
+			return "", toolInputValidationError("read_files", `use either "path" or "paths", not both`, `{"paths":["a.go","b.go"],"max_bytes":64000}`)
+		}
+		if args.Offset > 0 || args.StartLine > 0 {
+			return "", toolInputValidationError("read_files", `"offset" and "start_line" apply to a single path only`, `{"path":"main.py","offset":32000}`)
+		}
+		return s.readMultipleFiles(args.Paths, maxBytes)
+	}
+
+	pathValue, err := requireToolString("read_files", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	text, _, _, err := s.readFileContent(strings.TrimSpace(pathValue), args.Offset, args.StartLine, maxBytes)
+	return text, err
+}
+
+// readMultipleFiles reads several files against one combined byte budget and
+// returns them in a single result, each preceded by a "==> path <==" header.
+// Per-file failures are reported inline so one bad path does not hide the rest.
+func (s *Session) readMultipleFiles(paths []string, budget int) (string, error) {
+	const expected = `{"paths":["a.go","b.go"],"max_bytes":64000}`
+	if len(paths) > maxReadFilesPaths {
+		return "", toolInputValidationError("read_files", fmt.Sprintf("at most %d paths can be read in one call", maxReadFilesPaths), expected)
+	}
+
+	var b strings.Builder
+	failures := 0
+	for i, pathValue := range paths {
+		pathValue = strings.TrimSpace(pathValue)
+		if pathValue == "" {
+			return "", toolInputValidationError("read_files", fmt.Sprintf("paths[%d] cannot be empty", i), expected)
+		}
+		if budget <= 0 {
+			fmt.Fprintf(&b, "==> %s <==\n(skipped: combined max_bytes budget exhausted; read it in a separate call)\n\n", pathValue)
+			continue
+		}
+
+		text, displayPath, used, err := s.readFileContent(pathValue, 0, 0, budget)
+		if err != nil {
+			failures++
+			fmt.Fprintf(&b, "==> %s <==\n(error: %v)\n\n", pathValue, err)
+			continue
+		}
+		budget -= used
+		fmt.Fprintf(&b, "==> %s <==\n%s", displayPath, text)
+		if !strings.HasSuffix(text, "\n") {
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+
+	if failures == len(paths) {
+		return "", fmt.Errorf("failed to read all %d paths:\n%s", len(paths), strings.TrimSpace(b.String()))
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// readFileContent reads one workspace file for the model, starting at a byte
+// offset or 1-based line and returning at most maxBytes. When the file
+// continues past the returned window, a hint with the offset to read next is
+// appended. It returns the text to show the model, the display path, and the
+// number of bytes of file content included.
+func (s *Session) readFileContent(pathValue string, offset, startLine, maxBytes int) (string, string, int, error) {
+	absFile, displayPath, err := s.resolveWorkspaceFile(pathValue)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if workspaceIgnore(s.root).Ignored(displayPath, false) {
+		return "", "", 0, newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+
+	cacheKey := fmt.Sprintf("read\x00%s\x00%d\x00%d\x00%d", absFile, offset, startLine, maxBytes)
+	if s.cache.has(cacheKey) {
+		if changed, _ := s.files.changed(absFile); !changed {
+			fmt.Fprintf(s.out, "Read %s (unchanged, cached)\n", displayPath)
+			return fmt.Sprintf("%s is unchanged since you read it earlier in this turn; reuse that result instead of reading it again.", displayPath), displayPath, 0, nil
+		}
+	}
+
+	content, err := os.ReadFile(absFile)
+	if err != nil {
+		return "", displayPath, 0, fmt.Errorf("failed to read file %q: %w", displayPath, err)
+	}
+	s.files.record(absFile, content)
+	s.cache.put(cacheKey, absFile)
+	// Offsets and lines count in the UTF-8 text the model sees.
+	decoded, encoding := decodeFileText(content)
+	content = []byte(decoded)
+
+	total := len(content)
+	if startLine > 1 {
+		offset = lineOffset(content, startLine)
+		if offset < 0 || (offset == total && total > 0) {
+			return "", displayPath, 0, fmt.Errorf("start_line %d is past the end of %s (%d lines)", startLine, displayPath, countLines(content))
+		}
+	}
+	if offset > total {
+		return "", displayPath, 0, fmt.Errorf("offset %d is past the end of %s (%d bytes)", offset, displayPath, total)
+	}
+
+	end := readWindowEnd(content, offset, maxBytes)
+	window := content[offset:end]
+	encodingNote := ""
+	if encoding != encodingUTF8 {
+		encodingNote = fmt.Sprintf("[file is %s; shown as UTF-8 and saved back as %s when edited]", encoding, encoding)
+	}
+	if offset == 0 && end == total {
+		fmt.Fprintf(s.out, "Read %s (%d bytes)\n", displayPath, len(window))
+		if encodingNote != "" {
+			return appendReadNote(string(window), encodingNote), displayPath, len(window), nil
+		}
+		return string(window), displayPath, len(window), nil
+	}
+
+	fmt.Fprintf(s.out, "Read %s (bytes %d-%d of %d)\n", displayPath, offset, end, total)
+	text := string(window)
+	if end < total {
+		text = appendReadNote(text, fmt.Sprintf("[truncated: showed bytes %d-%d of %d. Read again with offset=%d to continue.]", offset, end, total, end))
+	}
+	if encodingNote != "" {
+		text = appendReadNote(text, encodingNote)
+	}
+	return text, displayPath, len(window), nil
+}
+
+// appendReadNote adds a bracketed note after file text, on its own paragraph.
+func appendReadNote(text, note string) string {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text + "\n" + note
+}
+
+// FileStat is the stat_file result.
+type FileStat struct {
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	Modified time.Time `json:"modified"`
+	Lines    *int      `json:"lines,omitempty"`
+	Language string    `json:"language,omitempty"`
+	Binary   bool      `json:"binary,omitempty"`
+	Encoding string    `json:"encoding,omitempty"`
+	Entries  *int      `json:"entries,omitempty"`
+}
+
+func (s *Session) statFile(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/main.go"}`
+
+	args := StatFileInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("stat_file", err.Error(), expected)
+	}
+	pathValue, err := requireToolString("stat_file", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+
+	absPath, displayPath, err := s.resolveWorkspaceDir(pathValue)
+	isDir := err == nil
+	if !isDir {
+		absPath, displayPath, err = s.resolveWorkspaceFile(pathValue)
+		if err != nil {
+			return "", err
+		}
+	}
+	if workspaceIgnore(s.root).Ignored(displayPath, isDir) {
+		return "", newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to access path %q: %w", displayPath, err)
+	}
+	stat := FileStat{
+		Path:     displayPath,
+		Type:     "file",
+		Size:     info.Size(),
+		Mode:     info.Mode().Perm().String(),
+		Modified: info.ModTime().UTC().Truncate(time.Second),
+	}
+	if linkInfo, err := os.Lstat(absPath); err == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
+		stat.Type = "symlink"
+	}
+
+	if isDir {
+		stat.Type = "directory"
+		entries, err := os.ReadDir(absPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read directory %q: %w", displayPath, err)
+		}
+		count := len(entries)
+		stat.Entries = &count
+	} else {
+		lines, binary, head, err := scanFile(absPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+		}
+		stat.Binary = binary
+		if !binary {
+			stat.Lines = &lines
+			if enc := detectEncoding(trimPartialRune(head)); enc != encodingUTF8 {
+				stat.Encoding = enc
+			}
+		}
+		stat.Language = detectLanguage(displayPath, head)
+	}
+
+	fmt.Fprintf(s.out, "Stat %s (%d bytes)\n", displayPath, stat.Size)
+	encoded, err := json.Marshal(stat)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode stat_file output: %w", err)
+	}
+	return string(encoded), nil
+}
+
+// scanFile counts lines without loading the whole file and reports whether
+// it looks binary (a NUL byte in the first block that is not UTF-16 text). It
+// also returns that first block for language detection.
+func scanFile(absFile string) (int, bool, []byte, error) {
+	f, err := os.Open(absFile)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 32*1024)
+	var head []byte
+	lines := 0
+	var last byte
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if head == nil {
+				head = append([]byte(nil), buf[:n]...)
+			}
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, nil, err
+		}
+	}
+	if last != 0 && last != '\n' {
+		lines++
+	}
+	return lines, bytes.IndexByte(head, 0) >= 0 && !isUTF16(detectEncoding(head)), head, nil
+}
+
+var languageByExtension = map[string]string{
+	".go": "Go", ".py": "Python", ".js": "JavaScript", ".mjs": "JavaScript", ".cjs": "JavaScript",
+	".jsx": "JavaScript", ".ts": "TypeScript", ".tsx": "TypeScript", ".rs": "Rust", ".java": "Java",
+	".kt": "Kotlin", ".swift": "Swift", ".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++",
+	".hpp": "C++", ".cs": "C#", ".rb": "Ruby", ".php": "PHP", ".scala": "Scala", ".sh": "Shell",
+	".bash": "Shell", ".zsh": "Shell", ".lua": "Lua", ".sql": "SQL", ".html": "HTML", ".css": "CSS",
+	".scss": "SCSS", ".md": "Markdown", ".json": "JSON", ".yaml": "YAML", ".yml": "YAML",
+	".toml": "TOML", ".xml": "XML", ".proto": "Protocol Buffers", ".tf": "Terraform",
+	".ex": "Elixir", ".exs": "Elixir", ".erl": "Erlang", ".hs": "Haskell", ".ml": "OCaml",
+	".dart": "Dart", ".r": "R", ".vue": "Vue", ".svelte": "Svelte", ".zig": "Zig",
+}
+
+var languageByName = map[string]string{
+	"Makefile": "Makefile", "Dockerfile": "Dockerfile", "go.mod": "Go Module", "Gemfile": "Ruby",
+	"Rakefile": "Ruby", "CMakeLists.txt": "CMake",
+}
+
+// detectLanguage guesses a file's language from its name, falling back to a
+// shebang line.
+func detectLanguage(displayPath string, head []byte) string {
+	name := filepath.Base(displayPath)
+	if lang, ok := languageByName[name]; ok {
+		return lang
+	}
+	if lang, ok := languageByExtension[strings.ToLower(filepath.Ext(name))]; ok {
+		return lang
+	}
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	shebang, _, _ := bytes.Cut(head, []byte("\n"))
+	for _, interp := range []struct{ name, lang string }{
+		{"python", "Python"}, {"node", "JavaScript"}, {"ruby", "Ruby"}, {"perl", "Perl"},
+		{"bash", "Shell"}, {"sh", "Shell"}, {"zsh", "Shell"},
+	} {
+		if bytes.Contains(shebang, []byte(interp.name)) {
+			return interp.lang
+		}
+	}
+	return ""
+}
+
+func countLines(content []byte) int {
+	lines := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// lineOffset returns the byte offset where 1-based line n starts, or -1 if
+// the content has fewer lines.
+func lineOffset(content []byte, n int) int {
+	offset := 0
+	for line := 1; line < n; line++ {
+		i := bytes.IndexByte(content[offset:], '\n')
+		if i < 0 {
+			return -1
+		}
+		offset += i + 1
+	}
+	return offset
+}
+
+// readWindowEnd picks where a maxBytes window starting at offset should end.
+// It prefers to stop after a newline in the second half of the window and
+// never splits a UTF-8 sequence.
+func readWindowEnd(content []byte, offset, maxBytes int) int {
+	end := offset + maxBytes
+	if end >= len(content) {
+		return len(content)
+	}
+	if i := bytes.LastIndexByte(content[offset:end], '\n'); i >= maxBytes/2 {
+		return offset + i + 1
+	}
+	for end > offset && !utf8.RuneStart(content[end]) {
+		end--
+	}
+	if end == offset {
+		return offset + maxBytes
+	}
+	return end
+}
+
+// fileStamp identifies the on-disk state of a file the agent has seen.
+type fileStamp struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+}
+
+// fileTracker remembers the state of files the agent has read or written so
+// edits made outside the agent can be detected before they are overwritten.
+type fileTracker struct {
+	stamps map[string]fileStamp
+}
+
+func newFileTracker() *fileTracker {
+	return &fileTracker{stamps: make(map[string]fileStamp)}
+}
+
+func (t *fileTracker) record(absFile string, content []byte) {
+	info, err := os.Stat(absFile)
+	if err != nil {
+		delete(t.stamps, absFile)
+		return
+	}
+	t.stamps[absFile] = fileStamp{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Hash:    hashContent(content),
+	}
+}
+
+// changed reports whether a tracked file differs from its last recorded state.
+// Untracked files are never reported as changed. A touched file whose content
+// is identical is not considered changed.
+func (t *fileTracker) changed(absFile string) (bool, string) {
+	stamp, ok := t.stamps[absFile]
+	if !ok {
+		return false, ""
+	}
+	info, err := os.Stat(absFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, "deleted"
+		}
+		return false, ""
+	}
+	if info.ModTime().Equal(stamp.ModTime) && info.Size() == stamp.Size {
+		return false, ""
+	}
+	content, err := os.ReadFile(absFile)
+	if err != nil {
+		return false, ""
+	}
+	if hashContent(content) == stamp.Hash {
+		t.stamps[absFile] = fileStamp{ModTime: info.ModTime(), Size: info.Size(), Hash: stamp.Hash}
+		return false, ""
+	}
+	return true, "modified"
+}
+
+// emitDiff reports a file change to event listeners as a unified diff.
+func (s *Session) emitDiff(displayPath string, before, after []byte) {
+	if s.OnEvent == nil || s.inScratch(displayPath) {
+		return
+	}
+	s.emit(Event{Type: EventDiff, Path: displayPath, Text: unifiedDiff(displayPath, before, after, maxDiffBytes)})
+}
+
+// editResultDiff is the diff added to a write or edit result so the model
+// can check what changed without reading the file again.
+func editResultDiff(displayPath string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return "\n(no changes)"
+	}
+	diff := unifiedDiff(displayPath, before, after, maxEditResultDiffBytes)
+	return "\n" + strings.TrimSuffix(strings.ReplaceAll(diff, "\r\n", "\n"), "\n")
+}
+
+// unifiedDiff returns a unified diff with three lines of context, cut at
+// maxBytes. Files too large to compare line by line show the changed region as
+// one replacement hunk.
+func unifiedDiff(displayPath string, before, after []byte, maxBytes int) string {
+	oldLines := splitDiffLines(string(before))
+	newLines := splitDiffLines(string(after))
+
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix && oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+	oldMid := oldLines[prefix : len(oldLines)-suffix]
+	newMid := newLines[prefix : len(newLines)-suffix]
+
+	type diffOp struct {
+		kind byte
+		text string
+	}
+	ops := make([]diffOp, 0, len(oldLines)+len(newLines))
+	for _, line := range oldLines[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	if len(oldMid)*len(newMid) > maxDiffCells {
+		for _, line := range oldMid {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range newMid {
+			ops = append(ops, diffOp{'+', line})
+		}
+	} else {
+		// lcs[i][j] is the longest common subsequence of oldMid[i:] and newMid[j:].
+		lcs := make([][]int, len(oldMid)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(newMid)+1)
+		}
+		for i := len(oldMid) - 1; i >= 0; i-- {
+			for j := len(newMid) - 1; j >= 0; j-- {
+				if oldMid[i] == newMid[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(oldMid) || j < len(newMid) {
+			switch {
+			case i < len(oldMid) && j < len(newMid) && oldMid[i] == newMid[j]:
+				ops = append(ops, diffOp{' ', oldMid[i]})
+				i++
+				j++
+			case i < len(oldMid) && (j == len(newMid) || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, diffOp{'-', oldMid[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', newMid[j]})
+				j++
+			}
+		}
+	}
+	for _, line := range oldLines[len(oldLines)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", displayPath, displayPath)
+	const diffContext = 3
+	oldLine, newLine := 1, 1
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			oldLine++
+			newLine++
+			continue
+		}
+		// Extend the hunk until a run of more than 2*diffContext unchanged lines.
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+		from := max(start-diffContext, 0)
+		to := min(end+diffContext, len(ops))
+		hunkOld, hunkNew := oldLine-(start-from), newLine-(start-from)
+		oldCount, newCount := 0, 0
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		// An empty side is numbered by the line before it, as diff -u does.
+		if oldCount == 0 {
+			hunkOld--
+		}
+		if newCount == 0 {
+			hunkNew--
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", hunkOld, oldCount, hunkNew, newCount)
+		for _, op := range ops[from:to] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.text)
+			b.WriteByte('\n')
+		}
+		for _, op := range ops[start:to] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		start = to
+		if b.Len() > maxBytes {
+			break
+		}
+	}
+	diff := b.String()
+	if len(diff) > maxBytes {
+		diff = strings.ToValidUTF8(diff[:maxBytes], "") + "\n... (diff truncated)\n"
+	}
+	return diff
+}
+
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordWrite notes that the agent itself wrote absFile so the write is not
+// mistaken for an external change and stale cached results are dropped.
+func (s *Session) recordWrite(absFile string, content []byte) {
+	s.edited[absFile] = true
+	if content != nil {
+		s.callWrites = append(s.callWrites, absFile)
+	}
+	s.writes++
+	s.files.record(absFile, content)
+	s.cache.invalidate(absFile)
+}
+
+// AuditEntry is one line of the audit log. File writes record content hashes
+// and sizes before and after; commands record the command text and outcome.
+// Each entry carries the SHA-256 of the previous line so truncation or edits
+// of the log are detectable.
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	Session       string    `json:"session"`
+	Tool          string    `json:"tool"`
+	Path          string    `json:"path,omitempty"`
+	Destination   string    `json:"destination,omitempty"`
+	Existed       bool      `json:"existed,omitempty"`
+	BytesBefore   int       `json:"bytes_before,omitempty"`
+	BytesAfter    int       `json:"bytes_after,omitempty"`
+	BeforeSHA256  string    `json:"before_sha256,omitempty"`
+	AfterSHA256   string    `json:"after_sha256,omitempty"`
+	Command       string    `json:"command,omitempty"`
+	ExitCode      *int      `json:"exit_code,omitempty"`
+	TimedOut      bool      `json:"timed_out,omitempty"`
+	Background    bool      `json:"background,omitempty"`
+	OutputBytes   int       `json:"output_bytes,omitempty"`
+	DurationMs    int64     `json:"duration_ms,omitempty"`
+	Checkpoint    string    `json:"checkpoint,omitempty"`
+	FilesRemoved  int       `json:"files_removed,omitempty"`
+	PrevEntryHash string    `json:"prev"`
+}
+
+type auditLog struct {
+	path      string
+	sessionID string
+	lastHash  string
+	loaded    bool
+}
+
+func newAuditLog(root string, cfg AuditConfig, sessionID string) *auditLog {
+	if cfg.Disabled {
+		return nil
+	}
+	path := cfg.Path
+	if path == "" {
+		path = filepath.Join(coderDirName, auditLogName)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	return &auditLog{path: path, sessionID: sessionID}
+}
+
+// record appends an entry. Failures are reported but never block the tool
+// call that triggered them.
+func (a *auditLog) record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	if !a.loaded {
+		a.loaded = true
+		a.lastHash = lastLineHash(a.path)
+	}
+	entry.Time = time.Now().UTC()
+	entry.Session = a.sessionID
+	entry.PrevEntryHash = a.lastHash
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.path), 0o755)
+	}
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		debugf("audit_log_failed path=%q error=%q", a.path, err.Error())
+		fmt.Fprintf(os.Stderr, "Audit log write failed: %v\n", err)
+		return
+	}
+	a.lastHash = hashContent(line)
+}
+
+func lastLineHash(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if last == "" {
+		return ""
+	}
+	return hashContent([]byte(last))
+}
+
+func (s *Session) auditFileWrite(tool, displayPath string, before []byte, existed bool, after []byte) {
+	entry := AuditEntry{
+		Tool:        tool,
+		Path:        displayPath,
+		Existed:     existed,
+		BytesAfter:  len(after),
+		AfterSHA256: hashContent(after),
+	}
+	if existed {
+		entry.BytesBefore = len(before)
+		entry.BeforeSHA256 = hashContent(before)
+	}
+	s.audit.record(entry)
+}
+
+func (s *Session) auditCommand(command, dir string, runErr error, timedOut bool, outputBytes int, duration time.Duration) {
+	entry := AuditEntry{
+		Tool:        "bash",
+		Path:        dir,
+		Command:     command,
+		TimedOut:    timedOut,
+		OutputBytes: outputBytes,
+		DurationMs:  duration.Milliseconds(),
+	}
+	exitCode := 0
+	var exitErr *exec.ExitError
+	switch {
+	case runErr == nil:
+	case errors.As(runErr, &exitErr):
+		exitCode = exitErr.ExitCode()
+	default:
+		exitCode = -1
+	}
+	entry.ExitCode = &exitCode
+	s.audit.record(entry)
+}
+
+// toolCache remembers which read_file and list_files calls were already
+// answered in the current turn. Repeats of an identical call return a short
+// pointer to the earlier result instead of the full content. Entries are keyed
+// by tool kind, resolved path, and limits, and are dropped when the agent
+// writes under the path, runs a command, or starts a new turn.
+type toolCache struct {
+	paths map[string]string
+}
+
+func newToolCache() *toolCache {
+	return &toolCache{paths: make(map[string]string)}
+}
+
+func (c *toolCache) has(key string) bool {
+	_, ok := c.paths[key]
+	return ok
+}
+
+func (c *toolCache) put(key, absPath string) {
+	c.paths[key] = absPath
+}
+
+// invalidate drops entries for absPath itself and for any directory listing
+// that contains it.
+func (c *toolCache) invalidate(absPath string) {
+	for key, cached := range c.paths {
+		if cached == absPath || strings.HasPrefix(absPath, cached+string(filepath.Separator)) {
+			delete(c.paths, key)
+		}
+	}
+}
+
+func (c *toolCache) clear() {
+	clear(c.paths)
+}
+
+// checkExternalChange warns the user and queues a note for the model when a
+// file the agent has seen was changed by someone else since.
+func (s *Session) checkExternalChange(absFile, displayPath string) {
+	changed, how := s.files.changed(absFile)
+	if !changed {
+		return
+	}
+	debugf("external_file_change path=%q change=%q", displayPath, how)
+	fmt.Fprintf(s.out, "%s: %s was %s outside the agent since it was last read\n", colorLabel("warning", warnColor, s.colorOutput), displayPath, how)
+	s.addNote(fmt.Sprintf(
+		"Note: %s was %s outside of your tool calls since you last read or wrote it. Edits are applied against the current on-disk state; re-read the file before making further edits based on earlier contents.",
+		displayPath,
+		how,
+	))
+}
+
+// checkStaleRead rejects a write to a file that changed on disk since the
+// model last read or wrote it, so an edit planned against old contents cannot
+// clobber a concurrent change. The error carries the current contents, which
+// are recorded as read: the same edit retried against them goes through.
+func (s *Session) checkStaleRead(absFile, displayPath string) error {
+	changed, how := s.files.changed(absFile)
+	if !changed {
+		return nil
+	}
+	debugf("stale_read path=%q change=%q", displayPath, how)
+	fmt.Fprintf(s.out, "%s: %s was %s since it was last read; rejected the write\n", colorLabel("warning", warnColor, s.colorOutput), displayPath, how)
+	content, err := os.ReadFile(absFile)
+	if err != nil {
+		s.recordWrite(absFile, nil)
+		return newToolError(ToolErrorConflict, "%s was %s since you last read it, so nothing was written; check whether it should still exist before retrying", displayPath, how)
+	}
+	s.recordWrite(absFile, content)
+	text, _ := decodeFileText(content)
+	if end := readWindowEnd([]byte(text), 0, defaultReadFilesMaxBytes); end < len(text) {
+		text = appendReadNote(text[:end], fmt.Sprintf("[truncated: showed bytes 0-%d of %d. Use read_files with offset=%d for the rest.]", end, len(text), end))
+	}
+	return newToolError(ToolErrorConflict, "%s was %s since you last read it, so nothing was written. Its current contents are below; redo the change against them.\n\n%s", displayPath, how, text)
+}
+
+func memoryDir(root string) string {
+	return filepath.Join(root, coderDirName, memoryDirName)
+}
+
+func validMemoryName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Session) memoryWrite(input json.RawMessage) (string, error) {
+	const expected = `{"name":"build-commands","content":"Run go test ./... before committing."}`
+
+	args := MemoryWriteInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("memory_write", err.Error(), expected)
+	}
+
+	name, err := requireToolString("memory_write", "name", args.Name, false, expected)
+	if err != nil {
+		return "", err
+	}
+	content, err := requireToolString("memory_write", "content", args.Content, false, expected)
+	if err != nil {
+		return "", err
+	}
+	name = strings.TrimSpace(name)
+	if !validMemoryName(name) {
+		return "", toolInputValidationError("memory_write", fmt.Sprintf("invalid note name %q; use up to 64 letters, digits, '-' or '_'", name), expected)
+	}
+
+	dir := memoryDir(s.root)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create memory directory: %w", err)
+	}
+	notePath := filepath.Join(dir, name+".md")
+
+	appendMode := args.Append != nil && *args.Append
+	if appendMode {
+		existing, err := os.ReadFile(notePath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read memory note %q: %w", name, err)
+		}
+		if len(existing) > 0 {
+			content = strings.TrimRight(string(existing), "\n") + "\n" + content
+		}
+	}
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if len(content) > maxMemoryNoteBytes {
+		return "", fmt.Errorf("memory note %q would be %d bytes, exceeding the %d byte limit; condense it", name, len(content), maxMemoryNoteBytes)
+	}
+	if err := os.WriteFile(notePath, []byte(content), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write memory note %q: %w", name, err)
+	}
+
+	fmt.Fprintf(s.out, "Saved memory note %s (%d bytes)\n", name, len(content))
+	return fmt.Sprintf("saved memory note %s", name), nil
+}
+
+func (s *Session) memoryRead(input json.RawMessage) (string, error) {
+	args := MemoryReadInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("memory_read", err.Error(), `{"name":"build-commands"}`)
+	}
+
+	name := strings.TrimSpace(args.Name)
+	if name == "" {
+		summary := memorySummary(s.root, 0)
+		if summary == "" {
+			return "No memory notes saved yet.", nil
+		}
+		return summary, nil
+	}
+	if !validMemoryName(name) {
+		return "", toolInputValidationError("memory_read", fmt.Sprintf("invalid note name %q", name), `{"name":"build-commands"}`)
+	}
+
+	content, err := os.ReadFile(filepath.Join(memoryDir(s.root), name+".md"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", newToolError(ToolErrorNotFound, "memory note not found: %s", name)
+		}
+		return "", fmt.Errorf("failed to read memory note %q: %w", name, err)
+	}
+	fmt.Fprintf(s.out, "Read memory note %s (%d bytes)\n", name, len(content))
+	return string(content), nil
+}
+
+// memorySummary lists the notes saved in the workspace at root as "- name:
+// first line". With maxBytes > 0 the full text of each note is included while
+// it fits in the budget.
+func memorySummary(root string, maxBytes int) string {
+	dir := memoryDir(root)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".md") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".md")
+		text := strings.TrimSpace(string(content))
+		line := text
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			line = text[:i]
+		}
+
+		item := fmt.Sprintf("- %s: %s\n", name, line)
+		if maxBytes > 0 {
+			full := fmt.Sprintf("## %s\n%s\n\n", name, text)
+			if b.Len()+len(full) <= maxBytes {
+				item = full
+			}
+			if b.Len()+len(item) > maxBytes {
+				break
+			}
+		}
+		b.WriteString(item)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+const (
+	todoPending    = "pending"
+	todoInProgress = "in_progress"
+	todoCompleted  = "completed"
+)
+
+func (s *Session) todoWrite(input json.RawMessage) (string, error) {
+	const expected = `{"todos":[{"content":"Add parser","status":"completed"},{"content":"Write tests","status":"in_progress"}]}`
+
+	args := TodoWriteInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("todo_write", err.Error(), expected)
+	}
+	if args.Todos == nil {
+		return "", toolInputValidationError("todo_write", `missing required field "todos"`, expected)
+	}
+
+	todos := make([]TodoItem, 0, len(args.Todos))
+	for i, item := range args.Todos {
+		content := strings.TrimSpace(item.Content)
+		if content == "" {
+			return "", toolInputValidationError("todo_write", fmt.Sprintf("todos[%d].content cannot be empty", i), expected)
+		}
+		switch item.Status {
+		case todoPending, todoInProgress, todoCompleted:
+		default:
+			return "", toolInputValidationError("todo_write", fmt.Sprintf("todos[%d].status must be one of pending, in_progress, completed", i), expected)
+		}
+		todos = append(todos, TodoItem{Content: content, Status: item.Status})
+	}
+	s.todos = todos
+
+	fmt.Fprint(s.out, renderTodos(s.todos, s.colorOutput))
+	done := 0
+	for _, item := range s.todos {
+		if item.Status == todoCompleted {
+			done++
+		}
+	}
+	return fmt.Sprintf("updated task list: %d of %d completed", done, len(s.todos)), nil
+}
+
+func (s *Session) todoRead(input json.RawMessage) (string, error) {
+	if len(s.todos) == 0 {
+		return "The task list is empty.", nil
+	}
+	encoded, err := json.Marshal(s.todos)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode todo_read output: %w", err)
+	}
+	return string(encoded), nil
+}
+
+func renderTodos(todos []TodoItem, colorEnabled bool) string {
+	if len(todos) == 0 {
+		return "Tasks: (none)\n"
+	}
+	done := 0
+	for _, item := range todos {
+		if item.Status == todoCompleted {
+			done++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Tasks (%d/%d done)\n", done, len(todos))
+	for _, item := range todos {
+		switch item.Status {
+		case todoCompleted:
+			fmt.Fprintf(&b, "  %s %s\n", colorLabel("[x]", resultColor, colorEnabled), item.Content)
+		case todoInProgress:
+			fmt.Fprintf(&b, "  %s %s\n", colorLabel("[~]", toolColor, colorEnabled), item.Content)
+		default:
+			fmt.Fprintf(&b, "  [ ] %s\n", item.Content)
+		}
+	}
+	return b.String()
+}
+
+// checkpoint records the workspace as it was at the start of a turn. The
+// snapshot is a git commit object built from a private index, so it captures
+// tracked and untracked (non-ignored) files without touching the user's index,
+// stash, or branches. A ref under refs/coder keeps it from being collected.
+type checkpoint struct {
+	Turn    int
+	Commit  string
+	Created time.Time
+	Prompt  string
+}
+
+func runGit(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// workspaceGitRoot returns the top level of the git repository containing the
+// workspace, or "" when the workspace is not inside one.
+func (s *Session) workspaceGitRoot() string {
+	if s.gitChecked {
+		return s.gitRoot
+	}
+	s.gitChecked = true
+	root, err := runGit(s.root, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		debugf("checkpoints_disabled reason=%q", err.Error())
+		return ""
+	}
+	s.gitRoot = root
+	return root
+}
+
+// withTempIndex runs fn with a GIT_INDEX_FILE environment entry pointing at a
+// throwaway index file.
+func withTempIndex(fn func(env []string) error) error {
+	f, err := os.CreateTemp("", "coder-index-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary index: %w", err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	defer os.Remove(path)
+	return fn([]string{"GIT_INDEX_FILE=" + path})
+}
+
+// snapshotWorkspace stores the working tree as a commit object. Paths under
+// exclude (the agent's own .coder state such as the audit log and memory) are
+// left out so restoring a checkpoint never rewrites them.
+func snapshotWorkspace(root, exclude, message string) (string, error) {
+	var commit string
+	err := withTempIndex(func(env []string) error {
+		if _, err := runGit(root, nil, "rev-parse", "--verify", "-q", "HEAD"); err == nil {
+			if _, err := runGit(root, env, "read-tree", "HEAD"); err != nil {
+				return err
+			}
+		}
+		if _, err := runGit(root, env, "add", "-A", "--", "."); err != nil {
+			return err
+		}
+		if _, err := runGit(root, env, "rm", "-r", "-q", "--cached", "--ignore-unmatch", "--", exclude); err != nil {
+			return err
+		}
+		tree, err := runGit(root, env, "write-tree")
+		if err != nil {
+			return err
+		}
+		commitEnv := append(env,
+			"GIT_AUTHOR_NAME=coder", "GIT_AUTHOR_EMAIL=coder@localhost",
+			"GIT_COMMITTER_NAME=coder", "GIT_COMMITTER_EMAIL=coder@localhost",
+		)
+		commit, err = runGit(root, commitEnv, "commit-tree", tree, "-m", message)
+		return err
+	})
+	return commit, err
+}
+
+// coderDirInRepo returns the workspace's .coder directory relative to the git
+// root, in slash form.
+func (s *Session) coderDirInRepo(root string) string {
+	rel, err := filepath.Rel(root, filepath.Join(s.root, coderDirName))
+	if err != nil {
+		return coderDirName
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *Session) createCheckpoint(turn int, prompt string) {
+	root := s.workspaceGitRoot()
+	if root == "" {
+		return
+	}
+	start := time.Now()
+	commit, err := snapshotWorkspace(root, s.coderDirInRepo(root), fmt.Sprintf("coder checkpoint %s turn %d", s.ID, turn))
+	if err == nil {
+		_, err = runGit(root, nil, "update-ref", fmt.Sprintf("refs/coder/%s/%d", s.ID, turn), commit)
+	}
+	if err != nil {
+		debugf("checkpoint_failed turn=%d error=%q", turn, err.Error())
+		fmt.Fprintf(os.Stderr, "Checkpoint failed: %v\n", err)
+		return
+	}
+	s.checkpoints = append(s.checkpoints, checkpoint{Turn: turn, Commit: commit, Created: time.Now(), Prompt: prompt})
+	debugf("checkpoint_created turn=%d commit=%q latency_ms=%d", turn, commit, time.Since(start).Milliseconds())
+}
+
+func (s *Session) restoreCheckpoint(turn int) error {
+	var target *checkpoint
+	for i := range s.checkpoints {
+		if s.checkpoints[i].Turn == turn {
+			target = &s.checkpoints[i]
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no checkpoint for turn %d (see /checkpoints)", turn)
+	}
+	root := s.workspaceGitRoot()
+
+	current, err := runGit(root, nil, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	wanted, err := runGit(root, nil, "ls-tree", "-r", "-z", "--name-only", target.Commit)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, name := range strings.Split(wanted, "\x00") {
+		keep[name] = true
+	}
+	exclude := s.coderDirInRepo(root) + "/"
+	removed := 0
+	for _, name := range strings.Split(current, "\x00") {
+		if name == "" || keep[name] || strings.HasPrefix(name, exclude) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+		removed++
+	}
+
+	err = withTempIndex(func(env []string) error {
+		if _, err := runGit(root, env, "read-tree", target.Commit); err != nil {
+			return err
+		}
+		_, err := runGit(root, env, "checkout-index", "-a", "-f")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.cache.clear()
+	s.audit.record(AuditEntry{Tool: "restore", Command: fmt.Sprintf("/restore %d", turn), Checkpoint: target.Commit, FilesRemoved: removed})
+	debugf("checkpoint_restored turn=%d commit=%q removed=%d", turn, target.Commit, removed)
+	fmt.Fprintf(s.out, "Restored working tree to checkpoint %d (%s); removed %d file(s) created since.\n", turn, target.Commit[:12], removed)
+	s.addNote(fmt.Sprintf("Note: the user restored the workspace to its state at the start of turn %d. Files changed since then were reverted; re-read files before editing them.", turn))
+	return nil
+}
+
+func previewText(text string, maxChars int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= maxChars {
+		return text
+	}
+	return string(runes[:maxChars-1]) + "…"
+}
+
+func truncateOutput(output []byte, maxBytes int) (string, bool) {
+	if maxBytes < 1 {
+		maxBytes = defaultBashMaxOutputBytes
+	}
+	if len(output) <= maxBytes {
+		return string(output), false
+	}
+	return string(output[:maxBytes]), true
+}
+
+func (s *Session) listFiles(input json.RawMessage) (string, error) {
+	args := ListFilesInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", fmt.Errorf("invalid list_files input: %w", err)
+	}
+
+	recursive := true
+	if args.Recursive != nil {
+		recursive = *args.Recursive
+	}
+
+	maxEntries := defaultListFilesMaxEntries
+	if args.MaxEntries > 0 {
+		maxEntries = args.MaxEntries
+	}
+	if maxEntries > hardListFilesMaxEntries {
+		maxEntries = hardListFilesMaxEntries
+	}
+
+	absDir, displayPath, err := s.resolveWorkspaceDir(args.Path)
+	if err != nil {
+		return "", err
+	}
+	ignore := workspaceIgnore(s.root)
+	if ignore.Ignored(displayPath, true) {
+		return "", newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+
+	cacheKey := fmt.Sprintf("list\x00%s\x00%t\x00%d", absDir, recursive, maxEntries)
+	if s.cache.has(cacheKey) {
+		fmt.Fprintf(s.out, "Searched %s (unchanged, cached)\n", displayPath)
+		return fmt.Sprintf("The listing of %s is unchanged since you listed it earlier in this turn; reuse that result instead of listing it again.", displayPath), nil
+	}
+
+	entries, truncated, err := collectFileEntries(absDir, displayPath, recursive, maxEntries, ignore)
+	if err != nil {
+		return "", err
+	}
+	s.cache.put(cacheKey, absDir)
+
+	if truncated {
+		fmt.Fprintf(s.out, "Searched %s\nListed %d files (truncated at max_entries=%d)\n", displayPath, len(entries), maxEntries)
+	} else {
+		fmt.Fprintf(s.out, "Searched %s\nListed %d files\n", displayPath, len(entries))
+	}
+
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode list_files output: %w", err)
+	}
+
+	return string(encoded), nil
+}
+
+// ignoreRule is one compiled .coderignore pattern.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher applies .coderignore patterns (gitignore syntax) to
+// workspace-relative, slash-separated paths.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// cachedIgnore is a parsed .coderignore and the modification time it was
+// read at.
+type cachedIgnore struct {
+	matcher *ignoreMatcher
+	modTime time.Time
+}
+
+var (
+	coderIgnoreMu    sync.Mutex
+	coderIgnoreCache = map[string]cachedIgnore{}
+)
+
+// workspaceIgnore returns the matcher for the .coderignore of the workspace
+// at root, re-reading the file when it changes. It returns nil when there is
+// no .coderignore.
+func workspaceIgnore(root string) *ignoreMatcher {
+	path := filepath.Join(root, coderIgnoreName)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	coderIgnoreMu.Lock()
+	defer coderIgnoreMu.Unlock()
+	if cached, ok := coderIgnoreCache[path]; ok && info.ModTime().Equal(cached.modTime) {
+		return cached.matcher
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		debugf("coderignore_read_failed error=%q", err.Error())
+		return nil
+	}
+	matcher := parseIgnorePatterns(string(data))
+	coderIgnoreCache[path] = cachedIgnore{matcher: matcher, modTime: info.ModTime()}
+	return matcher
+}
+
+func parseIgnorePatterns(text string) *ignoreMatcher {
+	m := &ignoreMatcher{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasSuffix(line, "\\ ") {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// Like git, a pattern with a slash anywhere but the end is anchored
+		// at the workspace root; otherwise it matches at any depth.
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		re, err := regexp.Compile(globToRegexp(line, anchored))
+		if err != nil {
+			debugf("coderignore_bad_pattern pattern=%q error=%q", line, err.Error())
+			continue
+		}
+		rule.re = re
+		m.rules = append(m.rules, rule)
+	}
+	return m
+}
+
+func globToRegexp(pattern string, anchored bool) string {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern) && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Ignored reports whether rel (workspace-relative, slash-separated) is
+// excluded. As in git, a path inside an excluded directory stays excluded
+// even if a later pattern negates the path itself.
+func (m *ignoreMatcher) Ignored(rel string, isDir bool) bool {
+	if m == nil || len(m.rules) == 0 {
+		return false
+	}
+	rel = strings.Trim(rel, "/")
+	if rel == "" || rel == "." {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		last := i == len(parts)-1
+		if m.matches(prefix, !last || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ignoreMatcher) matches(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func joinDisplayPath(display, rel string) string {
+	if display == "" || display == "." {
+		return rel
+	}
+	return display + "/" + rel
+}
+
+// collectFileEntries lists dir (shown to the model as display), skipping
+// anything matched by ignore.
+func collectFileEntries(dir, display string, recursive bool, maxEntries int, ignore *ignoreMatcher) ([]string, bool, error) {
+	if maxEntries < 1 {
+		maxEntries = defaultListFilesMaxEntries
+	}
+
+	entries := make([]string, 0, min(maxEntries, 128))
+	truncated := false
+
+	if recursive {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			if path == dir {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if ignore.Ignored(joinDisplayPath(display, rel), d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				rel += "/"
+			}
+			entries = append(entries, rel)
+
+			if len(entries) >= maxEntries {
+				truncated = true
+				return errListLimitReached
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errListLimitReached) {
+			return nil, false, err
+		}
+	} else {
+		dirEntries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, entry := range dirEntries {
+			name := entry.Name()
+			if ignore.Ignored(joinDisplayPath(display, name), entry.IsDir()) {
+				continue
+			}
+			if entry.IsDir() {
+				name += "/"
+			}
+			entries = append(entries, filepath.ToSlash(name))
+			if len(entries) >= maxEntries {
+				truncated = true
+				break
+			}
+		}
+	}
+
+	sort.Strings(entries)
+	return entries, truncated, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var (
+	metrics = newMetricsRegistry()
+
+	apiLatencyBuckets  = []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120}
+	toolLatencyBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 15, 30, 60, 120}
+)
+
+// histogram is a cumulative Prometheus-style histogram.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metricsRegistry collects process-wide counters and histograms and renders
+// them in the Prometheus text exposition format.
+type metricsRegistry struct {
+	mu           sync.Mutex
+	apiCalls     map[string]uint64
+	apiLatency   map[string]*histogram
+	tokens       map[string]uint64
+	toolCalls    map[string]uint64
+	toolFailures map[string]uint64
+	toolLatency  map[string]*histogram
+	retries      uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		apiCalls:     make(map[string]uint64),
+		apiLatency:   make(map[string]*histogram),
+		tokens:       make(map[string]uint64),
+		toolCalls:    make(map[string]uint64),
+		toolFailures: make(map[string]uint64),
+		toolLatency:  make(map[string]*histogram),
+	}
+}
+
+func (m *metricsRegistry) observeAPICall(modelID string, latency time.Duration, message *anthropic.Message, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.apiCalls[labels("model", modelID, "outcome", outcome)]++
+	key := labels("model", modelID)
+	h, ok := m.apiLatency[key]
+	if !ok {
+		h = newHistogram(apiLatencyBuckets)
+		m.apiLatency[key] = h
+	}
+	h.observe(latency.Seconds())
+	if message != nil {
+		m.tokens[labels("model", modelID, "direction", "input")] += uint64(message.Usage.InputTokens)
+		m.tokens[labels("model", modelID, "direction", "output")] += uint64(message.Usage.OutputTokens)
+	}
+}
+
+func (m *metricsRegistry) observeToolCall(toolName string, latency time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := labels("tool", toolName)
+	m.toolCalls[key]++
+	if failed {
+		m.toolFailures[key]++
+	}
+	h, ok := m.toolLatency[key]
+	if !ok {
+		h = newHistogram(toolLatencyBuckets)
+		m.toolLatency[key] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+func (m *metricsRegistry) observeRetry() {
+	m.mu.Lock()
+	m.retries++
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeCounter(w, "coder_api_requests_total", "Messages API calls by model and outcome.", m.apiCalls)
+	writeHistogram(w, "coder_api_request_duration_seconds", "Messages API call latency, including SDK retries.", m.apiLatency)
+	writeCounter(w, "coder_tokens_total", "Tokens reported by the API by model and direction.", m.tokens)
+	writeCounter(w, "coder_api_retries_total", "HTTP retries performed by the API client.", map[string]uint64{"": m.retries})
+	writeCounter(w, "coder_tool_calls_total", "Tool invocations by tool name.", m.toolCalls)
+	writeCounter(w, "coder_tool_failures_total", "Tool invocations that returned an error, by tool name.", m.toolFailures)
+	writeHistogram(w, "coder_tool_duration_seconds", "Tool execution latency by tool name.", m.toolLatency)
+}
+
+// labels renders key/value pairs as a Prometheus label set body, e.g.
+// model="x",outcome="ok".
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, pairs[i]+`="`+value+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, key := range sortedKeys(values) {
+		if key == "" {
+			fmt.Fprintf(w, "%s %d\n", name, values[key])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, key, values[key])
+		}
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, values map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range sortedKeys(values) {
+		h := values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, strconv.FormatFloat(upper, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, key, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, key, h.count)
+	}
+}
+
+// countRetries is API client middleware that counts every retried attempt.
+func countRetries(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+	if n := req.Header.Get("X-Stainless-Retry-Count"); n != "" && n != "0" {
+		metrics.observeRetry()
+		debugf("api_retry attempt=%s", n)
+	}
+	return next(req)
+}
+
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.writeTo(w)
+	})
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "Metrics server error: %v\n", err)
+		}
+	}()
+	debugf("metrics_server_started addr=%q", addr)
+}
+
+// formatAssistantText prepares an assistant reply for the terminal: markdown
+// outside code blocks is rendered and fenced code blocks are highlighted,
+// each when enabled.
+func formatAssistantText(text string, cfg Config) string {
+	if !cfg.Highlight && !cfg.Markdown {
+		return text
+	}
+	width := terminalWidth()
+	var out, code, prose []string
+	flushProse := func() {
+		if cfg.Markdown {
+			out = append(out, renderMarkdown(prose, width)...)
+		} else {
+			out = append(out, prose...)
+		}
+		prose = nil
+	}
+	flushCode := func(lang string) {
+		block := strings.Join(code, "\n")
+		if cfg.Highlight {
+			block = highlightCode(block, lang)
+		}
+		out = append(out, block)
+		code = nil
+	}
+
+	inFence := false
+	fence, lang := "", ""
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if !inFence {
+			if marker := fenceMarker(trimmed); marker != "" && len(line)-len(trimmed) <= 3 {
+				flushProse()
+				inFence, fence = true, marker
+				lang = strings.ToLower(strings.TrimSpace(strings.TrimLeft(trimmed, marker[:1])))
+				out = append(out, commentColor+line+colorReset)
+				continue
+			}
+			prose = append(prose, line)
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])) == "" {
+			flushCode(lang)
+			out = append(out, commentColor+line+colorReset)
+			inFence = false
+			continue
+		}
+		code = append(code, line)
+	}
+	if inFence {
+		flushCode(lang)
+	}
+	flushProse()
+	return strings.Join(out, "\n")
+}
+
+// fenceMarker returns the run of backticks or tildes opening a fenced code
+// block, or "" if line does not open one.
+func fenceMarker(line string) string {
+	for _, ch := range []string{"`", "~"} {
+		n := len(line) - len(strings.TrimLeft(line, ch))
+		if n >= 3 {
+			return line[:n]
+		}
+	}
+	return ""
+}
+
+var (
+	headingPattern    = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	listItemPattern   = regexp.MustCompile(`^(\s*)([-*+]|\d{1,3}[.)])\s+(.*)$`)
+	rulePattern       = regexp.MustCompile(`^\s{0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	tableSepPattern   = regexp.MustCompile(`^\s*\|?\s*:?-{3,}:?\s*(\|\s*:?-{3,}:?\s*)*\|?\s*$`)
+	inlineCodeSpan    = regexp.MustCompile("`([^`]+)`")
+	boldSpan          = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	italicSpan        = regexp.MustCompile(`(^|[^\w*])\*([^*\s][^*]*)\*|(^|[^\w_])_([^_\s][^_]*)_`)
+	linkSpan          = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	ansiEscapePattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// renderMarkdown formats markdown prose for the terminal: headings, lists,
+// quotes, rules, tables, and inline emphasis, wrapped to width.
+func renderMarkdown(lines []string, width int) []string {
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			out = append(out, "")
+		case strings.HasPrefix(trimmed, "|") && i+1 < len(lines) && tableSepPattern.MatchString(lines[i+1]):
+			end := i + 2
+			for end < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[end]), "|") {
+				end++
+			}
+			out = append(out, renderTable(lines[i:end], width)...)
+			i = end - 1
+		case headingPattern.MatchString(trimmed):
+			m := headingPattern.FindStringSubmatch(trimmed)
+			heading := boldOn + renderInline(m[2]) + boldOff
+			if len(m[1]) == 1 {
+				heading = underlineOn + heading + underlineOff
+			}
+			out = append(out, wrapText(heading, width, "", "")...)
+		case rulePattern.MatchString(line):
+			out = append(out, commentColor+strings.Repeat("─", min(width, 40))+colorReset)
+		case listItemPattern.MatchString(line):
+			m := listItemPattern.FindStringSubmatch(line)
+			indent := strings.Repeat(" ", len(strings.ReplaceAll(m[1], "\t", "  ")))
+			marker := m[2]
+			if strings.ContainsAny(marker, "-*+") {
+				marker = "•"
+			}
+			first := indent + marker + " "
+			out = append(out, wrapText(renderInline(m[3]), width, first, strings.Repeat(" ", visibleWidth(first)))...)
+		case strings.HasPrefix(trimmed, ">"):
+			quote := strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))
+			bar := commentColor + "│ " + colorReset
+			out = append(out, wrapText(italicOn+renderInline(quote)+italicOff, width, bar, bar)...)
+		default:
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			out = append(out, wrapText(renderInline(trimmed), width, indent, indent)...)
+		}
+	}
+	return out
+}
+
+// renderInline applies code spans, bold, italics, and links within a line.
+// Code spans are set aside first so markup inside them is left alone.
+func renderInline(text string) string {
+	var spans []string
+	text = inlineCodeSpan.ReplaceAllStringFunc(text, func(m string) string {
+		spans = append(spans, numberColor+m[1:len(m)-1]+defaultFg)
+		return fmt.Sprintf("\x00%d\x00", len(spans)-1)
+	})
+	text = linkSpan.ReplaceAllString(text, underlineOn+"$1"+underlineOff+" ($2)")
+	text = boldSpan.ReplaceAllString(text, boldOn+"$1$2"+boldOff)
+	text = italicSpan.ReplaceAllString(text, "$1$3"+italicOn+"$2$4"+italicOff)
+	for i, span := range spans {
+		text = strings.Replace(text, fmt.Sprintf("\x00%d\x00", i), span, 1)
+	}
+	return text
+}
+
+// renderTable aligns a markdown table into columns. Tables too wide for the
+// terminal are left as written.
+func renderTable(lines []string, width int) []string {
+	splitRow := func(line string) []string {
+		line = strings.TrimSpace(line)
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+		cells := strings.Split(line, "|")
+		for i := range cells {
+			cells[i] = renderInline(strings.TrimSpace(cells[i]))
+		}
+		return cells
+	}
+	header := splitRow(lines[0])
+	aligns := strings.Split(strings.Trim(strings.TrimSpace(lines[1]), "|"), "|")
+	rows := [][]string{header}
+	for _, line := range lines[2:] {
+		rows = append(rows, splitRow(line))
+	}
+
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for c := 0; c < len(row) && c < len(widths); c++ {
+			widths[c] = max(widths[c], visibleWidth(row[c]))
+		}
+	}
+	total := 0
+	for _, w := range widths {
+		total += w + 3
+	}
+	if total > width {
+		return lines
+	}
+
+	pad := func(cell string, c int) string {
+		gap := widths[c] - visibleWidth(cell)
+		align := ""
+		if c < len(aligns) {
+			align = strings.TrimSpace(aligns[c])
+		}
+		switch {
+		case strings.HasPrefix(align, ":") && strings.HasSuffix(align, ":"):
+			return strings.Repeat(" ", gap/2) + cell + strings.Repeat(" ", gap-gap/2)
+		case strings.HasSuffix(align, ":"):
+			return strings.Repeat(" ", gap) + cell
+		default:
+			return cell + strings.Repeat(" ", gap)
+		}
+	}
+	var out []string
+	for r, row := range rows {
+		cells := make([]string, len(widths))
+		for c := range widths {
+			cell := ""
+			if c < len(row) {
+				cell = row[c]
+			}
+			if r == 0 {
+				cell = boldOn + cell + boldOff
+			}
+			cells[c] = pad(cell, c)
+		}
+		out = append(out, strings.Join(cells, commentColor+" │ "+colorReset))
+		if r == 0 {
+			rules := make([]string, len(widths))
+			for c, w := range widths {
+				rules[c] = strings.Repeat("─", w)
+			}
+			out = append(out, commentColor+strings.Join(rules, "─┼─")+colorReset)
+		}
+	}
+	return out
+}
+
+// wrapText breaks text at spaces so no line exceeds width visible columns,
+// starting the first line with first and later lines with rest.
+func wrapText(text string, width int, first, rest string) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return []string{strings.TrimRight(first, " ")}
+	}
+	var lines []string
+	line := first + words[0]
+	for _, word := range words[1:] {
+		if visibleWidth(line)+1+visibleWidth(word) > width {
+			lines = append(lines, line)
+			line = rest + word
+			continue
+		}
+		line += " " + word
+	}
+	return append(lines, line)
+}
+
+func visibleWidth(text string) int {
+	return utf8.RuneCountInString(ansiEscapePattern.ReplaceAllString(text, ""))
+}
+
+// terminalWidth returns the width of the terminal on stdout, honoring
+// $COLUMNS, or 100 when it cannot be determined.
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return max(columns, 20)
+	}
+	columns, ok := stdoutColumns()
+	if !ok {
+		return 100
+	}
+	return max(columns, 20)
+}
+
+type syntaxRules struct {
+	keywords     map[string]bool
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+}
+
+func keywordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+var (
+	cLikeKeywords = "if else for while do switch case default break continue return goto struct union enum typedef const static extern void int char long short float double unsigned signed sizeof true false null"
+	goSyntax      = &syntaxRules{
+		keywords:     keywordSet("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota error string int int64 uint8 byte rune bool float64 any"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	}
+	pythonSyntax = &syntaxRules{
+		keywords:     keywordSet("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	jsSyntax = &syntaxRules{
+		keywords:     keywordSet("async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof let new of return super switch this throw try typeof var void while yield null undefined true false interface type enum implements readonly"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	}
+	rustSyntax = &syntaxRules{
+		keywords:     keywordSet("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while Some None Ok Err"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"",
+	}
+	cSyntax = &syntaxRules{
+		keywords:     keywordSet(cLikeKeywords + " class public private protected new delete this try catch throw namespace template typename virtual override final package import extends implements interface boolean String var val fun"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+	}
+	shellSyntax = &syntaxRules{
+		keywords:     keywordSet("if then else elif fi for in do done while until case esac function return local export set unset echo exit"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	sqlSyntax = &syntaxRules{
+		keywords:     keywordSet("select from where and or not insert into values update set delete create table index drop alter join left right inner outer on group by order limit having as null is in like distinct union primary key SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE INDEX DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER LIMIT HAVING AS NULL IS IN LIKE DISTINCT UNION PRIMARY KEY"),
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "'\"",
+	}
+	dataSyntax = &syntaxRules{
+		keywords:     keywordSet("true false null yes no"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	rubySyntax = &syntaxRules{
+		keywords:     keywordSet("alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require attr_reader attr_accessor"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+
+	syntaxByLanguage = map[string]*syntaxRules{
+		"go": goSyntax, "golang": goSyntax,
+		"python": pythonSyntax, "py": pythonSyntax, "python3": pythonSyntax,
+		"javascript": jsSyntax, "js": jsSyntax, "jsx": jsSyntax, "typescript": jsSyntax, "ts": jsSyntax, "tsx": jsSyntax,
+		"rust": rustSyntax, "rs": rustSyntax,
+		"c": cSyntax, "h": cSyntax, "cpp": cSyntax, "c++": cSyntax, "cs": cSyntax, "csharp": cSyntax, "java": cSyntax, "kotlin": cSyntax, "swift": cSyntax,
+		"sh": shellSyntax, "bash": shellSyntax, "shell": shellSyntax, "zsh": shellSyntax, "console": shellSyntax,
+		"sql":  sqlSyntax,
+		"json": dataSyntax, "yaml": dataSyntax, "yml": dataSyntax, "toml": dataSyntax,
+		"ruby": rubySyntax, "rb": rubySyntax,
+	}
+)
+
+// highlightCode colors keywords, strings, comments, and numbers in code using
+// a small per-language rule set. Unknown languages are returned unchanged.
+func highlightCode(code, lang string) string {
+	rules, ok := syntaxByLanguage[lang]
+	if !ok {
+		return code
+	}
+	var b strings.Builder
+	paint := func(color, text string) {
+		// Color each line separately so a reset always precedes the newline.
+		for i, part := range strings.Split(text, "\n") {
+			if i > 0 {
+				b.WriteByte('\n')
+			}
+			if part != "" {
+				b.WriteString(color + part + colorReset)
+			}
+		}
+	}
+	isIdent := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		if open := rules.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := strings.Index(rest[len(open):], rules.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(open) + end + len(rules.blockComment[1])
+			}
+			paint(commentColor, rest[:n])
+			i += n
+			continue
+		}
+		// A # only starts a comment at the beginning of a word, so $# and
+		// URL fragments are left alone.
+		if matchesAnyPrefix(rest, rules.lineComments) && (rest[0] != '#' || i == 0 || strings.IndexByte(" \t\n", code[i-1]) >= 0) {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			paint(commentColor, rest[:n])
+			i += n
+			continue
+		}
+		c := code[i]
+		switch {
+		case strings.IndexByte(rules.quotes, c) >= 0:
+			n := 1
+			for n < len(rest) && rest[n] != c {
+				if rest[n] == '\\' && c != '`' {
+					n++
+				} else if rest[n] == '\n' && c != '`' {
+					break
+				}
+				n++
+			}
+			n = min(n+1, len(rest))
+			paint(stringColor, rest[:n])
+			i += n
+		case c >= '0' && c <= '9' && (i == 0 || !isIdent(code[i-1])):
+			n := 1
+			for n < len(rest) && (isIdent(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			paint(numberColor, rest[:n])
+			i += n
+		case isIdent(c):
+			n := 1
+			for n < len(rest) && isIdent(rest[n]) {
+				n++
+			}
+			if rules.keywords[rest[:n]] {
+				paint(keywordColor, rest[:n])
+			} else {
+				b.WriteString(rest[:n])
+			}
+			i += n
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+func matchesAnyPrefix(text string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func colorLabel(label, color string, colorEnabled bool) string {
+	if !colorEnabled {
+		return label
+	}
+	return color + label + colorReset
+}
+
+func userPrefix(colorEnabled bool) string {
+	if !colorEnabled {
+		return "User: "
+	}
+	return userColor + "User: " + colorReset
+}
+
+func assistantPrefix(assistantName, modelName string, colorEnabled bool) string {
+	prefix := fmt.Sprintf("%s (%s): ", assistantName, modelName)
+	if !colorEnabled {
+		return prefix
+	}
+	return claudeColor + prefix + colorReset
+}
+
+func modelDisplayName(modelID string) string {
+	if modelID == defaultModelID {
+		return defaultModelName
+	}
+	return modelID
+}
+
+func supportsColor(output *os.File) bool {
+	if output == nil || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	term := strings.ToLower(strings.TrimSpace(os.Getenv("TERM")))
+	if term == "" || term == "dumb" {
+		return false
+	}
+	info, err := output.Stat()
+	if err != nil {
+		return false
+	}
+	return (info.Mode() & os.ModeCharDevice) != 0
+}
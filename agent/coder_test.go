@@ -0,0 +1,336 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 16; i++ {
+		lines = append(lines, fmt.Sprint(i))
+	}
+	numbers := strings.Join(lines, "\n") + "\n"
+	replace := func(pairs ...string) string {
+		return strings.NewReplacer(pairs...).Replace(numbers)
+	}
+
+	tests := []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{
+			name:   "close changes share a hunk",
+			before: numbers,
+			after:  replace("\n2\n", "\ntwo\n", "\n9\n", "\nnine\n"),
+			want:   "@@ -1,12 +1,12 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+nine\n 10\n 11\n 12\n",
+		},
+		{
+			name:   "distant changes get their own hunks",
+			before: numbers,
+			after:  replace("\n2\n", "\ntwo\n", "\n10\n", "\nten\n"),
+			want:   "@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n@@ -7,7 +7,7 @@\n 7\n 8\n 9\n-10\n+ten\n 11\n 12\n 13\n",
+		},
+		{
+			name:   "insertion",
+			before: "a\nb\nc\n",
+			after:  "a\nb\nnew\nc\n",
+			want:   "@@ -1,3 +1,4 @@\n a\n b\n+new\n c\n",
+		},
+		{
+			name:   "new file",
+			before: "",
+			after:  "x\n",
+			want:   "@@ -0,0 +1,1 @@\n+x\n",
+		},
+		{
+			name:   "emptied file",
+			before: "x\n",
+			after:  "",
+			want:   "@@ -1,1 +0,0 @@\n-x\n",
+		},
+		{
+			name:   "moved line",
+			before: "a\nb\nc\nd\n",
+			after:  "b\nc\na\nd\n",
+			want:   "@@ -1,4 +1,4 @@\n-a\n b\n c\n+a\n d\n",
+		},
+	}
+	for _, tc := range tests {
+		got := unifiedDiff("f.txt", []byte(tc.before), []byte(tc.after), 1<<20)
+		want := "--- a/f.txt\n+++ b/f.txt\n" + tc.want
+		if got != want {
+			t.Errorf("%s: unifiedDiff =\n%s\nwant\n%s", tc.name, got, want)
+		}
+	}
+
+	if got := unifiedDiff("f.txt", []byte(numbers), []byte(numbers), 1<<20); got != "--- a/f.txt\n+++ b/f.txt\n" {
+		t.Errorf("unifiedDiff of identical content = %q, want only the header", got)
+	}
+}
+
+func TestUnifiedDiffTruncates(t *testing.T) {
+	before := strings.Repeat("old line\n", 200)
+	after := strings.Repeat("new line\n", 200)
+	got := unifiedDiff("f.txt", []byte(before), []byte(after), 100)
+	if !strings.HasSuffix(got, "\n... (diff truncated)\n") || len(got) > 100+len("\n... (diff truncated)\n") {
+		t.Errorf("unifiedDiff with a 100-byte cap = %q", got)
+	}
+}
+
+func TestUnifiedDiffLargeChange(t *testing.T) {
+	var before, after strings.Builder
+	for i := range 3000 {
+		fmt.Fprintf(&before, "before %d\n", i)
+		fmt.Fprintf(&after, "after %d\n", i)
+	}
+	got := unifiedDiff("f.txt", []byte("same\n"+before.String()), []byte("same\n"+after.String()), 1<<30)
+	if !strings.Contains(got, "@@ -1,3001 +1,3001 @@\n same\n-before 0\n") || !strings.HasSuffix(got, "+after 2999\n") {
+		t.Errorf("unifiedDiff of a change too large to compare line by line starts %q", previewText(got, 200))
+	}
+}
+
+// blockingProvider waits for the request to be cancelled.
+type blockingProvider struct{ started chan struct{} }
+
+func (p blockingProvider) Name() string { return "blocking" }
+
+func (p blockingProvider) Send(ctx context.Context, req ProviderRequest) (*anthropic.Message, string, error) {
+	close(p.started)
+	<-ctx.Done()
+	return nil, "", ctx.Err()
+}
+
+func TestCancelRunningTurn(t *testing.T) {
+	a, err := New(Config{Dir: t.TempDir(), Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	provider := blockingProvider{started: make(chan struct{})}
+	a.Provider = provider
+	if a.Session.cancelRunningTurn() {
+		t.Error("cancelRunningTurn reported a turn before one started")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Run(context.Background(), "hello")
+		done <- err
+	}()
+	<-provider.started
+	if !a.Session.cancelRunningTurn() {
+		t.Fatal("cancelRunningTurn found no turn while a request was in flight")
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the turn did not stop after it was cancelled")
+	}
+	if a.Session.cancelRunningTurn() {
+		t.Error("cancelRunningTurn reported a turn after it ended")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// failingBody returns an error partway through a response body.
+type failingBody struct{}
+
+func (failingBody) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+func (failingBody) Close() error             { return nil }
+
+func TestTraceTransport(t *testing.T) {
+	dir := t.TempDir()
+	// 0002 was deleted, so numbering continues after 0003, not after the
+	// two files that remain.
+	for _, name := range []string{"0001-request.json", "0003-request.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trace, err := newTraceTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace.base = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: failingBody{}}, nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "https://api.example.com/v1/messages", strings.NewReader(`{"model":"m"}`))
+	resp, err := trace.RoundTrip(req)
+	if err == nil || resp != nil {
+		t.Errorf("RoundTrip with a failing response body = %v, %v; want no response and the error", resp, err)
+	}
+	for _, name := range []string{"0004-request.json", "0004-response.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("trace file %s was not written: %v", name, err)
+		}
+	}
+}
+
+func TestUndoTurnAfterCompact(t *testing.T) {
+	a, err := New(Config{Dir: t.TempDir(), Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	s := a.Session
+	s.turn = 3
+	s.history = []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock(compactSummaryHeader + "We renamed the config loader.")),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock("Understood. I'll continue from this summary.")),
+		anthropic.NewUserMessage(anthropic.NewTextBlock("now add a test")),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock("Added.")),
+	}
+
+	if err := s.undoTurn(false); err != nil {
+		t.Fatalf("undoTurn: %v", err)
+	}
+	if len(s.history) != 2 || firstUserText(s.history) != compactSummaryHeader+"We renamed the config loader." {
+		t.Fatalf("history after undo = %d messages, want only the summary exchange", len(s.history))
+	}
+	// The summary is not a prompt the user typed, so there is nothing left
+	// to undo.
+	if err := s.undoTurn(false); err == nil {
+		t.Error("undoTurn removed the compacted summary")
+	}
+	if len(s.history) != 2 {
+		t.Errorf("history has %d messages, want the summary exchange kept", len(s.history))
+	}
+}
+
+func TestRunHookEnvironment(t *testing.T) {
+	t.Setenv("CODER_TEST_API_TOKEN", "hook-should-not-see-this")
+	a, err := New(Config{Dir: t.TempDir(), Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	hook := HookConfig{Command: `echo "token=[$CODER_TEST_API_TOKEN] tool=$CODER_TOOL_NAME"`}
+	output, _, err := a.Session.runHook("pre_tool", hook, ToolUse{Name: "bash", Input: json.RawMessage(`{}`)}, "", false)
+	if err != nil {
+		t.Fatalf("runHook: %v", err)
+	}
+	// bash -l may print whatever the login profile does first.
+	if !strings.HasSuffix(output, "token=[] tool=bash") {
+		t.Errorf("hook output = %q, want the agent's secrets left out and the hook variables set", output)
+	}
+}
+
+func TestMoveFileRespectsCoderignore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		coderIgnoreName:   "secrets/\n*.pem\n",
+		"secrets/api.txt": "token\n",
+		"server.pem":      "key\n",
+		"config/tls.pem":  "key\n",
+		"config/app.yaml": "port: 80\n",
+		"notes.txt":       "notes\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := New(Config{Dir: dir, Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	move := func(source, destination string) error {
+		input, _ := json.Marshal(map[string]string{"source": source, "destination": destination})
+		_, err := a.Session.moveFile(input)
+		return err
+	}
+
+	refused := [][2]string{
+		{"secrets/api.txt", "api.txt"},
+		{"server.pem", "server.txt"},
+		{"notes.txt", "notes.pem"},
+		{"notes.txt", "secrets/notes.txt"},
+		{"config", "settings"},
+	}
+	for _, m := range refused {
+		if err := move(m[0], m[1]); err == nil || !strings.Contains(err.Error(), coderIgnoreName) {
+			t.Errorf("move_file %s -> %s = %v, want it refused for %s", m[0], m[1], err, coderIgnoreName)
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(m[0]))); err != nil {
+			t.Errorf("%s was moved: %v", m[0], err)
+		}
+	}
+	if err := move("notes.txt", "docs/notes.txt"); err != nil {
+		t.Errorf("move_file of a file that is not excluded: %v", err)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		coderIgnoreName:   ".env\n",
+		".env":            "API_KEY=secret\n",
+		"pages/[id].tsx":  "export default Page\n",
+		"pages/index.tsx": "export default Home\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := New(Config{Dir: dir, Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var events []Event
+	a.Session.OnEvent = func(e Event) { events = append(events, e) }
+	deleteFile := func(path string) error {
+		input, _ := json.Marshal(map[string]string{"path": path})
+		_, err := a.Session.deleteFile(input)
+		return err
+	}
+
+	if err := deleteFile(".env"); err == nil || !strings.Contains(err.Error(), coderIgnoreName) {
+		t.Errorf("delete_file of an excluded file = %v, want it refused", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("refused delete emitted %d event(s)", len(events))
+	}
+	if err := deleteFile("pages/[id].tsx"); err != nil {
+		t.Errorf("delete_file of a file named with brackets: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pages", "[id].tsx")); !os.IsNotExist(err) {
+		t.Errorf("pages/[id].tsx still exists: %v", err)
+	}
+	if err := deleteFile("pages/*.tsx"); err == nil || !strings.Contains(err.Error(), "not expanded") {
+		t.Errorf("delete_file of a glob = %v, want a hint that globs are not expanded", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pages", "index.tsx")); err != nil {
+		t.Errorf("a glob deleted pages/index.tsx: %v", err)
+	}
+}
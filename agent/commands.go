@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// customCommand is a slash command defined by a markdown file under
+// .coder/commands/: its body is the prompt, and optional frontmatter gives a
+// description, argument hint, model, and the tools the turn may use.
+//
+//	---
+//	description: Review the staged changes
+//	allowed-tools: read_files, bash
+//	model: claude-opus-4-5
+//	---
+//	Review the output of `git diff --cached`. Focus on {{args}}.
+type customCommand struct {
+	Name         string
+	Description  string
+	ArgumentHint string
+	Model        string
+	AllowedTools []string
+	Body         string
+}
+
+// queuedPrompt is a prompt a slash command queued to be sent as the next
+// turn, optionally on another model or with fewer tools.
+type queuedPrompt struct {
+	Prompt       string
+	Model        string
+	AllowedTools []string
+}
+
+// loadCustomCommands reads the command files in .coder/commands. Files that
+// cannot be parsed or whose names clash with a built-in command are skipped
+// with a warning.
+func loadCustomCommands() []customCommand {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join(cwd, coderDirName, commandsDirName, "*.md"))
+	sort.Strings(paths)
+	builtin := map[string]bool{"quit": true, "exit": true}
+	for _, cmd := range slashCommands() {
+		builtin[cmd.Name] = true
+	}
+	var commands []customCommand
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".md")
+		rel := filepath.Join(coderDirName, commandsDirName, filepath.Base(path))
+		if !validMemoryName(name) || builtin[name] {
+			fmt.Fprintf(os.Stderr, "Skipping custom command %s: /%s is not a valid new command name\n", rel, name)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping custom command %s: %v\n", rel, err)
+			continue
+		}
+		cmd, err := parseCustomCommand(name, string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping custom command %s: %v\n", rel, err)
+			continue
+		}
+		commands = append(commands, cmd)
+	}
+	debugf("custom_commands_loaded count=%d", len(commands))
+	return commands
+}
+
+// parseCustomCommand splits a command file into its frontmatter and prompt.
+func parseCustomCommand(name, text string) (customCommand, error) {
+	cmd := customCommand{Name: name}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if rest, ok := strings.CutPrefix(text, "---\n"); ok {
+		front, body, found := strings.Cut(rest, "\n---\n")
+		if !found {
+			front, found = strings.CutSuffix(rest, "\n---")
+		}
+		if !found {
+			return cmd, fmt.Errorf("frontmatter has no closing ---")
+		}
+		text = body
+		var listKey string
+		for _, line := range strings.Split(front, "\n") {
+			if item, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok && listKey != "" {
+				cmd.AllowedTools = append(cmd.AllowedTools, strings.Trim(strings.TrimSpace(item), `"'`))
+				continue
+			}
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				return cmd, fmt.Errorf("frontmatter line %q is not key: value", line)
+			}
+			key, value = strings.TrimSpace(key), strings.Trim(strings.TrimSpace(value), `"'`)
+			listKey = ""
+			switch key {
+			case "description":
+				cmd.Description = value
+			case "argument-hint":
+				cmd.ArgumentHint = value
+			case "model":
+				cmd.Model = value
+			case "allowed-tools", "allowed_tools":
+				if value == "" {
+					listKey = key
+					continue
+				}
+				for _, tool := range strings.Split(strings.Trim(value, "[]"), ",") {
+					if tool = strings.Trim(strings.TrimSpace(tool), `"'`); tool != "" {
+						cmd.AllowedTools = append(cmd.AllowedTools, tool)
+					}
+				}
+			default:
+				debugf("custom_command_unknown_key command=%q key=%q", name, key)
+			}
+		}
+	}
+	cmd.Body = strings.TrimSpace(text)
+	if cmd.Body == "" {
+		return cmd, fmt.Errorf("the prompt is empty")
+	}
+	if cmd.Description == "" {
+		line, _, _ := strings.Cut(cmd.Body, "\n")
+		cmd.Description = previewText(line, 60)
+	}
+	return cmd, nil
+}
+
+// run queues the command's prompt, with args filled in, as the next turn.
+// $ARGUMENTS is accepted as another spelling of {{args}}; a prompt without
+// placeholders gets the arguments appended.
+func (c customCommand) run(s *Session, args string) error {
+	body := strings.ReplaceAll(c.Body, "$ARGUMENTS", "{{args}}")
+	if args != "" && !promptPlaceholder.MatchString(body) {
+		body += "\n\n{{args}}"
+	}
+	prompt, err := expandPromptTemplate(body, args)
+	if err != nil {
+		return fmt.Errorf("/%s: %w", c.Name, err)
+	}
+	s.pendingPrompt = &queuedPrompt{Prompt: prompt, Model: c.Model, AllowedTools: c.AllowedTools}
+	return nil
+}
+
+func (c customCommand) usage() string {
+	if c.ArgumentHint != "" {
+		return "/" + c.Name + " " + c.ArgumentHint
+	}
+	return "/" + c.Name
+}
+
+// turnSetup returns the config and tools for the queued turn: the session's,
+// with the model replaced and the tools narrowed as the command asked.
+func (q *queuedPrompt) turnSetup(cfg Config, toolMap map[string]Tool, tools []anthropic.ToolUnionParam) (Config, map[string]Tool, []anthropic.ToolUnionParam, error) {
+	if q.Model != "" {
+		cfg.ModelID, cfg.ModelName = q.Model, modelDisplayName(q.Model)
+	}
+	if len(q.AllowedTools) == 0 {
+		return cfg, toolMap, tools, nil
+	}
+	allowed := make(map[string]bool, len(q.AllowedTools))
+	for _, name := range q.AllowedTools {
+		if _, ok := toolMap[name]; !ok {
+			return cfg, nil, nil, fmt.Errorf("allowed-tools names unknown or disabled tool %s", name)
+		}
+		allowed[name] = true
+	}
+	narrowedMap := make(map[string]Tool, len(allowed))
+	var narrowed []anthropic.ToolUnionParam
+	for _, tool := range tools {
+		if name := tool.GetName(); name != nil && allowed[*name] {
+			narrowedMap[*name] = toolMap[*name]
+			narrowed = append(narrowed, tool)
+		}
+	}
+	return cfg, narrowedMap, narrowed, nil
+}
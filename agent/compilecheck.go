@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pythonSyntaxCheck compiles the file named by its argument and prints just
+// the error, without the traceback of the check itself.
+const pythonSyntaxCheck = `import sys, traceback
+try:
+    compile(open(sys.argv[1], "rb").read(), sys.argv[1], "exec")
+except SyntaxError as e:
+    sys.exit("".join(traceback.format_exception_only(type(e), e)).rstrip())
+`
+
+const (
+	compileCheckTimeout   = time.Minute
+	maxCompileCheckOutput = 4 << 10
+)
+
+// compileCheck is one syntax or compile check covering files a tool call
+// wrote: a Go package, or a single Python, TypeScript, or JavaScript file.
+type compileCheck struct {
+	// Label names what was checked, such as ./internal/server or app/views.py.
+	Label string
+	// Command is how the check is shown to the model.
+	Command string
+	Dir     string
+	Name    string
+	Args    []string
+}
+
+// compileChecksFor returns the checks for the files written in the workspace
+// at root, one per Go package. Files in other languages, and those whose
+// checker is not installed, get none.
+func compileChecksFor(root string, absFiles []string) []compileCheck {
+	var checks []compileCheck
+	goPackages := map[string]bool{}
+	goTests := map[string]bool{}
+	python, node := pythonCommand(), ""
+	if _, err := exec.LookPath("node"); err == nil {
+		node = "node"
+	}
+	for _, absFile := range absFiles {
+		display := workspaceRelative(root, absFile)
+		switch ext := strings.ToLower(filepath.Ext(absFile)); ext {
+		case ".go":
+			dir := filepath.Dir(absFile)
+			goPackages[dir] = true
+			if strings.HasSuffix(absFile, "_test.go") {
+				goTests[dir] = true
+			}
+		case ".py":
+			if python == "" {
+				continue
+			}
+			// compile() rather than py_compile, which leaves __pycache__
+			// directories in the workspace.
+			checks = append(checks, compileCheck{Label: display, Command: python + " compile()", Dir: root, Name: python, Args: []string{
+				"-c", pythonSyntaxCheck, display,
+			}})
+		case ".ts", ".tsx", ".mts", ".cts":
+			tsc := typeScriptCompiler(root)
+			if tsc == "" {
+				continue
+			}
+			// Checked on its own, so without the project's tsconfig; the
+			// flags keep modern syntax and JSX from being reported.
+			checks = append(checks, compileCheck{Label: display, Command: "tsc --noEmit", Dir: root, Name: tsc, Args: []string{
+				"--noEmit", "--skipLibCheck", "--target", "es2022", "--module", "esnext", "--moduleResolution", "node", "--jsx", "preserve", "--esModuleInterop", display,
+			}})
+		case ".js", ".mjs", ".cjs":
+			if node == "" {
+				continue
+			}
+			checks = append(checks, compileCheck{Label: display, Command: "node --check", Dir: root, Name: node, Args: []string{"--check", display}})
+		}
+	}
+	if len(goPackages) > 0 {
+		if _, err := exec.LookPath("go"); err == nil {
+			for _, dir := range sortedKeys(goPackages) {
+				label := "./" + workspaceRelative(root, dir)
+				if label == "./." {
+					label = "."
+				}
+				// go test -run with no match compiles the package's tests too
+				// without running any.
+				args := []string{"build", "-o", os.DevNull, "."}
+				if goTests[dir] {
+					args = []string{"test", "-count=1", "-vet=off", "-run", "^$", "."}
+				}
+				checks = append(checks, compileCheck{Label: label, Command: "go " + strings.Join(args[:len(args)-1], " "), Dir: dir, Name: "go", Args: args})
+			}
+		}
+	}
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].Label < checks[j].Label })
+	return checks
+}
+
+func pythonCommand() string {
+	for _, name := range []string{"python3", "python"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// typeScriptCompiler prefers the project's own tsc over one on the PATH.
+func typeScriptCompiler(root string) string {
+	local := filepath.Join(root, "node_modules", ".bin", "tsc")
+	if _, err := os.Stat(local); err == nil {
+		return local
+	}
+	if _, err := exec.LookPath("tsc"); err == nil {
+		return "tsc"
+	}
+	return ""
+}
+
+// runCompileChecks checks the source files a tool call wrote and returns a
+// note on the failures to add to its result, or "" when everything compiles.
+func (s *Session) runCompileChecks(ctx context.Context, absFiles []string) string {
+	var failures []string
+	env := s.commandEnv()
+	for _, check := range compileChecksFor(s.root, absFiles) {
+		// A refused or declined check is skipped; the write stands either
+		// way.
+		if err := s.checkToolCommand("compile check", check.Command+" "+check.Label); err != nil {
+			debugf("compile_check_skipped target=%q error=%q", check.Label, err.Error())
+			continue
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, compileCheckTimeout)
+		cmd := exec.CommandContext(checkCtx, check.Name, check.Args...)
+		cmd.Dir = check.Dir
+		cmd.Env = env
+		output, err := cmd.CombinedOutput()
+		timedOut := errors.Is(checkCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		debugf("compile_check target=%q command=%q ok=%t timed_out=%t", check.Label, check.Command, err == nil, timedOut)
+		if err == nil {
+			continue
+		}
+		if timedOut {
+			// A check that cannot finish says nothing about the code.
+			fmt.Fprintf(s.out, "%s: %s timed out after %s\n", colorLabel("compile", warnColor, s.cfg.ColorOutput), check.Label, compileCheckTimeout)
+			continue
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			debugf("compile_check_skipped target=%q error=%q", check.Label, err.Error())
+			continue
+		}
+		fmt.Fprintf(s.out, "%s: %s failed\n", colorLabel("compile", warnColor, s.cfg.ColorOutput), check.Label)
+		text := strings.TrimSpace(strings.ToValidUTF8(string(output), ""))
+		if len(text) > maxCompileCheckOutput {
+			text = "...\n" + text[len(text)-maxCompileCheckOutput:]
+		}
+		failures = append(failures, fmt.Sprintf("%s (%s):\n%s", check.Label, check.Command, text))
+	}
+	if len(failures) == 0 {
+		return ""
+	}
+	return "\n\nCompile check failed after this change, which was still written:\n\n" + strings.Join(failures, "\n\n") + "\n\nFix the errors before moving on."
+}
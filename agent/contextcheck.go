@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// countTokensEstimateRatio is the share of the context window the local
+	// size estimate must reach before a request is counted exactly; smaller
+	// requests cannot be near the limit and skip the extra round trip.
+	countTokensEstimateRatio = 0.5
+	countTokensTimeout       = 30 * time.Second
+)
+
+var errContextWindowExceeded = errors.New("request exceeds the model's context window")
+
+// tokenCounter is implemented by providers that can count a request's input
+// tokens before it is sent.
+type tokenCounter interface {
+	CountTokens(ctx context.Context, req ProviderRequest) (int64, error)
+}
+
+func (p *anthropicProvider) CountTokens(ctx context.Context, req ProviderRequest) (int64, error) {
+	tools := make([]anthropic.MessageCountTokensToolUnionParam, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		tools = append(tools, anthropic.MessageCountTokensToolUnionParam{
+			OfTool:                  tool.OfTool,
+			OfBashTool20250124:      tool.OfBashTool20250124,
+			OfTextEditor20250124:    tool.OfTextEditor20250124,
+			OfWebSearchTool20250305: tool.OfWebSearchTool20250305,
+		})
+		if tool.OfTextEditor20250429 != nil {
+			tools[len(tools)-1].OfTextEditor20250429 = &anthropic.MessageCountTokensToolTextEditor20250429Param{}
+		}
+	}
+	count, err := p.client.Messages.CountTokens(ctx, anthropic.MessageCountTokensParams{
+		Model:    anthropic.Model(req.ModelID),
+		Messages: req.History,
+		System: anthropic.MessageCountTokensParamsSystemUnion{
+			OfTextBlockArray: []anthropic.TextBlockParam{{Text: req.SystemPrompt}},
+		},
+		Tools: tools,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.InputTokens, nil
+}
+
+// checkContextWindow counts the next request's tokens and, when it would not
+// leave room for a reply in the model's context window, compacts earlier
+// conversation. It returns errContextWindowExceeded if the request still does
+// not fit, so the turn stops instead of failing with a 400 from the API.
+// Providers that cannot count and models without a known window are not
+// checked.
+func (s *Session) checkContextWindow(ctx context.Context, provider Provider, modelID string, tools []anthropic.ToolUnionParam) error {
+	counter, ok := provider.(tokenCounter)
+	if !ok {
+		return nil
+	}
+	info, ok := lookupModel(modelID)
+	if !ok {
+		return nil
+	}
+	limit := info.ContextWindow - defaultMaxTokens
+	if float64(estimateTokens(s.history)+len(s.cfg.SystemPrompt)/4) < float64(limit)*countTokensEstimateRatio {
+		return nil
+	}
+
+	count := func() (int64, bool) {
+		countCtx, cancel := context.WithTimeout(ctx, countTokensTimeout)
+		defer cancel()
+		tokens, err := counter.CountTokens(countCtx, ProviderRequest{ModelID: modelID, SystemPrompt: s.cfg.SystemPrompt, History: s.history, Tools: tools})
+		if err != nil {
+			// Counting is only a precaution; let the request itself decide.
+			debugf("count_tokens_failed model_id=%q error=%q", modelID, err.Error())
+			return 0, false
+		}
+		debugf("count_tokens model_id=%q input_tokens=%d limit=%d", modelID, tokens, limit)
+		return tokens, true
+	}
+	tokens, ok := count()
+	if !ok || tokens <= limit {
+		return nil
+	}
+
+	fmt.Fprintf(s.out, "%s: the next request is %d tokens, more than the %d the context window leaves for a reply; compacting earlier conversation\n",
+		colorLabel("notice", warnColor, s.cfg.ColorOutput), tokens, limit)
+	if err := s.compact(); err != nil {
+		return fmt.Errorf("%w (%d tokens, limit %d) and compacting failed: %v; use /undo to drop recent turns", errContextWindowExceeded, tokens, limit, err)
+	}
+	if tokens, ok = count(); ok && tokens > limit {
+		return fmt.Errorf("%w even after compacting (%d tokens, limit %d); use /undo to drop recent turns, or ask for smaller steps", errContextWindowExceeded, tokens, limit)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// conversationFormat identifies files written by /save, so /load can reject
+// other JSON and later versions can read older files.
+const conversationFormat = "coder-conversation/1"
+
+// conversationFile is a conversation saved with /save: the session record,
+// with every message and tool call, in one file that does not depend on the
+// workspace it came from.
+type conversationFile struct {
+	Format   string    `json:"format"`
+	Exported time.Time `json:"exported"`
+	SessionRecord
+}
+
+// saveCommand writes the conversation to a JSON file that /load can read on
+// another machine.
+func saveCommand(s *Session, args string) error {
+	path := strings.TrimSpace(args)
+	if path == "" {
+		return errors.New("usage: /save <file>")
+	}
+	if len(s.history) == 0 {
+		return errors.New("nothing to save yet")
+	}
+	if s.title == "" {
+		s.title = previewText(firstUserText(s.history), 60)
+	}
+	data, err := json.MarshalIndent(conversationFile{
+		Format:   conversationFormat,
+		Exported: time.Now().UTC(),
+		SessionRecord: SessionRecord{
+			ID:        s.ID,
+			Title:     s.title,
+			Model:     s.cfg.ModelID,
+			Created:   s.created,
+			Updated:   time.Now(),
+			Turns:     s.turn,
+			History:   s.history,
+			ToolStats: s.toolStats,
+		},
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode conversation: %w", err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to save conversation: %w", err)
+		}
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to save conversation: %w", err)
+	}
+	debugf("conversation_saved path=%q messages=%d bytes=%d", path, len(s.history), len(data))
+	fmt.Fprintf(s.out, "Saved %d turn(s), %d messages, to %s (%s)\n", s.turn, len(s.history), path, formatByteSize(int64(len(data))))
+	return nil
+}
+
+// loadCommand replaces the conversation with one saved by /save. It continues
+// as a new session, so the file's original session is not overwritten; the
+// conversation it replaces stays available in /sessions.
+func loadCommand(s *Session, args string) error {
+	path := strings.TrimSpace(args)
+	if path == "" {
+		return errors.New("usage: /load <file>")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read conversation: %w", err)
+	}
+	var file conversationFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s is not a saved conversation: %w", path, err)
+	}
+	if file.Format != conversationFormat {
+		return fmt.Errorf("%s is not a saved conversation (format %q, expected %q)", path, file.Format, conversationFormat)
+	}
+	if err := validateConversation(file.History); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	s.save(s.cfg.ModelID)
+	s.ID = newSessionID()
+	s.title = file.Title
+	s.created = time.Now()
+	s.history = file.History
+	s.turn = file.Turns
+	s.toolStats = file.ToolStats
+	if s.toolStats == nil {
+		s.toolStats = make(map[string]*ToolStats)
+	}
+	s.checkpoints = nil
+	s.todos = nil
+	s.cache.clear()
+	if s.audit != nil {
+		s.audit.sessionID = s.ID
+	}
+	s.addNote("Note: this conversation was loaded from a file and may have started on another machine. Re-read files before relying on what earlier messages say about them.")
+	s.save(s.cfg.ModelID)
+
+	debugf("conversation_loaded path=%q session=%q from_session=%q messages=%d", path, s.ID, file.ID, len(file.History))
+	fmt.Fprintf(s.out, "Loaded %q (%d turn(s)) from %s as session %s\n", file.Title, file.Turns, path, s.ID)
+	if file.Model != "" && file.Model != s.cfg.ModelID {
+		fmt.Fprintf(s.out, "It was saved on %s; continuing on %s.\n", file.Model, s.cfg.ModelID)
+	}
+	return nil
+}
+
+// validateConversation checks that history can be sent as is: it starts with
+// a user message and every tool result answers an earlier tool call.
+func validateConversation(history []anthropic.MessageParam) error {
+	if len(history) == 0 {
+		return errors.New("the conversation has no messages")
+	}
+	if history[0].Role != anthropic.MessageParamRoleUser {
+		return errors.New("the conversation does not start with a user message")
+	}
+	calls := map[string]bool{}
+	for i, msg := range history {
+		if msg.Role != anthropic.MessageParamRoleUser && msg.Role != anthropic.MessageParamRoleAssistant {
+			return fmt.Errorf("message %d has unknown role %q", i+1, msg.Role)
+		}
+		for _, block := range msg.Content {
+			switch {
+			case block.OfToolUse != nil:
+				calls[block.OfToolUse.ID] = true
+			case block.OfToolResult != nil && !calls[block.OfToolResult.ToolUseID]:
+				return fmt.Errorf("message %d has a result for unknown tool call %q", i+1, block.OfToolResult.ToolUseID)
+			}
+		}
+	}
+	return nil
+}
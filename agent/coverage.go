@@ -0,0 +1,359 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	coverageTimeout       = 10 * time.Minute
+	maxCoverageFiles      = 200
+	maxCoverageOutputTail = 4_000
+)
+
+type TestCoverageInput struct {
+	Packages []string `json:"packages,omitempty"`
+	Language string   `json:"language,omitempty"`
+}
+
+// coverageCount is how many of a file's or package's statements the tests ran.
+type coverageCount struct {
+	Covered    int
+	Statements int
+}
+
+func (c coverageCount) percent() float64 {
+	if c.Statements == 0 {
+		return 0
+	}
+	return math.Round(1000*float64(c.Covered)/float64(c.Statements)) / 10
+}
+
+// coverageEntry is the coverage of the whole run, a package, or a file, with
+// the change since the session's previous coverage run when there was one.
+type coverageEntry struct {
+	Name       string   `json:"name,omitempty"`
+	Percent    float64  `json:"percent"`
+	Delta      *float64 `json:"delta,omitempty"`
+	Covered    int      `json:"covered"`
+	Statements int      `json:"statements"`
+}
+
+// coverageReport is the test_coverage result.
+type coverageReport struct {
+	Language     string          `json:"language"`
+	TestsPassed  bool            `json:"tests_passed"`
+	TestOutput   string          `json:"test_output,omitempty"`
+	Total        coverageEntry   `json:"total"`
+	Packages     []coverageEntry `json:"packages"`
+	Files        []coverageEntry `json:"files"`
+	FilesOmitted int             `json:"files_omitted,omitempty"`
+}
+
+func testCoverageInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"packages": map[string]any{
+				"type":        "array",
+				"items":       map[string]any{"type": "string"},
+				"description": "What to test: Go package patterns such as ./pkg/auth/..., or Python test paths. Defaults to everything.",
+			},
+			"language": map[string]any{
+				"type":        "string",
+				"enum":        []string{docLanguageGo, docLanguagePython},
+				"description": "Defaults to the workspace's language, detected from go.mod or pyproject.toml/requirements.txt/setup.py.",
+			},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// testCoverage runs the tests with coverage on and returns the coverage of
+// the run, each package, and each file as JSON. Each figure carries its change
+// since the previous test_coverage call in the session, so the model can tell
+// whether new tests moved it.
+func (s *Session) testCoverage(input json.RawMessage) (string, error) {
+	const expected = `{"packages":["./pkg/auth/..."]}`
+
+	args := TestCoverageInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("test_coverage", err.Error(), expected)
+	}
+	language := strings.ToLower(strings.TrimSpace(args.Language))
+	if language == "" {
+		language = detectDocLanguage(s.root)
+	}
+	if language != docLanguageGo && language != docLanguagePython {
+		return "", toolInputValidationError("test_coverage", "coverage is supported for Go and Python workspaces; set \"language\" if detection failed", expected)
+	}
+	var targets []string
+	for _, target := range args.Packages {
+		target = strings.TrimSpace(target)
+		if strings.HasPrefix(target, "-") {
+			return "", toolInputValidationError("test_coverage", fmt.Sprintf("%q is not a package or path", target), expected)
+		}
+		if _, _, err := s.resolveToolPath(strings.TrimSuffix(strings.TrimSuffix(target, "..."), "/"), false); err != nil {
+			return "", err
+		}
+		targets = append(targets, target)
+	}
+
+	ctx, cancel := context.WithTimeout(s.toolContext(), coverageTimeout)
+	defer cancel()
+	var files map[string]coverageCount
+	var output string
+	var testErr error
+	command := "coverage run -m pytest -q"
+	if language == docLanguageGo {
+		command = "go test -covermode=set"
+	}
+	if len(targets) > 0 {
+		command += " " + strings.Join(targets, " ")
+	}
+	if err := s.checkToolCommand("test_coverage", command); err != nil {
+		return "", err
+	}
+	env := s.commandEnv()
+	switch language {
+	case docLanguageGo:
+		files, output, testErr = goCoverage(ctx, s.root, env, targets)
+	case docLanguagePython:
+		files, output, testErr = pythonCoverage(ctx, s.root, env, targets)
+	}
+	if ctx.Err() != nil {
+		return "", newToolError(ToolErrorTimeout, "tests timed out after %s", coverageTimeout)
+	}
+	if files == nil {
+		if testErr == nil {
+			testErr = fmt.Errorf("no coverage data was written")
+		}
+		return "", fmt.Errorf("could not measure coverage: %v\n%s", testErr, tailText(output, maxCoverageOutputTail))
+	}
+
+	report := s.coverageReport(language, files)
+	report.TestsPassed = testErr == nil
+	if !report.TestsPassed {
+		report.TestOutput = tailText(output, maxCoverageOutputTail)
+	}
+	debugf("test_coverage language=%q files=%d percent=%.1f tests_passed=%t", language, len(files), report.Total.Percent, report.TestsPassed)
+	status := ""
+	if !report.TestsPassed {
+		status = "; some tests failed"
+	}
+	fmt.Fprintf(s.out, "Coverage: %.1f%% of %d statements in %d file(s)%s\n", report.Total.Percent, report.Total.Statements, len(files), status)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// coverageReport totals the per-file counts by package and for the run, and
+// records them for the deltas of the next run.
+func (s *Session) coverageReport(language string, files map[string]coverageCount) coverageReport {
+	packages := map[string]coverageCount{}
+	var total coverageCount
+	for name, count := range files {
+		pkg := packages[path.Dir(name)]
+		pkg.Covered += count.Covered
+		pkg.Statements += count.Statements
+		packages[path.Dir(name)] = pkg
+		total.Covered += count.Covered
+		total.Statements += count.Statements
+	}
+
+	if s.coverage == nil {
+		s.coverage = map[string]coverageCount{}
+	}
+	entry := func(key, name string, count coverageCount) coverageEntry {
+		e := coverageEntry{Name: name, Percent: count.percent(), Covered: count.Covered, Statements: count.Statements}
+		if previous, ok := s.coverage[key]; ok {
+			delta := math.Round(10*(e.Percent-previous.percent())) / 10
+			e.Delta = &delta
+		}
+		s.coverage[key] = count
+		return e
+	}
+	// A run over some packages is only compared with earlier runs over the
+	// same packages.
+	scope := make([]string, 0, len(packages))
+	for name := range packages {
+		scope = append(scope, name)
+	}
+	sort.Strings(scope)
+	report := coverageReport{Language: language, Packages: []coverageEntry{}, Files: []coverageEntry{}}
+	report.Total = entry(language+" total "+strings.Join(scope, ","), "", total)
+	for _, name := range scope {
+		report.Packages = append(report.Packages, entry(language+" package "+name, name, packages[name]))
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := entry(language+" file "+name, name, files[name])
+		if len(report.Files) < maxCoverageFiles {
+			report.Files = append(report.Files, e)
+		} else {
+			report.FilesOmitted++
+		}
+	}
+	return report
+}
+
+// goCoverage runs go test in the workspace at dir with a cover profile and
+// counts covered statements per file, relative to it. The error is the test
+// run's.
+func goCoverage(ctx context.Context, dir string, env, targets []string) (map[string]coverageCount, string, error) {
+	if len(targets) == 0 {
+		targets = []string{"./..."}
+	}
+	profile, err := os.CreateTemp("", "coder-cover-*.out")
+	if err != nil {
+		return nil, "", err
+	}
+	profile.Close()
+	defer os.Remove(profile.Name())
+	cmd := exec.CommandContext(ctx, "go", append([]string{"test", "-covermode=set", "-coverprofile=" + profile.Name()}, targets...)...)
+	cmd.Dir = dir
+	cmd.Env = env
+	output, testErr := cmd.CombinedOutput()
+
+	f, err := os.Open(profile.Name())
+	if err != nil {
+		return nil, string(output), testErr
+	}
+	defer f.Close()
+	module := goModulePath(dir)
+	// With several packages, a block can appear once per test binary; it is
+	// covered if any of them ran it.
+	blocks := map[string]bool{}
+	statements := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// file:start.col,end.col statements count
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		count, _ := strconv.Atoi(fields[2])
+		if _, seen := blocks[fields[0]]; !seen {
+			n, _ := strconv.Atoi(fields[1])
+			statements[fields[0]] = n
+		}
+		blocks[fields[0]] = blocks[fields[0]] || count > 0
+	}
+	if len(blocks) == 0 {
+		return nil, string(output), testErr
+	}
+	files := map[string]coverageCount{}
+	for block, covered := range blocks {
+		name := block[:strings.LastIndex(block, ":")]
+		if module != "" {
+			name = strings.TrimPrefix(name, module+"/")
+		}
+		count := files[name]
+		count.Statements += statements[block]
+		if covered {
+			count.Covered += statements[block]
+		}
+		files[name] = count
+	}
+	return files, string(output), testErr
+}
+
+// pythonCoverage runs pytest under coverage.py in the workspace at dir and
+// reads its JSON report.
+func pythonCoverage(ctx context.Context, dir string, env, targets []string) (map[string]coverageCount, string, error) {
+	if _, err := exec.LookPath("coverage"); err != nil {
+		return nil, "", newToolError(ToolErrorNotFound, "coverage.py is not installed (pip install coverage pytest)")
+	}
+	report, err := os.CreateTemp("", "coder-cover-*.json")
+	if err != nil {
+		return nil, "", err
+	}
+	report.Close()
+	defer os.Remove(report.Name())
+	run := exec.CommandContext(ctx, "coverage", append([]string{"run", "-m", "pytest", "-q"}, targets...)...)
+	run.Dir = dir
+	run.Env = env
+	output, testErr := run.CombinedOutput()
+	export := exec.CommandContext(ctx, "coverage", "json", "-q", "-o", report.Name())
+	export.Dir = dir
+	export.Env = env
+	if out, err := export.CombinedOutput(); err != nil {
+		return nil, string(output) + string(out), testErr
+	}
+	data, err := os.ReadFile(report.Name())
+	if err != nil {
+		return nil, string(output), testErr
+	}
+	var parsed struct {
+		Files map[string]struct {
+			Summary struct {
+				CoveredLines  int `json:"covered_lines"`
+				NumStatements int `json:"num_statements"`
+			} `json:"summary"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil || len(parsed.Files) == 0 {
+		return nil, string(output), testErr
+	}
+	files := map[string]coverageCount{}
+	for name, file := range parsed.Files {
+		files[workspaceRelative(dir, filepath.FromSlash(name))] = coverageCount{Covered: file.Summary.CoveredLines, Statements: file.Summary.NumStatements}
+	}
+	return files, string(output), testErr
+}
+
+// goModulePath returns the module path declared in the go.mod of the
+// workspace at dir.
+func goModulePath(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "module "); ok {
+			return strings.Trim(strings.TrimSpace(rest), `"`)
+		}
+	}
+	return ""
+}
+
+// tailText returns at most the last n bytes of text, starting on a line.
+func tailText(text string, n int) string {
+	text = strings.TrimSpace(text)
+	if len(text) <= n {
+		return text
+	}
+	text = text[len(text)-n:]
+	if i := strings.Index(text, "\n"); i >= 0 {
+		text = text[i+1:]
+	}
+	return "...\n" + text
+}
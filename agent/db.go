@@ -0,0 +1,484 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	defaultDBMaxRows        = 200
+	defaultDBMaxBytes       = 64_000
+	defaultDBTimeoutSeconds = 30
+)
+
+// dbForbiddenWords are keywords that write, change the schema or session, or
+// reach outside the database. A query containing any of them outside strings
+// and comments is refused, even inside a CTE or after EXPLAIN.
+var dbForbiddenWords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "UPSERT": true,
+	"INTO": true, "CREATE": true, "DROP": true, "ALTER": true, "TRUNCATE": true, "RENAME": true,
+	"GRANT": true, "REVOKE": true, "COPY": true, "CALL": true, "DO": true, "EXECUTE": true, "EXEC": true,
+	"PREPARE": true, "DEALLOCATE": true, "ATTACH": true, "DETACH": true, "PRAGMA": true, "VACUUM": true,
+	"REINDEX": true, "ANALYZE": true, "SET": true, "RESET": true, "LOCK": true, "LOAD": true, "HANDLER": true,
+	"BEGIN": true, "COMMIT": true, "ROLLBACK": true, "SAVEPOINT": true, "LISTEN": true, "NOTIFY": true,
+	"OUTFILE": true, "DUMPFILE": true, "LOAD_FILE": true,
+}
+
+// dbForbiddenFunctions are functions that read or write files on the server,
+// load code, reach other servers, or act on other sessions, none of which a
+// read-only session stops. Calling one, under any schema or quoted, is
+// refused.
+var dbForbiddenFunctions = map[string]bool{
+	// SQLite's shell and its bundled extensions.
+	"WRITEFILE": true, "READFILE": true, "LOAD_EXTENSION": true, "EDIT": true, "FSDIR": true,
+	"ZIPFILE": true, "FTS3_TOKENIZER": true,
+	// Postgres.
+	"PG_STAT_FILE": true, "PG_TERMINATE_BACKEND": true, "PG_CANCEL_BACKEND": true, "PG_RELOAD_CONF": true,
+	"PG_ROTATE_LOGFILE": true, "PG_PROMOTE": true, "PG_SWITCH_WAL": true, "PG_LOGICAL_EMIT_MESSAGE": true,
+	"PG_NOTIFY": true, "SET_CONFIG": true, "NEXTVAL": true, "SETVAL": true, "PG_IMPORT_SYSTEM_COLLATIONS": true,
+	// MySQL, including common user-defined functions.
+	"SYS_EXEC": true, "SYS_EVAL": true, "GET_LOCK": true, "RELEASE_LOCK": true, "RELEASE_ALL_LOCKS": true,
+	"MASTER_POS_WAIT": true, "SOURCE_POS_WAIT": true,
+}
+
+// dbForbiddenFunctionPrefixes are families of such functions, such as
+// Postgres's pg_read_file and pg_read_binary_file or the lo_ large object
+// functions.
+var dbForbiddenFunctionPrefixes = []string{
+	"PG_READ_", "PG_LS_", "PG_FILE_", "LO_", "DBLINK", "PG_CREATE_", "PG_DROP_", "PG_REPLICATION_",
+	"PG_ADVISORY_", "PG_TRY_ADVISORY_", "QUERY_TO_XML", "CURSOR_TO_XML",
+}
+
+func dbForbiddenFunction(name string) bool {
+	if dbForbiddenFunctions[name] {
+		return true
+	}
+	for _, prefix := range dbForbiddenFunctionPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DatabaseConfig points db_query at a database. The tool is offered only
+// when a DSN is set.
+type DatabaseConfig struct {
+	// DSN is a postgres://, mysql://, or sqlite: URL. DSNEnv names an
+	// environment variable holding it instead, to keep passwords out of the
+	// config file.
+	DSN    string `json:"dsn,omitempty"`
+	DSNEnv string `json:"dsn_env,omitempty"`
+	// MaxRows and MaxBytes cap each result. They default to 200 rows and
+	// 64000 bytes.
+	MaxRows  int `json:"max_rows,omitempty"`
+	MaxBytes int `json:"max_bytes,omitempty"`
+	// TimeoutSeconds bounds each query. Zero means 30.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+func (c DatabaseConfig) dsn() string {
+	if c.DSNEnv != "" {
+		return strings.TrimSpace(os.Getenv(c.DSNEnv))
+	}
+	return strings.TrimSpace(c.DSN)
+}
+
+type DBQueryInput struct {
+	Query   *string `json:"query"`
+	MaxRows int     `json:"max_rows,omitempty"`
+}
+
+func dbQueryInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": "One SELECT, WITH ... SELECT, or EXPLAIN statement. For the schema, query information_schema (Postgres, MySQL) or sqlite_master and pragma_table_info('t') (SQLite).",
+			},
+			"max_rows": map[string]any{
+				"type":        "integer",
+				"description": "Rows to return, at most the configured limit, which is also the default.",
+			},
+		},
+		Required: []string{"query"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// dbQuery runs a read-only query against the configured database with its
+// command-line client and returns the rows as CSV. The query is checked
+// before it runs, and the client's session is read-only as well.
+func (s *Session) dbQuery(input json.RawMessage) (string, error) {
+	const expected = `{"query":"SELECT id, email FROM users ORDER BY id DESC LIMIT 10"}`
+
+	args := DBQueryInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("db_query", err.Error(), expected)
+	}
+	query, err := requireToolString("db_query", "query", args.Query, false, expected)
+	if err != nil {
+		return "", err
+	}
+	query, err = checkReadOnlySQL(query)
+	if err != nil {
+		return "", newToolError(ToolErrorPermission, "query refused: %v; db_query only runs a single SELECT or EXPLAIN", err)
+	}
+	db := s.cfg.Project.Database
+	maxRows := db.MaxRows
+	if maxRows <= 0 {
+		maxRows = defaultDBMaxRows
+	}
+	if args.MaxRows > 0 {
+		maxRows = min(args.MaxRows, maxRows)
+	}
+	maxBytes := db.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultDBMaxBytes
+	}
+	timeoutSeconds := db.TimeoutSeconds
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultDBTimeoutSeconds
+	}
+
+	dsn := db.dsn()
+	client, clientArgs, env, secret, err := s.dbClientCommand(dsn, query)
+	if err != nil {
+		return "", err
+	}
+	if _, err := exec.LookPath(client); err != nil {
+		return "", newToolError(ToolErrorNotFound, "%s is not installed", client)
+	}
+	ctx, cancel := context.WithTimeout(s.toolContext(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, client, clientArgs...)
+	cmd.Dir = s.root
+	cmd.Env = append(os.Environ(), env...)
+	// The rows past the byte cap are never needed, so stop keeping them;
+	// the timeout ends a query that goes on producing them.
+	stdout := &cappedBuffer{max: maxBytes}
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = stdout, &stderr
+	start := time.Now()
+	runErr := cmd.Run()
+	redact := func(text string) string {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "[REDACTED]")
+		}
+		return s.redactSecrets(text)
+	}
+	s.audit.record(AuditEntry{
+		Tool:        "db_query",
+		Command:     query,
+		TimedOut:    ctx.Err() == context.DeadlineExceeded,
+		OutputBytes: stdout.written,
+		DurationMs:  time.Since(start).Milliseconds(),
+	})
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return "", newToolError(ToolErrorTimeout, "query timed out after %d seconds", timeoutSeconds)
+	case ctx.Err() == context.Canceled:
+		return "Query was cancelled by the user.", nil
+	case runErr != nil:
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = runErr.Error()
+		}
+		return "", fmt.Errorf("%s: %s", client, previewText(redact(msg), 2000))
+	}
+
+	comma := ','
+	if client == "mysql" {
+		comma = '\t'
+	}
+	table, rows, more := dbResultCSV(stdout.Bytes(), comma, maxRows)
+	truncated := more || stdout.written > maxBytes
+	debugf("db_query client=%q rows=%d truncated=%t", client, rows, truncated)
+	fmt.Fprintf(s.out, "%s: %d row(s)\n", colorLabel("db", commentColor, s.cfg.ColorOutput), rows)
+	result := fmt.Sprintf("%d row(s)", rows)
+	if truncated {
+		result += fmt.Sprintf(", truncated at %d rows or %d bytes; add a WHERE or LIMIT to see the rest", maxRows, maxBytes)
+	}
+	if table == "" {
+		return result, nil
+	}
+	return result + "\n" + redact(table), nil
+}
+
+// dbClientCommand picks the command-line client for dsn and returns its
+// arguments, extra environment, and the password to keep out of output.
+func (s *Session) dbClientCommand(dsn, query string) (string, []string, []string, string, error) {
+	if dsn == "" {
+		return "", nil, nil, "", errors.New("no database is configured; set database.dsn or database.dsn_env")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", nil, nil, "", errors.New("database.dsn is not a valid URL")
+	}
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		// Keep the password out of argv, where other users can read it.
+		params := u.Query()
+		if password == "" {
+			password = params.Get("password")
+		}
+		params.Del("password")
+		u.RawQuery = params.Encode()
+		if u.User != nil {
+			u.User = url.User(u.User.Username())
+		}
+		env := []string{"PGOPTIONS=-c default_transaction_read_only=on"}
+		if password != "" {
+			env = append(env, "PGPASSWORD="+password)
+		}
+		return "psql", []string{"--no-psqlrc", "--csv", "--quiet", "--set", "ON_ERROR_STOP=1", "--dbname", u.String(), "--command", query},
+			env, password, nil
+	case "mysql":
+		args := []string{"--batch", "--init-command", "SET SESSION TRANSACTION READ ONLY", "--host", u.Hostname()}
+		if port := u.Port(); port != "" {
+			args = append(args, "--port", port)
+		}
+		if user := u.User.Username(); user != "" {
+			args = append(args, "--user", user)
+		}
+		if database := strings.TrimPrefix(u.Path, "/"); database != "" {
+			args = append(args, "--database", database)
+		}
+		return "mysql", append(args, "--execute", query), []string{"MYSQL_PWD=" + password}, password, nil
+	case "sqlite", "sqlite3", "file":
+		path := u.Opaque
+		if path == "" {
+			path = u.Path
+		}
+		if path == "" {
+			return "", nil, nil, "", errors.New("the sqlite DSN names no file")
+		}
+		if !filepath.IsAbs(path) {
+			// Relative to the workspace, as file tools are.
+			if abs, _, err := s.resolveToolPath(path, false); err == nil {
+				path = abs
+			}
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "", nil, nil, "", newToolError(ToolErrorNotFound, "sqlite database does not exist: %s", path)
+		}
+		// -safe turns off the shell's functions and commands that reach
+		// files and extensions, which -readonly does not.
+		return "sqlite3", []string{"-readonly", "-safe", "-bail", "-csv", "-header", path, query}, nil, "", nil
+	}
+	return "", nil, nil, "", fmt.Errorf("unsupported database scheme %q; use postgres://, mysql://, or sqlite:", u.Scheme)
+}
+
+// dbResultCSV rewrites a client's output as CSV, keeping the header and at
+// most maxRows rows, and reports the rows kept and whether there were more.
+// A row cut off by the byte cap is dropped.
+func dbResultCSV(out []byte, comma rune, maxRows int) (string, int, bool) {
+	reader := csv.NewReader(bytes.NewReader(out))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	var b strings.Builder
+	writer := csv.NewWriter(&b)
+	rows, more := 0, false
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err != nil {
+			more = more || !errors.Is(err, io.EOF)
+			break
+		}
+		if !first {
+			if rows == maxRows {
+				more = true
+				break
+			}
+			rows++
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return strings.TrimRight(b.String(), "\n"), rows, more
+}
+
+// sqlToken is a word, a quoted identifier, or a "(" in a query.
+type sqlToken struct {
+	text   string
+	quoted bool
+}
+
+// checkReadOnlySQL makes sure query is a single SELECT, WITH, or EXPLAIN
+// statement with no keyword that could write and no call to a side-effecting
+// function, and returns it without a trailing semicolon. Strings and comments
+// are skipped, so a keyword in them does not count; a quoted identifier only
+// counts as a function name.
+func checkReadOnlySQL(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	var tokens []sqlToken
+	end := len(query)
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			j := i + 1
+			for ; j < len(query); j++ {
+				if query[j] == '\\' && c != '`' {
+					// MySQL strings and Postgres E'...' strings treat a
+					// backslash as an escape, so where the literal ends
+					// depends on the dialect.
+					return "", errors.New("it has a backslash inside a quoted string")
+				}
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(query) {
+				return "", errors.New("unterminated quote")
+			}
+			if c != '\'' {
+				name := strings.ReplaceAll(query[i+1:j], string(c)+string(c), string(c))
+				tokens = append(tokens, sqlToken{text: strings.ToUpper(name), quoted: true})
+			}
+			i = j + 1
+		case strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query) - i
+			}
+			i += j
+		case strings.HasPrefix(query[i:], "/*!"):
+			// MySQL runs the contents of these.
+			return "", errors.New("it has an executable comment")
+		case strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return "", errors.New("unterminated comment")
+			}
+			i += j + 4
+		case c == '$':
+			// A Postgres dollar-quoted string: $tag$ ... $tag$.
+			j := i + 1
+			for j < len(query) && (query[j] == '_' || isASCIIAlnum(query[j])) {
+				j++
+			}
+			if j < len(query) && query[j] == '$' {
+				tag := query[i : j+1]
+				k := strings.Index(query[j+1:], tag)
+				if k < 0 {
+					return "", errors.New("unterminated dollar-quoted string")
+				}
+				i = j + 1 + k + len(tag)
+			} else {
+				i = j
+			}
+		case c == ';':
+			if strings.TrimSpace(stripSQLComments(query[i+1:])) != "" {
+				return "", errors.New("it has more than one statement")
+			}
+			end = i
+			i = len(query)
+		case c == '_' || isASCIIAlnum(c):
+			j := i
+			for j < len(query) && (query[j] == '_' || isASCIIAlnum(query[j])) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: strings.ToUpper(query[i:j])})
+			i = j
+		case c == '(':
+			tokens = append(tokens, sqlToken{text: "("})
+			i++
+		default:
+			i++
+		}
+	}
+	first := 0
+	for first < len(tokens) && tokens[first].text == "(" {
+		first++
+	}
+	if first == len(tokens) {
+		return "", errors.New("it is empty")
+	}
+	switch {
+	case tokens[first].quoted:
+		return "", errors.New("it starts with a quoted identifier")
+	case tokens[first].text == "SELECT", tokens[first].text == "WITH", tokens[first].text == "EXPLAIN":
+	default:
+		return "", fmt.Errorf("it starts with %s", tokens[first].text)
+	}
+	for i, token := range tokens {
+		if !token.quoted && dbForbiddenWords[token.text] {
+			return "", fmt.Errorf("it contains %s", token.text)
+		}
+		if token.text != "(" && i+1 < len(tokens) && tokens[i+1].text == "(" && dbForbiddenFunction(token.text) {
+			return "", fmt.Errorf("it calls %s", strings.ToLower(token.text))
+		}
+	}
+	return strings.TrimSpace(query[:end]), nil
+}
+
+// stripSQLComments removes -- and /* */ comments, for what follows the last
+// semicolon.
+func stripSQLComments(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		switch {
+		case strings.HasPrefix(text[i:], "--"):
+			j := strings.IndexByte(text[i:], '\n')
+			if j < 0 {
+				return b.String()
+			}
+			i += j
+		case strings.HasPrefix(text[i:], "/*"):
+			j := strings.Index(text[i+2:], "*/")
+			if j < 0 {
+				return b.String()
+			}
+			i += j + 4
+		default:
+			b.WriteByte(text[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+func isASCIIAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max     int
+	written int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.written += len(p)
+	if room := b.max - b.Buffer.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
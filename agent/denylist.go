@@ -0,0 +1,37 @@
+package agent
+
+import "regexp"
+
+// defaultAutoApproveMaxCost caps a -yes session's spend when -max-cost is
+// not given, since no prompt will stop a runaway loop.
+const defaultAutoApproveMaxCost = 10.0
+
+// defaultDenyCommands are bash commands refused in every mode, approved or
+// not: wiping the filesystem root or the home directory, formatting or
+// overwriting disks, powering the machine off, fork bombs, and force pushes.
+var defaultDenyCommands = []string{
+	`\brm\s+(-\S+\s+)*(/|/\*|~/?|\$HOME/?)(\s|;|&|\||$)`,
+	`\bmkfs(\.\w+)?\b`,
+	`\bdd\b.*\bof=/dev/`,
+	`>\s*/dev/(sd|hd|nvme|disk)`,
+	`(^|[;&|(]|\bsudo)\s*(shutdown|reboot|halt|poweroff)(\s|;|&|\||$)`,
+	`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`,
+	`\bgit\s+push\b.*(\s--force|\s-f\b|\s--mirror\b)`,
+}
+
+// deniedCommandPattern returns the denylist pattern command matches, from
+// the built-in list or the project's permissions.deny_commands, or "".
+// The project's patterns were validated when the config was loaded.
+func (s *Session) deniedCommandPattern(command string) string {
+	patterns := append(append([]string(nil), defaultDenyCommands...), s.permissions.DenyCommands...)
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		if re.MatchString(command) {
+			return pattern
+		}
+	}
+	return ""
+}
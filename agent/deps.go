@@ -0,0 +1,363 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	depsTimeout    = 2 * time.Minute
+	maxDepsMatches = 20
+	// pipEnvironmentRoot stands for the Python environment, which has no
+	// package of its own at the top of its graph.
+	pipEnvironmentRoot = "(environment)"
+)
+
+type DependencyGraphInput struct {
+	Package  string `json:"package,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// depGraph is a dependency graph with nodes named name@version, as go mod
+// graph prints them.
+type depGraph struct {
+	Root  string
+	Edges map[string][]string
+}
+
+type depNode struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// depMatch is one version of the package asked about: the packages that
+// require it directly and the shortest chain from the root to it.
+type depMatch struct {
+	depNode
+	RequiredBy []string `json:"required_by"`
+	Path       []string `json:"path"`
+}
+
+type depsReport struct {
+	Language string     `json:"language"`
+	Root     string     `json:"root"`
+	Total    int        `json:"total"`
+	Direct   []depNode  `json:"direct,omitempty"`
+	Package  string     `json:"package,omitempty"`
+	Matches  []depMatch `json:"matches,omitempty"`
+	Omitted  int        `json:"omitted,omitempty"`
+}
+
+func dependencyGraphInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"package": map[string]any{
+				"type":        "string",
+				"description": "Package to trace, optionally with a version prefix: golang.org/x/net, lodash@4, requests@2.31. Omit it to list the direct dependencies.",
+			},
+			"language": map[string]any{
+				"type":        "string",
+				"enum":        []string{docLanguageGo, docLanguagePython, docLanguageNode},
+				"description": "Which ecosystem to ask: go mod graph, pipdeptree, or npm ls. Defaults to the workspace's language, detected from go.mod, pyproject.toml/requirements.txt/setup.py, or package.json.",
+			},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// dependencyGraph reads the workspace's dependency graph and returns, as
+// JSON, either its direct dependencies or every version of one package with
+// what requires it and how the root reaches it.
+func (s *Session) dependencyGraph(input json.RawMessage) (string, error) {
+	const expected = `{"package":"github.com/golang/protobuf@v1"}`
+
+	args := DependencyGraphInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("dependency_graph", err.Error(), expected)
+	}
+	language := strings.ToLower(strings.TrimSpace(args.Language))
+	if language == "" {
+		if language = detectDocLanguage(s.root); language == "" {
+			return "", toolInputValidationError("dependency_graph", "could not detect the workspace language; set \"language\"", expected)
+		}
+	}
+
+	var read func(ctx context.Context, dir string, env []string) (depGraph, error)
+	var command string
+	switch language {
+	case docLanguageGo:
+		read, command = goModGraph, "go mod graph"
+	case docLanguageNode:
+		read, command = npmGraph, "npm ls --all --json"
+	case docLanguagePython:
+		read, command = pipGraph, "pipdeptree --json"
+	default:
+		return "", toolInputValidationError("dependency_graph", fmt.Sprintf("unsupported language %q", language), expected)
+	}
+	// Package managers can run the project's hooks and plugins, so these
+	// run under bash's rules.
+	if err := s.checkToolCommand("dependency_graph", command); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(s.toolContext(), depsTimeout)
+	defer cancel()
+	graph, err := read(ctx, s.root, s.commandEnv())
+	if ctx.Err() != nil {
+		return "", newToolError(ToolErrorTimeout, "reading the dependency graph timed out after %s", depsTimeout)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	report := depsReport{Language: language, Root: graph.Root, Total: len(graph.nodes()) - 1}
+	query := strings.TrimSpace(args.Package)
+	if query == "" {
+		for _, child := range graph.Edges[graph.Root] {
+			report.Direct = append(report.Direct, splitDepNode(child))
+		}
+	} else {
+		report.Package = query
+		report.Matches, report.Omitted = graph.trace(query)
+	}
+	debugf("dependency_graph language=%q nodes=%d package=%q matches=%d", language, report.Total, query, len(report.Matches))
+	if query == "" {
+		fmt.Fprintf(s.out, "Dependency graph: %d direct, %d total\n", len(report.Direct), report.Total)
+	} else {
+		fmt.Fprintf(s.out, "Dependency graph: %d version(s) of %s\n", len(report.Matches)+report.Omitted, query)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// trace finds the versions of the package query names, with their direct
+// dependents and shortest path from the root.
+func (g depGraph) trace(query string) ([]depMatch, int) {
+	name, version, _ := strings.Cut(query, "@")
+	if strings.HasPrefix(query, "@") {
+		// A scoped npm package: @scope/name@version.
+		name, version, _ = strings.Cut(query[1:], "@")
+		name = "@" + name
+	}
+	parents := map[string][]string{}
+	for from, children := range g.Edges {
+		for _, child := range children {
+			parents[child] = append(parents[child], from)
+		}
+	}
+	paths := g.shortestPaths()
+
+	var matches []depMatch
+	omitted := 0
+	for _, node := range g.nodes() {
+		dep := splitDepNode(node)
+		if !strings.EqualFold(dep.Name, name) || !versionHasPrefix(dep.Version, version) {
+			continue
+		}
+		if len(matches) == maxDepsMatches {
+			omitted++
+			continue
+		}
+		requiredBy := parents[node]
+		sort.Strings(requiredBy)
+		matches = append(matches, depMatch{depNode: dep, RequiredBy: requiredBy, Path: paths[node]})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Version < matches[j].Version })
+	return matches, omitted
+}
+
+// versionHasPrefix reports whether version starts with the whole components
+// of prefix, so v1 matches v1.2.0 but not v10.0.0.
+func versionHasPrefix(version, prefix string) bool {
+	version, prefix = strings.TrimPrefix(version, "v"), strings.TrimPrefix(prefix, "v")
+	if prefix == "" || version == prefix {
+		return true
+	}
+	return strings.HasPrefix(version, prefix) && strings.ContainsRune(".-+", rune(version[len(prefix)]))
+}
+
+// shortestPaths returns, for each node reachable from the root, the shortest
+// chain of nodes leading to it.
+func (g depGraph) shortestPaths() map[string][]string {
+	paths := map[string][]string{g.Root: {g.Root}}
+	queue := []string{g.Root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, child := range g.Edges[node] {
+			if _, seen := paths[child]; seen {
+				continue
+			}
+			paths[child] = append(append([]string(nil), paths[node]...), child)
+			queue = append(queue, child)
+		}
+	}
+	return paths
+}
+
+// nodes returns every node of the graph, sorted.
+func (g depGraph) nodes() []string {
+	seen := map[string]bool{g.Root: true}
+	for from, children := range g.Edges {
+		seen[from] = true
+		for _, child := range children {
+			seen[child] = true
+		}
+	}
+	nodes := make([]string, 0, len(seen))
+	for node := range seen {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (g depGraph) addEdge(from, to string) {
+	for _, existing := range g.Edges[from] {
+		if existing == to {
+			return
+		}
+	}
+	g.Edges[from] = append(g.Edges[from], to)
+}
+
+// splitDepNode splits name@version at its last @, which keeps the @ of a
+// scoped npm package in the name.
+func splitDepNode(node string) depNode {
+	if at := strings.LastIndex(node, "@"); at > 0 {
+		return depNode{Name: node[:at], Version: node[at+1:]}
+	}
+	return depNode{Name: node}
+}
+
+func runDepsCommand(ctx context.Context, dir string, env []string, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, newToolError(ToolErrorNotFound, "%s is not installed", name)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	// npm ls exits non-zero for missing or invalid packages but still prints
+	// the tree.
+	if err != nil && len(out) == 0 {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s failed: %s", name, previewText(msg, 500))
+	}
+	return out, nil
+}
+
+func goModGraph(ctx context.Context, dir string, env []string) (depGraph, error) {
+	out, err := runDepsCommand(ctx, dir, env, "go", "mod", "graph")
+	if err != nil {
+		return depGraph{}, err
+	}
+	graph := depGraph{Root: goModulePath(dir), Edges: map[string][]string{}}
+	for _, line := range strings.Split(string(out), "\n") {
+		from, to, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		if graph.Root == "" && !strings.Contains(from, "@") {
+			graph.Root = from
+		}
+		graph.addEdge(from, to)
+	}
+	return graph, nil
+}
+
+// npmTree is a package in the output of npm ls --json.
+type npmTree struct {
+	Name         string             `json:"name"`
+	Version      string             `json:"version"`
+	Dependencies map[string]npmTree `json:"dependencies"`
+}
+
+func npmGraph(ctx context.Context, dir string, env []string) (depGraph, error) {
+	out, err := runDepsCommand(ctx, dir, env, "npm", "ls", "--all", "--json")
+	if err != nil {
+		return depGraph{}, err
+	}
+	var tree npmTree
+	if err := json.Unmarshal(out, &tree); err != nil {
+		return depGraph{}, fmt.Errorf("could not read npm ls output: %w", err)
+	}
+	root := tree.Name
+	if tree.Version != "" {
+		root += "@" + tree.Version
+	}
+	graph := depGraph{Root: root, Edges: map[string][]string{}}
+	var walk func(parent string, deps map[string]npmTree)
+	walk = func(parent string, deps map[string]npmTree) {
+		names := make([]string, 0, len(deps))
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			node := name + "@" + deps[name].Version
+			graph.addEdge(parent, node)
+			walk(node, deps[name].Dependencies)
+		}
+	}
+	walk(root, tree.Dependencies)
+	return graph, nil
+}
+
+func pipGraph(ctx context.Context, dir string, env []string) (depGraph, error) {
+	out, err := runDepsCommand(ctx, dir, env, "pipdeptree", "--json")
+	if err != nil {
+		return depGraph{}, err
+	}
+	var packages []struct {
+		Package struct {
+			Key              string `json:"key"`
+			InstalledVersion string `json:"installed_version"`
+		} `json:"package"`
+		Dependencies []struct {
+			Key              string `json:"key"`
+			InstalledVersion string `json:"installed_version"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(out, &packages); err != nil {
+		return depGraph{}, fmt.Errorf("could not read pipdeptree output: %w", err)
+	}
+	graph := depGraph{Root: pipEnvironmentRoot, Edges: map[string][]string{}}
+	required := map[string]bool{}
+	for _, pkg := range packages {
+		from := pkg.Package.Key + "@" + pkg.Package.InstalledVersion
+		for _, dep := range pkg.Dependencies {
+			to := dep.Key + "@" + dep.InstalledVersion
+			graph.addEdge(from, to)
+			required[to] = true
+		}
+	}
+	// Packages nothing else requires are the environment's own.
+	for _, pkg := range packages {
+		node := pkg.Package.Key + "@" + pkg.Package.InstalledVersion
+		if !required[node] {
+			graph.addEdge(pipEnvironmentRoot, node)
+		}
+	}
+	return graph, nil
+}
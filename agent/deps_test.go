@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDependencyGraphFollowsBashPermission(t *testing.T) {
+	a, err := New(Config{Dir: t.TempDir(), Project: ProjectConfig{Permissions: PermissionsConfig{Disabled: []string{"bash"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	input, _ := json.Marshal(map[string]string{"language": docLanguageNode})
+	_, err = a.Session.dependencyGraph(input)
+	if toolErr := asToolError(err); err == nil || toolErr.Code != ToolErrorPermission {
+		t.Errorf("dependencyGraph with bash disabled = %v, want a permission error", err)
+	}
+}
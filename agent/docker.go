@@ -0,0 +1,417 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	dockerBuildTimeout             = 15 * time.Minute
+	defaultDockerRunTimeoutSeconds = 300
+	hardDockerRunTimeoutSeconds    = 1800
+	maxDockerOutput                = 8_000
+	defaultDockerMemory            = "2g"
+	defaultDockerCPUs              = 2.0
+	defaultDockerPidsLimit         = 512
+	defaultDockerNetwork           = "none"
+	// dockerSessionLabel marks the images and containers a session made
+	// with its ID.
+	dockerSessionLabel    = "coder.session"
+	dockerRemoveTimeout   = 30 * time.Second
+	dockerImageCharacters = "lowercase letters, digits, and . _ - / : @"
+)
+
+var (
+	dockerImagePattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9._/:@-]*$`)
+	dockerMemoryPattern = regexp.MustCompile(`^(\d+)([bkmg]?)$`)
+)
+
+// DockerConfig turns on the docker_build and docker_run tools and limits the
+// containers they start.
+type DockerConfig struct {
+	// Enabled offers the tools, as -docker does. They are off by default.
+	Enabled bool `json:"enabled,omitempty"`
+	// Memory and CPUs are each container's default and largest limits;
+	// docker_run may ask for less. They default to 2g and 2.
+	Memory string  `json:"memory,omitempty"`
+	CPUs   float64 `json:"cpus,omitempty"`
+	// PidsLimit caps the processes in a container. Zero means 512.
+	PidsLimit int `json:"pids_limit,omitempty"`
+	// Network is the network containers join. It defaults to "none".
+	Network string `json:"network,omitempty"`
+}
+
+func (c DockerConfig) memory() string {
+	if c.Memory == "" {
+		return defaultDockerMemory
+	}
+	return strings.ToLower(c.Memory)
+}
+
+func (c DockerConfig) cpus() float64 {
+	if c.CPUs == 0 {
+		return defaultDockerCPUs
+	}
+	return c.CPUs
+}
+
+func (c DockerConfig) pidsLimit() int {
+	if c.PidsLimit == 0 {
+		return defaultDockerPidsLimit
+	}
+	return c.PidsLimit
+}
+
+func (c DockerConfig) network() string {
+	if c.Network == "" {
+		return defaultDockerNetwork
+	}
+	return c.Network
+}
+
+type DockerBuildInput struct {
+	Image      string            `json:"image,omitempty"`
+	Dockerfile string            `json:"dockerfile,omitempty"`
+	Context    string            `json:"context,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	BuildArgs  map[string]string `json:"build_args,omitempty"`
+}
+
+type DockerRunInput struct {
+	Image          *string           `json:"image"`
+	Command        string            `json:"command,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Memory         string            `json:"memory,omitempty"`
+	CPUs           float64           `json:"cpus,omitempty"`
+	Detach         bool              `json:"detach,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+func dockerBuildInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"image": map[string]any{
+				"type":        "string",
+				"description": "Name and tag for the built image, such as api:dev. Defaults to one named after the session.",
+			},
+			"dockerfile": map[string]any{
+				"type":        "string",
+				"description": "Relative path to the Dockerfile. Defaults to Dockerfile.",
+			},
+			"context": map[string]any{
+				"type":        "string",
+				"description": "Relative path to the build context directory. Defaults to the workspace root.",
+			},
+			"target": map[string]any{
+				"type":        "string",
+				"description": "Build stage to stop at, for multi-stage Dockerfiles.",
+			},
+			"build_args": map[string]any{
+				"type":                 "object",
+				"additionalProperties": map[string]any{"type": "string"},
+				"description":          "Values for the Dockerfile's ARG instructions.",
+			},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func dockerRunInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"image": map[string]any{
+				"type":        "string",
+				"description": "Image to run, usually one docker_build returned.",
+			},
+			"command": map[string]any{
+				"type":        "string",
+				"description": "Shell command to run in the container with sh -c. Defaults to the image's own command.",
+			},
+			"env": map[string]any{
+				"type":                 "object",
+				"additionalProperties": map[string]any{"type": "string"},
+				"description":          "Environment variables to set in the container.",
+			},
+			"memory": map[string]any{
+				"type":        "string",
+				"description": "Memory limit such as 512m, at most the configured limit, which is also the default.",
+			},
+			"cpus": map[string]any{
+				"type":        "number",
+				"description": "CPU limit such as 0.5, at most the configured limit, which is also the default.",
+			},
+			"detach": map[string]any{
+				"type":        "boolean",
+				"description": "Start the container in the background and return its name, for servers; read its output with docker logs in bash. It is removed when the session ends.",
+			},
+			"timeout_seconds": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("For containers not detached. Defaults to %d, capped at %d; the container is removed when it runs out.", defaultDockerRunTimeoutSeconds, hardDockerRunTimeoutSeconds),
+			},
+		},
+		Required: []string{"image"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// dockerBuild builds an image from a Dockerfile in the workspace and returns
+// the image name with the end of the build output.
+func (s *Session) dockerBuild(input json.RawMessage) (string, error) {
+	const expected = `{"image":"api:dev","dockerfile":"deploy/Dockerfile","context":"."}`
+
+	args := DockerBuildInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("docker_build", err.Error(), expected)
+	}
+	image := strings.TrimSpace(args.Image)
+	if image == "" {
+		image = "coder-" + strings.ToLower(s.ID)
+	}
+	if !dockerImagePattern.MatchString(image) {
+		return "", toolInputValidationError("docker_build", fmt.Sprintf("image %q may only use %s", image, dockerImageCharacters), expected)
+	}
+	dockerfile := strings.TrimSpace(args.Dockerfile)
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	dockerfileAbs, dockerfileDisplay, err := s.resolveToolPath(dockerfile, false)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dockerfileAbs); err != nil || info.IsDir() {
+		return "", newToolError(ToolErrorNotFound, "Dockerfile does not exist: %s", dockerfileDisplay)
+	}
+	buildContext := strings.TrimSpace(args.Context)
+	if buildContext == "" {
+		buildContext = "."
+	}
+	contextAbs, contextDisplay, err := s.resolveToolPath(buildContext, false)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(contextAbs); err != nil || !info.IsDir() {
+		return "", newToolError(ToolErrorNotFound, "build context is not a directory: %s", contextDisplay)
+	}
+
+	dockerArgs := []string{"build", "-f", dockerfileAbs, "-t", image, "--label", dockerSessionLabel + "=" + s.ID}
+	if target := strings.TrimSpace(args.Target); target != "" {
+		dockerArgs = append(dockerArgs, "--target", target)
+	}
+	for _, name := range sortedKeys(args.BuildArgs) {
+		if !validEnvName(name) {
+			return "", toolInputValidationError("docker_build", fmt.Sprintf("invalid build arg name %q", name), expected)
+		}
+		dockerArgs = append(dockerArgs, "--build-arg", name+"="+args.BuildArgs[name])
+	}
+	dockerArgs = append(dockerArgs, contextAbs)
+
+	ctx, cancel := context.WithTimeout(s.toolContext(), dockerBuildTimeout)
+	defer cancel()
+	output, exitCode, err := s.runDocker(ctx, "docker_build", dockerArgs...)
+	if err != nil {
+		return "", err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", newToolError(ToolErrorTimeout, "docker build timed out after %s\n%s", dockerBuildTimeout, output)
+	}
+	debugf("docker_build image=%q dockerfile=%q exit_code=%d", image, dockerfileDisplay, exitCode)
+	if exitCode != 0 {
+		fmt.Fprintf(s.out, "%s: %s failed with exit code %d\n", colorLabel("docker", warnColor, s.cfg.ColorOutput), dockerfileDisplay, exitCode)
+		return fmt.Sprintf("Build of %s failed with exit code %d.\n\nOutput:\n%s", dockerfileDisplay, exitCode, output), nil
+	}
+	fmt.Fprintf(s.out, "%s: built %s from %s\n", colorLabel("docker", commentColor, s.cfg.ColorOutput), image, dockerfileDisplay)
+	return fmt.Sprintf("Built image %s from %s.\n\nOutput:\n%s", image, dockerfileDisplay, output), nil
+}
+
+// dockerRun runs a container with the configured resource limits, labelled
+// with the session so removeContainers can clean it up. A container not
+// detached is removed as soon as it exits or times out.
+func (s *Session) dockerRun(input json.RawMessage) (string, error) {
+	const expected = `{"image":"api:dev","command":"./api --self-test","memory":"512m"}`
+
+	args := DockerRunInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("docker_run", err.Error(), expected)
+	}
+	image, err := requireToolString("docker_run", "image", args.Image, false, expected)
+	if err != nil {
+		return "", err
+	}
+	image = strings.TrimSpace(image)
+	if !dockerImagePattern.MatchString(image) {
+		return "", toolInputValidationError("docker_run", fmt.Sprintf("image %q may only use %s", image, dockerImageCharacters), expected)
+	}
+	limits := s.cfg.Project.Docker
+	memory := limits.memory()
+	if requested := strings.ToLower(strings.TrimSpace(args.Memory)); requested != "" {
+		requestedBytes, ok := dockerMemoryBytes(requested)
+		if !ok {
+			return "", toolInputValidationError("docker_run", fmt.Sprintf("memory %q is not a size such as 512m or 2g", args.Memory), expected)
+		}
+		if limitBytes, _ := dockerMemoryBytes(memory); requestedBytes > limitBytes {
+			return "", toolInputValidationError("docker_run", fmt.Sprintf("memory %s is over the limit of %s", requested, memory), expected)
+		}
+		memory = requested
+	}
+	cpus := limits.cpus()
+	if args.CPUs < 0 || args.CPUs > cpus {
+		return "", toolInputValidationError("docker_run", fmt.Sprintf("cpus must be between 0 and the limit of %g", cpus), expected)
+	}
+	if args.CPUs > 0 {
+		cpus = args.CPUs
+	}
+	timeoutSeconds := defaultDockerRunTimeoutSeconds
+	if args.TimeoutSeconds > 0 {
+		timeoutSeconds = min(args.TimeoutSeconds, hardDockerRunTimeoutSeconds)
+	}
+
+	for key := range args.Env {
+		if !validEnvName(key) {
+			return "", toolInputValidationError("docker_run", fmt.Sprintf("invalid environment variable name %q", key), expected)
+		}
+	}
+
+	s.containers++
+	name := fmt.Sprintf("coder-%s-%d", strings.ToLower(s.ID), s.containers)
+	dockerArgs := []string{"run", "--name", name, "--label", dockerSessionLabel + "=" + s.ID,
+		"--memory", memory, "--cpus", strconv.FormatFloat(cpus, 'f', -1, 64),
+		"--pids-limit", strconv.Itoa(limits.pidsLimit()), "--network", limits.network()}
+	if args.Detach {
+		dockerArgs = append(dockerArgs, "--detach")
+	} else {
+		dockerArgs = append(dockerArgs, "--rm")
+	}
+	for _, key := range sortedKeys(args.Env) {
+		dockerArgs = append(dockerArgs, "--env", key+"="+args.Env[key])
+	}
+	dockerArgs = append(dockerArgs, image)
+	if command := strings.TrimSpace(args.Command); command != "" {
+		dockerArgs = append(dockerArgs, "sh", "-c", command)
+	}
+
+	ctx := s.toolContext()
+	if !args.Detach {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	output, exitCode, err := s.runDocker(ctx, "docker_run", dockerArgs...)
+	if ctx.Err() != nil {
+		// Stopping the docker client leaves the container running.
+		removeDockerContainers(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	debugf("docker_run image=%q container=%q detach=%t exit_code=%d", image, name, args.Detach, exitCode)
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		fmt.Fprintf(s.out, "%s: %s timed out\n", colorLabel("docker", warnColor, s.cfg.ColorOutput), name)
+		return fmt.Sprintf("Container %s timed out after %d seconds and was removed.\n\nPartial output:\n%s", name, timeoutSeconds, output), nil
+	case ctx.Err() == context.Canceled:
+		return fmt.Sprintf("Container %s was cancelled by the user and removed.\n\nPartial output:\n%s", name, output), nil
+	case args.Detach && exitCode == 0:
+		fmt.Fprintf(s.out, "%s: started %s from %s\n", colorLabel("docker", commentColor, s.cfg.ColorOutput), name, image)
+		return fmt.Sprintf("Started container %s from %s in the background (memory %s, cpus %g, network %s). Read its output with `docker logs %s`; it is removed when the session ends.", name, image, memory, cpus, limits.network(), name), nil
+	}
+	fmt.Fprintf(s.out, "%s: %s exited with code %d\n", colorLabel("docker", commentColor, s.cfg.ColorOutput), name, exitCode)
+	msg := fmt.Sprintf("Container %s from %s exited with code %d (memory %s, cpus %g, network %s).", name, image, exitCode, memory, cpus, limits.network())
+	if output != "" {
+		msg += "\n\nOutput:\n" + output
+	}
+	return msg, nil
+}
+
+// runDocker runs the docker client and returns the end of its output, with
+// secrets redacted, and its exit code. The error is only set when docker could
+// not be run at all.
+func (s *Session) runDocker(ctx context.Context, tool string, args ...string) (string, int, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", 0, newToolError(ToolErrorNotFound, "docker is not installed")
+	}
+	start := time.Now()
+	out, runErr := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	exitCode := 0
+	var exitErr *exec.ExitError
+	switch {
+	case runErr == nil:
+	case errors.As(runErr, &exitErr):
+		exitCode = exitErr.ExitCode()
+	case ctx.Err() == nil:
+		return "", 0, fmt.Errorf("failed to run docker: %w", runErr)
+	default:
+		exitCode = -1
+	}
+	s.audit.record(AuditEntry{
+		Tool:        tool,
+		Command:     "docker " + strings.Join(args, " "),
+		ExitCode:    &exitCode,
+		TimedOut:    ctx.Err() == context.DeadlineExceeded,
+		OutputBytes: len(out),
+		DurationMs:  time.Since(start).Milliseconds(),
+	})
+	return tailText(s.redactSecrets(string(out)), maxDockerOutput), exitCode, nil
+}
+
+// removeContainers removes every container docker_run started this session,
+// so detached ones do not outlive the agent.
+func (s *Session) removeContainers() {
+	if s.containers == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRemoveTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "ps", "--all", "--quiet", "--filter", "label="+dockerSessionLabel+"="+s.ID).Output()
+	if err != nil {
+		debugf("docker_cleanup_failed error=%q", err.Error())
+		return
+	}
+	ids := strings.Fields(string(out))
+	removeDockerContainers(ids...)
+	debugf("docker_cleanup containers=%d", len(ids))
+}
+
+func removeDockerContainers(names ...string) {
+	if len(names) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRemoveTimeout)
+	defer cancel()
+	_ = exec.CommandContext(ctx, "docker", append([]string{"rm", "--force"}, names...)...).Run()
+}
+
+// dockerMemoryBytes parses a docker memory size such as 512m.
+func dockerMemoryBytes(size string) (int64, bool) {
+	match := dockerMemoryPattern.FindStringSubmatch(strings.ToLower(size))
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	shift := map[string]int64{"": 0, "b": 0, "k": 10, "m": 20, "g": 30}[match[2]]
+	return n << shift, true
+}
@@ -0,0 +1,249 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	docLookupTimeout     = 30 * time.Second
+	maxDocLookupBytes    = 24_000
+	docLookupMatchRadius = 12
+	maxDocLookupMatches  = 8
+)
+
+const (
+	docLanguageGo     = "go"
+	docLanguagePython = "python"
+	docLanguageNode   = "node"
+)
+
+var docSymbolPattern = regexp.MustCompile(`^[\w@./-]+$`)
+
+type DocLookupInput struct {
+	Symbol   *string `json:"symbol"`
+	Language string  `json:"language,omitempty"`
+}
+
+func docLookupInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"symbol": map[string]any{
+				"type":        "string",
+				"description": "Package or symbol to document, e.g. net/http.Client.Do (Go), json.dumps (Python), or lodash.debounce / @scope/pkg.name (Node).",
+			},
+			"language": map[string]any{
+				"type":        "string",
+				"enum":        []string{docLanguageGo, docLanguagePython, docLanguageNode},
+				"description": "Which toolchain to ask. Defaults to the workspace's language, detected from go.mod, pyproject.toml/requirements.txt/setup.py, or package.json.",
+			},
+		},
+		Required: []string{"symbol"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (s *Session) docLookup(input json.RawMessage) (string, error) {
+	const expected = `{"symbol":"net/http.Client.Do","language":"go"}`
+
+	args := DocLookupInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("doc_lookup", err.Error(), expected)
+	}
+	symbol, err := requireToolString("doc_lookup", "symbol", args.Symbol, false, expected)
+	if err != nil {
+		return "", err
+	}
+	symbol = strings.TrimSpace(symbol)
+	// The symbol becomes a command argument or a node_modules path; keep it
+	// to identifier syntax so it cannot pass flags or leave the directory.
+	if !docSymbolPattern.MatchString(symbol) || strings.HasPrefix(symbol, "-") || strings.Contains(symbol, "..") {
+		return "", toolInputValidationError("doc_lookup", fmt.Sprintf("%q is not a package or symbol name", symbol), expected)
+	}
+	language := strings.ToLower(strings.TrimSpace(args.Language))
+	if language == "" {
+		if language = detectDocLanguage(s.root); language == "" {
+			return "", toolInputValidationError("doc_lookup", "could not detect the workspace language; set \"language\"", expected)
+		}
+	}
+
+	python := "python3"
+	if language == docLanguagePython {
+		if _, lookErr := exec.LookPath(python); lookErr != nil {
+			python = "python"
+		}
+		// pydoc imports the module, which runs the project's code when the
+		// symbol is one of its own, so it runs under bash's rules.
+		if err := s.checkToolCommand("doc_lookup", python+" -m pydoc "+symbol); err != nil {
+			return "", err
+		}
+	}
+	env := s.commandEnv()
+	ctx, cancel := context.WithTimeout(s.toolContext(), docLookupTimeout)
+	defer cancel()
+	var doc string
+	switch language {
+	case docLanguageGo:
+		doc, err = runDocCommand(ctx, s.root, env, "go", "doc", symbol)
+	case docLanguagePython:
+		doc, err = runDocCommand(ctx, s.root, env, python, "-m", "pydoc", symbol)
+		if err == nil && strings.HasPrefix(doc, "No Python documentation found") {
+			err = errors.New(strings.TrimSpace(doc))
+		}
+	case docLanguageNode:
+		doc, err = nodePackageDoc(s.root, symbol)
+	default:
+		return "", toolInputValidationError("doc_lookup", fmt.Sprintf("unsupported language %q", language), expected)
+	}
+	if err != nil {
+		return "", fmt.Errorf("no %s documentation for %s: %w", language, symbol, err)
+	}
+	fmt.Fprintf(s.out, "Looked up %s docs for %s\n", language, symbol)
+	text, truncated := truncateOutput([]byte(doc), maxDocLookupBytes)
+	if truncated {
+		text += "\n\n[documentation truncated]"
+	}
+	return text, nil
+}
+
+// detectDocLanguage guesses the language of the workspace at root from its
+// manifest files.
+func detectDocLanguage(root string) string {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, name))
+		return err == nil
+	}
+	switch {
+	case exists("go.mod"):
+		return docLanguageGo
+	case exists("pyproject.toml"), exists("requirements.txt"), exists("setup.py"):
+		return docLanguagePython
+	case exists("package.json"):
+		return docLanguageNode
+	}
+	return ""
+}
+
+func runDocCommand(ctx context.Context, dir string, env []string, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return "", newToolError(ToolErrorTimeout, "%s timed out after %s", name, docLookupTimeout)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", errors.New(previewText(msg, 500))
+	}
+	return string(output), nil
+}
+
+// nodePackageDoc documents a package installed in the workspace at root from
+// its type declarations, or its README when it ships none. With a member
+// ("pkg.member") only the declaration lines around that name are shown.
+func nodePackageDoc(root, symbol string) (string, error) {
+	pkg, member := symbol, ""
+	// Scoped packages keep their first dot-free path segment: @scope/pkg.member.
+	nameStart := 0
+	if strings.HasPrefix(symbol, "@") {
+		nameStart = strings.Index(symbol, "/") + 1
+	}
+	if i := strings.Index(symbol[nameStart:], "."); i >= 0 {
+		pkg, member = symbol[:nameStart+i], symbol[nameStart+i+1:]
+	}
+	dir := filepath.Join(root, "node_modules", filepath.FromSlash(pkg))
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return "", fmt.Errorf("package %s is not installed in node_modules", pkg)
+	}
+	var manifest struct {
+		Version string `json:"version"`
+		Types   string `json:"types"`
+		Typings string `json:"typings"`
+	}
+	_ = json.Unmarshal(data, &manifest)
+
+	var candidates []string
+	for _, name := range []string{manifest.Types, manifest.Typings, "index.d.ts"} {
+		if name != "" {
+			candidates = append(candidates, filepath.Join(dir, filepath.FromSlash(name)))
+		}
+	}
+	candidates = append(candidates, filepath.Join(root, "node_modules", "@types", strings.ReplaceAll(strings.TrimPrefix(pkg, "@"), "/", "__"), "index.d.ts"))
+	source, content := "", ""
+	for _, candidate := range candidates {
+		if data, err := os.ReadFile(candidate); err == nil {
+			source, content = workspaceRelative(root, candidate), string(data)
+			break
+		}
+	}
+	if content == "" {
+		for _, name := range []string{"README.md", "readme.md", "README"} {
+			if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+				source, content = workspaceRelative(root, filepath.Join(dir, name)), string(data)
+				break
+			}
+		}
+	}
+	if content == "" {
+		return "", fmt.Errorf("package %s has no type declarations or README", pkg)
+	}
+
+	header := fmt.Sprintf("%s@%s (from %s)\n\n", pkg, manifest.Version, source)
+	if member == "" {
+		return header + content, nil
+	}
+	excerpt := declarationExcerpt(content, member[strings.LastIndex(member, ".")+1:])
+	if excerpt == "" {
+		return "", fmt.Errorf("%s is not mentioned in %s", member, source)
+	}
+	return header + excerpt, nil
+}
+
+// declarationExcerpt returns the lines around the first few whole-word
+// mentions of name, with line numbers.
+func declarationExcerpt(content, name string) string {
+	pattern, err := regexp.Compile(`\b` + regexp.QuoteMeta(name) + `\b`)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(content, "\n")
+	var b strings.Builder
+	shownUntil, matches := -1, 0
+	for i, line := range lines {
+		if matches >= maxDocLookupMatches || !pattern.MatchString(line) || i <= shownUntil {
+			continue
+		}
+		matches++
+		start := max(i-docLookupMatchRadius/3, shownUntil+1)
+		end := min(i+docLookupMatchRadius, len(lines)-1)
+		if b.Len() > 0 {
+			b.WriteString("...\n")
+		}
+		for j := start; j <= end; j++ {
+			fmt.Fprintf(&b, "%5d| %s\n", j+1, lines[j])
+		}
+		shownUntil = end
+	}
+	return b.String()
+}
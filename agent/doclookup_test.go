@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDocLookupPythonFollowsBashPermission(t *testing.T) {
+	// pydoc imports the module it documents, so the read-only profile,
+	// which hides bash, must not let it run.
+	a, err := New(Config{Dir: t.TempDir(), Project: ProjectConfig{Permissions: PermissionsConfig{Profile: profileReadOnly}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	input, _ := json.Marshal(map[string]string{"symbol": "myproject.settings", "language": docLanguagePython})
+	_, err = a.Session.docLookup(input)
+	if toolErr := asToolError(err); err == nil || toolErr.Code != ToolErrorPermission {
+		t.Errorf("docLookup under the read-only profile = %v, want a permission error", err)
+	}
+}
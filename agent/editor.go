@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// editKey is what the terminal sends for Ctrl-E. The prompt is read a line at
+// a time, so Ctrl-E followed by Enter opens the editor like /edit.
+const editKey = "\x05"
+
+// editCommand opens $VISUAL or $EDITOR (vi if neither is set) on a temp file
+// to compose a long prompt, and sends what is saved as the next prompt. Text
+// after /edit starts the draft.
+func editCommand(s *Session, args string) error {
+	prompt, err := composeInEditor(args)
+	if err != nil {
+		return err
+	}
+	if prompt == "" {
+		fmt.Fprintln(s.out, "Empty prompt; nothing sent")
+		return nil
+	}
+	s.pendingPrompt = &queuedPrompt{Prompt: prompt}
+	return nil
+}
+
+func composeInEditor(draft string) (string, error) {
+	editor := strings.Fields(os.Getenv("VISUAL"))
+	if len(editor) == 0 {
+		editor = strings.Fields(os.Getenv("EDITOR"))
+	}
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	if _, err := exec.LookPath(editor[0]); err != nil {
+		return "", fmt.Errorf("editor %s not found; set $EDITOR", editor[0])
+	}
+
+	file, err := os.CreateTemp("", "coder-prompt-*.md")
+	if err != nil {
+		return "", fmt.Errorf("failed to create prompt file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if draft != "" {
+		draft += "\n"
+	}
+	_, err = file.WriteString(draft)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write prompt file: %w", err)
+	}
+
+	cmd := exec.Command(editor[0], append(editor[1:], file.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%s exited with status %d; prompt discarded", editor[0], exitErr.ExitCode())
+		}
+		return "", fmt.Errorf("failed to run %s: %w", editor[0], err)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read prompt file: %w", err)
+	}
+	debugf("editor_prompt editor=%q chars=%d", editor[0], len(data))
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const maxEditSetEdits = 200
+
+type ApplyEditsInput struct {
+	Edits []EditFilesInput `json:"edits"`
+}
+
+func applyEditsInputSchema() anthropic.ToolInputSchemaParam {
+	edit := editFilesInputSchema()
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"edits": map[string]any{
+				"type":        "array",
+				"description": "Edits to apply in order, each with the same fields as edit_files. Several edits may target the same file; each sees the result of the ones before it.",
+				"minItems":    1,
+				"maxItems":    maxEditSetEdits,
+				"items": map[string]any{
+					"type":                 "object",
+					"properties":           edit.Properties,
+					"required":             edit.Required,
+					"additionalProperties": false,
+				},
+			},
+		},
+		Required: []string{"edits"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// applyEdits applies a set of edits as one transaction. Every edit is
+// validated against the staged content of its file before anything is
+// written; if a write then fails, the files already written are restored, so
+// the workspace ends up with all of the edits or none of them.
+func (s *Session) applyEdits(input json.RawMessage) (string, error) {
+	const expected = `{"edits":[{"path":"a.go","old_str":"Foo(","new_str":"Bar("},{"path":"b.go","old_str":"Foo(","new_str":"Bar("}]}`
+
+	args := ApplyEditsInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("apply_edits", err.Error(), expected)
+	}
+	if len(args.Edits) == 0 {
+		return "", toolInputValidationError("apply_edits", `"edits" must list at least one edit`, expected)
+	}
+	if len(args.Edits) > maxEditSetEdits {
+		return "", toolInputValidationError("apply_edits", fmt.Sprintf("at most %d edits per call", maxEditSetEdits), expected)
+	}
+
+	var targets []*editTarget
+	byPath := make(map[string]*editTarget)
+	for i, edit := range args.Edits {
+		field := func(name string) string { return fmt.Sprintf("edits[%d].%s", i, name) }
+		pathValue, err := requireToolString("apply_edits", field("path"), edit.Path, false, expected)
+		if err != nil {
+			return "", err
+		}
+		oldStr, err := requireToolString("apply_edits", field("old_str"), edit.OldStr, true, expected)
+		if err != nil {
+			return "", err
+		}
+		newStr, err := requireToolString("apply_edits", field("new_str"), edit.NewStr, true, expected)
+		if err != nil {
+			return "", err
+		}
+		if oldStr == newStr {
+			return "", toolInputValidationError("apply_edits", fmt.Sprintf("%s and %s must be different", field("old_str"), field("new_str")), expected)
+		}
+
+		absFile, _, err := s.resolveWorkspaceFileForWrite(pathValue)
+		if err != nil {
+			return "", editSetError(i, err)
+		}
+		target := byPath[absFile]
+		if target == nil {
+			if target, err = s.openEditTarget("apply_edits", pathValue); err != nil {
+				return "", editSetError(i, err)
+			}
+			byPath[absFile] = target
+			targets = append(targets, target)
+		}
+		if err := target.apply(oldStr, newStr); err != nil {
+			return "", editSetError(i, err)
+		}
+	}
+
+	type stagedWrite struct {
+		target      *editTarget
+		text, data  []byte
+		conventions string
+	}
+	staged := make([]stagedWrite, 0, len(targets))
+	for _, target := range targets {
+		text, data, conventions, err := s.encodeEditTarget(target)
+		if err != nil {
+			return "", fmt.Errorf("no edits were applied: %w", err)
+		}
+		staged = append(staged, stagedWrite{target, text, data, conventions})
+	}
+
+	for i, write := range staged {
+		if err := writeEditTarget(write.target, write.data); err != nil {
+			// The failed write may have truncated its file, so it is
+			// restored along with the ones before it.
+			var failed []string
+			for j := i; j >= 0; j-- {
+				if rollbackErr := rollbackEditTarget(staged[j].target); rollbackErr != nil {
+					failed = append(failed, fmt.Sprintf("%s (%v)", staged[j].target.displayPath, rollbackErr))
+				}
+			}
+			if len(failed) > 0 {
+				return "", fmt.Errorf("%w; rolling back the other edits also failed for %s, which may be left modified", err, strings.Join(failed, ", "))
+			}
+			return "", fmt.Errorf("%w; the %d file(s) already written were restored and no edits were applied", err, i)
+		}
+	}
+
+	lines := make([]string, 0, len(staged))
+	for _, write := range staged {
+		lines = append(lines, s.reportEdit(write.target, "apply_edits", write.text, write.data, write.conventions))
+	}
+	return fmt.Sprintf("applied %d edits to %d files:\n%s", len(args.Edits), len(staged), strings.Join(lines, "\n")), nil
+}
+
+// editSetError points a validation failure at the edit that caused it.
+func editSetError(index int, err error) error {
+	return fmt.Errorf("edits[%d]: %w; no edits were applied", index, err)
+}
+
+// rollbackEditTarget puts a written target back as it was before the edit
+// set: its previous bytes, or no file at all if it was created.
+func rollbackEditTarget(t *editTarget) error {
+	if !t.existed {
+		if err := os.Remove(t.absFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(t.absFile, t.previous, 0o644)
+}
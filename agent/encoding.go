@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text encodings the file tools recognize. Files are shown to the model as
+// UTF-8 and written back in the encoding they had.
+const (
+	encodingUTF8        = "utf-8"
+	encodingUTF8BOM     = "utf-8 with BOM"
+	encodingUTF16LE     = "utf-16le"
+	encodingUTF16BE     = "utf-16be"
+	encodingWindows1252 = "windows-1252"
+
+	encodingSniffBytes = 4096
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// windows1252High maps bytes 0x80-0x9F to their characters. The five bytes
+// Windows-1252 leaves undefined map to the C1 control with the same value,
+// as in Latin-1, so every byte sequence round-trips.
+var windows1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// detectEncoding guesses the encoding of file content from its byte order
+// mark, the NUL pattern of UTF-16 text, or failing UTF-8 validation. Binary
+// content is reported as UTF-8 so it passes through unchanged.
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return encodingUTF8BOM
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return encodingUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return encodingUTF16BE
+	}
+	sample := data[:min(len(data), encodingSniffBytes)]
+	if enc := sniffUTF16(sample); enc != "" {
+		return enc
+	}
+	if bytes.IndexByte(sample, 0) >= 0 || utf8.Valid(data) {
+		return encodingUTF8
+	}
+	return encodingWindows1252
+}
+
+// sniffUTF16 recognizes BOM-less UTF-16 text that is mostly ASCII: one byte
+// of nearly every pair is NUL, always the same one.
+func sniffUTF16(sample []byte) string {
+	pairs := len(sample) / 2
+	if pairs < 2 {
+		return ""
+	}
+	evenZeros, oddZeros := 0, 0
+	for i := 0; i+1 < len(sample); i += 2 {
+		if sample[i] == 0 {
+			evenZeros++
+		}
+		if sample[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	switch {
+	case oddZeros*10 >= pairs*7 && evenZeros*20 < pairs:
+		return encodingUTF16LE
+	case evenZeros*10 >= pairs*7 && oddZeros*20 < pairs:
+		return encodingUTF16BE
+	}
+	return ""
+}
+
+// decodeText converts file content in enc to UTF-8, dropping any byte order
+// mark.
+func decodeText(data []byte, enc string) (string, error) {
+	switch enc {
+	case encodingUTF8BOM:
+		return string(bytes.TrimPrefix(data, utf8BOM)), nil
+	case encodingUTF16LE, encodingUTF16BE:
+		var order binary.ByteOrder = binary.LittleEndian
+		bom := []byte{0xFF, 0xFE}
+		if enc == encodingUTF16BE {
+			order, bom = binary.BigEndian, []byte{0xFE, 0xFF}
+		}
+		data = bytes.TrimPrefix(data, bom)
+		if len(data)%2 != 0 {
+			return "", fmt.Errorf("%s text has an odd number of bytes", enc)
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case encodingWindows1252:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+			if b >= 0x80 && b <= 0x9F {
+				runes[i] = windows1252High[b-0x80]
+			}
+		}
+		return string(runes), nil
+	}
+	return string(data), nil
+}
+
+// encodeText converts UTF-8 text back to enc, restoring a byte order mark
+// the encoding implies. It fails when text has characters enc cannot hold.
+func encodeText(text string, enc string) ([]byte, error) {
+	switch enc {
+	case encodingUTF8BOM:
+		return append(append([]byte(nil), utf8BOM...), text...), nil
+	case encodingUTF16LE, encodingUTF16BE:
+		units := utf16.Encode([]rune(text))
+		out := make([]byte, 0, 2+2*len(units))
+		if enc == encodingUTF16LE {
+			out = append(out, 0xFF, 0xFE)
+			for _, u := range units {
+				out = binary.LittleEndian.AppendUint16(out, u)
+			}
+		} else {
+			out = append(out, 0xFE, 0xFF)
+			for _, u := range units {
+				out = binary.BigEndian.AppendUint16(out, u)
+			}
+		}
+		return out, nil
+	case encodingWindows1252:
+		out := make([]byte, 0, len(text))
+		for _, r := range text {
+			b, ok := windows1252Byte(r)
+			if !ok {
+				return nil, fmt.Errorf("%q cannot be encoded in %s, the file's encoding", r, enc)
+			}
+			out = append(out, b)
+		}
+		return out, nil
+	}
+	return []byte(text), nil
+}
+
+func windows1252Byte(r rune) (byte, bool) {
+	if r < 0x80 || (r >= 0xA0 && r <= 0xFF) {
+		return byte(r), true
+	}
+	for i, mapped := range windows1252High {
+		if mapped == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
+
+// decodeFileText returns existing file content as UTF-8 along with the
+// encoding to write it back in. Content that fails to decode is passed
+// through unchanged.
+func decodeFileText(data []byte) (string, string) {
+	enc := detectEncoding(data)
+	text, err := decodeText(data, enc)
+	if err != nil {
+		return string(data), encodingUTF8
+	}
+	return text, enc
+}
+
+// isUTF16 reports whether enc is one of the UTF-16 encodings, whose text is
+// full of NUL bytes without being binary.
+func isUTF16(enc string) bool {
+	return enc == encodingUTF16LE || enc == encodingUTF16BE
+}
+
+// trimPartialRune drops a UTF-8 sequence cut off at the end of a sample read
+// from the start of a file, so it does not fail validation.
+func trimPartialRune(sample []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(sample); i++ {
+		if utf8.RuneStart(sample[len(sample)-i]) {
+			if !utf8.FullRune(sample[len(sample)-i:]) {
+				return sample[:len(sample)-i]
+			}
+			break
+		}
+	}
+	return sample
+}
+
+// withEncodingNote extends a write result's conventions note to say the file
+// kept a non-UTF-8 encoding.
+func withEncodingNote(note, enc string) string {
+	if enc == encodingUTF8 {
+		return note
+	}
+	if note != "" {
+		note += "; "
+	}
+	return note + "saved as " + enc + " to match the file"
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, encodingUTF8},
+		{"ascii", []byte("hello\n"), encodingUTF8},
+		{"utf-8", []byte("naïve café\n"), encodingUTF8},
+		{"utf-8 bom", []byte("\xEF\xBB\xBFhello"), encodingUTF8BOM},
+		{"utf-16le bom", []byte("\xFF\xFEh\x00i\x00"), encodingUTF16LE},
+		{"utf-16be bom", []byte("\xFE\xFF\x00h\x00i"), encodingUTF16BE},
+		{"utf-16le without bom", []byte("h\x00e\x00l\x00l\x00o\x00"), encodingUTF16LE},
+		{"utf-16be without bom", []byte("\x00h\x00e\x00l\x00l\x00o"), encodingUTF16BE},
+		{"windows-1252", []byte("caf\xE9 \x93quoted\x94"), encodingWindows1252},
+		{"binary", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\xff"), encodingUTF8},
+	}
+	for _, tc := range tests {
+		if got := detectEncoding(tc.data); got != tc.want {
+			t.Errorf("%s: detectEncoding = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		text string
+	}{
+		{"utf-8 bom", []byte("\xEF\xBB\xBFx := 1\n"), "x := 1\n"},
+		{"utf-16le", []byte("\xFF\xFEo\x00k\x00\n\x00"), "ok\n"},
+		{"utf-16be", []byte("\xFE\xFF\x00o\x00k\x00\n"), "ok\n"},
+		{"utf-16le surrogate pair", []byte("\xFF\xFE\x3D\xD8\x00\xDE"), "😀"},
+		{"windows-1252", []byte("\x80 caf\xE9 \x93q\x94"), "€ café “q”"},
+		{"windows-1252 undefined byte", []byte("a\x81\x8D b\xFF"), "a\u0081\u008D bÿ"},
+	}
+	for _, tc := range tests {
+		text, enc := decodeFileText(tc.data)
+		if text != tc.text {
+			t.Errorf("%s: decoded %q, want %q", tc.name, text, tc.text)
+		}
+		data, err := encodeText(text, enc)
+		if err != nil {
+			t.Errorf("%s: encodeText: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(data, tc.data) {
+			t.Errorf("%s: encoded %q, want the original %q", tc.name, data, tc.data)
+		}
+	}
+}
+
+func TestEncodeTextRefusesUnencodable(t *testing.T) {
+	_, err := encodeText("smile 😀", encodingWindows1252)
+	if err == nil || !strings.Contains(err.Error(), encodingWindows1252) {
+		t.Errorf("encodeText = %v, want an error naming %s", err, encodingWindows1252)
+	}
+}
+
+func TestDecodeFileTextOddUTF16(t *testing.T) {
+	data := []byte("\xFF\xFEh\x00i")
+	text, enc := decodeFileText(data)
+	if enc != encodingUTF8 || text != string(data) {
+		t.Errorf("decodeFileText = %q, %q; want the bytes unchanged as utf-8", text, enc)
+	}
+}
+
+func TestTrimPartialRune(t *testing.T) {
+	full := []byte("café")
+	if got := trimPartialRune(full); !bytes.Equal(got, full) {
+		t.Errorf("trimPartialRune(%q) = %q, want it unchanged", full, got)
+	}
+	cut := full[:len(full)-1]
+	if got := trimPartialRune(cut); string(got) != "caf" {
+		t.Errorf("trimPartialRune(%q) = %q, want \"caf\"", cut, got)
+	}
+}
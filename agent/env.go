@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultEnvAllow is what bash commands see of the agent's environment when
+// the project config does not set env.inherit: enough for shells, locales,
+// and common toolchains to work, and no credentials. A trailing * matches a
+// prefix.
+var defaultEnvAllow = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "COLORTERM",
+	"LANG", "LANGUAGE", "LC_*", "TZ", "TMPDIR", "XDG_*",
+	"GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOFLAGS", "GOPROXY", "GOPRIVATE",
+	"CARGO_HOME", "RUSTUP_HOME", "JAVA_HOME", "NVM_DIR", "PYENV_ROOT",
+	"VIRTUAL_ENV", "CONDA_PREFIX",
+}
+
+// secretEnvName matches variable names whose values are treated as secrets.
+var secretEnvName = regexp.MustCompile(`(?i)(KEY|TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|AUTH)`)
+
+// minRedactedSecret keeps short values such as "1" or "true" from being
+// redacted wherever they happen to appear in output.
+const minRedactedSecret = 8
+
+// EnvConfig controls the environment of bash commands. By default they get
+// only the variables in defaultEnvAllow; Inherit passes the agent's whole
+// environment instead. Allow names more variables to pass through (a
+// trailing * matches a prefix) and Set adds or overrides variables.
+type EnvConfig struct {
+	Inherit bool              `json:"inherit,omitempty"`
+	Allow   []string          `json:"allow,omitempty"`
+	Set     map[string]string `json:"set,omitempty"`
+}
+
+// envFlag collects repeated -env values of the form NAME=VALUE.
+type envFlag map[string]string
+
+func (f envFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f envFlag) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || !validEnvName(name) {
+		return errors.New("expected NAME=VALUE")
+	}
+	f[name] = val
+	return nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func envNameAllowed(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// commandEnv is the environment bash commands run with: the allowed part of
+// the agent's environment, then the project's env.set, then the session's
+// -env variables.
+func (s *Session) commandEnv() []string {
+	policy := s.cfg.Project.Env
+	allow := append(append([]string(nil), defaultEnvAllow...), policy.Allow...)
+	vars := make(map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if policy.Inherit || envNameAllowed(name, allow) {
+			vars[name] = value
+		}
+	}
+	for name, value := range policy.Set {
+		vars[name] = value
+	}
+	for name, value := range s.cfg.Env {
+		vars[name] = value
+	}
+	if s.scratch != "" && ensureScratchDir(s.scratch) == nil {
+		vars[scratchEnvName] = s.scratch
+	}
+
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// redactSecrets replaces the values of secret-looking variables, from the
+// agent's environment or set for commands, in command output, so a command
+// that prints its environment or a dotfile does not put credentials into the
+// conversation.
+func (s *Session) redactSecrets(output string) string {
+	secrets := make(map[string]string)
+	collect := func(name, value string) {
+		if len(value) >= minRedactedSecret && secretEnvName.MatchString(name) {
+			secrets[value] = name
+		}
+	}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		collect(name, value)
+	}
+	for name, value := range s.cfg.Project.Env.Set {
+		collect(name, value)
+	}
+	for name, value := range s.cfg.Env {
+		collect(name, value)
+	}
+	if len(secrets) == 0 {
+		return output
+	}
+
+	// Longer values first, so a secret that contains another is replaced
+	// whole.
+	values := make([]string, 0, len(secrets))
+	for value := range secrets {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		output = strings.ReplaceAll(output, value, "[redacted $"+secrets[value]+"]")
+	}
+	return output
+}
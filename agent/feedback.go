@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// defaultFeedbackMaxRounds is how many failing checks in a row a turn feeds
+// back to the model when feedback.max_rounds is not set.
+const defaultFeedbackMaxRounds = 5
+
+// FeedbackConfig sets up the feedback loop: a command, such as a build and
+// test run, checked after the model changes files, with failures sent back to
+// it so it can fix them without being asked.
+type FeedbackConfig struct {
+	// Command is run after each round of tool calls that wrote a file;
+	// -feedback overrides it.
+	Command string `json:"command,omitempty"`
+	// MaxRounds is how many failures in a row a turn sends back before the
+	// checks stop for the rest of it. Zero means 5.
+	MaxRounds int `json:"max_rounds,omitempty"`
+}
+
+// runFeedbackCheck runs the feedback command and returns the note to send
+// with the round's tool results: its output when it fails, a line when it
+// passes again after failing, and "" otherwise. failures counts the failures
+// in a row this turn; once it reaches the limit, no more checks run.
+func (s *Session) runFeedbackCheck(ctx context.Context, failures *int) string {
+	feedback := s.cfg.Project.Feedback
+	limit := feedback.MaxRounds
+	if limit == 0 {
+		limit = defaultFeedbackMaxRounds
+	}
+	if feedback.Command == "" || *failures >= limit {
+		return ""
+	}
+	fmt.Fprintf(s.out, "%s: running %s\n", colorLabel("feedback", commentColor, s.cfg.ColorOutput), feedback.Command)
+	test := runCITests(ctx, feedback.Command)
+	debugf("feedback_check turn=%d passed=%t exit_code=%d failures=%d", s.turn, test.Passed, test.ExitCode, *failures)
+	if test.Passed {
+		fmt.Fprintf(s.out, "%s: passed\n", colorLabel("feedback", commentColor, s.cfg.ColorOutput))
+		if *failures == 0 {
+			return ""
+		}
+		*failures = 0
+		return fmt.Sprintf("Automatic check: `%s` passes now.", feedback.Command)
+	}
+
+	*failures++
+	fmt.Fprintf(s.out, "%s: failed with exit code %d (%d of %d)\n", colorLabel("feedback", warnColor, s.cfg.ColorOutput), test.ExitCode, *failures, limit)
+	note := fmt.Sprintf("Automatic check after your changes: `%s` failed with exit code %d.\n<output>\n%s\n</output>\nFix the cause before going on.", feedback.Command, test.ExitCode, strings.TrimSpace(test.Output))
+	if *failures >= limit {
+		note += fmt.Sprintf(" It has now failed %d times in a row, so it will not run again this turn; if you cannot fix it, tell the user what still fails.", *failures)
+	}
+	return note
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultFixRounds = 5
+	// fixStallRounds is how many rounds in a row may leave the command's
+	// failure unchanged before coder fix gives up.
+	fixStallRounds = 2
+)
+
+// fixVolatileOutput matches the parts of a failure that differ between
+// otherwise identical runs: timings and memory addresses.
+var fixVolatileOutput = regexp.MustCompile(`\b\d+(\.\d+)?(ns|µs|us|ms|s|m)\b|0x[0-9a-fA-F]+`)
+
+// runFix implements coder fix: it runs the -until command and, while it
+// fails, hands the failure to the model for one turn and runs the command
+// again. It stops when the command passes, after -rounds turns, when
+// -max-cost is reached, or when turns stop making progress, and returns the
+// process exit code, using the codes of headless runs.
+func runFix() (int, error) {
+	until := flag.String("until", "", "Shell command that must exit 0 for the fix to be done (e.g. \"go test ./...\")")
+	rounds := flag.Int("rounds", defaultFixRounds, "Most turns to spend fixing before giving up")
+	cfg, err := loadConfig()
+	if err != nil {
+		return exitHeadlessError, err
+	}
+	configureLogging(cfg.Verbose)
+	command := strings.TrimSpace(*until)
+	if command == "" {
+		return exitHeadlessError, errors.New(`usage: coder fix -until "<command>" [-rounds n] [-max-cost dollars] [instructions]`)
+	}
+	if *rounds < 1 {
+		return exitHeadlessError, errors.New("-rounds must be at least 1")
+	}
+	instructions := strings.TrimSpace(strings.Join(flag.Args(), " "))
+
+	session := newSession(cfg)
+	session.input = bufio.NewScanner(strings.NewReader(""))
+	toolMap, anthropicTools, err := buildToolRegistry(registeredTools(session), cfg.Project.Permissions)
+	if err != nil {
+		return exitHeadlessError, err
+	}
+	if cfg.MetricsAddr != "" {
+		startMetricsServer(cfg.MetricsAddr)
+	}
+	provider := newProvider(cfg)
+	session.provider, session.tools = provider, anthropicTools
+	handleInterrupts(session)
+	defer session.cleanup()
+
+	label := colorLabel("fix", commentColor, cfg.ColorOutput)
+	finish := func(code int, status string) int {
+		color := commentColor
+		if code != exitHeadlessSuccess {
+			color = warnColor
+		}
+		fmt.Fprintf(os.Stdout, "%s: %s ($%.2f)\n", colorLabel("fix", color, cfg.ColorOutput), status, session.usage.Cost)
+		session.printArtifacts(os.Stdout)
+		debugf("fix_exit code=%d status=%q cost=%.4f", code, status, session.usage.Cost)
+		return code
+	}
+
+	fmt.Fprintf(os.Stdout, "%s: running %s\n", label, command)
+	test := runCITests(context.Background(), command)
+	if test.Passed {
+		return finish(exitHeadlessSuccess, command+" already passes"), nil
+	}
+	stalled := 0
+	for round := 1; ; round++ {
+		fmt.Fprintf(os.Stdout, "%s: round %d/%d: %s exited with status %d\n", label, round, *rounds, command, test.ExitCode)
+		writes := session.writes
+		stats := runTurn(context.Background(), cfg, session, provider, toolMap, anthropicTools, fixPrompt(command, test, instructions, round))
+		switch {
+		case errors.Is(stats.Err, errCostBudgetExceeded), errors.Is(stats.Err, errContextWindowExceeded):
+			return finish(exitHeadlessLimit, fmt.Sprintf("stopped in round %d: %v", round, stats.Err)), nil
+		case stats.Stopped == stopConditionStopped:
+			return finish(exitHeadlessLimit, fmt.Sprintf("stopped in round %d: %s", round, stats.StopReason)), nil
+		case stats.Err != nil:
+			return finish(exitHeadlessError, fmt.Sprintf("stopped in round %d: the model request failed", round)), nil
+		}
+
+		fmt.Fprintf(os.Stdout, "%s: running %s\n", label, command)
+		previous := test
+		test = runCITests(context.Background(), command)
+		if test.Passed {
+			return finish(exitHeadlessSuccess, fmt.Sprintf("%s passes after %d round(s)", command, round)), nil
+		}
+		if round >= *rounds {
+			return finish(exitHeadlessLimit, fmt.Sprintf("%s still fails after %d round(s)", command, round)), nil
+		}
+		// A round makes no progress if it changed nothing or left the failure
+		// exactly as it was.
+		if session.writes == writes || fixFailureKey(previous) == fixFailureKey(test) {
+			stalled++
+		} else {
+			stalled = 0
+		}
+		debugf("fix_round round=%d exit_code=%d writes=%d stalled=%d", round, test.ExitCode, session.writes-writes, stalled)
+		if stalled >= fixStallRounds {
+			return finish(exitHeadlessTaskFailed, fmt.Sprintf("gave up after round %d: %d rounds in a row made no progress on %s", round, stalled, command)), nil
+		}
+	}
+}
+
+// fixPrompt asks the model to fix the command's latest failure.
+func fixPrompt(command string, test *CITestResult, instructions string, round int) string {
+	var b strings.Builder
+	if round == 1 {
+		fmt.Fprintf(&b, "`%s` fails with exit status %d. Find the cause and fix it, changing the code rather than the check, until the command passes. It is run again after your turn.", command, test.ExitCode)
+	} else {
+		fmt.Fprintf(&b, "`%s` still fails after your changes, with exit status %d. Keep fixing it; if the failure looks the same, try a different approach.", command, test.ExitCode)
+	}
+	if instructions != "" {
+		fmt.Fprintf(&b, "\n\n%s", instructions)
+	}
+	fmt.Fprintf(&b, "\n\n<output>\n%s\n</output>", strings.TrimSpace(test.Output))
+	return b.String()
+}
+
+// fixFailureKey is a failure's output without its timings and addresses, so
+// that two runs failing the same way compare equal.
+func fixFailureKey(test *CITestResult) string {
+	return fmt.Sprintf("%d\n%s", test.ExitCode, fixVolatileOutput.ReplaceAllString(test.Output, "_"))
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// fuzzyEditMinSimilarity is how close, after collapsing whitespace, a
+	// region of the file must be to old_str to stand in for it.
+	fuzzyEditMinSimilarity = 0.9
+	// fuzzyEditMinChars keeps short old_str values, where a few characters
+	// are a different statement, out of similarity matching.
+	fuzzyEditMinChars = 40
+	// fuzzyEditMaxChars bounds the cost of similarity matching.
+	fuzzyEditMaxChars = 8000
+)
+
+// fuzzyMatch is the whole lines [first, last] of a file that old_str was
+// taken to mean, and how they were found.
+type fuzzyMatch struct {
+	first, last int
+	similarity  float64
+}
+
+// applyFuzzy is the fallback for an old_str that is not in the file. It
+// looks for whole lines that equal old_str apart from whitespace, then for
+// lines at least fuzzyEditMinSimilarity similar to it, and replaces them
+// only when exactly one place qualifies. new_str is re-indented by the
+// difference between old_str's indentation and the file's. It returns a
+// note describing the match.
+func (t *editTarget) applyFuzzy(oldStr, newStr string) (string, error) {
+	if strings.HasSuffix(oldStr, "\n") {
+		oldStr = strings.TrimSuffix(oldStr, "\n")
+		newStr = strings.TrimSuffix(newStr, "\n")
+	}
+	oldLines := strings.Split(oldStr, "\n")
+	fileLines := strings.Split(t.text, "\n")
+	if strings.TrimSpace(oldStr) == "" || len(oldLines) > len(fileLines) {
+		return "", newToolError(ToolErrorNotFound, "old_str not found in file: %s", t.displayPath)
+	}
+
+	normalizedOld := normalizeLines(oldLines)
+	windows := make([]string, len(fileLines)-len(oldLines)+1)
+	for i := range windows {
+		windows[i] = normalizeLines(fileLines[i : i+len(oldLines)])
+	}
+
+	var matches []fuzzyMatch
+	for i, window := range windows {
+		if window == normalizedOld {
+			matches = append(matches, fuzzyMatch{first: i, last: i + len(oldLines) - 1, similarity: 1})
+		}
+	}
+	if len(matches) == 0 && len(normalizedOld) >= fuzzyEditMinChars && len(normalizedOld) <= fuzzyEditMaxChars {
+		for i, window := range windows {
+			if similarity := textSimilarity(normalizedOld, window, fuzzyEditMinSimilarity); similarity >= fuzzyEditMinSimilarity {
+				matches = append(matches, fuzzyMatch{first: i, last: i + len(oldLines) - 1, similarity: similarity})
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", newToolError(ToolErrorNotFound, "old_str not found in file: %s", t.displayPath)
+	case 1:
+	default:
+		places := make([]string, 0, min(len(matches), 5))
+		for _, m := range matches[:min(len(matches), 5)] {
+			places = append(places, lineRange(m.first, m.last))
+		}
+		return "", newToolError(ToolErrorValidation, "old_str not found exactly in file: %s, and it loosely matches %d places (%s); provide more specific text", t.displayPath, len(matches), strings.Join(places, ", "))
+	}
+
+	m := matches[0]
+	matched := fileLines[m.first : m.last+1]
+	replacement := reindent(newStr, oldLines, matched)
+	updated := append(append(append([]string(nil), fileLines[:m.first]...), replacement), fileLines[m.last+1:]...)
+	t.text = strings.Join(updated, "\n")
+
+	if m.similarity == 1 {
+		return fmt.Sprintf("old_str matched %s ignoring whitespace", lineRange(m.first, m.last)), nil
+	}
+	return fmt.Sprintf("old_str matched %s at %.0f%% similarity; the replaced text was:\n%s", lineRange(m.first, m.last), m.similarity*100, strings.Join(matched, "\n")), nil
+}
+
+// normalizeLines joins lines with each one's runs of whitespace collapsed to
+// a single space and its ends trimmed.
+func normalizeLines(lines []string) string {
+	normalized := make([]string, len(lines))
+	for i, line := range lines {
+		normalized[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.Join(normalized, "\n")
+}
+
+func lineRange(first, last int) string {
+	if first == last {
+		return fmt.Sprintf("line %d", first+1)
+	}
+	return fmt.Sprintf("lines %d-%d", first+1, last+1)
+}
+
+// reindent moves newStr's lines from the indentation old_str was written
+// with to the file's. Each line's indentation is matched against the
+// longest indentation of an old_str line it starts with, which is replaced
+// by the indentation of the file line that one matched.
+func reindent(newStr string, oldLines, matched []string) string {
+	indents := make(map[string]string)
+	for i, line := range oldLines {
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(matched[i]) == "" {
+			continue
+		}
+		oldIndent := leadingWhitespace(line)
+		if _, ok := indents[oldIndent]; !ok {
+			indents[oldIndent] = leadingWhitespace(matched[i])
+		}
+	}
+	if len(indents) == 0 {
+		return newStr
+	}
+	lines := strings.Split(newStr, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent, best := leadingWhitespace(line), ""
+		found := false
+		for oldIndent := range indents {
+			if strings.HasPrefix(indent, oldIndent) && (!found || len(oldIndent) > len(best)) {
+				best, found = oldIndent, true
+			}
+		}
+		if found {
+			lines[i] = indents[best] + line[len(best):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// textSimilarity is 1 minus the edit distance between a and b over the
+// longer length. Below minimum the result is only known to be below it.
+func textSimilarity(a, b string, minimum float64) float64 {
+	longest := max(len(a), len(b))
+	if longest == 0 {
+		return 1
+	}
+	limit := int(float64(longest) * (1 - minimum))
+	distance := boundedEditDistance(a, b, limit)
+	if distance > limit {
+		return 0
+	}
+	return 1 - float64(distance)/float64(longest)
+}
+
+// boundedEditDistance is the Levenshtein distance between a and b, or
+// limit+1 when it is larger. Only the diagonal band of width limit is
+// computed, so the cost is proportional to len(a)*limit.
+func boundedEditDistance(a, b string, limit int) int {
+	if len(a)-len(b) > limit || len(b)-len(a) > limit {
+		return limit + 1
+	}
+	const unreachable = 1 << 30
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = unreachable
+		if j <= limit {
+			prev[j] = j
+		}
+	}
+	for i := 1; i <= len(a); i++ {
+		lo, hi := max(1, i-limit), min(len(b), i+limit)
+		cur[lo-1] = unreachable
+		if lo == 1 {
+			cur[0] = i
+		}
+		rowMin := cur[lo-1]
+		for j := lo; j <= hi; j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j], cur[j-1])+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if hi < len(b) {
+			cur[hi+1] = unreachable
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return min(prev[len(b)], limit+1)
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestApplyFuzzy(t *testing.T) {
+	const file = "func main() {\n\tif ready {\n\t\tstart(1, 2)\n\t}\n}\n"
+	tests := []struct {
+		name, text, old, new, want, note string
+	}{
+		{
+			name: "whitespace",
+			text: file,
+			old:  "if ready {\n    start(1,  2)\n}",
+			new:  "if ready {\n    start(3, 4)\n}",
+			want: "func main() {\n\tif ready {\n\t\tstart(3, 4)\n\t}\n}\n",
+			note: "matched lines 2-4 ignoring whitespace",
+		},
+		{
+			name: "reindent added lines",
+			text: file,
+			old:  "    start(1, 2)\n",
+			new:  "    log(\"starting\")\n    start(1, 2)\n",
+			want: "func main() {\n\tif ready {\n\t\tlog(\"starting\")\n\t\tstart(1, 2)\n\t}\n}\n",
+			note: "matched line 3 ignoring whitespace",
+		},
+		{
+			name: "similar",
+			text: "total := computeTotal(order.Items, order.Discount, taxRate)\nreturn total\n",
+			old:  "total := computeTotal(order.Items, order.Discounts, taxRate)",
+			new:  "total := computeTotal(order)",
+			want: "total := computeTotal(order)\nreturn total\n",
+			note: "at 98% similarity; the replaced text was:\ntotal := computeTotal(order.Items, order.Discount, taxRate)",
+		},
+	}
+	for _, tc := range tests {
+		target := &editTarget{displayPath: "main.go", text: tc.text}
+		note, err := target.applyFuzzy(tc.old, tc.new)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if target.text != tc.want {
+			t.Errorf("%s: text = %q, want %q", tc.name, target.text, tc.want)
+		}
+		if !strings.Contains(note, tc.note) {
+			t.Errorf("%s: note = %q, want it to contain %q", tc.name, note, tc.note)
+		}
+	}
+
+	failures := []struct {
+		name, text, old, reason string
+	}{
+		{"missing", file, "stop()", "not found"},
+		{"blank", file, "  \n", "not found"},
+		{"short and similar", file, "start(1, 3)", "not found"},
+		{"ambiguous", "a := 1\nb := 2\na  := 1\n", "a := 1", "loosely matches 2 places (line 1, line 3)"},
+	}
+	for _, tc := range failures {
+		target := &editTarget{displayPath: "main.go", text: tc.text}
+		_, err := target.applyFuzzy(tc.old, "x")
+		if err == nil {
+			t.Errorf("%s: applyFuzzy matched; text = %q", tc.name, target.text)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("%s: error = %q, want it to mention %q", tc.name, err, tc.reason)
+		}
+		if target.text != tc.text {
+			t.Errorf("%s: applyFuzzy changed the text after failing", tc.name)
+		}
+	}
+}
+
+func TestBoundedEditDistance(t *testing.T) {
+	levenshtein := func(a, b string) int {
+		prev := make([]int, len(b)+1)
+		for j := range prev {
+			prev[j] = j
+		}
+		for i := 1; i <= len(a); i++ {
+			cur := make([]int, len(b)+1)
+			cur[0] = i
+			for j := 1; j <= len(b); j++ {
+				cost := 1
+				if a[i-1] == b[j-1] {
+					cost = 0
+				}
+				cur[j] = min(min(prev[j], cur[j-1])+1, prev[j-1]+cost)
+			}
+			prev = cur
+		}
+		return prev[len(b)]
+	}
+	random := rand.New(rand.NewSource(1))
+	word := func() string {
+		b := make([]byte, random.Intn(12))
+		for i := range b {
+			b[i] = "abc"[random.Intn(3)]
+		}
+		return string(b)
+	}
+	for range 2000 {
+		a, b, limit := word(), word(), random.Intn(8)
+		want := min(levenshtein(a, b), limit+1)
+		if got := boundedEditDistance(a, b, limit); got != want {
+			t.Fatalf("boundedEditDistance(%q, %q, %d) = %d, want %d", a, b, limit, got, want)
+		}
+	}
+}
+
+func TestTextSimilarity(t *testing.T) {
+	if got := textSimilarity("", "", 0.9); got != 1 {
+		t.Errorf("textSimilarity of empty strings = %v, want 1", got)
+	}
+	if got := textSimilarity("abcdefghij", "abcdefghiX", 0.5); got != 0.9 {
+		t.Errorf("textSimilarity with one change in ten = %v, want 0.9", got)
+	}
+	if got := textSimilarity("abcdefghij", "zyxwvutsrq", 0.5); got != 0 {
+		t.Errorf("textSimilarity below the minimum = %v, want 0", got)
+	}
+}
@@ -0,0 +1,676 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	defaultGitHubAPIURL = "https://api.github.com"
+	githubTimeout       = 30 * time.Second
+	maxIssueBytes       = 40_000
+	maxIssueComments    = 100
+	prPrompt            = `Write a pull request for the changes made in this session. Reply with only a JSON object with the fields "title" (under 72 characters), "body" (markdown: what changed and why, and how it was verified), "commit_message" (a subject line, a blank line, and a short body), and "branch" (a short kebab-case branch name). Do not call tools.`
+)
+
+var (
+	githubRemotePattern = regexp.MustCompile(`[:/]([^/:]+)/([^/]+?)(?:\.git)?/?$`)
+	// issueURLPattern matches GitHub (/issues/n, /pull/n) and GitLab
+	// (/-/issues/n) issue URLs.
+	issueURLPattern = regexp.MustCompile(`^https?://([^/]+)/(.+?)(?:/-)?/(?:issues|pull|merge_requests)/(\d+)`)
+	issueRefPattern = regexp.MustCompile(`^(?:([\w.-]+(?:/[\w.-]+)+))?#?(\d+)$`)
+)
+
+type FetchIssueInput struct {
+	Issue *string `json:"issue"`
+}
+
+// issueRef identifies an issue on a GitHub or GitLab host.
+type issueRef struct {
+	Host    string
+	Project string
+	Number  string
+}
+
+// issue is the part of an issue the fetch_issue tool reports.
+type issue struct {
+	Title    string
+	URL      string
+	State    string
+	Author   string
+	Labels   []string
+	Body     string
+	Comments []issueComment
+}
+
+type issueComment struct {
+	Author  string
+	Created time.Time
+	Body    string
+}
+
+type CreatePRInput struct {
+	Title         *string `json:"title"`
+	Body          *string `json:"body"`
+	CommitMessage *string `json:"commit_message,omitempty"`
+	Branch        *string `json:"branch,omitempty"`
+	Base          *string `json:"base,omitempty"`
+	Draft         *bool   `json:"draft,omitempty"`
+}
+
+// pullRequestSpec describes the pull request to open. Empty fields get
+// defaults: the title as commit message, a branch named after the title, and
+// the current branch as base.
+type pullRequestSpec struct {
+	Title         string `json:"title"`
+	Body          string `json:"body"`
+	CommitMessage string `json:"commit_message"`
+	Branch        string `json:"branch"`
+	Base          string `json:"base"`
+	Draft         bool   `json:"draft"`
+}
+
+func createPRInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"title": map[string]any{
+				"type":        "string",
+				"description": "Pull request title.",
+			},
+			"body": map[string]any{
+				"type":        "string",
+				"description": "Pull request description in markdown: what changed, why, and how it was verified.",
+			},
+			"commit_message": map[string]any{
+				"type":        "string",
+				"description": "Commit message for the session's changes. Defaults to the title.",
+			},
+			"branch": map[string]any{
+				"type":        "string",
+				"description": "Name of the new branch. Defaults to one derived from the title.",
+			},
+			"base": map[string]any{
+				"type":        "string",
+				"description": "Branch to merge into. Defaults to the current branch.",
+			},
+			"draft": map[string]any{
+				"type":        "boolean",
+				"description": "Open the pull request as a draft. Defaults to false.",
+			},
+		},
+		Required: []string{"title", "body"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func fetchIssueInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"issue": map[string]any{
+				"type":        "string",
+				"description": "Issue URL (GitHub or GitLab), owner/repo#123, or just 123 for an issue in this repository's origin.",
+			},
+		},
+		Required: []string{"issue"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (s *Session) fetchIssue(input json.RawMessage) (string, error) {
+	const expected = `{"issue":"https://github.com/owner/repo/issues/123"}`
+
+	args := FetchIssueInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("fetch_issue", err.Error(), expected)
+	}
+	value, err := requireToolString("fetch_issue", "issue", args.Issue, false, expected)
+	if err != nil {
+		return "", err
+	}
+	ref, err := s.parseIssueRef(strings.TrimSpace(value))
+	if err != nil {
+		return "", toolInputValidationError("fetch_issue", err.Error(), expected)
+	}
+
+	var found issue
+	if isGitLabHost(ref.Host) {
+		found, err = fetchGitLabIssue(ref)
+	} else {
+		found, err = fetchGitHubIssue(ref)
+	}
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(s.out, "Fetched %s/%s#%s (%d comment(s))\n", ref.Host, ref.Project, ref.Number, len(found.Comments))
+	text, truncated := truncateOutput([]byte(found.format()), maxIssueBytes)
+	if truncated {
+		text += "\n\n[issue truncated]"
+	}
+	return text, nil
+}
+
+// parseIssueRef accepts an issue URL, owner/repo#n (on GitHub), or a bare
+// number that refers to the origin remote's project.
+func (s *Session) parseIssueRef(value string) (issueRef, error) {
+	if match := issueURLPattern.FindStringSubmatch(value); match != nil {
+		return issueRef{Host: match[1], Project: match[2], Number: match[3]}, nil
+	}
+	match := issueRefPattern.FindStringSubmatch(value)
+	if match == nil {
+		return issueRef{}, fmt.Errorf("cannot parse issue %q", value)
+	}
+	if match[1] != "" {
+		return issueRef{Host: "github.com", Project: match[1], Number: match[2]}, nil
+	}
+	root := s.workspaceGitRoot()
+	if root == "" {
+		return issueRef{}, errors.New("a bare issue number needs a git repository with an origin remote; pass a URL instead")
+	}
+	remote, err := runGit(root, nil, "remote", "get-url", "origin")
+	if err != nil {
+		return issueRef{}, err
+	}
+	host, project := splitRemote(remote)
+	if host == "" || project == "" {
+		return issueRef{}, fmt.Errorf("cannot tell the project from remote %q", remote)
+	}
+	return issueRef{Host: host, Project: project, Number: match[2]}, nil
+}
+
+// splitRemote returns the host and project path of a remote in either URL or
+// scp-like (git@host:path) form.
+func splitRemote(remote string) (string, string) {
+	remote = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(remote), "/"), ".git")
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return "", ""
+		}
+		return u.Hostname(), strings.TrimPrefix(u.Path, "/")
+	}
+	userHost, path, ok := strings.Cut(remote, ":")
+	if !ok {
+		return "", ""
+	}
+	if _, host, found := strings.Cut(userHost, "@"); found {
+		return host, path
+	}
+	return userHost, path
+}
+
+func fetchGitHubIssue(ref issueRef) (issue, error) {
+	if ref.Host != "github.com" && os.Getenv("GITHUB_API_URL") == "" {
+		return issue{}, fmt.Errorf("set GITHUB_API_URL or GITLAB_HOST to fetch issues from %s", ref.Host)
+	}
+	token := githubToken()
+	path := fmt.Sprintf("/repos/%s/issues/%s", ref.Project, ref.Number)
+	var data struct {
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		State   string `json:"state"`
+		Body    string `json:"body"`
+		User    struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Labels []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
+	}
+	if err := githubRequest(http.MethodGet, path, token, nil, &data); err != nil {
+		return issue{}, err
+	}
+	found := issue{Title: data.Title, URL: data.HTMLURL, State: data.State, Author: data.User.Login, Body: data.Body}
+	for _, label := range data.Labels {
+		found.Labels = append(found.Labels, label.Name)
+	}
+	var comments []struct {
+		Body      string    `json:"body"`
+		CreatedAt time.Time `json:"created_at"`
+		User      struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := githubRequest(http.MethodGet, fmt.Sprintf("%s/comments?per_page=%d", path, maxIssueComments), token, nil, &comments); err != nil {
+		return issue{}, err
+	}
+	for _, comment := range comments {
+		found.Comments = append(found.Comments, issueComment{Author: comment.User.Login, Created: comment.CreatedAt, Body: comment.Body})
+	}
+	return found, nil
+}
+
+func fetchGitLabIssue(ref issueRef) (issue, error) {
+	path := fmt.Sprintf("/projects/%s/issues/%s", url.PathEscape(ref.Project), ref.Number)
+	var data struct {
+		Title  string   `json:"title"`
+		WebURL string   `json:"web_url"`
+		State  string   `json:"state"`
+		Body   string   `json:"description"`
+		Labels []string `json:"labels"`
+		Author struct {
+			Username string `json:"username"`
+		} `json:"author"`
+	}
+	if err := gitlabRequest(ref.Host, path, &data); err != nil {
+		return issue{}, err
+	}
+	found := issue{Title: data.Title, URL: data.WebURL, State: data.State, Author: data.Author.Username, Labels: data.Labels, Body: data.Body}
+	var notes []struct {
+		Body      string    `json:"body"`
+		CreatedAt time.Time `json:"created_at"`
+		System    bool      `json:"system"`
+		Author    struct {
+			Username string `json:"username"`
+		} `json:"author"`
+	}
+	if err := gitlabRequest(ref.Host, fmt.Sprintf("%s/notes?sort=asc&per_page=%d", path, maxIssueComments), &notes); err != nil {
+		return issue{}, err
+	}
+	for _, note := range notes {
+		if !note.System {
+			found.Comments = append(found.Comments, issueComment{Author: note.Author.Username, Created: note.CreatedAt, Body: note.Body})
+		}
+	}
+	return found, nil
+}
+
+// isGitLabHost reports whether host is gitlab.com or the self-hosted GitLab
+// named by $GITLAB_HOST. Only these hosts are sent $GITLAB_TOKEN.
+func isGitLabHost(host string) bool {
+	host = strings.ToLower(host)
+	if host == "gitlab.com" {
+		return true
+	}
+	configured := strings.ToLower(strings.TrimRight(strings.TrimSpace(os.Getenv("GITLAB_HOST")), "/"))
+	if u, err := url.Parse(configured); err == nil && u.Host != "" {
+		configured = u.Host
+	}
+	return configured != "" && host == configured
+}
+
+// gitlabRequest calls the GitLab REST API on host, authenticating with
+// $GITLAB_TOKEN when it is set.
+func gitlabRequest(host, path string, out any) error {
+	if !isGitLabHost(host) {
+		return fmt.Errorf("%s is not gitlab.com or $GITLAB_HOST", host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), githubTimeout)
+	defer cancel()
+	endpoint := "https://" + host + "/api/v4" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if token := strings.TrimSpace(os.Getenv("GITLAB_TOKEN")); token != "" {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message any `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return statusErrorf(resp.StatusCode, "GitLab API GET %s: %s (%v)", path, resp.Status, apiErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (i issue) format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", i.Title)
+	fmt.Fprintf(&b, "URL: %s\nState: %s\nAuthor: %s\n", i.URL, i.State, i.Author)
+	if len(i.Labels) > 0 {
+		fmt.Fprintf(&b, "Labels: %s\n", strings.Join(i.Labels, ", "))
+	}
+	body := strings.TrimSpace(i.Body)
+	if body == "" {
+		body = "(no description)"
+	}
+	fmt.Fprintf(&b, "\n%s\n", body)
+	for _, comment := range i.Comments {
+		fmt.Fprintf(&b, "\n---\n%s commented on %s:\n\n%s\n", comment.Author, comment.Created.Format("2006-01-02"), strings.TrimSpace(comment.Body))
+	}
+	return b.String()
+}
+
+func (s *Session) createPRTool(input json.RawMessage) (string, error) {
+	const expected = `{"title":"Fix off-by-one in pager","body":"The last page was skipped because ...","commit_message":"Fix off-by-one in pager"}`
+
+	args := CreatePRInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("create_pr", err.Error(), expected)
+	}
+	title, err := requireToolString("create_pr", "title", args.Title, false, expected)
+	if err != nil {
+		return "", err
+	}
+	body, err := requireToolString("create_pr", "body", args.Body, true, expected)
+	if err != nil {
+		return "", err
+	}
+	spec := pullRequestSpec{Title: strings.TrimSpace(title), Body: body}
+	if args.CommitMessage != nil {
+		spec.CommitMessage = *args.CommitMessage
+	}
+	if args.Branch != nil {
+		spec.Branch = strings.TrimSpace(*args.Branch)
+	}
+	if args.Base != nil {
+		spec.Base = strings.TrimSpace(*args.Base)
+	}
+	if args.Draft != nil {
+		spec.Draft = *args.Draft
+	}
+	url, err := s.openPullRequest(&spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("opened pull request %s from branch %s", url, spec.Branch), nil
+}
+
+func prCommand(s *Session, args string) error {
+	spec, err := s.draftPullRequest()
+	if err != nil {
+		return err
+	}
+	if args != "" {
+		spec.Base = args
+	}
+	url, err := s.openPullRequest(&spec)
+	if err != nil {
+		return err
+	}
+	s.addNote(fmt.Sprintf("Note: the user committed this session's changes to branch %s and opened pull request %s.", spec.Branch, url))
+	return nil
+}
+
+// draftPullRequest asks the model for a title, description, commit message,
+// and branch name for the session's work.
+func (s *Session) draftPullRequest() (pullRequestSpec, error) {
+	var spec pullRequestSpec
+	if len(s.history) == 0 {
+		return spec, errors.New("nothing has happened in this session yet")
+	}
+	if s.history[len(s.history)-1].Role == anthropic.MessageParamRoleUser {
+		return spec, errors.New("cannot draft a pull request right after a failed request; send another prompt first")
+	}
+	request := append(append([]anthropic.MessageParam(nil), s.history...), anthropic.NewUserMessage(anthropic.NewTextBlock(prPrompt)))
+	fmt.Fprintln(s.out, "Drafting the pull request...")
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout(s.cfg, s.cfg.ModelID, defaultMaxTokens))
+	defer cancel()
+	start := time.Now()
+	message, _, err := s.provider.Send(ctx, ProviderRequest{
+		ModelID:      s.cfg.ModelID,
+		SystemPrompt: s.cfg.SystemPrompt,
+		History:      request,
+		Tools:        s.tools,
+	})
+	metrics.observeAPICall(s.cfg.ModelID, time.Since(start), message, err)
+	if err != nil {
+		return spec, fmt.Errorf("draft request failed: %w", err)
+	}
+	text, _ := parseContent(message.Content)
+	first, last := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if first < 0 || last < first {
+		return spec, errors.New("the model did not return a pull request draft")
+	}
+	if err := json.Unmarshal([]byte(text[first:last+1]), &spec); err != nil {
+		return spec, fmt.Errorf("the model returned an invalid pull request draft: %w", err)
+	}
+	spec.Base, spec.Draft = "", false
+	if strings.TrimSpace(spec.Title) == "" {
+		return spec, errors.New("the model's pull request draft has no title")
+	}
+	return spec, nil
+}
+
+// openPullRequest commits the files changed during the session to a new
+// branch, pushes it to origin, and opens a pull request on GitHub. It fills
+// in the defaults of spec and returns the pull request URL.
+func (s *Session) openPullRequest(spec *pullRequestSpec) (string, error) {
+	root := s.workspaceGitRoot()
+	if root == "" {
+		return "", errors.New("the workspace is not inside a git repository")
+	}
+	token := githubToken()
+	if token == "" {
+		return "", errors.New("GITHUB_TOKEN (or GH_TOKEN) is not set")
+	}
+	remote, err := runGit(root, nil, "remote", "get-url", "origin")
+	if err != nil {
+		return "", err
+	}
+	owner, repo, err := parseGitHubRemote(remote)
+	if err != nil {
+		return "", err
+	}
+	paths, err := s.sessionChangedPaths(root)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", errors.New("no files have changed in this session")
+	}
+
+	if spec.Base == "" {
+		spec.Base, err = runGit(root, nil, "rev-parse", "--abbrev-ref", "HEAD")
+		if err != nil || spec.Base == "HEAD" {
+			var info struct {
+				DefaultBranch string `json:"default_branch"`
+			}
+			if err := githubRequest(http.MethodGet, fmt.Sprintf("/repos/%s/%s", owner, repo), token, nil, &info); err != nil {
+				return "", err
+			}
+			spec.Base = info.DefaultBranch
+		}
+	}
+	if spec.Branch == "" {
+		spec.Branch = "coder/" + branchSlug(spec.Title)
+	}
+	if spec.Branch == spec.Base {
+		return "", fmt.Errorf("branch %s is the base branch; choose another name", spec.Branch)
+	}
+	if strings.TrimSpace(spec.CommitMessage) == "" {
+		spec.CommitMessage = spec.Title
+	}
+
+	if !s.confirm(fmt.Sprintf("Commit %d file(s) to new branch %s, push it to %s/%s, and open a pull request into %s titled %q?", len(paths), spec.Branch, owner, repo, spec.Base, spec.Title)) {
+		return "", errors.New("the user declined to open the pull request")
+	}
+	start, err := runGit(root, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	startBranch, _ := runGit(root, nil, "symbolic-ref", "-q", "--short", "HEAD")
+	literal := []string{"GIT_LITERAL_PATHSPECS=1"}
+	if _, err := runGit(root, nil, "switch", "-c", spec.Branch); err != nil {
+		return "", err
+	}
+	if _, err := runGit(root, literal, append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		return "", abandonBranch(root, spec.Branch, startBranch, start, err)
+	}
+	if _, err := runGit(root, literal, append([]string{"commit", "-q", "-m", spec.CommitMessage, "--"}, paths...)...); err != nil {
+		return "", abandonBranch(root, spec.Branch, startBranch, start, err)
+	}
+	if _, err := runGit(root, nil, "push", "-q", "-u", "origin", spec.Branch); err != nil {
+		return "", abandonBranch(root, spec.Branch, startBranch, start, err)
+	}
+
+	body := strings.TrimSpace(spec.Body) + "\n\n<details><summary>Files changed</summary>\n\n"
+	for _, path := range paths {
+		body += "- `" + path + "`\n"
+	}
+	body += "\n</details>\n"
+	var pr struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	payload := map[string]any{"title": spec.Title, "body": body, "head": spec.Branch, "base": spec.Base, "draft": spec.Draft}
+	if err := githubRequest(http.MethodPost, fmt.Sprintf("/repos/%s/%s/pulls", owner, repo), token, payload, &pr); err != nil {
+		return "", fmt.Errorf("pushed branch %s but could not open the pull request: %w", spec.Branch, err)
+	}
+	s.audit.record(AuditEntry{Tool: "create_pr", Command: fmt.Sprintf("push origin %s; open %s", spec.Branch, pr.HTMLURL)})
+	debugf("pull_request_opened number=%d branch=%q base=%q files=%d", pr.Number, spec.Branch, spec.Base, len(paths))
+	fmt.Fprintf(s.out, "Opened pull request #%d: %s\n", pr.Number, pr.HTMLURL)
+	return pr.HTMLURL, nil
+}
+
+// abandonBranch undoes the local half of openPullRequest after a step failed:
+// it moves HEAD back to start without touching the index or working tree, so a
+// commit already made on branch is undone but its changes stay in place, then
+// checks out startBranch (or start itself when HEAD was detached) and deletes
+// branch. It returns err, extended with anything that could not be undone.
+func abandonBranch(root, branch, startBranch, start string, err error) error {
+	if _, resetErr := runGit(root, nil, "reset", "-q", "--soft", start); resetErr != nil {
+		return fmt.Errorf("%w (branch %s is still checked out: %v)", err, branch, resetErr)
+	}
+	back := []string{"switch", "-q", startBranch}
+	if startBranch == "" {
+		back = []string{"switch", "-q", "--detach", start}
+	}
+	if _, switchErr := runGit(root, nil, back...); switchErr != nil {
+		return fmt.Errorf("%w (branch %s is still checked out: %v)", err, branch, switchErr)
+	}
+	if _, deleteErr := runGit(root, nil, "branch", "-q", "-D", branch); deleteErr != nil {
+		return fmt.Errorf("%w (could not delete branch %s: %v)", err, branch, deleteErr)
+	}
+	return err
+}
+
+// sessionChangedPaths lists the files, relative to the repository root, that
+// differ between the session's first checkpoint and the working tree now.
+// Without checkpoints it compares against HEAD.
+func (s *Session) sessionChangedPaths(root string) ([]string, error) {
+	from := "HEAD"
+	if len(s.checkpoints) > 0 {
+		from = s.checkpoints[0].Commit
+	}
+	now, err := snapshotWorkspace(root, s.coderDirInRepo(root), "coder pull request snapshot")
+	if err != nil {
+		return nil, err
+	}
+	out, err := runGit(root, nil, "diff", "--name-only", "--no-renames", "-z", from, now)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range strings.Split(out, "\x00") {
+		if name != "" {
+			paths = append(paths, name)
+		}
+	}
+	return paths, nil
+}
+
+func githubToken() string {
+	if token := strings.TrimSpace(os.Getenv("GITHUB_TOKEN")); token != "" {
+		return token
+	}
+	return strings.TrimSpace(os.Getenv("GH_TOKEN"))
+}
+
+// parseGitHubRemote extracts owner and repository from an origin URL such as
+// git@github.com:owner/repo.git or https://github.com/owner/repo.
+func parseGitHubRemote(remote string) (string, string, error) {
+	match := githubRemotePattern.FindStringSubmatch(strings.TrimSpace(remote))
+	if match == nil {
+		return "", "", fmt.Errorf("cannot tell the GitHub repository from remote %q", remote)
+	}
+	return match[1], match[2], nil
+}
+
+// githubRequest calls the GitHub REST API ($GITHUB_API_URL, for GitHub
+// Enterprise, or api.github.com) and decodes the JSON response into out.
+func githubRequest(method, path, token string, payload, out any) error {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("GITHUB_API_URL")), "/")
+	if base == "" {
+		base = defaultGitHubAPIURL
+	}
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), githubTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return statusErrorf(resp.StatusCode, "GitHub API %s %s: %s (%s)", method, path, resp.Status, apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// branchSlug turns a title into a branch-name fragment.
+func branchSlug(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= 40 {
+			break
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		return "changes"
+	}
+	return slug
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAbandonBranch(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "test@example.com")
+	}
+	root := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(root, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	file := filepath.Join(root, "main.go")
+	git("init", "-q", "-b", "main")
+	if err := os.WriteFile(file, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "main.go")
+	git("commit", "-q", "-m", "initial")
+	start := git("rev-parse", "HEAD")
+
+	// A push failed after the change was committed on the new branch.
+	if err := os.WriteFile(file, []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("switch", "-q", "-c", "coder/fix")
+	git("add", "main.go")
+	git("commit", "-q", "-m", "fix")
+	pushErr := errors.New("git push: rejected")
+	if err := abandonBranch(root, "coder/fix", "main", start, pushErr); err != pushErr {
+		t.Fatalf("abandonBranch = %v, want %v", err, pushErr)
+	}
+
+	if branch := git("symbolic-ref", "--short", "HEAD"); branch != "main" {
+		t.Errorf("checked out %s after abandoning the branch, want main", branch)
+	}
+	if head := git("rev-parse", "HEAD"); head != start {
+		t.Errorf("main moved to %s, want %s", head, start)
+	}
+	if branches := git("branch", "--list", "coder/fix"); branches != "" {
+		t.Errorf("branch coder/fix still exists: %q", branches)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "new\n" {
+		t.Errorf("main.go = %q, %v; want the session's change kept", data, err)
+	}
+}
+
+func TestIsGitLabHost(t *testing.T) {
+	t.Setenv("GITLAB_HOST", "https://git.example.com/")
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"gitlab.com", true},
+		{"GitLab.com", true},
+		{"git.example.com", true},
+		{"gitlab.attacker.example", false},
+		{"gitlab.com.attacker.example", false},
+		{"git.example.com.attacker.example", false},
+		{"github.com", false},
+	}
+	for _, tc := range tests {
+		if got := isGitLabHost(tc.host); got != tc.want {
+			t.Errorf("isGitLabHost(%q) = %v, want %v", tc.host, got, tc.want)
+		}
+	}
+
+	t.Setenv("GITLAB_HOST", "")
+	if isGitLabHost("git.example.com") {
+		t.Error("isGitLabHost accepted a self-hosted instance with GITLAB_HOST unset")
+	}
+}
+
+func TestGitLabRequestRefusesOtherHosts(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "glpat-secret")
+	t.Setenv("GITLAB_HOST", "")
+	var out any
+	err := gitlabRequest("gitlab.attacker.example", "/projects/x/issues/1", &out)
+	if err == nil || !strings.Contains(err.Error(), "is not gitlab.com or $GITLAB_HOST") {
+		t.Errorf("gitlabRequest to an unconfigured host = %v, want it refused before any request", err)
+	}
+}
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// maxPipedInputBytes caps how much piped stdin is attached to the prompt. Logs
+// tend to end with the failure, so the tail is kept.
+const maxPipedInputBytes = 256 << 10
+
+// readPipedInput reads all of stdin when it is not a terminal, as in
+// cat error.log | coder -p "explain this failure". It returns "" for a
+// terminal.
+func readPipedInput() (string, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return "", nil
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read stdin: %w", err)
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(string(data), "")), nil
+}
+
+// pipedInputBlock formats piped stdin as context for the first message.
+func pipedInputBlock(piped string) string {
+	note := ""
+	if len(piped) > maxPipedInputBytes {
+		note = fmt.Sprintf(" (only the last %d of %d bytes)", maxPipedInputBytes, len(piped))
+		piped = strings.ToValidUTF8(piped[len(piped)-maxPipedInputBytes:], "")
+	}
+	return fmt.Sprintf("Content piped to stdin%s:\n<stdin>\n%s\n</stdin>", note, piped)
+}
+
+// Exit codes for headless, -ci, and coder fix runs, so wrappers can branch on
+// the outcome whichever way a task was run.
+const (
+	exitHeadlessSuccess    = 0
+	exitHeadlessTaskFailed = 1
+	exitHeadlessLimit      = 2
+	exitHeadlessError      = 3
+)
+
+// taskOutcome is what the model reported with report_outcome.
+type taskOutcome struct {
+	Success bool
+	Summary string
+}
+
+type ReportOutcomeInput struct {
+	Success *bool  `json:"success"`
+	Summary string `json:"summary,omitempty"`
+}
+
+func reportOutcomeInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"success": map[string]any{
+				"type":        "boolean",
+				"description": "Whether the task was completed successfully.",
+			},
+			"summary": map[string]any{
+				"type":        "string",
+				"description": "One or two sentences on what was done, or why it failed.",
+			},
+		},
+		Required: []string{"success"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// reportOutcome records the model's verdict on the task for the exit code of
+// a headless run. A later report replaces an earlier one.
+func (s *Session) reportOutcome(input json.RawMessage) (string, error) {
+	const expected = `{"success":true,"summary":"Fixed the nil map write in parseConfig; go test ./... passes."}`
+
+	args := ReportOutcomeInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("report_outcome", err.Error(), expected)
+	}
+	if args.Success == nil {
+		return "", toolInputValidationError("report_outcome", `missing required field "success"`, expected)
+	}
+	s.outcome = &taskOutcome{Success: *args.Success, Summary: strings.TrimSpace(args.Summary)}
+	debugf("report_outcome success=%t summary_chars=%d", s.outcome.Success, len(s.outcome.Summary))
+	if s.outcome.Success {
+		fmt.Fprintln(s.out, "Outcome: success")
+		return "Recorded: success.", nil
+	}
+	fmt.Fprintln(s.out, "Outcome: failure")
+	return "Recorded: failure.", nil
+}
+
+// runHeadless runs the -p prompt, with any piped stdin attached, or the
+// piped stdin itself as the prompt, or the steps of a -script file, without
+// the chat loop. Stdin is used up, so confirmation prompts are declined unless
+// -yes is set. With -quiet, everything a turn prints is discarded and only its
+// final reply is written, so the output can be captured by a script.
+//
+// It returns the exit code: failure if the model reported it with
+// report_outcome or a verify command failed, the limit code if a cost,
+// context, or round limit ended a turn, and the error code if a model request
+// failed or the script could not be read. A script stops at the first step
+// that does not succeed.
+func runHeadless(cfg Config, session *Session, provider Provider, toolMap map[string]Tool, anthropicTools []anthropic.ToolUnionParam, piped string) int {
+	var steps []scriptStep
+	switch {
+	case cfg.ScriptPath != "":
+		var err error
+		if steps, err = loadScript(cfg.ScriptPath); err != nil {
+			return headlessFailure(exitHeadlessError, err)
+		}
+		if piped != "" {
+			session.addNote(pipedInputBlock(piped))
+		}
+	case cfg.Prompt != "":
+		steps = []scriptStep{{Prompt: cfg.Prompt}}
+		if piped != "" {
+			session.addNote(pipedInputBlock(piped))
+		}
+	default:
+		if len(piped) > maxPipedInputBytes {
+			return headlessFailure(exitHeadlessError, fmt.Errorf("piped prompt is %d bytes, more than %d; pass a short instruction with -p and pipe the content", len(piped), maxPipedInputBytes))
+		}
+		steps = []scriptStep{{Prompt: piped}}
+	}
+	debugf("headless_run steps=%d piped_chars=%d", len(steps), len(piped))
+
+	session.input = bufio.NewScanner(strings.NewReader(""))
+	session.provider, session.tools = provider, anthropicTools
+	for i, step := range steps {
+		if len(steps) > 1 && !cfg.Quiet {
+			fmt.Fprintf(session.out, "%s %d/%d: %s\n", colorLabel("step", warnColor, cfg.ColorOutput), i+1, len(steps), previewText(step.Prompt, 60))
+		}
+		session.outcome = nil
+		code, err := runHeadlessTurn(cfg, session, provider, toolMap, anthropicTools, step.Prompt)
+		if code == exitHeadlessSuccess && step.Verify != "" {
+			code, err = verifyTask(cfg, step.Verify)
+		}
+		if code != exitHeadlessSuccess {
+			if err == nil {
+				// The failed request has already been reported on stderr.
+				debugf("headless_exit code=%d step=%d", code, i+1)
+				return code
+			}
+			if len(steps) > 1 {
+				err = fmt.Errorf("step %d: %w", i+1, err)
+			}
+			return headlessFailure(code, err)
+		}
+	}
+	if cfg.VerifyCommand != "" {
+		if code, err := verifyTask(cfg, cfg.VerifyCommand); code != exitHeadlessSuccess {
+			return headlessFailure(code, err)
+		}
+	}
+	debugf("headless_exit code=%d", exitHeadlessSuccess)
+	return exitHeadlessSuccess
+}
+
+func headlessFailure(code int, err error) int {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	debugf("headless_exit code=%d error=%q", code, err.Error())
+	return code
+}
+
+// runHeadlessTurn runs one prompt and maps how the turn ended to an exit
+// code. The error is nil for failures runTurn has already reported.
+func runHeadlessTurn(cfg Config, session *Session, provider Provider, toolMap map[string]Tool, anthropicTools []anthropic.ToolUnionParam, prompt string) (int, error) {
+	out := session.out
+	if cfg.Quiet {
+		session.out = io.Discard
+	}
+	stats := runTurn(context.Background(), cfg, session, provider, toolMap, anthropicTools, prompt)
+	session.out = out
+	if cfg.Quiet && stats.FinalText != "" {
+		fmt.Fprintln(out, stats.FinalText)
+	}
+
+	switch {
+	case errors.Is(stats.Err, errCostBudgetExceeded), errors.Is(stats.Err, errContextWindowExceeded):
+		return exitHeadlessLimit, stats.Err
+	case stats.Err != nil:
+		return exitHeadlessError, nil
+	case stats.Stopped == stopConditionStopped:
+		return exitHeadlessLimit, fmt.Errorf("stopped: %s", stats.StopReason)
+	case stats.Stopped == "max_tool_rounds":
+		return exitHeadlessLimit, fmt.Errorf("stopped after %d tool rounds", maxToolRoundsPerTurn)
+	case stats.Stopped != "":
+		return exitHeadlessTaskFailed, fmt.Errorf("tool loop stopped: %s", stats.Stopped)
+	case session.outcome != nil && !session.outcome.Success:
+		if session.outcome.Summary != "" {
+			return exitHeadlessTaskFailed, fmt.Errorf("the agent reported failure: %s", session.outcome.Summary)
+		}
+		return exitHeadlessTaskFailed, errors.New("the agent reported failure")
+	}
+	return exitHeadlessSuccess, nil
+}
+
+// verifyTask runs a verify command after a turn; it fails the task if the
+// command exits non-zero, printing the end of its output to stderr.
+func verifyTask(cfg Config, command string) (int, error) {
+	if !cfg.Quiet {
+		fmt.Fprintf(os.Stdout, "Verifying with %s\n", command)
+	}
+	test := runCITests(context.Background(), command)
+	if !test.Passed {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(test.Output))
+		return exitHeadlessTaskFailed, fmt.Errorf("%q exited with status %d", command, test.ExitCode)
+	}
+	return exitHeadlessSuccess, nil
+}
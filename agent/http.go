@@ -0,0 +1,318 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	defaultHTTPTimeoutSeconds = 30
+	hardHTTPTimeoutSeconds    = 120
+	defaultHTTPResponseBytes  = 64_000
+	hardHTTPResponseBytes     = 1_000_000
+	maxHTTPRequestBody        = 1_000_000
+	maxHTTPRedirects          = 5
+)
+
+var (
+	// httpEnvReference is a ${NAME} in a header value, filled in when the
+	// request is sent.
+	httpEnvReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	// httpSharedAddressSpace is the carrier-grade NAT range, private in
+	// practice but not in net.IP.IsPrivate.
+	httpSharedAddressSpace = net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+)
+
+// HTTPConfig controls http_request.
+type HTTPConfig struct {
+	// AllowHosts are hosts, or host:port pairs, the tool may reach even
+	// though they are loopback or private addresses, such as a local dev
+	// server at localhost:8080.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+	// EnvAllow are patterns, like env.allow's, for agent environment
+	// variables that ${NAME} in headers may use on top of those bash
+	// commands see, such as API_TOKEN.
+	EnvAllow []string `json:"env_allow,omitempty"`
+}
+
+type HTTPRequestInput struct {
+	Method           string            `json:"method,omitempty"`
+	URL              *string           `json:"url"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Body             string            `json:"body,omitempty"`
+	TimeoutSeconds   int               `json:"timeout_seconds,omitempty"`
+	MaxResponseBytes int               `json:"max_response_bytes,omitempty"`
+}
+
+func httpRequestInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"method": map[string]any{
+				"type":        "string",
+				"enum":        []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+				"description": "Defaults to GET.",
+			},
+			"url": map[string]any{
+				"type":        "string",
+				"description": "Absolute http or https URL.",
+			},
+			"headers": map[string]any{
+				"type":                 "object",
+				"additionalProperties": map[string]any{"type": "string"},
+				"description":          "Request headers. Write secrets as ${ENV_VAR}, as in {\"Authorization\": \"Bearer ${API_TOKEN}\"}; the value is filled in from the environment and never shown.",
+			},
+			"body": map[string]any{
+				"type":        "string",
+				"description": "Request body. Set Content-Type in headers; a body that is valid JSON defaults to application/json.",
+			},
+			"timeout_seconds": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Defaults to %d, capped at %d.", defaultHTTPTimeoutSeconds, hardHTTPTimeoutSeconds),
+			},
+			"max_response_bytes": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("How much of the response body to return. Defaults to %d, capped at %d.", defaultHTTPResponseBytes, hardHTTPResponseBytes),
+			},
+		},
+		Required: []string{"url"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// httpRequest sends one HTTP request and returns the status, the response
+// headers, and the start of the body. Loopback, private, and link-local
+// addresses are refused unless the project allows the host, and the check
+// runs on each connection, so neither redirects nor DNS can get around it.
+func (s *Session) httpRequest(input json.RawMessage) (string, error) {
+	const expected = `{"method":"GET","url":"https://api.example.com/v1/users/42","headers":{"Authorization":"Bearer ${API_TOKEN}"}}`
+
+	args := HTTPRequestInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("http_request", err.Error(), expected)
+	}
+	rawURL, err := requireToolString("http_request", "url", args.URL, false, expected)
+	if err != nil {
+		return "", err
+	}
+	target, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return "", toolInputValidationError("http_request", "url must be an absolute http or https URL", expected)
+	}
+	method := strings.ToUpper(strings.TrimSpace(args.Method))
+	if method == "" {
+		method = http.MethodGet
+	}
+	if len(args.Body) > maxHTTPRequestBody {
+		return "", toolInputValidationError("http_request", fmt.Sprintf("body is larger than %d bytes", maxHTTPRequestBody), expected)
+	}
+	timeoutSeconds := defaultHTTPTimeoutSeconds
+	if args.TimeoutSeconds > 0 {
+		timeoutSeconds = min(args.TimeoutSeconds, hardHTTPTimeoutSeconds)
+	}
+	maxBytes := defaultHTTPResponseBytes
+	if args.MaxResponseBytes > 0 {
+		maxBytes = min(args.MaxResponseBytes, hardHTTPResponseBytes)
+	}
+
+	ctx, cancel := context.WithTimeout(s.toolContext(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), strings.NewReader(args.Body))
+	if err != nil {
+		return "", toolInputValidationError("http_request", err.Error(), expected)
+	}
+	for _, name := range sortedKeys(args.Headers) {
+		value, err := s.expandHTTPHeader(args.Headers[name])
+		if err != nil {
+			return "", newToolError(ToolErrorValidation, "header %s: %v", name, err)
+		}
+		req.Header.Set(name, value)
+	}
+	if args.Body != "" && req.Header.Get("Content-Type") == "" && json.Valid([]byte(args.Body)) {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "coder")
+	}
+
+	start := time.Now()
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		var blocked *blockedAddressError
+		switch {
+		case errors.As(err, &blocked):
+			return "", newToolError(ToolErrorPermission, "%s resolves to %s, a %s address; add the host to http.allow_hosts in the project config to reach it", target.Hostname(), blocked.ip, blocked.kind)
+		case ctx.Err() == context.DeadlineExceeded:
+			return "", newToolError(ToolErrorTimeout, "request timed out after %d seconds", timeoutSeconds)
+		}
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil && len(body) == 0 {
+		return "", fmt.Errorf("reading the response failed: %v", err)
+	}
+	truncated := len(body) > maxBytes
+	if truncated {
+		body = body[:maxBytes]
+	}
+	s.audit.record(AuditEntry{
+		Tool:        "http_request",
+		Command:     method + " " + target.Redacted(),
+		OutputBytes: len(body),
+		DurationMs:  time.Since(start).Milliseconds(),
+	})
+	debugf("http_request method=%q url=%q status=%d body_bytes=%d", method, target.Redacted(), resp.StatusCode, len(body))
+	fmt.Fprintf(s.out, "%s: %s %s -> %s\n", colorLabel("http", commentColor, s.cfg.ColorOutput), method, target.Redacted(), resp.Status)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", resp.Proto, resp.Status)
+	if final := resp.Request.URL; final.String() != target.String() {
+		fmt.Fprintf(&b, "(redirected to %s)\n", final.Redacted())
+	}
+	for _, name := range sortedKeys(resp.Header) {
+		for _, value := range resp.Header[name] {
+			if sensitiveHTTPHeader(name) {
+				value = redactionMarker + "header]"
+			}
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	b.WriteString("\n")
+	switch {
+	case method == http.MethodHead:
+	case !utf8.Valid(body):
+		fmt.Fprintf(&b, "(%d bytes of binary content)", len(body))
+	default:
+		b.Write(body)
+		if truncated {
+			fmt.Fprintf(&b, "\n\n(body truncated at %d bytes)", maxBytes)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// httpClient returns a client whose connections refuse addresses inside the
+// machine or its networks, apart from the hosts the project allows. It
+// ignores proxy settings, which would hide the real destination.
+func (s *Session) httpClient() *http.Client {
+	allowed := map[string]bool{}
+	for _, host := range s.cfg.Project.HTTP.AllowHosts {
+		allowed[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+	transport := &http.Transport{
+		Proxy:               nil,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			dialer := &net.Dialer{Timeout: 10 * time.Second}
+			if !allowed[strings.ToLower(host)] && !allowed[strings.ToLower(addr)] {
+				dialer.Control = func(_, address string, _ syscall.RawConn) error {
+					ipText, _, _ := net.SplitHostPort(address)
+					if kind := blockedAddressKind(net.ParseIP(ipText)); kind != "" {
+						return &blockedAddressError{ip: ipText, kind: kind}
+					}
+					return nil
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxHTTPRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxHTTPRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+type blockedAddressError struct {
+	ip   string
+	kind string
+}
+
+func (e *blockedAddressError) Error() string {
+	return fmt.Sprintf("%s is a %s address", e.ip, e.kind)
+}
+
+// blockedAddressKind names why http_request may not connect to ip, or
+// returns "" if it may.
+func blockedAddressKind(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return "unparseable"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate(), httpSharedAddressSpace.Contains(ip):
+		return "private"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		// Including 169.254.169.254, the cloud metadata service.
+		return "link-local"
+	case ip.IsUnspecified(), ip.IsMulticast(), ip.IsInterfaceLocalMulticast():
+		return "non-unicast"
+	}
+	return ""
+}
+
+// expandHTTPHeader fills in the ${NAME} references in a header value from
+// the environment bash commands get, and from the agent's own variables
+// that http.env_allow names. Other variables are never read, so a request
+// cannot send off a credential the project did not hand out.
+func (s *Session) expandHTTPHeader(value string) (string, error) {
+	if !httpEnvReference.MatchString(value) {
+		return value, nil
+	}
+	vars := make(map[string]string)
+	for _, entry := range s.commandEnv() {
+		name, v, _ := strings.Cut(entry, "=")
+		vars[name] = v
+	}
+	var missing []string
+	expanded := httpEnvReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := httpEnvReference.FindStringSubmatch(ref)[1]
+		v, ok := vars[name]
+		if !ok && envNameAllowed(name, s.cfg.Project.HTTP.EnvAllow) {
+			v, ok = os.LookupEnv(name)
+		}
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set, or not listed in http.env_allow", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// sensitiveHTTPHeader reports whether a header carries credentials.
+func sensitiveHTTPHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	}
+	return strings.Contains(name, "token") || strings.Contains(name, "api-key") || strings.Contains(name, "apikey") || strings.Contains(name, "secret")
+}
@@ -0,0 +1,607 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	indexDirName       = "index"
+	codeIndexName      = "files.json"
+	embeddingIndexName = "embeddings.json"
+	codeIndexVersion   = 1
+	maxSummaryChars    = 200
+)
+
+// codeIndex is the persistent record of the workspace's text files kept in
+// .coder/index. An entry is refreshed when its file's size or modification
+// time changes and the content hash no longer matches.
+type codeIndex struct {
+	Version int                     `json:"version"`
+	Updated time.Time               `json:"updated"`
+	Files   map[string]*indexedFile `json:"files"`
+}
+
+type indexedFile struct {
+	Hash    string         `json:"hash"`
+	Size    int64          `json:"size"`
+	ModTime time.Time      `json:"mod_time"`
+	Lines   int            `json:"lines"`
+	Summary string         `json:"summary,omitempty"`
+	Symbols []sourceSymbol `json:"symbols,omitempty"`
+}
+
+// indexUpdate counts what updateCodeIndex changed.
+type indexUpdate struct {
+	Files   int
+	Updated int
+	Removed int
+}
+
+func (u indexUpdate) changed() bool { return u.Updated > 0 || u.Removed > 0 }
+
+func indexDir(root string) string {
+	return filepath.Join(root, coderDirName, indexDirName)
+}
+
+func readIndexFile(root, name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(indexDir(root), name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeIndexFile(root, name string, v any) error {
+	dir := indexDir(root)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// loadCodeIndex reads the index saved in the workspace at root, or returns
+// an empty one when there is none or it was written by an incompatible
+// version.
+func loadCodeIndex(root string) *codeIndex {
+	var index codeIndex
+	if err := readIndexFile(root, codeIndexName, &index); err != nil || index.Version != codeIndexVersion || index.Files == nil {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			debugf("code_index_unreadable error=%q", err.Error())
+		}
+		return &codeIndex{Version: codeIndexVersion, Files: make(map[string]*indexedFile)}
+	}
+	return &index
+}
+
+// updateCodeIndex brings index up to date with the workspace at root. Binary
+// files and files over maxSourceFileBytes are left out.
+func updateCodeIndex(root string, index *codeIndex) (indexUpdate, error) {
+	paths, err := workspaceSourceFiles(root, maxSourceFiles)
+	if err != nil {
+		return indexUpdate{}, err
+	}
+	var update indexUpdate
+	present := make(map[string]bool, len(paths))
+	for _, rel := range paths {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxSourceFileBytes {
+			continue
+		}
+		entry := index.Files[rel]
+		if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			present[rel] = true
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil || bytes.IndexByte(content, 0) >= 0 {
+			continue
+		}
+		present[rel] = true
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])
+		if entry != nil && entry.Hash == hash {
+			entry.ModTime = info.ModTime()
+			continue
+		}
+		index.Files[rel] = &indexedFile{
+			Hash:    hash,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Lines:   bytes.Count(content, []byte("\n")),
+			Summary: fileSummary(content),
+			Symbols: extractSymbols(rel, content),
+		}
+		update.Updated++
+	}
+	for rel := range index.Files {
+		if !present[rel] {
+			delete(index.Files, rel)
+			update.Removed++
+		}
+	}
+	update.Files = len(index.Files)
+	index.Updated = time.Now()
+	return update, nil
+}
+
+// fileSummary returns the file's leading comment, skipping license headers,
+// as a one-line description.
+func fileSummary(content []byte) string {
+	var block []string
+	flush := func() string {
+		text := strings.Join(block, " ")
+		block = nil
+		if strings.Contains(strings.ToLower(text), "license") || strings.Contains(strings.ToLower(text), "copyright") {
+			return ""
+		}
+		if len(text) > maxSummaryChars {
+			text = strings.ToValidUTF8(text[:maxSummaryChars], "") + "…"
+		}
+		return text
+	}
+
+	blockEnd := ""
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if i == 0 && strings.HasPrefix(trimmed, "#!") {
+			continue
+		}
+		if blockEnd == "" {
+			for _, open := range []string{"/*", `"""`, "'''"} {
+				if strings.HasPrefix(trimmed, open) {
+					blockEnd, trimmed = open, trimmed[len(open):]
+					if open == "/*" {
+						blockEnd = "*/"
+					}
+					break
+				}
+			}
+		}
+		if blockEnd != "" {
+			closed := false
+			if j := strings.Index(trimmed, blockEnd); j >= 0 {
+				trimmed, closed = trimmed[:j], true
+			}
+			if text := strings.TrimSpace(strings.TrimLeft(trimmed, "* ")); text != "" {
+				block = append(block, text)
+			}
+			if closed {
+				blockEnd = ""
+				if summary := flush(); summary != "" {
+					return summary
+				}
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "//"), strings.HasPrefix(trimmed, "#"), strings.HasPrefix(trimmed, "--"):
+			if text := strings.TrimSpace(strings.TrimLeft(trimmed, "/#-!")); text != "" {
+				block = append(block, text)
+			}
+		case trimmed == "":
+			if summary := flush(); summary != "" {
+				return summary
+			}
+		default:
+			// Code starts; a comment directly above it still counts.
+			return flush()
+		}
+	}
+	return flush()
+}
+
+// embeddingVector stores a vector as base64 little-endian float32s, which
+// keeps the on-disk embedding index several times smaller than JSON numbers.
+type embeddingVector []float32
+
+func (v embeddingVector) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(buf))
+}
+
+func (v *embeddingVector) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	if len(buf)%4 != 0 {
+		return errors.New("embedding vector has a truncated value")
+	}
+	out := make([]float32, len(buf)/4)
+	for i := range out {
+		out[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	*v = out
+	return nil
+}
+
+// runIndex implements "coder index [flags]".
+func runIndex(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ContinueOnError)
+	embeddings := fs.String("embeddings", "", "Also embed changed files with this model, as provider:model (e.g. ollama:nomic-embed-text)")
+	ollamaURL := fs.String("ollama-url", "", "Ollama server URL (defaults to $OLLAMA_HOST or "+defaultOllamaURL+")")
+	openAIBaseURL := fs.String("base-url", "", "Base URL for openai embeddings (defaults to $OPENAI_BASE_URL or "+defaultOpenAIBaseURL+")")
+	rebuild := fs.Bool("rebuild", false, "Discard the saved index and index every file again")
+	verbose := fs.Bool("verbose", false, "Enable verbose debug logs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: coder index [-embeddings provider:model] [-rebuild]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	configureLogging(*verbose)
+
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir := indexDir(root)
+	if *rebuild {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove index: %w", err)
+		}
+	}
+	start := time.Now()
+	index := loadCodeIndex(root)
+	update, err := updateCodeIndex(root, index)
+	if err != nil {
+		return err
+	}
+	if err := writeIndexFile(root, codeIndexName, index); err != nil {
+		return err
+	}
+	symbols := 0
+	for _, file := range index.Files {
+		symbols += len(file.Symbols)
+	}
+	fmt.Fprintf(os.Stdout, "Indexed %d files in %s (%d updated, %d removed, %d symbols) in %s\n",
+		update.Files, dir, update.Updated, update.Removed, symbols, time.Since(start).Round(time.Millisecond))
+
+	spec := strings.TrimSpace(*embeddings)
+	if spec == "" {
+		return nil
+	}
+	embedder, err := newEmbedder(spec, Config{
+		OllamaURL:     resolveOllamaURL(*ollamaURL),
+		OpenAIBaseURL: resolveOpenAIBaseURL(*openAIBaseURL),
+		OpenAIAPIKey:  strings.TrimSpace(os.Getenv("OPENAI_API_KEY")),
+	})
+	if err != nil {
+		return err
+	}
+	r := newRetriever(root, embedder, 0)
+	r.code = index
+	embedded, err := r.update(context.Background())
+	if err != nil {
+		return fmt.Errorf("embedding failed after %d file(s): %w", embedded, err)
+	}
+	fmt.Fprintf(os.Stdout, "Embedded %d changed file(s) with %s\n", embedded, embedder.Name())
+	return nil
+}
+
+const (
+	defaultSearchResults = 10
+	maxSearchResults     = 30
+	searchPreviewLines   = 8
+	// maxSearchPreviewLineBytes cuts minified or generated lines short.
+	maxSearchPreviewLineBytes = 160
+	// rrfOffset damps the weight of top ranks when keyword and embedding
+	// results are fused.
+	rrfOffset = 60
+)
+
+// searchStopWords are dropped from semantic_search queries before keyword
+// matching.
+var searchStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "where": true, "what": true, "how": true,
+	"which": true, "who": true, "does": true, "are": true, "is": true, "implemented": true,
+	"implementation": true, "code": true, "function": true, "find": true, "that": true,
+	"with": true, "this": true, "from": true, "into": true, "handled": true, "defined": true,
+}
+
+type SemanticSearchInput struct {
+	Query *string `json:"query"`
+	Limit int     `json:"limit,omitempty"`
+}
+
+func semanticSearchInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": "What to look for, in natural language or as identifiers, e.g. \"where is JWT validation implemented\".",
+			},
+			"limit": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Maximum number of results. Defaults to %d, capped at %d.", defaultSearchResults, maxSearchResults),
+				"minimum":     1,
+				"maximum":     maxSearchResults,
+			},
+		},
+		Required: []string{"query"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+type searchResult struct {
+	path   string
+	line   int
+	end    int
+	score  float64
+	symbol string
+}
+
+func (s *Session) semanticSearch(input json.RawMessage) (string, error) {
+	const expected = `{"query":"where is JWT validation implemented","limit":10}`
+
+	args := SemanticSearchInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("semantic_search", err.Error(), expected)
+	}
+	query, err := requireToolString("semantic_search", "query", args.Query, false, expected)
+	if err != nil {
+		return "", err
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultSearchResults
+	}
+	limit = min(limit, maxSearchResults)
+
+	ctx := s.toolContext()
+	index, err := s.currentCodeIndex(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to update the code index: %w", err)
+	}
+
+	// Fuse the keyword and embedding rankings by reciprocal rank, one result
+	// per file.
+	fused := make(map[string]*searchResult)
+	add := func(rank int, hit searchResult) {
+		result := fused[hit.path]
+		if result == nil {
+			result = &searchResult{path: hit.path, line: hit.line, end: hit.end, symbol: hit.symbol}
+			fused[hit.path] = result
+		}
+		if result.symbol == "" && hit.symbol != "" {
+			result.line, result.symbol = hit.line, hit.symbol
+		}
+		result.score += 1 / float64(rrfOffset+rank)
+	}
+	for rank, hit := range keywordSearch(index, query) {
+		add(rank, hit)
+	}
+	method := "keyword"
+	if s.retrieval != nil {
+		hits, err := s.retrieval.search(ctx, query, limit*3)
+		if err != nil {
+			method = "keyword; embedding search failed: " + err.Error()
+		} else {
+			method = "keyword and embedding"
+			seen := make(map[string]bool)
+			for _, hit := range hits {
+				if !seen[hit.Path] {
+					seen[hit.Path] = true
+					add(len(seen)-1, searchResult{path: hit.Path, line: hit.StartLine, end: hit.EndLine})
+				}
+			}
+		}
+	}
+
+	results := make([]*searchResult, 0, len(fused))
+	for _, result := range fused {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].path < results[j].path
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	fmt.Fprintf(s.out, "Searched %d indexed files for %q (%d result(s))\n", len(index.Files), previewText(query, 60), len(results))
+	if len(results) == 0 {
+		return fmt.Sprintf("No matches for %q (%s search over %d files).", query, method, len(index.Files)), nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d result(s) for %q (%s search over %d files):\n", len(results), query, method, len(index.Files))
+	for i, result := range results {
+		entry := index.Files[result.path]
+		fmt.Fprintf(&b, "\n%d. %s:%d", i+1, result.path, result.line)
+		if result.symbol != "" {
+			fmt.Fprintf(&b, " (%s)", result.symbol)
+		}
+		b.WriteByte('\n')
+		if entry != nil && entry.Summary != "" {
+			fmt.Fprintf(&b, "   %s\n", entry.Summary)
+		}
+		b.WriteString(searchPreview(s.root, result.path, result.line))
+	}
+	return b.String(), nil
+}
+
+// currentCodeIndex returns the code index brought up to date with the
+// workspace, sharing the retriever's copy when retrieval is on.
+func (s *Session) currentCodeIndex(ctx context.Context) (*codeIndex, error) {
+	if s.retrieval != nil {
+		if _, err := s.retrieval.update(ctx); err != nil && s.retrieval.code == nil {
+			return nil, err
+		}
+		return s.retrieval.code, nil
+	}
+	if s.codeIndex == nil {
+		s.codeIndex = loadCodeIndex(s.root)
+	}
+	update, err := updateCodeIndex(s.root, s.codeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if update.changed() {
+		if err := writeIndexFile(s.root, codeIndexName, s.codeIndex); err != nil {
+			debugf("code_index_save_failed error=%q", err.Error())
+		}
+	}
+	return s.codeIndex, nil
+}
+
+// keywordSearch ranks indexed files by how well the query's terms match their
+// symbol names, paths, and summaries. Each hit points at the best-matching
+// symbol when there is one.
+func keywordSearch(index *codeIndex, query string) []searchResult {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	var hits []searchResult
+	for rel, entry := range index.Files {
+		pathTerms := searchTerms(rel)
+		summary := strings.ToLower(entry.Summary)
+		score := 0.0
+		bestSymbol, bestSymbolScore := sourceSymbol{}, 0.0
+		symbolScores := make(map[string]float64)
+		for _, term := range terms {
+			for _, symbol := range entry.Symbols {
+				points := 0.0
+				switch {
+				case strings.EqualFold(symbol.Name, term):
+					points = 5
+				case containsString(searchTerms(symbol.Name), term):
+					points = 3
+				case strings.Contains(strings.ToLower(symbol.Name), term):
+					points = 1
+				}
+				symbolScores[symbol.Name] += points
+				if symbolScores[symbol.Name] > bestSymbolScore {
+					bestSymbol, bestSymbolScore = symbol, symbolScores[symbol.Name]
+				}
+			}
+			if containsString(pathTerms, term) {
+				score += 2
+			}
+			if strings.Contains(summary, term) {
+				score++
+			}
+		}
+		score += bestSymbolScore
+		if score == 0 {
+			continue
+		}
+		hit := searchResult{path: rel, line: 1, score: score}
+		if bestSymbolScore > 0 {
+			hit.line, hit.symbol = bestSymbol.Line, bestSymbol.Name
+		}
+		hits = append(hits, hit)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].path < hits[j].path
+	})
+	return hits
+}
+
+// searchTerms splits text into lowercase words, breaking identifiers at
+// underscores, punctuation, and camelCase boundaries, and drops stop words
+// and words under three letters.
+func searchTerms(text string) []string {
+	var terms []string
+	var word []rune
+	flush := func() {
+		if len(word) >= 3 {
+			if term := strings.ToLower(string(word)); !searchStopWords[term] {
+				terms = append(terms, term)
+			}
+		}
+		word = word[:0]
+	}
+	runes := []rune(text)
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// "parseJWTToken" splits as parse, jwt, token.
+			if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+func containsString(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+// searchPreview returns a few numbered lines of path starting at line.
+func searchPreview(root, path string, line int) string {
+	content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	start := max(line, 1) - 1
+	if start >= len(lines) {
+		return ""
+	}
+	var b strings.Builder
+	for i := start; i < min(start+searchPreviewLines, len(lines)); i++ {
+		text := strings.TrimRight(lines[i], " \t\r")
+		if len(text) > maxSearchPreviewLineBytes {
+			text = strings.ToValidUTF8(text[:maxSearchPreviewLineBytes], "") + "…"
+		}
+		fmt.Fprintf(&b, "   %5d| %s\n", i+1, text)
+	}
+	return b.String()
+}
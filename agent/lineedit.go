@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+type InsertAtLineInput struct {
+	Path *string `json:"path"`
+	Line int     `json:"line"`
+	Text *string `json:"text"`
+}
+
+type ReplaceLinesInput struct {
+	Path      *string `json:"path"`
+	StartLine int     `json:"start_line"`
+	EndLine   int     `json:"end_line"`
+	Text      *string `json:"text"`
+}
+
+func insertAtLineInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace.",
+			},
+			"line": map[string]any{
+				"type":        "integer",
+				"description": "1-based line number the text is inserted before. One past the last line appends to the file.",
+				"minimum":     1,
+			},
+			"text": map[string]any{
+				"type":        "string",
+				"description": "Lines to insert. A final newline is added if missing.",
+			},
+		},
+		Required: []string{"path", "line", "text"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func replaceLinesInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace.",
+			},
+			"start_line": map[string]any{
+				"type":        "integer",
+				"description": "1-based number of the first line to replace.",
+				"minimum":     1,
+			},
+			"end_line": map[string]any{
+				"type":        "integer",
+				"description": "1-based number of the last line to replace, inclusive.",
+				"minimum":     1,
+			},
+			"text": map[string]any{
+				"type":        "string",
+				"description": "Lines to put in their place; empty to delete them. A final newline is added if missing.",
+			},
+		},
+		Required: []string{"path", "start_line", "end_line", "text"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func (s *Session) insertAtLine(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/main.go","line":12,"text":"\tlog.Println(\"starting\")\n"}`
+
+	args := InsertAtLineInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("insert_at_line", err.Error(), expected)
+	}
+	pathValue, err := requireToolString("insert_at_line", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	text, err := requireToolString("insert_at_line", "text", args.Text, false, expected)
+	if err != nil {
+		return "", err
+	}
+	if args.Line < 1 {
+		return "", toolInputValidationError("insert_at_line", `"line" must be at least 1`, expected)
+	}
+
+	target, err := s.openLineEditTarget("insert_at_line", pathValue)
+	if err != nil {
+		return "", err
+	}
+	lines := textLines(target.text)
+	if args.Line > len(lines)+1 {
+		return "", newToolError(ToolErrorValidation, "line %d is past the end of %s (%d lines); use %d to append", args.Line, target.displayPath, len(lines), len(lines)+1)
+	}
+	return s.commitLineEdit(target, "insert_at_line", lines, args.Line, args.Line-1, text)
+}
+
+func (s *Session) replaceLines(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/main.go","start_line":12,"end_line":14,"text":"\treturn nil\n"}`
+
+	args := ReplaceLinesInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("replace_lines", err.Error(), expected)
+	}
+	pathValue, err := requireToolString("replace_lines", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	text, err := requireToolString("replace_lines", "text", args.Text, true, expected)
+	if err != nil {
+		return "", err
+	}
+	if args.StartLine < 1 || args.EndLine < args.StartLine {
+		return "", toolInputValidationError("replace_lines", `"start_line" must be at least 1 and "end_line" at least "start_line"`, expected)
+	}
+
+	target, err := s.openLineEditTarget("replace_lines", pathValue)
+	if err != nil {
+		return "", err
+	}
+	lines := textLines(target.text)
+	if args.EndLine > len(lines) {
+		return "", newToolError(ToolErrorValidation, "end_line %d is past the end of %s (%d lines)", args.EndLine, target.displayPath, len(lines))
+	}
+	return s.commitLineEdit(target, "replace_lines", lines, args.StartLine, args.EndLine, text)
+}
+
+// openLineEditTarget opens an existing file for a line edit.
+func (s *Session) openLineEditTarget(tool, pathValue string) (*editTarget, error) {
+	target, err := s.openEditTarget(tool, pathValue)
+	if err != nil {
+		return nil, err
+	}
+	if !target.present {
+		return nil, newToolError(ToolErrorNotFound, "file does not exist: %s (use write_file to create it)", target.displayPath)
+	}
+	return target, nil
+}
+
+// commitLineEdit replaces lines first through last (1-based, inclusive; last
+// is first-1 for a pure insertion) with text and writes the file. The result
+// says how later lines moved, and its diff's hunk headers give the new line
+// numbers, so the next line edit can be aimed without reading the file again.
+func (s *Session) commitLineEdit(target *editTarget, tool string, lines []string, first, last int, text string) (string, error) {
+	if target.crlf {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+	}
+	inserted := textLines(text)
+	updated := make([]string, 0, len(lines)-(last-first+1)+len(inserted))
+	updated = append(updated, lines[:first-1]...)
+	updated = append(updated, inserted...)
+	updated = append(updated, lines[last:]...)
+
+	newText := strings.Join(updated, "\n")
+	if len(updated) > 0 && (strings.HasSuffix(target.text, "\n") || target.text == "") {
+		newText += "\n"
+	}
+	if newText == target.text {
+		return fmt.Sprintf("%s already has that text at line %d; the file was not changed", target.displayPath, first), nil
+	}
+	target.text = newText
+
+	removed := last - first + 1
+	switch {
+	case len(inserted) == 0:
+		target.notes = append(target.notes, "deleted "+lineRange(first-1, last-1))
+	case removed == 0:
+		target.notes = append(target.notes, fmt.Sprintf("inserted %d line(s) at line %d", len(inserted), first))
+	default:
+		target.notes = append(target.notes, fmt.Sprintf("replaced %s with %d line(s)", lineRange(first-1, last-1), len(inserted)))
+	}
+	if shift := len(inserted) - removed; shift != 0 && last < len(lines) {
+		target.notes = append(target.notes, fmt.Sprintf("later lines moved by %+d", shift))
+	}
+	return s.commitEdit(target, tool)
+}
+
+// textLines splits text into lines without their newlines. A final newline
+// does not start another line, and empty text has no lines.
+func textLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,352 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	lintTimeout     = 5 * time.Minute
+	maxLintFindings = 200
+	linterGolangci  = "golangci-lint"
+	linterESLint    = "eslint"
+	linterRuff      = "ruff"
+)
+
+var golangciVersionPattern = regexp.MustCompile(`version v?(\d+)\.`)
+
+type RunLintInput struct {
+	Linter string   `json:"linter,omitempty"`
+	Paths  []string `json:"paths,omitempty"`
+}
+
+// lintFinding is one problem a linter reported, with its file relative to the
+// workspace.
+type lintFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity,omitempty"`
+	Message  string `json:"message"`
+	// Edited marks files the session has written, whose findings are most
+	// likely the agent's own doing.
+	Edited bool `json:"edited,omitempty"`
+}
+
+// lintReport is the run_lint result.
+type lintReport struct {
+	Linter        string        `json:"linter"`
+	Total         int           `json:"total"`
+	InEditedFiles int           `json:"in_edited_files"`
+	Truncated     bool          `json:"truncated,omitempty"`
+	Findings      []lintFinding `json:"findings"`
+}
+
+func runLintInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"linter": map[string]any{
+				"type":        "string",
+				"enum":        []string{linterGolangci, linterESLint, linterRuff},
+				"description": "Which linter to run. Defaults to the workspace's language, detected from go.mod, pyproject.toml/requirements.txt/setup.py, or package.json.",
+			},
+			"paths": map[string]any{
+				"type":        "array",
+				"items":       map[string]any{"type": "string"},
+				"description": "Relative files or directories to lint. Defaults to the whole workspace.",
+			},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// runLint runs the project's linter and returns its findings as JSON, those
+// in files the session edited first.
+func (s *Session) runLint(input json.RawMessage) (string, error) {
+	const expected = `{"linter":"golangci-lint","paths":["internal/server"]}`
+
+	args := RunLintInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("run_lint", err.Error(), expected)
+	}
+	linter := strings.ToLower(strings.TrimSpace(args.Linter))
+	if linter == "" {
+		switch detectDocLanguage(s.root) {
+		case docLanguageGo:
+			linter = linterGolangci
+		case docLanguagePython:
+			linter = linterRuff
+		case docLanguageNode:
+			linter = linterESLint
+		default:
+			return "", toolInputValidationError("run_lint", "could not detect the workspace language; set \"linter\"", expected)
+		}
+	}
+	var paths []string
+	for _, p := range args.Paths {
+		abs, display, err := s.resolveToolPath(strings.TrimSpace(p), false)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return "", newToolError(ToolErrorNotFound, "path does not exist: %s", display)
+		}
+		if linter == linterGolangci {
+			// golangci-lint takes packages, not single files.
+			if !info.IsDir() {
+				display = path.Dir(display)
+			}
+			display = "./" + path.Clean(display) + "/..."
+		}
+		paths = append(paths, display)
+	}
+
+	// Linters load the project's own config and plugins, and eslint's are
+	// JavaScript, so they run under bash's rules.
+	if err := s.checkToolCommand("run_lint", strings.TrimSpace(linter+" "+strings.Join(paths, " "))); err != nil {
+		return "", err
+	}
+	env := s.commandEnv()
+	ctx, cancel := context.WithTimeout(s.toolContext(), lintTimeout)
+	defer cancel()
+	var findings []lintFinding
+	var err error
+	switch linter {
+	case linterGolangci:
+		findings, err = runGolangciLint(ctx, s.root, env, paths)
+	case linterESLint:
+		findings, err = runESLint(ctx, s.root, env, paths)
+	case linterRuff:
+		findings, err = runRuff(ctx, s.root, env, paths)
+	default:
+		return "", toolInputValidationError("run_lint", fmt.Sprintf("unsupported linter %q", linter), expected)
+	}
+	if ctx.Err() != nil {
+		return "", newToolError(ToolErrorTimeout, "%s timed out after %s", linter, lintTimeout)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	report := lintReport{Linter: linter, Total: len(findings), Findings: findings}
+	for i := range report.Findings {
+		if abs, _, err := s.resolveToolPath(report.Findings[i].File, false); err == nil && s.edited[abs] {
+			report.Findings[i].Edited = true
+			report.InEditedFiles++
+		}
+	}
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Edited != b.Edited {
+			return a.Edited
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	if len(report.Findings) > maxLintFindings {
+		report.Findings, report.Truncated = report.Findings[:maxLintFindings], true
+	}
+	if report.Findings == nil {
+		report.Findings = []lintFinding{}
+	}
+	debugf("run_lint linter=%q findings=%d in_edited_files=%d", linter, report.Total, report.InEditedFiles)
+	fmt.Fprintf(s.out, "Linted with %s: %d finding(s), %d in files edited this session\n", linter, report.Total, report.InEditedFiles)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// runLinter runs a linter in dir that exits non-zero when it finds problems,
+// and returns its stdout as long as it wrote some.
+func runLinter(ctx context.Context, dir string, env []string, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, newToolError(ToolErrorNotFound, "%s is not installed; install it or pick another linter", filepath.Base(name))
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if err != nil && len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s failed: %s", filepath.Base(name), previewText(msg, 500))
+	}
+	return stdout.Bytes(), nil
+}
+
+func runGolangciLint(ctx context.Context, dir string, env, paths []string) ([]lintFinding, error) {
+	if len(paths) == 0 {
+		paths = []string{"./..."}
+	}
+	versionCmd := exec.CommandContext(ctx, linterGolangci, "--version")
+	versionCmd.Dir = dir
+	versionCmd.Env = env
+	version, _ := versionCmd.Output()
+	format := []string{"--out-format=json"}
+	if match := golangciVersionPattern.FindSubmatch(version); match != nil && string(match[1]) != "1" {
+		format = []string{"--output.json.path=stdout", "--output.text.path=stderr"}
+	}
+	out, err := runLinter(ctx, dir, env, linterGolangci, append(append([]string{"run"}, format...), paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Issues []struct {
+			FromLinter string `json:"FromLinter"`
+			Text       string `json:"Text"`
+			Severity   string `json:"Severity"`
+			Pos        struct {
+				Filename string `json:"Filename"`
+				Line     int    `json:"Line"`
+				Column   int    `json:"Column"`
+			} `json:"Pos"`
+		} `json:"Issues"`
+	}
+	if err := json.Unmarshal(firstJSONLine(out), &result); err != nil {
+		return nil, fmt.Errorf("could not read golangci-lint output: %w", err)
+	}
+	var findings []lintFinding
+	for _, issue := range result.Issues {
+		findings = append(findings, lintFinding{
+			File:     workspaceRelative(dir, issue.Pos.Filename),
+			Line:     issue.Pos.Line,
+			Column:   issue.Pos.Column,
+			Rule:     issue.FromLinter,
+			Severity: issue.Severity,
+			Message:  issue.Text,
+		})
+	}
+	return findings, nil
+}
+
+func runESLint(ctx context.Context, dir string, env, paths []string) ([]lintFinding, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	// A project's own eslint, with the plugins its config needs, wins.
+	name := linterESLint
+	local := filepath.Join(dir, "node_modules", ".bin", "eslint")
+	if _, err := os.Stat(local); err == nil {
+		name = local
+	}
+	out, err := runLinter(ctx, dir, env, name, append([]string{"--format", "json"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		FilePath string `json:"filePath"`
+		Messages []struct {
+			RuleID   string `json:"ruleId"`
+			Severity int    `json:"severity"`
+			Message  string `json:"message"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(out, &files); err != nil {
+		return nil, fmt.Errorf("could not read eslint output: %w", err)
+	}
+	var findings []lintFinding
+	for _, file := range files {
+		for _, msg := range file.Messages {
+			severity := "warning"
+			if msg.Severity == 2 {
+				severity = "error"
+			}
+			findings = append(findings, lintFinding{
+				File:     workspaceRelative(dir, file.FilePath),
+				Line:     msg.Line,
+				Column:   msg.Column,
+				Rule:     msg.RuleID,
+				Severity: severity,
+				Message:  msg.Message,
+			})
+		}
+	}
+	return findings, nil
+}
+
+func runRuff(ctx context.Context, dir string, env, paths []string) ([]lintFinding, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	out, err := runLinter(ctx, dir, env, linterRuff, append([]string{"check", "--output-format", "json"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+		Filename string `json:"filename"`
+		Location struct {
+			Row    int `json:"row"`
+			Column int `json:"column"`
+		} `json:"location"`
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("could not read ruff output: %w", err)
+	}
+	var findings []lintFinding
+	for _, result := range results {
+		findings = append(findings, lintFinding{
+			File:    workspaceRelative(dir, result.Filename),
+			Line:    result.Location.Row,
+			Column:  result.Location.Column,
+			Rule:    result.Code,
+			Message: result.Message,
+		})
+	}
+	return findings, nil
+}
+
+// firstJSONLine returns the first line of out that starts a JSON object;
+// golangci-lint can print its text report after the JSON one.
+func firstJSONLine(out []byte) []byte {
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) {
+			return line
+		}
+	}
+	return out
+}
+
+// workspaceRelative turns a path a linter printed, absolute or relative to
+// the workspace at root, into a slash-separated workspace-relative path.
+func workspaceRelative(root, name string) string {
+	if !filepath.IsAbs(name) {
+		return filepath.ToSlash(filepath.Clean(name))
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil || pathEscapes(rel) {
+		return filepath.ToSlash(name)
+	}
+	return filepath.ToSlash(rel)
+}
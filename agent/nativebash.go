@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// NativeBashInput is the input of Anthropic's built-in bash tool (type
+// bash_20250124).
+type NativeBashInput struct {
+	Command *string `json:"command,omitempty"`
+	Restart bool    `json:"restart,omitempty"`
+}
+
+type StartProcessInput struct {
+	Command *string `json:"command"`
+	Cwd     string  `json:"cwd,omitempty"`
+}
+
+// nativeBashInputSchema describes the native tool's input for validation; the
+// model already knows the tool, so this schema is never sent.
+func nativeBashInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"command": map[string]any{"type": "string"},
+			"restart": map[string]any{"type": "boolean"},
+		},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+func startProcessInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"command": map[string]any{
+				"type":        "string",
+				"description": "The bash command to start.",
+			},
+			"cwd": map[string]any{
+				"type":        "string",
+				"description": "Optional directory to run the command in, relative to the workspace root. Defaults to the workspace root.",
+			},
+		},
+		Required: []string{"command"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// supportsNativeBash reports whether the session's model is trained on the
+// bash_20250124 tool: Claude 3.7 and later.
+func supportsNativeBash(cfg Config) bool {
+	return cfg.Provider == providerAnthropic && (!strings.HasPrefix(cfg.ModelID, "claude-3") || strings.HasPrefix(cfg.ModelID, "claude-3-7"))
+}
+
+// shellState is what the native bash tool carries from one command to the
+// next, as a persistent shell would: the working directory and exported
+// variables. Each command still runs in a fresh bash process.
+type shellState struct {
+	dir     string
+	exports string
+}
+
+// nativeBash runs a command for the native bash tool. The model expects one
+// long-lived shell, so the directory and exported variables left by a command
+// are restored before the next; restart drops them and starts again from the
+// workspace root.
+func (s *Session) nativeBash(input json.RawMessage) (string, error) {
+	const expected = `{"command":"go test ./..."}`
+
+	args := NativeBashInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("bash", err.Error(), expected)
+	}
+	if args.Restart {
+		s.shell = nil
+		fmt.Fprintln(s.out, "Restarted shell")
+		return "The shell was restarted: it is back in the workspace root with the default environment.", nil
+	}
+	command := ""
+	if args.Command != nil {
+		command = strings.TrimSpace(*args.Command)
+	}
+	if command == "" {
+		return "", toolInputValidationError("bash", `missing required field "command"`, expected)
+	}
+	if err := s.checkCommand(command); err != nil {
+		return "", err
+	}
+
+	root := s.root
+	state := s.shell
+	if state == nil {
+		state = &shellState{dir: root}
+	}
+	if info, err := os.Stat(state.dir); err != nil || !info.IsDir() {
+		state = &shellState{dir: root, exports: state.exports}
+	}
+	dir := ""
+	if rel, err := filepath.Rel(root, state.dir); err == nil && rel != "." {
+		dir = filepath.ToSlash(rel)
+	}
+
+	stateFile, err := os.CreateTemp("", "coder-shell-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create shell state file: %w", err)
+	}
+	stateFile.Close()
+	defer os.Remove(stateFile.Name())
+
+	var script strings.Builder
+	script.WriteString(state.exports)
+	fmt.Fprintf(&script, "__coder_state=%s\n", shellQuote(stateFile.Name()))
+	script.WriteString("trap '__coder_status=$?; { pwd; export -p; } > \"$__coder_state\"; exit $__coder_status' EXIT\n")
+	script.WriteString(command)
+	script.WriteString("\n")
+
+	s.cache.clear()
+	result, err := s.runCommand(command, script.String(), state.dir, dir, hardBashTimeoutSeconds, defaultBashMaxOutputBytes)
+	if saved, readErr := os.ReadFile(stateFile.Name()); readErr == nil && len(saved) > 0 {
+		s.shell = parseShellState(string(saved))
+	} else {
+		s.shell = state
+	}
+	return result, err
+}
+
+// parseShellState reads the pwd and export -p output the shell saved on
+// exit. Variables bash manages itself, and read-only ones that could not be
+// declared again, are left out.
+func parseShellState(saved string) *shellState {
+	dir, exports, _ := strings.Cut(saved, "\n")
+	var kept strings.Builder
+	for _, line := range strings.Split(exports, "\n") {
+		flags, rest, ok := strings.Cut(strings.TrimPrefix(line, "declare "), " ")
+		if !ok || !strings.HasPrefix(line, "declare -") {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, "=")
+		if strings.Contains(flags, "r") || name == "PWD" || name == "OLDPWD" || name == "SHLVL" || name == "_" {
+			continue
+		}
+		kept.WriteString(line)
+		kept.WriteString("\n")
+	}
+	return &shellState{dir: strings.TrimSpace(dir), exports: kept.String()}
+}
+
+// startProcess starts a background command for sessions using the native
+// bash tool, whose input has no run_in_background.
+func (s *Session) startProcess(input json.RawMessage) (string, error) {
+	const expected = `{"command":"npm run dev"}`
+
+	args := StartProcessInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("start_process", err.Error(), expected)
+	}
+	command, err := requireToolString("start_process", "command", args.Command, false, expected)
+	if err != nil {
+		return "", err
+	}
+	command = strings.TrimSpace(command)
+	cwd := s.root
+	dir := ""
+	if strings.TrimSpace(args.Cwd) != "" {
+		absDir, displayPath, err := s.resolveWorkspaceDir(args.Cwd)
+		if err != nil {
+			return "", fmt.Errorf("invalid cwd: %w", err)
+		}
+		cwd = absDir
+		if displayPath != "." {
+			dir = displayPath
+		}
+	}
+	if err := s.checkCommand(command); err != nil {
+		return "", err
+	}
+	s.cache.clear()
+	return s.startBackgroundProcess(command, cwd, dir)
+}
+
+// shellQuote quotes value as a single bash word.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// nativeTextEditorName is the name Anthropic's built-in text editor tool
+// (type text_editor_20250429) is called by.
+const nativeTextEditorName = "str_replace_based_edit_tool"
+
+// TextEditorInput is the input of the native text editor tool. Which fields
+// apply depends on Command.
+type TextEditorInput struct {
+	Command    *string `json:"command"`
+	Path       *string `json:"path"`
+	ViewRange  []int   `json:"view_range,omitempty"`
+	OldStr     *string `json:"old_str,omitempty"`
+	NewStr     *string `json:"new_str,omitempty"`
+	FileText   *string `json:"file_text,omitempty"`
+	InsertLine *int    `json:"insert_line,omitempty"`
+}
+
+// textEditorInputSchema describes the native tool's input for validation; the
+// model already knows the tool, so this schema is never sent.
+func textEditorInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"command": map[string]any{
+				"type": "string",
+				"enum": []string{"view", "str_replace", "create", "insert", "undo_edit"},
+			},
+			"path":        map[string]any{"type": "string"},
+			"view_range":  map[string]any{"type": "array", "items": map[string]any{"type": "integer"}},
+			"old_str":     map[string]any{"type": "string"},
+			"new_str":     map[string]any{"type": "string"},
+			"file_text":   map[string]any{"type": "string"},
+			"insert_line": map[string]any{"type": "integer", "minimum": 0},
+		},
+		Required: []string{"command", "path"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// supportsNativeTextEditor reports whether the session's model is trained on
+// the text_editor_20250429 tool: Claude 4 and later.
+func supportsNativeTextEditor(cfg Config) bool {
+	return cfg.Provider == providerAnthropic && !strings.HasPrefix(cfg.ModelID, "claude-3")
+}
+
+// textEditor dispatches the native text editor tool's commands to the same
+// code as read_files, edit_files, write_file, and insert_at_line, so they
+// share path checks, stale-read detection, protection, and audit.
+func (s *Session) textEditor(input json.RawMessage) (string, error) {
+	const expected = `{"command":"str_replace","path":"src/main.go","old_str":"before","new_str":"after"}`
+
+	args := TextEditorInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError(nativeTextEditorName, err.Error(), expected)
+	}
+	command, err := requireToolString(nativeTextEditorName, "command", args.Command, false, expected)
+	if err != nil {
+		return "", err
+	}
+	pathValue, err := requireToolString(nativeTextEditorName, "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	pathValue = strings.TrimSpace(pathValue)
+
+	switch command {
+	case "view":
+		return s.textEditorView(pathValue, args.ViewRange)
+	case "str_replace":
+		oldStr, err := requireToolString(nativeTextEditorName, "old_str", args.OldStr, false, expected)
+		if err != nil {
+			return "", err
+		}
+		newStr := ""
+		if args.NewStr != nil {
+			newStr = *args.NewStr
+		}
+		if oldStr == newStr {
+			return "", toolInputValidationError(nativeTextEditorName, `"old_str" and "new_str" must be different`, expected)
+		}
+		target, err := s.openEditTarget(nativeTextEditorName, pathValue)
+		if err != nil {
+			return "", err
+		}
+		if !target.present {
+			return "", newToolError(ToolErrorNotFound, "file does not exist: %s (use the create command to create it)", target.displayPath)
+		}
+		if err := target.apply(oldStr, newStr); err != nil {
+			return "", err
+		}
+		return s.commitEdit(target, nativeTextEditorName)
+	case "create":
+		fileText, err := requireToolString(nativeTextEditorName, "file_text", args.FileText, true, `{"command":"create","path":"src/util.go","file_text":"package main\n"}`)
+		if err != nil {
+			return "", err
+		}
+		overwrite := true
+		return s.writeFile(mustMarshalJSON(WriteFileInput{Path: &pathValue, Content: &fileText, Overwrite: &overwrite}))
+	case "insert":
+		if args.InsertLine == nil || *args.InsertLine < 0 {
+			return "", toolInputValidationError(nativeTextEditorName, `insert needs "insert_line", the line to insert after (0 for the start of the file)`, `{"command":"insert","path":"src/main.go","insert_line":12,"new_str":"\tlog.Println(\"starting\")\n"}`)
+		}
+		text, err := requireToolString(nativeTextEditorName, "new_str", args.NewStr, false, expected)
+		if err != nil {
+			return "", err
+		}
+		target, err := s.openLineEditTarget(nativeTextEditorName, pathValue)
+		if err != nil {
+			return "", err
+		}
+		lines := textLines(target.text)
+		after := *args.InsertLine
+		if after > len(lines) {
+			return "", newToolError(ToolErrorValidation, "insert_line %d is past the end of %s (%d lines)", after, target.displayPath, len(lines))
+		}
+		return s.commitLineEdit(target, nativeTextEditorName, lines, after+1, after, text)
+	case "undo_edit":
+		return "", newToolError(ToolErrorValidation, "undo_edit is not supported; make another edit that restores the text instead")
+	default:
+		return "", toolInputValidationError(nativeTextEditorName, fmt.Sprintf("unknown command %q (expected view, str_replace, create, or insert)", command), expected)
+	}
+}
+
+// textEditorView shows a file with line numbers, optionally only view_range
+// [start, end] (1-based, inclusive; end -1 for the end of the file), or lists
+// a directory.
+func (s *Session) textEditorView(pathValue string, viewRange []int) (string, error) {
+	if absDir, _, err := s.resolveWorkspaceDir(pathValue); err == nil {
+		if info, statErr := os.Stat(absDir); statErr == nil && info.IsDir() {
+			return s.listFiles(mustMarshalJSON(ListFilesInput{Path: pathValue}))
+		}
+	}
+	absFile, displayPath, err := s.resolveWorkspaceFile(pathValue)
+	if err != nil {
+		return "", err
+	}
+	if workspaceIgnore(s.root).Ignored(displayPath, false) {
+		return "", newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+	content, err := os.ReadFile(absFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+	}
+	s.files.record(absFile, content)
+	text, _ := decodeFileText(content)
+	lines := textLines(strings.ReplaceAll(text, "\r\n", "\n"))
+
+	first, last := 1, len(lines)
+	if len(viewRange) > 0 {
+		if len(viewRange) != 2 {
+			return "", toolInputValidationError(nativeTextEditorName, `"view_range" must be [start_line, end_line]`, `{"command":"view","path":"src/main.go","view_range":[10,40]}`)
+		}
+		first = viewRange[0]
+		if viewRange[1] != -1 {
+			last = viewRange[1]
+		}
+		if first < 1 || last < first || last > len(lines) {
+			return "", newToolError(ToolErrorValidation, "view_range %v is outside %s (%d lines)", viewRange, displayPath, len(lines))
+		}
+	}
+
+	var b strings.Builder
+	for i := first; i <= last; i++ {
+		line := fmt.Sprintf("%6d\t%s\n", i, lines[i-1])
+		if b.Len()+len(line) > defaultReadFilesMaxBytes {
+			fmt.Fprintf(&b, "[truncated at line %d of %d; view again with view_range to see more]\n", i-1, len(lines))
+			break
+		}
+		b.WriteString(line)
+	}
+	fmt.Fprintf(s.out, "Read %s (lines %d-%d)\n", displayPath, first, last)
+	if b.Len() == 0 {
+		return fmt.Sprintf("%s is empty", displayPath), nil
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// mustMarshalJSON encodes a tool input struct, which cannot fail.
+func mustMarshalJSON(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
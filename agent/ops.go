@@ -0,0 +1,312 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	defaultOpsTimeoutSeconds = 60
+	hardOpsTimeoutSeconds    = 300
+	opsKubectl               = "kubectl"
+	opsAWS                   = "aws"
+	opsGcloud                = "gcloud"
+)
+
+// The ops profile's allowlist. Each CLI's rule names what may run; anything
+// else, including every verb that changes a cluster or cloud account, is
+// refused whatever the permissions say.
+var (
+	opsKubectlVerbs = map[string]bool{
+		"get": true, "describe": true, "logs": true, "top": true, "explain": true, "events": true,
+		"api-resources": true, "api-versions": true, "version": true, "cluster-info": true,
+	}
+	// opsKubectlSubcommands are the allowed subcommands of kubectl verbs
+	// that otherwise change things.
+	opsKubectlSubcommands = map[string]map[string]bool{
+		"auth":   {"can-i": true, "whoami": true},
+		"config": {"view": true, "get-contexts": true, "current-context": true, "get-clusters": true},
+	}
+	opsAWSOperation = regexp.MustCompile(`^(describe|get|list)-[a-z0-9-]+$`)
+	// opsAWSExtra are read-only operations outside describe-, get-, and
+	// list-.
+	opsAWSExtra = map[string]bool{"s3 ls": true, "logs filter-log-events": true}
+	// opsAWSSensitive matches operations that return credentials or
+	// secrets, or write a file, despite their read-only names.
+	opsAWSSensitive = regexp.MustCompile(`secret|password|token|credential|login|^get-object`)
+	opsGcloudVerbs  = map[string]bool{"list": true, "describe": true, "get-iam-policy": true, "get-value": true, "read": true}
+	// opsGcloudMutating are gcloud commands that change things. One before
+	// the read verb makes the read verb an argument, as in instances delete
+	// list, so they are refused wherever they appear.
+	opsGcloudMutating = map[string]bool{
+		"create": true, "delete": true, "update": true, "set": true, "unset": true, "add": true, "remove": true,
+		"deploy": true, "patch": true, "apply": true, "reset": true, "start": true, "stop": true, "restart": true,
+		"resize": true, "import": true, "export": true, "rollback": true, "enable": true, "disable": true,
+		"cancel": true, "ssh": true, "scp": true, "submit": true, "run": true, "attach": true, "detach": true,
+		"move": true, "copy": true, "execute": true, "activate": true, "revoke": true, "login": true,
+		"access": true, "rotate": true, "undelete": true, "upgrade": true, "call": true, "publish": true,
+		"pull": true, "suspend": true, "resume": true, "restore": true, "get-credentials": true,
+		"print-access-token": true, "print-identity-token": true,
+	}
+	opsGcloudGroup = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	// opsPlainArg matches arguments shown unquoted in logs and the audit.
+	opsPlainArg = regexp.MustCompile(`^[A-Za-z0-9_./:=,@%+-]+$`)
+	// opsBlockedFlags print credentials, act as someone else, or read more
+	// arguments from a file.
+	opsBlockedFlags = map[string][]string{
+		opsKubectl: {"--raw", "--token", "--username", "--password", "--as", "--as-group", "--as-uid"},
+		opsAWS:     {"--with-decryption", "--cli-input-json", "--cli-input-yaml", "--outfile"},
+		opsGcloud:  {"--flags-file", "--impersonate-service-account", "--access-token-file"},
+	}
+)
+
+type OpsCommandInput struct {
+	CLI            *string  `json:"cli"`
+	Args           []string `json:"args"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+}
+
+func opsCommandInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"cli": map[string]any{
+				"type": "string",
+				"enum": []string{opsKubectl, opsAWS, opsGcloud},
+			},
+			"args": map[string]any{
+				"type":        "array",
+				"items":       map[string]any{"type": "string"},
+				"description": `Arguments, starting with the subcommand and no shell quoting: ["get","pods","-n","payments"], ["ec2","describe-instances","--region","eu-west-1"], ["compute","instances","list"].`,
+			},
+			"timeout_seconds": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Defaults to %d, capped at %d.", defaultOpsTimeoutSeconds, hardOpsTimeoutSeconds),
+			},
+		},
+		Required: []string{"cli", "args"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// opsCommand runs a read-only kubectl, aws, or gcloud command that passes
+// the ops allowlist. It runs without a shell, with the agent's whole
+// environment so the CLIs find their credentials.
+func (s *Session) opsCommand(input json.RawMessage) (string, error) {
+	const expected = `{"cli":"kubectl","args":["get","pods","-n","payments"]}`
+
+	args := OpsCommandInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("ops_command", err.Error(), expected)
+	}
+	cli, err := requireToolString("ops_command", "cli", args.CLI, false, expected)
+	if err != nil {
+		return "", err
+	}
+	cli = strings.TrimSpace(cli)
+	if len(args.Args) == 0 {
+		return "", toolInputValidationError("ops_command", "args must name a subcommand", expected)
+	}
+	var reason string
+	switch cli {
+	case opsKubectl:
+		reason = checkKubectlArgs(args.Args)
+	case opsAWS:
+		reason = checkAWSArgs(args.Args)
+	case opsGcloud:
+		reason = checkGcloudArgs(args.Args)
+	default:
+		return "", toolInputValidationError("ops_command", fmt.Sprintf("cli must be %q, %q, or %q", opsKubectl, opsAWS, opsGcloud), expected)
+	}
+	if reason == "" {
+		reason = checkOpsFlags(cli, args.Args)
+	}
+	quoted := make([]string, len(args.Args))
+	for i, arg := range args.Args {
+		quoted[i] = arg
+		if !opsPlainArg.MatchString(arg) {
+			quoted[i] = shellQuote(arg)
+		}
+	}
+	command := cli + " " + strings.Join(quoted, " ")
+	if reason != "" {
+		debugf("ops_command_refused command=%q reason=%q", command, reason)
+		return "", newToolError(ToolErrorPermission, "refused %s: %s. The ops profile only runs commands that read", command, reason)
+	}
+	if pattern := s.deniedCommandPattern(command); pattern != "" {
+		return "", newToolError(ToolErrorPermission, "command refused: it matches the denylist pattern %s", pattern)
+	}
+	if _, err := exec.LookPath(cli); err != nil {
+		return "", newToolError(ToolErrorNotFound, "%s is not installed", cli)
+	}
+	timeoutSeconds := defaultOpsTimeoutSeconds
+	if args.TimeoutSeconds > 0 {
+		timeoutSeconds = min(args.TimeoutSeconds, hardOpsTimeoutSeconds)
+	}
+
+	ctx, cancel := context.WithTimeout(s.toolContext(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+	start := time.Now()
+	// No stdin, so a command that would prompt fails instead of waiting.
+	cmd := exec.CommandContext(ctx, cli, args.Args...)
+	cmd.Dir = s.root
+	out, runErr := cmd.CombinedOutput()
+	exitCode := 0
+	var exitErr *exec.ExitError
+	switch {
+	case runErr == nil:
+	case errors.As(runErr, &exitErr):
+		exitCode = exitErr.ExitCode()
+	case ctx.Err() == nil:
+		return "", fmt.Errorf("failed to run %s: %w", cli, runErr)
+	default:
+		exitCode = -1
+	}
+	s.audit.record(AuditEntry{
+		Tool:        "ops_command",
+		Command:     command,
+		ExitCode:    &exitCode,
+		TimedOut:    ctx.Err() == context.DeadlineExceeded,
+		OutputBytes: len(out),
+		DurationMs:  time.Since(start).Milliseconds(),
+	})
+	debugf("ops_command command=%q exit_code=%d output_bytes=%d", command, exitCode, len(out))
+	fmt.Fprintf(s.out, "%s: %s\n", colorLabel("ops", commentColor, s.cfg.ColorOutput), command)
+
+	output, truncated := truncateOutput([]byte(s.redactSecrets(string(out))), defaultBashMaxOutputBytes)
+	output = strings.TrimSpace(output)
+	if truncated {
+		output += fmt.Sprintf("\n\n(output truncated at %d bytes; narrow the query)", defaultBashMaxOutputBytes)
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Sprintf("Command timed out after %d seconds.\n\nPartial output:\n%s", timeoutSeconds, output), nil
+	case ctx.Err() == context.Canceled:
+		return "Command was cancelled by the user.\n\nPartial output:\n" + output, nil
+	case exitCode != 0:
+		return fmt.Sprintf("Command exited with code %d.\n\nOutput:\n%s", exitCode, output), nil
+	case output == "":
+		return "Command completed successfully with no output.", nil
+	}
+	return output, nil
+}
+
+// opsPositionals returns the arguments that are not flags, up to the first
+// flag, which is where the CLIs' subcommands end.
+func opsPositionals(args []string) []string {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return args[:i]
+		}
+	}
+	return args
+}
+
+func checkKubectlArgs(args []string) string {
+	verb := args[0]
+	if subcommands, ok := opsKubectlSubcommands[verb]; ok {
+		if len(args) < 2 || !subcommands[args[1]] {
+			return fmt.Sprintf("only %s of kubectl %s is allowed", strings.Join(sortedKeys(subcommands), ", "), verb)
+		}
+		return ""
+	}
+	if !opsKubectlVerbs[verb] {
+		return fmt.Sprintf("kubectl %s is not one of %s", verb, strings.Join(sortedKeys(opsKubectlVerbs), ", "))
+	}
+	if verb == "cluster-info" && len(opsPositionals(args)) > 1 {
+		return "kubectl cluster-info takes no subcommand"
+	}
+	if verb == "get" {
+		// kubectl get secret -o yaml prints their values; describe does not.
+		// Flag values are checked too, which errs on the side of refusing.
+		output, fromFiles := false, false
+		for _, arg := range args[1:] {
+			if strings.HasPrefix(arg, "-") {
+				name, _, _ := strings.Cut(arg, "=")
+				switch {
+				case name == "--output" || strings.HasPrefix(arg, "-o"):
+					output = true
+				case name == "-f" || name == "--filename" || name == "-k" || name == "--kustomize" || strings.HasPrefix(arg, "-f") || strings.HasPrefix(arg, "-k"):
+					fromFiles = true
+				}
+				continue
+			}
+			for _, resource := range strings.Split(arg, ",") {
+				kind, _, _ := strings.Cut(strings.ToLower(resource), "/")
+				if kubectlSecretKind(kind) {
+					return "kubectl get on secrets prints their values; use kubectl describe"
+				}
+			}
+		}
+		// The objects named in manifests may be secrets.
+		if output && fromFiles {
+			return "kubectl get -o with -f or -k may print secrets' values; name the resources instead"
+		}
+	}
+	return ""
+}
+
+// kubectlSecretKind reports whether a kubectl resource kind names secrets,
+// including the kind.version.group forms.
+func kubectlSecretKind(kind string) bool {
+	name, _, _ := strings.Cut(kind, ".")
+	return name == "secret" || name == "secrets"
+}
+
+func checkAWSArgs(args []string) string {
+	positionals := opsPositionals(args)
+	if len(positionals) < 2 {
+		return "aws arguments must start with a service and an operation, such as ec2 describe-instances"
+	}
+	service, operation := positionals[0], positionals[1]
+	if opsAWSExtra[service+" "+operation] {
+		return ""
+	}
+	if !opsAWSOperation.MatchString(operation) {
+		return fmt.Sprintf("aws %s %s is not a describe-, get-, or list- operation", service, operation)
+	}
+	if opsAWSSensitive.MatchString(operation) {
+		return fmt.Sprintf("aws %s %s returns credentials or writes a file", service, operation)
+	}
+	return ""
+}
+
+func checkGcloudArgs(args []string) string {
+	for _, arg := range opsPositionals(args) {
+		if opsGcloudMutating[arg] {
+			return fmt.Sprintf("gcloud %s changes things or prints credentials", arg)
+		}
+		if opsGcloudVerbs[arg] {
+			return ""
+		}
+		if !opsGcloudGroup.MatchString(arg) {
+			break
+		}
+	}
+	return fmt.Sprintf("gcloud commands must end in one of %s", strings.Join(sortedKeys(opsGcloudVerbs), ", "))
+}
+
+func checkOpsFlags(cli string, args []string) string {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(arg, "=")
+		for _, blocked := range opsBlockedFlags[cli] {
+			if name == blocked {
+				return fmt.Sprintf("%s is not allowed", blocked)
+			}
+		}
+	}
+	return ""
+}
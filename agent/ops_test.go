@@ -0,0 +1,37 @@
+package agent
+
+import "testing"
+
+func TestCheckKubectlArgs(t *testing.T) {
+	allowed := [][]string{
+		{"get", "pods", "-o", "yaml"},
+		{"get", "deployments,services", "-n", "prod"},
+		{"get", "-f", "deploy.yaml"},
+		{"describe", "secret", "db-password"},
+		{"auth", "can-i", "list", "pods"},
+	}
+	for _, args := range allowed {
+		if reason := checkKubectlArgs(args); reason != "" {
+			t.Errorf("checkKubectlArgs(%q) refused: %s", args, reason)
+		}
+	}
+
+	refused := [][]string{
+		{"delete", "pod", "web"},
+		{"get", "secret", "db-password", "-o", "yaml"},
+		{"get", "secrets"},
+		{"get", "-o", "json", "Secret/db-password"},
+		{"get", "pods,secrets", "-oyaml"},
+		{"get", "secret.v1", "-o=jsonpath={.data}"},
+		{"get", "secrets.v1.", "--output", "json"},
+		{"get", "-f", "manifests/", "-o", "yaml"},
+		{"get", "--filename=all.yaml", "--output=json"},
+		{"get", "-k", "overlays/prod", "-ojson"},
+		{"config", "set-context", "prod"},
+	}
+	for _, args := range refused {
+		if reason := checkKubectlArgs(args); reason == "" {
+			t.Errorf("checkKubectlArgs(%q) allowed the command", args)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package agent
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// startProcessGroup starts cmd in a new process group, so that console
+// interrupts meant for the agent do not reach it.
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// terminateProcessGroup stops the process tree under cmd. Windows has no
+// signal asking a console process to exit, so this is the same as
+// killProcessGroup.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return killProcessGroup(cmd)
+}
+
+// killProcessGroup kills cmd's process and its children with taskkill,
+// falling back to the process alone.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
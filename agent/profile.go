@@ -0,0 +1,269 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	defaultProfileTop            = 20
+	maxProfileTop                = 100
+	defaultProfileTimeoutSeconds = 120
+	hardProfileTimeoutSeconds    = 600
+	// maxProfileCommandOutput keeps the end of the profiled command's output,
+	// where benchmarks print their timings.
+	maxProfileCommandOutput = 4_000
+)
+
+const (
+	profileKindCPU    = "cpu"
+	profileKindMemory = "memory"
+)
+
+type ProfileInput struct {
+	Command        *string `json:"command"`
+	Language       string  `json:"language,omitempty"`
+	Kind           string  `json:"kind,omitempty"`
+	Top            int     `json:"top,omitempty"`
+	Cumulative     bool    `json:"cumulative,omitempty"`
+	TimeoutSeconds int     `json:"timeout_seconds,omitempty"`
+}
+
+func profileInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"command": map[string]any{
+				"type":        "string",
+				"description": "For Go, a go test command for one package, usually a benchmark: go test -run=^$ -bench=BenchmarkParse ./parser. For Python, the command that runs the code: python bench.py.",
+			},
+			"language": map[string]any{
+				"type":        "string",
+				"enum":        []string{docLanguageGo, docLanguagePython},
+				"description": "Defaults to the workspace's language, detected from go.mod or pyproject.toml/requirements.txt/setup.py.",
+			},
+			"kind": map[string]any{
+				"type":        "string",
+				"enum":        []string{profileKindCPU, profileKindMemory},
+				"description": "What to profile: cpu time (default) or, for Go only, memory allocated.",
+			},
+			"top": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("How many functions to list. Defaults to %d, at most %d.", defaultProfileTop, maxProfileTop),
+			},
+			"cumulative": map[string]any{
+				"type":        "boolean",
+				"description": "Rank by time including callees instead of time in the function itself.",
+			},
+			"timeout_seconds": map[string]any{
+				"type":        "integer",
+				"description": fmt.Sprintf("Defaults to %d, capped at %d.", defaultProfileTimeoutSeconds, hardProfileTimeoutSeconds),
+			},
+		},
+		Required: []string{"command"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// profile runs a command under the language's profiler, pprof through go
+// test's profile flags or py-spy, and returns the hottest functions as a
+// table, after the end of the command's own output.
+func (s *Session) profile(input json.RawMessage) (string, error) {
+	const expected = `{"command":"go test -run=^$ -bench=BenchmarkParse ./parser","top":20}`
+
+	args := ProfileInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("profile", err.Error(), expected)
+	}
+	command, err := requireToolString("profile", "command", args.Command, false, expected)
+	if err != nil {
+		return "", err
+	}
+	command = strings.TrimSpace(command)
+	language := strings.ToLower(strings.TrimSpace(args.Language))
+	if language == "" {
+		language = detectDocLanguage(s.root)
+	}
+	kind := strings.ToLower(strings.TrimSpace(args.Kind))
+	if kind == "" {
+		kind = profileKindCPU
+	}
+	if kind != profileKindCPU && kind != profileKindMemory {
+		return "", toolInputValidationError("profile", fmt.Sprintf("kind must be %q or %q", profileKindCPU, profileKindMemory), expected)
+	}
+	top := args.Top
+	if top <= 0 {
+		top = defaultProfileTop
+	}
+	top = min(top, maxProfileTop)
+	timeoutSeconds := defaultProfileTimeoutSeconds
+	if args.TimeoutSeconds > 0 {
+		timeoutSeconds = min(args.TimeoutSeconds, hardProfileTimeoutSeconds)
+	}
+
+	var script string
+	profileFile, err := os.CreateTemp("", "coder-profile-*")
+	if err != nil {
+		return "", err
+	}
+	profileFile.Close()
+	defer os.Remove(profileFile.Name())
+	switch language {
+	case docLanguageGo:
+		if !strings.HasPrefix(command, "go test ") {
+			return "", toolInputValidationError("profile", "Go profiles come from go test; pass a go test command, such as a benchmark", expected)
+		}
+		flag := "-cpuprofile="
+		if kind == profileKindMemory {
+			flag = "-memprofile="
+		}
+		// The test binary is kept in the temp directory, not the workspace.
+		script = fmt.Sprintf("%s %s%s -o %s", command, flag, shellQuote(profileFile.Name()), shellQuote(profileFile.Name()+".test"))
+		defer os.Remove(profileFile.Name() + ".test")
+	case docLanguagePython:
+		if kind != profileKindCPU {
+			return "", toolInputValidationError("profile", "py-spy only profiles cpu time", expected)
+		}
+		if _, err := exec.LookPath("py-spy"); err != nil {
+			return "", newToolError(ToolErrorNotFound, "py-spy is not installed (pip install py-spy)")
+		}
+		script = fmt.Sprintf("py-spy record --subprocesses --format raw --output %s -- bash -c %s", shellQuote(profileFile.Name()), shellQuote(command))
+	default:
+		return "", toolInputValidationError("profile", "profiling is supported for Go and Python workspaces; set \"language\" if detection failed", expected)
+	}
+	if err := s.checkCommand(command); err != nil {
+		return "", err
+	}
+	s.cache.clear()
+	output, err := s.runCommand(command, script, s.root, "", timeoutSeconds, maxProfileCommandOutput)
+	if err != nil {
+		return "", err
+	}
+
+	var table string
+	if info, statErr := os.Stat(profileFile.Name()); statErr == nil && info.Size() > 0 {
+		switch language {
+		case docLanguageGo:
+			table, err = pprofTop(profileFile.Name(), kind, top, args.Cumulative)
+		case docLanguagePython:
+			table, err = collapsedStacksTop(profileFile.Name(), top, args.Cumulative)
+		}
+	} else {
+		err = fmt.Errorf("no profile was written")
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not profile %q: %v\n\nCommand output:\n%s", command, err, tailText(output, maxProfileCommandOutput))
+	}
+	debugf("profile language=%q kind=%q top=%d", language, kind, top)
+	fmt.Fprintf(s.out, "Profiled %s (%s)\n", command, kind)
+	return fmt.Sprintf("Command output:\n%s\n\nTop %d functions by %s:\n%s", tailText(output, maxProfileCommandOutput), top, profileRanking(kind, args.Cumulative), table), nil
+}
+
+func profileRanking(kind string, cumulative bool) string {
+	measure := "cpu time"
+	if kind == profileKindMemory {
+		measure = "bytes allocated"
+	}
+	if cumulative {
+		return measure + " including callees"
+	}
+	return measure + " in the function itself"
+}
+
+// pprofTop runs go tool pprof -top, keeping its table and dropping the
+// header lines about the binary and the build.
+func pprofTop(file, kind string, top int, cumulative bool) (string, error) {
+	args := []string{"tool", "pprof", "-top", "-nodecount=" + strconv.Itoa(top)}
+	if kind == profileKindMemory {
+		args = append(args, "-sample_index=alloc_space")
+	}
+	if cumulative {
+		args = append(args, "-cum")
+	}
+	out, err := exec.Command("go", append(args, file)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("go tool pprof: %s", strings.TrimSpace(string(out)))
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.HasPrefix(line, "File: ") || strings.HasPrefix(line, "Build ID: ") || strings.HasPrefix(line, "Type: ") || strings.HasPrefix(line, "Time: ") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// collapsedStacksTop ranks the functions of a py-spy raw profile, whose lines
+// are a semicolon-separated stack and a sample count.
+func collapsedStacksTop(file string, top int, cumulative bool) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	self, cum := map[string]int{}, map[string]int{}
+	total := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		space := strings.LastIndex(line, " ")
+		if space < 0 {
+			continue
+		}
+		count, err := strconv.Atoi(line[space+1:])
+		if err != nil {
+			continue
+		}
+		frames := strings.Split(line[:space], ";")
+		total += count
+		self[frames[len(frames)-1]] += count
+		seen := map[string]bool{}
+		for _, frame := range frames {
+			if !seen[frame] {
+				seen[frame] = true
+				cum[frame] += count
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if total == 0 {
+		return "", fmt.Errorf("the profile has no samples; is the command a Python program?")
+	}
+	frames := make([]string, 0, len(cum))
+	for frame := range cum {
+		frames = append(frames, frame)
+	}
+	rank := self
+	if cumulative {
+		rank = cum
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		if rank[frames[i]] != rank[frames[j]] {
+			return rank[frames[i]] > rank[frames[j]]
+		}
+		return frames[i] < frames[j]
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d samples\n  self%%    cum%%  function\n", total)
+	for _, frame := range frames[:min(top, len(frames))] {
+		fmt.Fprintf(&b, "%6.1f%%  %5.1f%%  %s\n", 100*float64(self[frame])/float64(total), 100*float64(cum[frame])/float64(total), frame)
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// promptPlaceholder matches {{name}} in a prompt template. {{args}} stands for
+// everything after the template name.
+var promptPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_-]*)\s*\}\}`)
+
+func promptsDir() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve working directory: %w", err)
+	}
+	return filepath.Join(cwd, coderDirName, promptsDirName), nil
+}
+
+// promptCommand expands the template .coder/prompts/<name>.md with args and
+// sends it as the next prompt. Without a name it lists the templates.
+func promptCommand(s *Session, args string) error {
+	dir, err := promptsDir()
+	if err != nil {
+		return err
+	}
+	name, rest, _ := strings.Cut(args, " ")
+	if name == "" {
+		return listPromptTemplates(dir)
+	}
+	if !validMemoryName(name) {
+		return fmt.Errorf("invalid template name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name+".md"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no prompt template %q in %s (try /prompt to list them)", name, filepath.Join(coderDirName, promptsDirName))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read prompt template %q: %w", name, err)
+	}
+	prompt, err := expandPromptTemplate(string(data), strings.TrimSpace(rest))
+	if err != nil {
+		return fmt.Errorf("/prompt %s: %w", name, err)
+	}
+	fmt.Fprintf(s.out, "Running prompt template %s\n", name)
+	s.pendingPrompt = &queuedPrompt{Prompt: prompt}
+	return nil
+}
+
+func listPromptTemplates(dir string) error {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.md"))
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stdout, "No prompt templates yet. Add markdown files with {{placeholders}} to %s.\n", filepath.Join(coderDirName, promptsDirName))
+		return nil
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".md")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		usage := name
+		for _, placeholder := range templatePlaceholders(string(data)) {
+			usage += " <" + placeholder + ">"
+		}
+		line, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+		fmt.Fprintf(os.Stdout, "  %-30s %s\n", usage, previewText(line, 60))
+	}
+	return nil
+}
+
+// expandPromptTemplate fills a template's placeholders from args. Arguments
+// of the form name=value fill that placeholder; the others fill the remaining
+// placeholders in the order they first appear. {{args}} is all of args.
+func expandPromptTemplate(template, args string) (string, error) {
+	words, err := splitPromptArgs(args)
+	if err != nil {
+		return "", err
+	}
+	values := map[string]string{"args": args}
+	var positional []string
+	for _, word := range words {
+		if name, value, ok := strings.Cut(word, "="); ok && promptPlaceholder.MatchString("{{"+name+"}}") {
+			values[name] = value
+			continue
+		}
+		positional = append(positional, word)
+	}
+	var missing []string
+	for _, name := range templatePlaceholders(template) {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		if len(positional) == 0 {
+			missing = append(missing, name)
+			continue
+		}
+		values[name], positional = positional[0], positional[1:]
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing value for %s", strings.Join(missing, ", "))
+	}
+	usesArgs := false
+	for _, match := range promptPlaceholder.FindAllStringSubmatch(template, -1) {
+		usesArgs = usesArgs || match[1] == "args"
+	}
+	if len(positional) > 0 && !usesArgs {
+		return "", fmt.Errorf("too many arguments: %s", strings.Join(positional, " "))
+	}
+	return strings.TrimSpace(promptPlaceholder.ReplaceAllStringFunc(template, func(match string) string {
+		return values[promptPlaceholder.FindStringSubmatch(match)[1]]
+	})), nil
+}
+
+// templatePlaceholders returns the placeholder names of a template in order of
+// first appearance, without args.
+func templatePlaceholders(template string) []string {
+	var names []string
+	seen := map[string]bool{"args": true}
+	for _, match := range promptPlaceholder.FindAllStringSubmatch(template, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// splitPromptArgs splits args at spaces, keeping quoted strings together.
+func splitPromptArgs(args string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+	for _, r := range args {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in arguments")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// takePendingPrompt returns and clears the prompt a slash command queued to
+// be sent as the next turn, or nil.
+func (s *Session) takePendingPrompt() *queuedPrompt {
+	queued := s.pendingPrompt
+	s.pendingPrompt = nil
+	return queued
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// defaultProtectedPaths are .coderignore-style patterns for files the write,
+// edit, move, and delete tools change only with the user's approval:
+// environment files, keys, and git's own data.
+var defaultProtectedPaths = []string{".env*", "*.pem", "*.key", ".git/"}
+
+// newProtectedMatcher combines the default protected patterns with the
+// project's permissions.protected. Later patterns win, so a project can
+// unprotect a default with a negation such as "!.env.example".
+func newProtectedMatcher(patterns []string) *ignoreMatcher {
+	all := append(append([]string(nil), defaultProtectedPaths...), patterns...)
+	return parseIgnorePatterns(strings.Join(all, "\n"))
+}
+
+// checkProtected asks the user before tool changes a protected path. Under
+// -yes, which approves everything else, protected paths are refused: they
+// need a person's say-so.
+func (s *Session) checkProtected(tool, displayPath string, isDir bool) error {
+	if !s.protected.Ignored(displayPath, isDir) {
+		return nil
+	}
+	return s.approveProtected(tool, displayPath)
+}
+
+// checkProtectedTree is checkProtected for a directory about to be moved or
+// deleted: the directory itself or any file under it may be protected.
+func (s *Session) checkProtectedTree(tool, absDir, displayPath string) error {
+	if s.protected.Ignored(displayPath, true) {
+		return s.approveProtected(tool, displayPath)
+	}
+	var protected []string
+	filepath.WalkDir(absDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == absDir {
+			return nil
+		}
+		rel, relErr := filepath.Rel(absDir, path)
+		if relErr != nil {
+			return nil
+		}
+		inner := joinDisplayPath(displayPath, filepath.ToSlash(rel))
+		if s.protected.Ignored(inner, d.IsDir()) {
+			protected = append(protected, inner)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if len(protected) == 0 {
+		return nil
+	}
+	subject := fmt.Sprintf("%s, which contains protected %s", displayPath, strings.Join(protected[:min(len(protected), 3)], ", "))
+	if len(protected) > 3 {
+		subject += fmt.Sprintf(" and %d more", len(protected)-3)
+	}
+	return s.approveProtected(tool, subject)
+}
+
+func (s *Session) approveProtected(tool, subject string) error {
+	if s.cfg.AutoApprove {
+		return newToolError(ToolErrorPermission, "%s is protected; -yes does not approve changes to protected paths, so ask the user to make this change", subject)
+	}
+	if !s.confirm(fmt.Sprintf("Allow %s to change protected path %s?", tool, subject)) {
+		return newToolError(ToolErrorPermission, "%s is protected and the user declined the change; ask what they would like to do instead", subject)
+	}
+	return nil
+}
@@ -0,0 +1,656 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	maxQueryFileBytes   = 50_000_000
+	maxQueryOutputBytes = 16_000
+)
+
+type QueryFileInput struct {
+	Path       *string `json:"path"`
+	Expression string  `json:"expression,omitempty"`
+}
+
+func queryFileInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Workspace JSON or YAML file.",
+			},
+			"expression": map[string]any{
+				"type":        "string",
+				"description": `jq-style expression. Defaults to ".". Supports .key, ."odd/key", .[0], .[-1], .[2:5], .[], ? after a step, | pipes, keys, length, type, and select(.field == "value") with ==, !=, <, <=, >, >=.`,
+			},
+		},
+		Required: []string{"path"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// queryFile evaluates a jq-style expression over a JSON or YAML file and
+// returns only the matching values, so one key of a large lockfile or Helm
+// values file costs a few lines instead of the whole file.
+func (s *Session) queryFile(input json.RawMessage) (string, error) {
+	const expected = `{"path":"package-lock.json","expression":".packages[\"node_modules/lodash\"].version"}`
+
+	args := QueryFileInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("query_file", err.Error(), expected)
+	}
+	pathValue, err := requireToolString("query_file", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	expression := strings.TrimSpace(args.Expression)
+	if expression == "" {
+		expression = "."
+	}
+	query, err := parseQuery(expression)
+	if err != nil {
+		return "", toolInputValidationError("query_file", "expression: "+err.Error(), expected)
+	}
+
+	absFile, displayPath, err := s.resolveWorkspaceFile(pathValue)
+	if err != nil {
+		return "", err
+	}
+	if workspaceIgnore(s.root).Ignored(displayPath, false) {
+		return "", newToolError(ToolErrorPermission, "path %s is excluded by %s", displayPath, coderIgnoreName)
+	}
+	if info, err := os.Stat(absFile); err == nil && info.Size() > maxQueryFileBytes {
+		return "", newToolError(ToolErrorValidation, "%s is larger than %d bytes", displayPath, maxQueryFileBytes)
+	}
+	data, err := os.ReadFile(absFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %q: %w", displayPath, err)
+	}
+	document, err := decodeStructuredFile(absFile, data)
+	if err != nil {
+		return "", newToolError(ToolErrorValidation, "%s: %v", displayPath, err)
+	}
+
+	results, err := query.eval([]any{document})
+	if err != nil {
+		return "", newToolError(ToolErrorFailed, "%s: %v", expression, err)
+	}
+	debugf("query_file path=%q expression=%q results=%d", displayPath, expression, len(results))
+	fmt.Fprintf(s.out, "%s: %s %s\n", colorLabel("query", commentColor, s.cfg.ColorOutput), displayPath, expression)
+
+	if len(results) == 0 {
+		return "No results.", nil
+	}
+	var b strings.Builder
+	for _, result := range results {
+		encoded, err := encodeQueryResult(result)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode result: %w", err)
+		}
+		b.WriteString(encoded)
+		b.WriteString("\n")
+	}
+	output, truncated := truncateOutput([]byte(b.String()), maxQueryOutputBytes)
+	output = strings.TrimRight(output, "\n")
+	if truncated {
+		output += fmt.Sprintf("\n\n(output truncated at %d bytes; narrow the expression, or list the keys with | keys)", maxQueryOutputBytes)
+	}
+	return output, nil
+}
+
+// decodeStructuredFile parses a JSON or YAML file, choosing by extension
+// and falling back to whichever parses.
+func decodeStructuredFile(path string, data []byte) (any, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return nil, errors.New("not a text file")
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return decodeQueryJSON(data)
+	case ".yaml", ".yml":
+		return parseYAML(string(data))
+	}
+	if value, err := decodeQueryJSON(data); err == nil {
+		return value, nil
+	}
+	value, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("neither JSON nor YAML: %w", err)
+	}
+	return value, nil
+}
+
+func decodeQueryJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, so large integers and versions survive.
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("more than one JSON value")
+	}
+	return value, nil
+}
+
+// encodeQueryResult writes scalars on one line and collections indented.
+func encodeQueryResult(value any) (string, error) {
+	if f, ok := value.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	switch value.(type) {
+	case map[string]any, []any:
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// queryPipeline is a parsed expression: stages joined by |, each fed every
+// result of the one before.
+type queryPipeline []queryStage
+
+type queryStage interface {
+	apply(value any) ([]any, error)
+}
+
+func (p queryPipeline) eval(values []any) ([]any, error) {
+	for _, stage := range p {
+		var next []any
+		for _, value := range values {
+			results, err := stage.apply(value)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, results...)
+		}
+		values = next
+	}
+	return values, nil
+}
+
+// queryPath is a path such as .spec.containers[0].image. An optional step,
+// written with a trailing ?, yields nothing instead of failing.
+type queryPath []queryStep
+
+type queryStep struct {
+	key      *string
+	index    *int
+	iterate  bool
+	slice    bool
+	from, to *int
+	optional bool
+}
+
+func (p queryPath) apply(value any) ([]any, error) {
+	values := []any{value}
+	for _, step := range p {
+		var next []any
+		for _, v := range values {
+			results, err := step.apply(v)
+			if err != nil {
+				if step.optional {
+					continue
+				}
+				return nil, err
+			}
+			next = append(next, results...)
+		}
+		values = next
+	}
+	return values, nil
+}
+
+func (s queryStep) apply(value any) ([]any, error) {
+	switch {
+	case s.key != nil:
+		switch v := value.(type) {
+		case nil:
+			return []any{nil}, nil
+		case map[string]any:
+			return []any{v[*s.key]}, nil
+		}
+		return nil, fmt.Errorf("cannot index %s with %q", queryType(value), *s.key)
+	case s.index != nil:
+		switch v := value.(type) {
+		case nil:
+			return []any{nil}, nil
+		case []any:
+			i := *s.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return []any{nil}, nil
+			}
+			return []any{v[i]}, nil
+		}
+		return nil, fmt.Errorf("cannot index %s with a number", queryType(value))
+	case s.iterate:
+		switch v := value.(type) {
+		case []any:
+			return v, nil
+		case map[string]any:
+			results := make([]any, 0, len(v))
+			for _, key := range sortedKeys(v) {
+				results = append(results, v[key])
+			}
+			return results, nil
+		}
+		return nil, fmt.Errorf("cannot iterate over %s", queryType(value))
+	case s.slice:
+		var length int
+		switch v := value.(type) {
+		case nil:
+			return []any{nil}, nil
+		case []any:
+			length = len(v)
+		case string:
+			length = len(v)
+		default:
+			return nil, fmt.Errorf("cannot slice %s", queryType(value))
+		}
+		from, to := 0, length
+		if s.from != nil {
+			from = *s.from
+		}
+		if s.to != nil {
+			to = *s.to
+		}
+		if from < 0 {
+			from += length
+		}
+		if to < 0 {
+			to += length
+		}
+		from, to = max(0, min(from, length)), max(0, min(to, length))
+		if to < from {
+			to = from
+		}
+		if v, ok := value.([]any); ok {
+			return []any{v[from:to]}, nil
+		}
+		return []any{value.(string)[from:to]}, nil
+	}
+	return []any{value}, nil
+}
+
+// queryBuiltin is keys, length, or type.
+type queryBuiltin string
+
+func (b queryBuiltin) apply(value any) ([]any, error) {
+	switch b {
+	case "type":
+		return []any{queryType(value)}, nil
+	case "keys":
+		switch v := value.(type) {
+		case map[string]any:
+			keys := make([]any, 0, len(v))
+			for _, key := range sortedKeys(v) {
+				keys = append(keys, key)
+			}
+			return []any{keys}, nil
+		case []any:
+			keys := make([]any, len(v))
+			for i := range v {
+				keys[i] = int64(i)
+			}
+			return []any{keys}, nil
+		}
+		return nil, fmt.Errorf("%s has no keys", queryType(value))
+	case "length":
+		switch v := value.(type) {
+		case nil:
+			return []any{int64(0)}, nil
+		case string:
+			return []any{int64(utf8.RuneCountInString(v))}, nil
+		case []any:
+			return []any{int64(len(v))}, nil
+		case map[string]any:
+			return []any{int64(len(v))}, nil
+		}
+		if n, ok := queryNumber(value); ok {
+			return []any{math.Abs(n)}, nil
+		}
+		return nil, fmt.Errorf("%s has no length", queryType(value))
+	}
+	return nil, fmt.Errorf("unknown function %s", string(b))
+}
+
+// querySelect keeps its input when the condition holds: a path compared
+// with a literal, or a path alone, which holds when it is neither null nor
+// false.
+type querySelect struct {
+	path    queryPipeline
+	op      string
+	literal any
+}
+
+func (s querySelect) apply(value any) ([]any, error) {
+	results, err := s.path.eval([]any{value})
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if s.holds(result) {
+			return []any{value}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s querySelect) holds(value any) bool {
+	if s.op == "" {
+		return value != nil && value != false
+	}
+	order, comparable := compareQueryValues(value, s.literal)
+	switch s.op {
+	case "==":
+		return comparable && order == 0
+	case "!=":
+		return !comparable || order != 0
+	case "<":
+		return comparable && order < 0
+	case "<=":
+		return comparable && order <= 0
+	case ">":
+		return comparable && order > 0
+	case ">=":
+		return comparable && order >= 0
+	}
+	return false
+}
+
+// compareQueryValues orders two numbers or two strings, and reports other
+// pairs comparable only when they are equal.
+func compareQueryValues(a, b any) (int, bool) {
+	if x, ok := queryNumber(a); ok {
+		if y, ok := queryNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+		return 0, false
+	}
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	if errA != nil || errB != nil || !bytes.Equal(x, y) {
+		return 0, false
+	}
+	return 0, true
+}
+
+func queryNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func queryType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	if _, ok := queryNumber(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// parseQuery parses the jq subset query_file supports.
+func parseQuery(expression string) (queryPipeline, error) {
+	var pipeline queryPipeline
+	for _, part := range splitQuery(expression, '|') {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+			return nil, errors.New("empty stage in pipeline")
+		case part == "keys" || part == "length" || part == "type":
+			pipeline = append(pipeline, queryBuiltin(part))
+		case strings.HasPrefix(part, "select(") && strings.HasSuffix(part, ")"):
+			stage, err := parseQuerySelect(part[len("select(") : len(part)-1])
+			if err != nil {
+				return nil, err
+			}
+			pipeline = append(pipeline, stage)
+		case strings.HasPrefix(part, "."):
+			path, err := parseQueryPath(part)
+			if err != nil {
+				return nil, err
+			}
+			pipeline = append(pipeline, path)
+		default:
+			return nil, fmt.Errorf("unsupported expression %q; use a path such as .a.b[0], keys, length, type, or select(...)", part)
+		}
+	}
+	return pipeline, nil
+}
+
+func parseQuerySelect(condition string) (querySelect, error) {
+	operators := []string{"==", "!=", "<=", ">=", "<", ">"}
+	for i := 0; i < len(condition); i++ {
+		if condition[i] == '"' {
+			// Skip quoted keys, which may contain operator characters.
+			for i++; i < len(condition) && condition[i] != '"'; i++ {
+				if condition[i] == '\\' {
+					i++
+				}
+			}
+			continue
+		}
+		for _, op := range operators {
+			if !strings.HasPrefix(condition[i:], op) {
+				continue
+			}
+			path, err := parseQuery(strings.TrimSpace(condition[:i]))
+			if err != nil {
+				return querySelect{}, err
+			}
+			var literal any
+			decoder := json.NewDecoder(strings.NewReader(strings.TrimSpace(condition[i+len(op):])))
+			decoder.UseNumber()
+			if err := decoder.Decode(&literal); err != nil {
+				return querySelect{}, fmt.Errorf("select compares with a JSON literal such as \"x\", 3, true, or null: %v", err)
+			}
+			if decoder.More() {
+				return querySelect{}, errors.New("select compares with a single literal")
+			}
+			return querySelect{path: path, op: op, literal: literal}, nil
+		}
+	}
+	path, err := parseQuery(strings.TrimSpace(condition))
+	if err != nil {
+		return querySelect{}, err
+	}
+	return querySelect{path: path}, nil
+}
+
+// splitQuery splits an expression at sep outside quotes, brackets, and
+// parentheses.
+func splitQuery(expression string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(expression); i++ {
+		switch c := expression[i]; {
+		case c == '"':
+			for i++; i < len(expression) && expression[i] != '"'; i++ {
+				if expression[i] == '\\' {
+					i++
+				}
+			}
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, expression[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, expression[start:])
+}
+
+func parseQueryPath(text string) (queryPath, error) {
+	var path queryPath
+	i := 0
+	if text == "." {
+		return path, nil
+	}
+	for i < len(text) {
+		var step queryStep
+		switch {
+		case text[i] == '.' && i+1 < len(text) && text[i+1] == '"':
+			key, n, err := readQueryString(text[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			step.key = &key
+			i += 1 + n
+		case text[i] == '.' && i+1 < len(text) && text[i+1] == '[':
+			i++
+			continue
+		case text[i] == '.':
+			j := i + 1
+			for j < len(text) && (isASCIIAlnum(text[j]) || text[j] == '_' || text[j] == '-') {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("expected a key after . at %q; quote keys with other characters, as in .\"a/b\"", text[i:])
+			}
+			key := text[i+1 : j]
+			step.key = &key
+			i = j
+		case text[i] == '[':
+			end := strings.IndexByte(text[i:], ']')
+			if inner := strings.TrimSpace(text[i+1:]); strings.HasPrefix(inner, `"`) {
+				key, n, err := readQueryString(inner)
+				if err != nil {
+					return nil, err
+				}
+				rest := strings.TrimSpace(inner[n:])
+				if !strings.HasPrefix(rest, "]") {
+					return nil, fmt.Errorf("expected ] after %s", inner[:n])
+				}
+				step.key = &key
+				i = len(text) - len(rest) + 1
+				break
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %q", text[i:])
+			}
+			if err := parseQueryIndex(strings.TrimSpace(text[i+1:i+end]), &step); err != nil {
+				return nil, err
+			}
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("unexpected %q in path", text[i:])
+		}
+		if i < len(text) && text[i] == '?' {
+			step.optional = true
+			i++
+		}
+		path = append(path, step)
+	}
+	return path, nil
+}
+
+// parseQueryIndex reads the inside of [], [n], or [from:to].
+func parseQueryIndex(inner string, step *queryStep) error {
+	if inner == "" {
+		step.iterate = true
+		return nil
+	}
+	bound := func(text string) (*int, error) {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("index %q is not an integer", text)
+		}
+		return &n, nil
+	}
+	if from, to, ok := strings.Cut(inner, ":"); ok {
+		var err error
+		step.slice = true
+		if step.from, err = bound(from); err != nil {
+			return err
+		}
+		step.to, err = bound(to)
+		return err
+	}
+	index, err := bound(inner)
+	step.index = index
+	return err
+}
+
+// readQueryString reads the JSON string at the start of text and returns it
+// with the number of bytes it took.
+func readQueryString(text string) (string, int, error) {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(text[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("bad string %s", text[:i+1])
+			}
+			return value, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %s", text)
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+const queryTestDocument = `{
+  "name": "demo",
+  "version": "1.2.0",
+  "big": 12345678901234567890,
+  "packages": {
+    "node_modules/lodash": {"version": "4.17.21", "dev": false},
+    "node_modules/jest": {"version": "29.7.0", "dev": true}
+  },
+  "items": [
+    {"id": 1, "tags": ["a", "b"], "price": 9.5},
+    {"id": 2, "tags": [], "price": 20},
+    {"id": 3, "price": null}
+  ]
+}`
+
+func TestQueryEval(t *testing.T) {
+	document, err := decodeQueryJSON([]byte(queryTestDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expression, want string
+	}{
+		{".name", `"demo"`},
+		{".big", `12345678901234567890`},
+		{`.packages["node_modules/lodash"].version`, `"4.17.21"`},
+		{`.packages."node_modules/jest".dev`, `true`},
+		{".items[0].id", `1`},
+		{".items[-1].id", `3`},
+		{".items[5]", `null`},
+		// A slice is one array, which has no .id.
+		{".items[1:].id", ""},
+		{".items[1:] | length", `2`},
+		{".items[].id", "1\n2\n3"},
+		{".items[].tags[]?", `"a"` + "\n" + `"b"`},
+		{".missing.deeper", `null`},
+		{".packages | keys", "[\n  \"node_modules/jest\",\n  \"node_modules/lodash\"\n]"},
+		{".items | length", `3`},
+		{".name | length", `4`},
+		{".items[0] | type", `"object"`},
+		{".items[] | select(.price > 10) | .id", `2`},
+		{".items[] | select(.price == null) | .id", `3`},
+		{`.packages[] | select(.dev) | .version`, `"29.7.0"`},
+		{`.packages[] | select(.version != "4.17.21") | .version`, `"29.7.0"`},
+		{".name[1:3]", `"em"`},
+	}
+	for _, tc := range tests {
+		query, err := parseQuery(tc.expression)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", tc.expression, err)
+			continue
+		}
+		results, err := query.eval([]any{document})
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: want an error, got %v", tc.expression, results)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.expression, err)
+			continue
+		}
+		var encoded []string
+		for _, result := range results {
+			text, err := encodeQueryResult(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded = append(encoded, text)
+		}
+		if got := strings.Join(encoded, "\n"); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.expression, got, tc.want)
+		}
+	}
+
+	for _, expression := range []string{"name", ".items[", ".a |", "select(.a ==)", `.["unterminated]`, ".x | nope"} {
+		if _, err := parseQuery(expression); err == nil {
+			t.Errorf("parseQuery(%q) accepted an invalid expression", expression)
+		}
+	}
+}
+
+func TestDecodeStructuredFile(t *testing.T) {
+	for _, tc := range []struct {
+		path, data, want string
+	}{
+		{"a.json", `{"a": 1}`, `{"a":1}`},
+		{"a.yaml", "a: 1\n", `{"a":1}`},
+		{"config", "a: 1\n", `{"a":1}`},
+		{"config", "\xef\xbb\xbf{\"a\": [1, 2]}", "{\"a\":[1,2]}"},
+	} {
+		value, err := decodeStructuredFile(tc.path, []byte(tc.data))
+		if err != nil {
+			t.Errorf("decodeStructuredFile(%s): %v", tc.path, err)
+			continue
+		}
+		got, _ := encodeQueryResult(value)
+		if got := strings.Join(strings.Fields(got), ""); got != tc.want {
+			t.Errorf("decodeStructuredFile(%s) = %s, want %s", tc.path, got, tc.want)
+		}
+	}
+	if _, err := decodeStructuredFile("a.json", []byte("a: 1")); err == nil {
+		t.Error("decodeStructuredFile parsed YAML in a .json file")
+	}
+	if _, err := decodeStructuredFile("a.bin", []byte{0xff, 0xfe, 0x00}); err == nil {
+		t.Error("decodeStructuredFile accepted a binary file")
+	}
+}
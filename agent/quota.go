@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// diskQuota limits how much a session may grow the workspace on disk. Usage
+// is measured rather than counted, so files created by bash commands and
+// background processes count as well as those written by file tools.
+type diskQuota struct {
+	limit    int64
+	root     string
+	baseline int64
+}
+
+// newDiskQuota measures the workspace at root as the baseline for limit, or
+// returns nil when limit is zero.
+func newDiskQuota(root string, limit int64) *diskQuota {
+	if limit <= 0 {
+		return nil
+	}
+	return &diskQuota{limit: limit, root: root, baseline: directorySize(root)}
+}
+
+// used returns how many bytes the workspace has grown since the session
+// started.
+func (q *diskQuota) used() int64 {
+	return directorySize(q.root) - q.baseline
+}
+
+// checkDiskQuota refuses a write or command once the session has grown the
+// workspace past the quota. Deleting files is still allowed, to make room.
+func (s *Session) checkDiskQuota(tool string) error {
+	if s.quota == nil {
+		return nil
+	}
+	used := s.quota.used()
+	if used <= s.quota.limit {
+		return nil
+	}
+	debugf("disk_quota_exceeded tool=%q used_bytes=%d limit_bytes=%d", tool, used, s.quota.limit)
+	return newToolError(ToolErrorPermission, "disk quota exceeded: this session has added %s to the workspace, over its quota of %s, so %s is blocked; delete generated files with delete_file or delete_directory to continue",
+		formatByteSize(used), formatByteSize(s.quota.limit), tool)
+}
+
+// directorySize returns the total size of the regular files under root,
+// without following symlinks. Unreadable entries are skipped, as is the
+// agent's own .coder directory, so the audit log does not count and deleted
+// files, which go to its trash, stop counting.
+func directorySize(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && path == filepath.Join(root, coderDirName) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// parseByteSize parses sizes such as "512", "200K", "500M", or "2G", with
+// binary units.
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if number, ok := strings.CutSuffix(value, unit); ok {
+			value, multiplier = number, int64(1)<<(10*(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("expected a size such as 500M or 2G")
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatByteSize formats a size with the largest binary unit that keeps it
+// at least 1, e.g. "1.5 MiB".
+func formatByteSize(n int64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n)/(1<<10), "KiB"
+	for _, next := range []string{"MiB", "GiB", "TiB"} {
+		if size < 1<<10 {
+			break
+		}
+		size, unit = size/(1<<10), next
+	}
+	return fmt.Sprintf("%.1f %s", size, unit)
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// credentialPattern is one shape of credential. Its match is replaced by a
+// [redacted <name>] marker; groups named "before" and "after" are kept
+// around the marker, so "API_KEY=" still shows which setting it was.
+type credentialPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// secretName matches setting names whose values are secrets.
+const secretName = `[A-Za-z0-9_.-]*(?i:key|token|secret|password|passwd|credential)s?`
+
+// credentialPatterns are the credential shapes redacted from tool results and
+// debug logs, whatever their source.
+var credentialPatterns = []credentialPattern{
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)},
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"Anthropic API key", regexp.MustCompile(`\bsk-ant-[A-Za-z0-9_-]{20,}`)},
+	{"OpenAI API key", regexp.MustCompile(`\bsk-(proj-)?[A-Za-z0-9_-]{20,}`)},
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"bearer token", regexp.MustCompile(`(?P<before>(?i:\bbearer)\s+)[A-Za-z0-9._~+/=-]{16,}`)},
+	// Credential headers written as JSON, as in http_request input. Values
+	// with a ${NAME} reference hold no secret and stay readable.
+	{"auth header", regexp.MustCompile(`(?P<before>"(?i:(?:proxy-)?authorization|cookie|x-api-key|api-key|x-auth-token)"\s*:\s*")[^"$]{8,}(?P<after>")`)},
+	// NAME=value lines of .env files and shell exports. The value must look
+	// like a token, so code such as token = get_token() is left alone.
+	{"secret", regexp.MustCompile(`(?m)(?P<before>^\s*(?:export\s+)?` + secretName + `\s*=\s*["']?)[A-Za-z0-9+/=_~.-]{8,}(?P<after>["']?\s*$)`)},
+	// Quoted values assigned to secret names in code and JSON or YAML config.
+	{"secret", regexp.MustCompile(`(?P<before>\b` + secretName + `["']?\s*[:=]\s*["'])[A-Za-z0-9+/=_~.-]{8,}(?P<after>["'])`)},
+}
+
+// redactCredentials replaces credential-shaped strings in text with
+// [redacted <name>] markers.
+func redactCredentials(text string) string {
+	for _, p := range credentialPatterns {
+		replacement := redactionMarker + p.name + "]"
+		if p.re.SubexpIndex("before") >= 0 {
+			replacement = "${before}" + replacement
+		}
+		if p.re.SubexpIndex("after") >= 0 {
+			replacement += "${after}"
+		}
+		text = p.re.ReplaceAllString(text, replacement)
+	}
+	return text
+}
+
+// redactionMarker starts every marker redaction puts in tool results.
+const redactionMarker = "[redacted "
+
+// checkRedactionMarkers refuses new content that gained a redaction marker:
+// the model only ever saw the marker, so writing it would replace the real
+// secret with it.
+func checkRedactionMarkers(displayPath, previous, content string) error {
+	if strings.Count(content, redactionMarker) > strings.Count(previous, redactionMarker) {
+		return newToolError(ToolErrorValidation, "the new content of %s contains a %s...] marker; the real value was hidden from you, so edit around it instead of rewriting it, or ask the user to make the change", displayPath, redactionMarker)
+	}
+	return nil
+}
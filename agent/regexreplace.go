@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// regexReplaceConfirmThreshold is the number of replacements above which
+	// regex_replace needs confirm after showing a preview.
+	regexReplaceConfirmThreshold = 25
+	// regexReplacePreviewMatches is how many changed lines or matches a
+	// preview lists.
+	regexReplacePreviewMatches = 30
+)
+
+type RegexReplaceInput struct {
+	Path            *string `json:"path"`
+	Pattern         *string `json:"pattern"`
+	Replacement     *string `json:"replacement"`
+	MaxReplacements int     `json:"max_replacements,omitempty"`
+	Preview         bool    `json:"preview,omitempty"`
+	Confirm         bool    `json:"confirm,omitempty"`
+}
+
+func regexReplaceInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Relative file path within the current workspace.",
+			},
+			"pattern": map[string]any{
+				"type":        "string",
+				"description": "Go (RE2) regular expression to search for, e.g. \\bOldName\\b. Prefix with (?m) to make ^ and $ match at line boundaries.",
+				"minLength":   1,
+			},
+			"replacement": map[string]any{
+				"type":        "string",
+				"description": "Replacement text. $1 or ${name} insert capture groups; write $$ for a literal $.",
+			},
+			"max_replacements": map[string]any{
+				"type":        "integer",
+				"description": "Replace at most this many matches, the first ones in the file. Defaults to all.",
+				"minimum":     1,
+			},
+			"preview": map[string]any{
+				"type":        "boolean",
+				"description": "List the matches and what each would become without changing the file.",
+			},
+			"confirm": map[string]any{
+				"type":        "boolean",
+				"description": fmt.Sprintf("Required to apply more than %d replacements, after checking a preview.", regexReplaceConfirmThreshold),
+			},
+		},
+		Required: []string{"path", "pattern", "replacement"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// regexReplace replaces matches of a regular expression in one file. Large
+// replacements are refused with a preview until the call is repeated with
+// confirm, so a pattern that matches more than intended is seen first.
+func (s *Session) regexReplace(input json.RawMessage) (string, error) {
+	const expected = `{"path":"src/app.go","pattern":"\\bfetchUser\\b","replacement":"loadUser"}`
+
+	args := RegexReplaceInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("regex_replace", err.Error(), expected)
+	}
+	pathValue, err := requireToolString("regex_replace", "path", args.Path, false, expected)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := requireToolString("regex_replace", "pattern", args.Pattern, false, expected)
+	if err != nil {
+		return "", err
+	}
+	replacement, err := requireToolString("regex_replace", "replacement", args.Replacement, true, expected)
+	if err != nil {
+		return "", err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", toolInputValidationError("regex_replace", fmt.Sprintf("invalid pattern: %v", err), expected)
+	}
+
+	target, err := s.openEditTarget("regex_replace", pathValue)
+	if err != nil {
+		return "", err
+	}
+	if !target.present {
+		return "", newToolError(ToolErrorNotFound, "file does not exist: %s", target.displayPath)
+	}
+
+	matches := re.FindAllStringSubmatchIndex(target.text, -1)
+	total := len(matches)
+	if total == 0 {
+		return "", newToolError(ToolErrorNotFound, "pattern %s matches nothing in %s", pattern, target.displayPath)
+	}
+	if args.MaxReplacements > 0 && len(matches) > args.MaxReplacements {
+		matches = matches[:args.MaxReplacements]
+	}
+
+	if args.Preview {
+		return regexReplacePreview(re, replacement, target, matches, total), nil
+	}
+	if len(matches) > regexReplaceConfirmThreshold && !args.Confirm {
+		return "", newToolError(ToolErrorValidation, "%d replacements is more than %d; check the preview and call again with \"confirm\": true, or narrow the pattern or set max_replacements\n\n%s",
+			len(matches), regexReplaceConfirmThreshold, regexReplacePreview(re, replacement, target, matches, total))
+	}
+
+	replaced := expandMatches(re, replacement, target.text, matches)
+	if replaced == target.text {
+		return fmt.Sprintf("%d match(es) of %s in %s already equal their replacement; the file was not changed", len(matches), pattern, target.displayPath), nil
+	}
+	target.text = replaced
+	if len(matches) < total {
+		target.notes = append(target.notes, fmt.Sprintf("replaced %d of %d matches", len(matches), total))
+	} else {
+		target.notes = append(target.notes, fmt.Sprintf("replaced %d match(es)", len(matches)))
+	}
+	return s.commitEdit(target, "regex_replace")
+}
+
+// expandMatches returns text with each match replaced by the expansion of
+// replacement.
+func expandMatches(re *regexp.Regexp, replacement, text string, matches [][]int) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range matches {
+		out.WriteString(text[last:match[0]])
+		out.Write(re.ExpandString(nil, replacement, text, match))
+		last = match[1]
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// regexReplacePreview shows what a replacement would change: each changed
+// line before and after, or, when replacements add or remove lines, each
+// match and what it becomes.
+func regexReplacePreview(re *regexp.Regexp, replacement string, target *editTarget, matches [][]int, total int) string {
+	var b strings.Builder
+	if len(matches) < total {
+		fmt.Fprintf(&b, "%d of %d matches in %s would be replaced:\n", len(matches), total, target.displayPath)
+	} else {
+		fmt.Fprintf(&b, "%d match(es) in %s would be replaced:\n", len(matches), target.displayPath)
+	}
+
+	oldLines := strings.Split(target.text, "\n")
+	newLines := strings.Split(expandMatches(re, replacement, target.text, matches), "\n")
+	shown := 0
+	if len(oldLines) == len(newLines) {
+		for i := range oldLines {
+			if oldLines[i] == newLines[i] {
+				continue
+			}
+			if shown == regexReplacePreviewMatches {
+				b.WriteString("... and more changed lines\n")
+				break
+			}
+			fmt.Fprintf(&b, "line %d: %s\n     -> %s\n", i+1, previewText(oldLines[i], 120), previewText(newLines[i], 120))
+			shown++
+		}
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	for i, match := range matches {
+		if i == regexReplacePreviewMatches {
+			fmt.Fprintf(&b, "... and %d more\n", len(matches)-i)
+			break
+		}
+		line := strings.Count(target.text[:match[0]], "\n") + 1
+		before := target.text[match[0]:match[1]]
+		after := string(re.ExpandString(nil, replacement, target.text, match))
+		fmt.Fprintf(&b, "line %d: %.80q -> %.80q\n", line, before, after)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultRepoMapTokens  = 1024
+	maxSourceFiles        = 5_000
+	maxSourceFileBytes    = 256 << 10
+	maxRepoMapSymbols     = 8
+	maxRepoMapScanBytes   = 32 << 20
+	repoMapBytesPerToken  = 4
+	minRepoMapSymbolChars = 3
+)
+
+// sourceSkipDirs are never walked when the workspace is not a git checkout.
+var sourceSkipDirs = map[string]bool{
+	"node_modules": true,
+	"vendor":       true,
+	"target":       true,
+	"dist":         true,
+	"build":        true,
+	"__pycache__":  true,
+}
+
+// symbolPatterns find top-level definitions by file extension. The last
+// submatch of each pattern is the symbol name.
+var symbolPatterns = map[string][]*regexp.Regexp{
+	".go": {
+		regexp.MustCompile(`(?m)^func ([A-Za-z_]\w*)`),
+		regexp.MustCompile(`(?m)^type ([A-Za-z_]\w*)`),
+	},
+	".py": {
+		regexp.MustCompile(`(?m)^(?:async )?(?:def|class) ([A-Za-z_]\w*)`),
+	},
+	".js":  jsSymbolPatterns,
+	".jsx": jsSymbolPatterns,
+	".ts":  jsSymbolPatterns,
+	".tsx": jsSymbolPatterns,
+	".mjs": jsSymbolPatterns,
+	".rs": {
+		regexp.MustCompile(`(?m)^(?:pub(?:\([^)]*\))? )?(?:async )?(?:fn|struct|enum|trait|type|mod) ([A-Za-z_]\w*)`),
+	},
+	".java": classSymbolPatterns,
+	".kt":   classSymbolPatterns,
+	".cs":   classSymbolPatterns,
+	".rb": {
+		regexp.MustCompile(`(?m)^\s*(?:class|module|def) (?:self\.)?([A-Za-z_]\w*[?!]?)`),
+	},
+	".c":   cSymbolPatterns,
+	".h":   cSymbolPatterns,
+	".cc":  cSymbolPatterns,
+	".cpp": cSymbolPatterns,
+	".hpp": cSymbolPatterns,
+}
+
+var (
+	jsSymbolPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^(?:export )?(?:default )?(?:async )?(?:function\*?|class|interface|type|enum) ([A-Za-z_$][\w$]*)`),
+		regexp.MustCompile(`(?m)^export (?:const|let|var) ([A-Za-z_$][\w$]*)`),
+	}
+	classSymbolPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^\s*(?:(?:public|private|protected|internal|abstract|final|static|sealed|data|open)\s+)*(?:class|interface|enum|record|object) ([A-Za-z_]\w*)`),
+	}
+	cSymbolPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^(?:struct|class|enum|union) ([A-Za-z_]\w*)`),
+		regexp.MustCompile(`(?m)^[A-Za-z_][\w \t*&:<>,]*?[ \t*&]([A-Za-z_]\w*)\([^;]*$`),
+	}
+	identifierPattern = regexp.MustCompile(`[A-Za-z_]\w*`)
+)
+
+// sourceSymbol is a top-level definition and the 1-based line it starts on.
+type sourceSymbol struct {
+	Name string `json:"name"`
+	Line int    `json:"line"`
+}
+
+// extractSymbols returns the top-level definitions in a source file, in the
+// order they appear, or nil for languages it does not know.
+func extractSymbols(name string, content []byte) []sourceSymbol {
+	patterns := symbolPatterns[strings.ToLower(filepath.Ext(name))]
+	if len(patterns) == 0 {
+		return nil
+	}
+	type match struct {
+		pos  int
+		name string
+	}
+	var matches []match
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		for _, loc := range pattern.FindAllSubmatchIndex(content, -1) {
+			start, end := loc[len(loc)-2], loc[len(loc)-1]
+			if start < 0 {
+				continue
+			}
+			symbol := string(content[start:end])
+			if seen[symbol] {
+				continue
+			}
+			seen[symbol] = true
+			matches = append(matches, match{start, symbol})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].pos < matches[j].pos })
+	symbols := make([]sourceSymbol, len(matches))
+	line, counted := 1, 0
+	for i, m := range matches {
+		line += bytes.Count(content[counted:m.pos], []byte("\n"))
+		counted = m.pos
+		symbols[i] = sourceSymbol{Name: m.name, Line: line}
+	}
+	return symbols
+}
+
+// workspaceSourceFiles lists the files of the workspace at root as
+// slash-separated paths relative to it. In a git checkout that is the tracked
+// and unignored untracked files; otherwise a walk that skips hidden and
+// dependency directories. .coderignore applies either way.
+func workspaceSourceFiles(root string, maxFiles int) ([]string, error) {
+	ignore := workspaceIgnore(root)
+	var files []string
+	add := func(rel string) bool {
+		if ignore.Ignored(rel, false) {
+			return true
+		}
+		files = append(files, rel)
+		return len(files) < maxFiles
+	}
+
+	if out, err := runGit(root, nil, "ls-files", "-z", "--cached", "--others", "--exclude-standard"); err == nil {
+		for _, rel := range strings.Split(out, "\x00") {
+			if rel == "" || strings.HasPrefix(rel, coderDirName+"/") {
+				continue
+			}
+			if !add(rel) {
+				break
+			}
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil || p == root {
+			return walkErr
+		}
+		relPath, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(relPath)
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") || sourceSkipDirs[d.Name()] || ignore.Ignored(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if !add(rel) {
+			return errListLimitReached
+		}
+		return nil
+	})
+	if err != nil && err != errListLimitReached {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type repoMapFile struct {
+	path    string
+	symbols []string
+	refs    map[string]int
+	score   int
+}
+
+// buildRepoMap summarizes the workspace as a directory tree with each file's
+// main definitions, for the system prompt. Files whose symbols are used by
+// the most other files come first when the map has to be cut to maxTokens.
+func buildRepoMap(root string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	paths, err := workspaceSourceFiles(root, maxSourceFiles)
+	if err != nil || len(paths) == 0 {
+		if err != nil {
+			debugf("repo_map_failed error=%q", err.Error())
+		}
+		return ""
+	}
+
+	files := make([]*repoMapFile, 0, len(paths))
+	definedIn := make(map[string][]*repoMapFile)
+	usedBy := make(map[string]map[string]bool)
+	scanned := 0
+	for _, rel := range paths {
+		file := &repoMapFile{path: rel, refs: make(map[string]int)}
+		files = append(files, file)
+		if symbolPatterns[strings.ToLower(path.Ext(rel))] == nil || scanned > maxRepoMapScanBytes {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil || len(content) > maxSourceFileBytes || bytes.IndexByte(content, 0) >= 0 {
+			continue
+		}
+		scanned += len(content)
+		for _, def := range extractSymbols(rel, content) {
+			symbol := def.Name
+			if len(symbol) >= minRepoMapSymbolChars && symbol != "main" && symbol != "init" {
+				file.symbols = append(file.symbols, symbol)
+				definedIn[symbol] = append(definedIn[symbol], file)
+			}
+		}
+		for _, ident := range identifierPattern.FindAll(content, -1) {
+			users := usedBy[string(ident)]
+			if users == nil {
+				users = make(map[string]bool)
+				usedBy[string(ident)] = users
+			}
+			users[rel] = true
+		}
+	}
+
+	// A symbol counts once for each other file that mentions it.
+	for symbol, defs := range definedIn {
+		for _, file := range defs {
+			n := len(usedBy[symbol])
+			if usedBy[symbol][file.path] {
+				n--
+			}
+			file.refs[symbol] = n
+			file.score += n
+		}
+	}
+	for _, file := range files {
+		sort.SliceStable(file.symbols, func(i, j int) bool {
+			return file.refs[file.symbols[i]] > file.refs[file.symbols[j]]
+		})
+		if len(file.symbols) > maxRepoMapSymbols {
+			file.symbols = file.symbols[:maxRepoMapSymbols]
+		}
+	}
+
+	ranked := append([]*repoMapFile(nil), files...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return len(ranked[i].symbols) > len(ranked[j].symbols)
+	})
+	budget := maxTokens * repoMapBytesPerToken
+	var selected []*repoMapFile
+	used := 0
+	for _, file := range ranked {
+		cost := len(file.path) + 4
+		for _, symbol := range file.symbols {
+			cost += len(symbol) + 2
+		}
+		if used+cost > budget {
+			continue
+		}
+		used += cost
+		selected = append(selected, file)
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].path < selected[j].path })
+
+	var b strings.Builder
+	lastDir := ""
+	for _, file := range selected {
+		dir, name := path.Split(file.path)
+		if dir != lastDir {
+			if dir != "" {
+				fmt.Fprintf(&b, "%s\n", dir)
+			}
+			lastDir = dir
+		}
+		indent := ""
+		if dir != "" {
+			indent = "  "
+		}
+		b.WriteString(indent + name)
+		if len(file.symbols) > 0 {
+			b.WriteString(": " + strings.Join(file.symbols, ", "))
+		}
+		b.WriteByte('\n')
+	}
+	if omitted := len(files) - len(selected); omitted > 0 {
+		fmt.Fprintf(&b, "(%d more files not shown)\n", omitted)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
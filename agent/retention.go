@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// retainedPromptsHeader starts the message that keeps the prompts of turns
+// dropped by max_tokens when keep_user_messages is set.
+const retainedPromptsHeader = "Earlier requests from the user (the rest of those turns was dropped from history to save context):"
+
+// retentionSummaryPrefix marks a tool result already replaced by its summary.
+const retentionSummaryPrefix = "[result elided by retention policy: "
+
+// RetentionConfig controls what the session keeps in its history after each
+// turn, trading what the model can recall for the size of every request.
+type RetentionConfig struct {
+	// ToolResultTurns replaces the tool results of turns more than this many
+	// prompts back with a one-line summary. Zero keeps them.
+	ToolResultTurns int `json:"tool_result_turns,omitempty"`
+	// MaxTokens drops the oldest turns once the estimated size of the history
+	// passes it. The latest turn is always kept. Zero means no cap.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// KeepUserMessages keeps the prompts of turns dropped by MaxTokens,
+	// gathered into one message at the start of the history.
+	KeepUserMessages bool `json:"keep_user_messages,omitempty"`
+}
+
+// applyRetention trims the history as the project's retention policy asks.
+func (s *Session) applyRetention() {
+	policy := s.cfg.Project.Retention
+	summarized, dropped := 0, 0
+	if policy.ToolResultTurns > 0 {
+		summarized = s.summarizeOldToolResults(policy.ToolResultTurns)
+	}
+	if policy.MaxTokens > 0 {
+		dropped = s.dropOldTurns(policy.MaxTokens, policy.KeepUserMessages)
+	}
+	if summarized == 0 && dropped == 0 {
+		return
+	}
+	debugf("history_retention tool_results_summarized=%d turns_dropped=%d tokens=%d", summarized, dropped, estimateTokens(s.history))
+	if dropped > 0 {
+		fmt.Fprintf(s.out, "%s: dropped the %d oldest turn(s) from history to stay under %d tokens\n",
+			colorLabel("notice", warnColor, s.cfg.ColorOutput), dropped, policy.MaxTokens)
+	}
+}
+
+// summarizeOldToolResults replaces the tool results before the last keep
+// prompts with one line naming the tool, the result's size, and its start.
+func (s *Session) summarizeOldToolResults(keep int) int {
+	prompts := userPromptIndexes(s.history)
+	if len(prompts) <= keep {
+		return 0
+	}
+	cutoff := prompts[len(prompts)-keep]
+	toolNames := map[string]string{}
+	summarized := 0
+	for i := 0; i < cutoff; i++ {
+		for j, block := range s.history[i].Content {
+			switch {
+			case block.OfToolUse != nil:
+				toolNames[block.OfToolUse.ID] = block.OfToolUse.Name
+			case block.OfToolResult != nil:
+				result := block.OfToolResult
+				text := toolResultText(result)
+				if strings.HasPrefix(text, retentionSummaryPrefix) || strings.HasPrefix(text, "Error: "+retentionSummaryPrefix) {
+					continue
+				}
+				firstLine, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+				summary := fmt.Sprintf("%s%s, %d bytes] %s", retentionSummaryPrefix, toolNames[result.ToolUseID], len(text), previewText(firstLine, 100))
+				s.history[i].Content[j].OfToolResult = &anthropic.ToolResultBlockParam{
+					ToolUseID: result.ToolUseID,
+					IsError:   result.IsError,
+					Content: []anthropic.ToolResultBlockParamContentUnion{
+						{OfText: &anthropic.TextBlockParam{Text: strings.TrimSpace(summary)}},
+					},
+				}
+				summarized++
+			}
+		}
+	}
+	return summarized
+}
+
+// dropOldTurns removes whole turns from the start of the history until its
+// estimated size is at most maxTokens. With keepPrompts, their prompts are
+// kept in a message at the start instead.
+func (s *Session) dropOldTurns(maxTokens int, keepPrompts bool) int {
+	history := s.history
+	digest := ""
+	if len(history) >= 2 && strings.HasPrefix(firstUserText(history[:1]), retainedPromptsHeader) {
+		digest = strings.TrimPrefix(firstUserText(history[:1]), retainedPromptsHeader)
+		history = history[2:]
+	}
+	dropped := 0
+	for estimateTokens(history)+len(digest)/4 > maxTokens {
+		prompts := userPromptIndexes(history)
+		if len(prompts) < 2 {
+			break
+		}
+		if keepPrompts {
+			for _, msg := range history[:prompts[1]] {
+				if isUserPrompt(msg) {
+					digest += "\n- " + strings.TrimSpace(firstUserText([]anthropic.MessageParam{msg}))
+				}
+			}
+		}
+		history = history[prompts[1]:]
+		dropped++
+	}
+	if dropped == 0 {
+		return 0
+	}
+	if digest != "" {
+		history = append([]anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock(retainedPromptsHeader + digest)),
+			anthropic.NewAssistantMessage(anthropic.NewTextBlock("Understood.")),
+		}, history...)
+	}
+	s.history = history
+	return dropped
+}
+
+// userPromptIndexes returns the indexes of the messages in history the user
+// typed.
+func userPromptIndexes(history []anthropic.MessageParam) []int {
+	var indexes []int
+	for i, msg := range history {
+		if isUserPrompt(msg) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
@@ -0,0 +1,431 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetrievalK      = 5
+	retrievalChunkLines    = 60
+	maxRetrievalChunkBytes = 4_000
+	embedBatchSize         = 64
+	embedRequestTimeout    = 2 * time.Minute
+	defaultVoyageBaseURL   = "https://api.voyageai.com/v1"
+)
+
+// Embedder turns texts into vectors for retrieval. Embed returns one vector
+// per text, in order. Vectors are only compared with others from an embedder
+// of the same Name.
+type Embedder interface {
+	Name() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// newEmbedder builds an Embedder from a -embeddings value of the form
+// provider:model, where provider is ollama, openai, or voyage.
+func newEmbedder(spec string, cfg Config) (Embedder, error) {
+	provider, model, ok := strings.Cut(spec, ":")
+	if !ok || strings.TrimSpace(model) == "" {
+		return nil, fmt.Errorf("invalid -embeddings %q (expected provider:model, e.g. ollama:nomic-embed-text)", spec)
+	}
+	client := &http.Client{Timeout: embedRequestTimeout}
+	switch provider {
+	case providerOllama:
+		return &ollamaEmbedder{baseURL: cfg.OllamaURL, model: model, client: client}, nil
+	case providerOpenAI:
+		return &openAIEmbedder{baseURL: cfg.OpenAIBaseURL, apiKey: cfg.OpenAIAPIKey, model: model, client: client, name: providerOpenAI}, nil
+	case "voyage":
+		apiKey := strings.TrimSpace(os.Getenv("VOYAGE_API_KEY"))
+		if apiKey == "" {
+			return nil, errors.New("-embeddings voyage:... requires VOYAGE_API_KEY")
+		}
+		return &openAIEmbedder{baseURL: defaultVoyageBaseURL, apiKey: apiKey, model: model, client: client, name: "voyage"}, nil
+	default:
+		return nil, fmt.Errorf("unknown embeddings provider %q (expected ollama, openai, or voyage)", provider)
+	}
+}
+
+// ollamaEmbedder uses Ollama's /api/embed endpoint.
+type ollamaEmbedder struct {
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+func (e *ollamaEmbedder) Name() string { return providerOllama + ":" + e.model }
+
+func (e *ollamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var out struct {
+		Embeddings [][]float32 `json:"embeddings"`
+		Error      string      `json:"error"`
+	}
+	if err := postEmbeddingRequest(ctx, e.client, e.baseURL+"/api/embed", "", map[string]any{"model": e.model, "input": texts}, &out); err != nil {
+		return nil, err
+	}
+	if out.Error != "" {
+		return nil, fmt.Errorf("ollama embeddings failed: %s", out.Error)
+	}
+	if len(out.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("ollama returned %d embeddings for %d inputs", len(out.Embeddings), len(texts))
+	}
+	return out.Embeddings, nil
+}
+
+// openAIEmbedder uses an OpenAI-compatible /embeddings endpoint, which Voyage
+// also implements.
+type openAIEmbedder struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+	name    string
+}
+
+func (e *openAIEmbedder) Name() string { return e.name + ":" + e.model }
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := postEmbeddingRequest(ctx, e.client, e.baseURL+"/embeddings", e.apiKey, map[string]any{"model": e.model, "input": texts}, &out); err != nil {
+		return nil, err
+	}
+	vectors := make([][]float32, len(texts))
+	for _, item := range out.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, fmt.Errorf("embeddings response has out-of-range index %d", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	for i, vector := range vectors {
+		if len(vector) == 0 {
+			return nil, fmt.Errorf("embeddings response is missing input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+func postEmbeddingRequest(ctx context.Context, client *http.Client, url, apiKey string, payload any, out any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode embeddings request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("embeddings request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read embeddings response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusErrorf(resp.StatusCode, "embeddings request returned %s: %s", resp.Status, previewText(string(respBody), 200))
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("embeddings response is not valid JSON: %w", err)
+	}
+	return nil
+}
+
+// embeddingIndex holds the embedded chunks of every file in the code index.
+// Files are re-embedded only when their content hash changes. It is saved
+// next to the code index so later sessions start where this one left off.
+type embeddingIndex struct {
+	Model string                   `json:"model"`
+	Files map[string]*embeddedFile `json:"files"`
+}
+
+type embeddedFile struct {
+	Hash   string          `json:"hash"`
+	Chunks []embeddedChunk `json:"chunks"`
+}
+
+// embeddedChunk covers lines StartLine through EndLine (1-based, inclusive).
+// Vectors are normalized so a dot product is the cosine similarity.
+type embeddedChunk struct {
+	StartLine int             `json:"start_line"`
+	EndLine   int             `json:"end_line"`
+	Vector    embeddingVector `json:"vector"`
+}
+
+type retrievalHit struct {
+	Path      string
+	StartLine int
+	EndLine   int
+	Score     float64
+}
+
+// retriever finds workspace snippets relevant to a prompt.
+type retriever struct {
+	root     string
+	embedder Embedder
+	k        int
+
+	mu    sync.Mutex
+	code  *codeIndex
+	index *embeddingIndex
+}
+
+func newRetriever(root string, embedder Embedder, k int) *retriever {
+	if k <= 0 {
+		k = defaultRetrievalK
+	}
+	return &retriever{root: root, embedder: embedder, k: k}
+}
+
+// update brings the code and embedding indexes up to date with the workspace,
+// saving them when they change, and returns how many files were embedded.
+func (r *retriever) update(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.code == nil {
+		r.code = loadCodeIndex(r.root)
+	}
+	codeUpdate, err := updateCodeIndex(r.root, r.code)
+	if err != nil {
+		return 0, err
+	}
+	if codeUpdate.changed() {
+		if err := writeIndexFile(r.root, codeIndexName, r.code); err != nil {
+			debugf("code_index_save_failed error=%q", err.Error())
+		}
+	}
+	if r.index == nil {
+		var saved embeddingIndex
+		if err := readIndexFile(r.root, embeddingIndexName, &saved); err == nil && saved.Model == r.embedder.Name() && saved.Files != nil {
+			r.index = &saved
+		} else {
+			r.index = &embeddingIndex{Model: r.embedder.Name(), Files: make(map[string]*embeddedFile)}
+		}
+	}
+	embedded, removed, err := updateEmbeddingIndex(ctx, r.root, r.code, r.index, r.embedder)
+	if embedded > 0 || removed > 0 {
+		if saveErr := writeIndexFile(r.root, embeddingIndexName, r.index); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return embedded, err
+}
+
+// updateEmbeddingIndex embeds the files of code whose hash differs from the
+// embedded version and drops files code no longer has. It returns the number
+// of files embedded and removed.
+func updateEmbeddingIndex(ctx context.Context, root string, code *codeIndex, index *embeddingIndex, embedder Embedder) (int, int, error) {
+	type pending struct {
+		path  string
+		file  *embeddedFile
+		texts []string
+	}
+	var queue []pending
+	for rel, entry := range code.Files {
+		if existing := index.Files[rel]; existing != nil && existing.Hash == entry.Hash {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			continue
+		}
+		file := &embeddedFile{Hash: entry.Hash}
+		var texts []string
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		for start := 0; start < len(lines); start += retrievalChunkLines {
+			end := min(start+retrievalChunkLines, len(lines))
+			text := strings.Join(lines[start:end], "\n")
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			if len(text) > maxRetrievalChunkBytes {
+				text = strings.ToValidUTF8(text[:maxRetrievalChunkBytes], "")
+			}
+			file.Chunks = append(file.Chunks, embeddedChunk{StartLine: start + 1, EndLine: end})
+			texts = append(texts, fmt.Sprintf("%s:%d-%d\n%s", rel, start+1, end, text))
+		}
+		queue = append(queue, pending{path: rel, file: file, texts: texts})
+	}
+	removed := 0
+	for rel := range index.Files {
+		if code.Files[rel] == nil {
+			delete(index.Files, rel)
+			removed++
+		}
+	}
+
+	// Batch chunks across files; a file is stored only once all of its
+	// chunks have vectors, so a failure leaves it to the next update.
+	embedded := 0
+	var batch []string
+	var owners []*embeddedChunk
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		vectors, err := embedder.Embed(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for i, vector := range vectors {
+			owners[i].Vector = normalizeVector(vector)
+		}
+		batch, owners = batch[:0], owners[:0]
+		return nil
+	}
+	var err error
+queue:
+	for i := range queue {
+		item := &queue[i]
+		for j, text := range item.texts {
+			batch = append(batch, text)
+			owners = append(owners, &item.file.Chunks[j])
+			if len(batch) >= embedBatchSize {
+				if err = flush(); err != nil {
+					break queue
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = flush()
+	}
+	for _, item := range queue {
+		complete := true
+		for _, chunk := range item.file.Chunks {
+			complete = complete && chunk.Vector != nil
+		}
+		if complete {
+			index.Files[item.path] = item.file
+			embedded++
+		}
+	}
+	return embedded, removed, err
+}
+
+// search returns the k chunks most similar to query.
+func (r *retriever) search(ctx context.Context, query string, k int) ([]retrievalHit, error) {
+	vectors, err := r.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != 1 {
+		return nil, errors.New("embedder returned no vector for the query")
+	}
+	queryVector := normalizeVector(vectors[0])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var hits []retrievalHit
+	for rel, file := range r.index.Files {
+		for _, chunk := range file.Chunks {
+			if len(chunk.Vector) != len(queryVector) {
+				continue
+			}
+			hits = append(hits, retrievalHit{Path: rel, StartLine: chunk.StartLine, EndLine: chunk.EndLine, Score: dotProduct(queryVector, chunk.Vector)})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Path < hits[j].Path
+	})
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits, nil
+}
+
+// retrieveContext indexes any changed files and returns the snippets most
+// relevant to prompt as a text block for the user message, or "" when
+// retrieval is off or fails. Failures are reported but never stop a turn.
+func (s *Session) retrieveContext(ctx context.Context, prompt string) string {
+	if s.retrieval == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, embedRequestTimeout)
+	defer cancel()
+	start := time.Now()
+	embedded, err := s.retrieval.update(ctx)
+	var hits []retrievalHit
+	if err == nil {
+		hits, err = s.retrieval.search(ctx, prompt, s.retrieval.k)
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "%s: retrieval skipped: %v\n", colorLabel("notice", warnColor, s.colorOutput), err)
+		debugf("retrieval_failed turn=%d error=%q", s.turn, err.Error())
+		return ""
+	}
+	debugf("retrieval_done turn=%d embedded_files=%d hits=%d duration_ms=%d", s.turn, embedded, len(hits), time.Since(start).Milliseconds())
+	return formatRetrievalHits(s.root, hits)
+}
+
+func formatRetrievalHits(root string, hits []retrievalHit) string {
+	if len(hits) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Workspace snippets that may be relevant to this request, found by embedding search. They can be incomplete; read the files before editing them.\n")
+	for _, hit := range hits {
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(hit.Path)))
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if hit.StartLine > len(lines) {
+			continue
+		}
+		text := strings.Join(lines[hit.StartLine-1:min(hit.EndLine, len(lines))], "\n")
+		if len(text) > maxRetrievalChunkBytes {
+			text = strings.ToValidUTF8(text[:maxRetrievalChunkBytes], "") + "\n…"
+		}
+		fmt.Fprintf(&b, "\n%s (lines %d-%d):\n```\n%s\n```\n", hit.Path, hit.StartLine, hit.EndLine, text)
+	}
+	return b.String()
+}
+
+func normalizeVector(vector []float32) []float32 {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return vector
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(vector))
+	for i, v := range vector {
+		out[i] = v / norm
+	}
+	return out
+}
+
+func dotProduct(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
@@ -0,0 +1,408 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// maxReviewDiffBytes caps the diff sent with the review prompt; the model
+	// can read the rest of a file with the read tools.
+	maxReviewDiffBytes = 200 << 10
+	// maxReviewFiles is the most files GitHub lists in one page of a pull
+	// request's files.
+	maxReviewFiles = 100
+
+	reviewPrompt   = `Review the code change below as a careful senior engineer would. Use the read-only tools to look at the code around the changed lines, the callers of changed functions, and the tests, rather than judging the diff alone. Report real problems: bugs, missed edge cases, broken error handling, security issues, races, missing tests, and unclear code. Skip style nits a formatter would catch, and do not comment on lines just to praise them. When you are done, call submit_review once with every comment; anchor each comment to a line on the new side of the diff.`
+	reviewReminder = "Call submit_review now with your comments, or with none if the change looks good."
+)
+
+// Review severities, most serious first.
+const (
+	severityBlocker = "blocker"
+	severityMajor   = "major"
+	severityMinor   = "minor"
+	severityNit     = "nit"
+)
+
+var (
+	reviewSeverities = []string{severityBlocker, severityMajor, severityMinor, severityNit}
+	pullURLPattern   = regexp.MustCompile(`^https?://([^/]+)/([^/]+)/([^/]+)/pull/(\d+)`)
+	hunkHeaderRegexp = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+)
+
+// reviewTarget is the change coder review looks at: a pull request on GitHub
+// or a git revision range in the workspace.
+type reviewTarget struct {
+	Label string
+	Diff  string
+	// Owner, Repo, Number, and HeadSHA are set for pull requests.
+	Owner   string
+	Repo    string
+	Number  int
+	HeadSHA string
+}
+
+// reviewComment is one finding, anchored to a line of the new version.
+type reviewComment struct {
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	Severity   string `json:"severity"`
+	Comment    string `json:"comment"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// codeReview is what the model submitted with submit_review.
+type codeReview struct {
+	Summary  string          `json:"summary"`
+	Comments []reviewComment `json:"comments"`
+}
+
+type SubmitReviewInput struct {
+	Summary  *string         `json:"summary"`
+	Comments []reviewComment `json:"comments"`
+}
+
+// runReview implements coder review: the model reviews a pull request or a
+// revision range with the read-only tools, and the comments are printed and,
+// with -post, posted to the pull request as a review.
+func runReview() error {
+	post := flag.Bool("post", false, "Post the comments to the pull request as a GitHub review (needs GITHUB_TOKEN)")
+	asJSON := flag.Bool("json", false, "Print the review as JSON")
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	configureLogging(cfg.Verbose)
+	if flag.NArg() != 1 {
+		return errors.New("usage: coder review [flags] <pull request URL | revision range>")
+	}
+
+	// Reviewing must not change the workspace, so only the read-only tools
+	// are offered.
+	cfg.Review = true
+	cfg.Project.Permissions.Profile = profileReadOnly
+	if *asJSON {
+		cfg.ColorOutput, cfg.Highlight, cfg.Markdown = false, false, false
+	}
+	session := newSession(cfg)
+	target, err := session.loadReviewTarget(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	session.reviewDiff = target.Diff
+	if *post && target.Number == 0 {
+		return errors.New("-post needs a pull request URL, not a revision range")
+	}
+	toolMap, anthropicTools, err := buildToolRegistry(registeredTools(session), cfg.Project.Permissions)
+	if err != nil {
+		return err
+	}
+	provider := newProvider(cfg)
+	session.provider, session.tools = provider, anthropicTools
+	debugf("review_start target=%q diff_bytes=%d", target.Label, len(target.Diff))
+
+	// With -json, the turn's tool activity is discarded so that stdout is
+	// only the review.
+	if *asJSON {
+		session.out = io.Discard
+	}
+	prompts := []string{reviewPrompt + "\n\n" + target.prompt(), reviewReminder}
+	for _, prompt := range prompts {
+		stats := runTurn(context.Background(), cfg, session, provider, toolMap, anthropicTools, prompt)
+		if stats.Err != nil || session.review != nil {
+			break
+		}
+	}
+	session.cleanup()
+	if session.review == nil {
+		return errors.New("the review did not finish: the model never called submit_review")
+	}
+
+	review := *session.review
+	sort.SliceStable(review.Comments, func(i, j int) bool {
+		return severityRank(review.Comments[i].Severity) < severityRank(review.Comments[j].Severity)
+	})
+	if *asJSON {
+		data, err := json.MarshalIndent(review, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+	} else {
+		printReview(cfg, target, review)
+	}
+	if *post {
+		return session.postReview(target, review)
+	}
+	return nil
+}
+
+// loadReviewTarget fetches the diff of a pull request URL, or runs git diff
+// for anything else, such as main..HEAD or HEAD~3.
+func (s *Session) loadReviewTarget(arg string) (reviewTarget, error) {
+	if match := pullURLPattern.FindStringSubmatch(arg); match != nil {
+		if match[1] != "github.com" && os.Getenv("GITHUB_API_URL") == "" {
+			return reviewTarget{}, fmt.Errorf("set GITHUB_API_URL to review pull requests on %s", match[1])
+		}
+		number, _ := strconv.Atoi(match[4])
+		return fetchPullRequestDiff(match[2], match[3], number)
+	}
+	root := s.workspaceGitRoot()
+	if root == "" {
+		return reviewTarget{}, errors.New("reviewing a revision range needs a git repository; pass a pull request URL instead")
+	}
+	if strings.HasPrefix(arg, "-") {
+		return reviewTarget{}, fmt.Errorf("invalid revision range %q", arg)
+	}
+	diff, err := runGit(root, nil, "diff", "--no-color", "--no-ext-diff", arg, "--")
+	if err != nil {
+		return reviewTarget{}, err
+	}
+	if diff == "" {
+		return reviewTarget{}, fmt.Errorf("%s has no changes to review", arg)
+	}
+	return reviewTarget{Label: arg, Diff: diff}, nil
+}
+
+// fetchPullRequestDiff builds a unified diff from the pull request's files,
+// whose patches GitHub returns without the file headers.
+func fetchPullRequestDiff(owner, repo string, number int) (reviewTarget, error) {
+	token := githubToken()
+	path := fmt.Sprintf("/repos/%s/%s/pulls/%d", owner, repo, number)
+	var pr struct {
+		Title string `json:"title"`
+		Head  struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	}
+	if err := githubRequest(http.MethodGet, path, token, nil, &pr); err != nil {
+		return reviewTarget{}, err
+	}
+	var files []struct {
+		Filename string `json:"filename"`
+		Status   string `json:"status"`
+		Patch    string `json:"patch"`
+	}
+	if err := githubRequest(http.MethodGet, fmt.Sprintf("%s/files?per_page=%d", path, maxReviewFiles), token, nil, &files); err != nil {
+		return reviewTarget{}, err
+	}
+	var diff strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&diff, "diff --git a/%s b/%s\n", file.Filename, file.Filename)
+		if file.Patch == "" {
+			fmt.Fprintf(&diff, "(%s; binary or too large to show)\n", file.Status)
+			continue
+		}
+		fmt.Fprintf(&diff, "--- a/%s\n+++ b/%s\n%s\n", file.Filename, file.Filename, file.Patch)
+	}
+	return reviewTarget{
+		Label:   fmt.Sprintf("%s/%s#%d %s", owner, repo, number, pr.Title),
+		Diff:    diff.String(),
+		Owner:   owner,
+		Repo:    repo,
+		Number:  number,
+		HeadSHA: pr.Head.SHA,
+	}, nil
+}
+
+// prompt describes the change for the model, with the diff cut to
+// maxReviewDiffBytes.
+func (t reviewTarget) prompt() string {
+	diff, note := t.Diff, ""
+	if len(diff) > maxReviewDiffBytes {
+		diff = strings.ToValidUTF8(diff[:maxReviewDiffBytes], "")
+		note = fmt.Sprintf(" (the first %d of %d bytes; read the remaining files with the tools)", maxReviewDiffBytes, len(t.Diff))
+	}
+	where := "The diff was taken in this workspace's repository."
+	if t.Number != 0 {
+		where = fmt.Sprintf("The workspace may not have the pull request's head (%s) checked out, so the files you read can differ from the new side of the diff.", t.HeadSHA)
+	}
+	return fmt.Sprintf("Change: %s\n%s\n\nDiff%s:\n<diff>\n%s\n</diff>", t.Label, where, note, diff)
+}
+
+func submitReviewInputSchema() anthropic.ToolInputSchemaParam {
+	return anthropic.ToolInputSchemaParam{
+		Properties: map[string]any{
+			"summary": map[string]any{
+				"type":        "string",
+				"description": "Two or three sentences on what the change does and whether it is ready to merge.",
+			},
+			"comments": map[string]any{
+				"type":        "array",
+				"description": "Every finding, each anchored to a line of the new version of a file in the diff. Empty if there are none.",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"file": map[string]any{
+							"type":        "string",
+							"description": "Path of the file as it appears in the diff.",
+						},
+						"line": map[string]any{
+							"type":        "integer",
+							"description": "Line number in the new version of the file.",
+						},
+						"severity": map[string]any{
+							"type":        "string",
+							"enum":        reviewSeverities,
+							"description": "blocker: must be fixed before merging; major: a real bug or risk; minor: worth fixing; nit: optional polish.",
+						},
+						"comment": map[string]any{
+							"type":        "string",
+							"description": "What is wrong and why it matters.",
+						},
+						"suggestion": map[string]any{
+							"type":        "string",
+							"description": "How to fix it, as prose or replacement code.",
+						},
+					},
+					"required":             []string{"file", "line", "severity", "comment"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		Required: []string{"summary", "comments"},
+		ExtraFields: map[string]any{
+			"additionalProperties": false,
+		},
+	}
+}
+
+// submitReview records the model's review. Comments must name files in the
+// diff; a later submission replaces an earlier one.
+func (s *Session) submitReview(input json.RawMessage) (string, error) {
+	const expected = `{"summary":"Adds retries to uploads; one bug in the backoff.","comments":[{"file":"upload.go","line":42,"severity":"major","comment":"The delay never grows: attempt is not incremented.","suggestion":"Increment attempt at the end of the loop."}]}`
+
+	args := SubmitReviewInput{}
+	raw := strings.TrimSpace(string(input))
+	if raw == "" {
+		raw = "{}"
+	}
+	if err := json.Unmarshal([]byte(raw), &args); err != nil {
+		return "", toolInputValidationError("submit_review", err.Error(), expected)
+	}
+	summary, err := requireToolString("submit_review", "summary", args.Summary, false, expected)
+	if err != nil {
+		return "", err
+	}
+	files := diffNewLines(s.reviewDiff)
+	for i, comment := range args.Comments {
+		comment.File = strings.TrimPrefix(strings.TrimSpace(comment.File), "b/")
+		switch {
+		case files != nil && files[comment.File] == nil:
+			return "", toolInputValidationError("submit_review", fmt.Sprintf("comment %d is on %s, which is not in the diff", i+1, comment.File), expected)
+		case comment.Line < 1:
+			return "", toolInputValidationError("submit_review", fmt.Sprintf("comment %d needs a line number of 1 or more", i+1), expected)
+		case severityRank(comment.Severity) == len(reviewSeverities):
+			return "", toolInputValidationError("submit_review", fmt.Sprintf("comment %d has severity %q (expected one of %s)", i+1, comment.Severity, strings.Join(reviewSeverities, ", ")), expected)
+		case strings.TrimSpace(comment.Comment) == "":
+			return "", toolInputValidationError("submit_review", fmt.Sprintf("comment %d is empty", i+1), expected)
+		}
+		args.Comments[i] = comment
+	}
+	s.review = &codeReview{Summary: strings.TrimSpace(summary), Comments: args.Comments}
+	debugf("submit_review comments=%d", len(args.Comments))
+	return fmt.Sprintf("Recorded the review with %d comment(s).", len(args.Comments)), nil
+}
+
+func severityRank(severity string) int {
+	for i, known := range reviewSeverities {
+		if severity == known {
+			return i
+		}
+	}
+	return len(reviewSeverities)
+}
+
+// diffNewLines maps each file of a unified diff to the line numbers of the
+// new version that appear in it, which are the lines GitHub accepts review
+// comments on.
+func diffNewLines(diff string) map[string]map[int]bool {
+	if diff == "" {
+		return nil
+	}
+	files := map[string]map[int]bool{}
+	var lines map[int]bool
+	line := 0
+	for _, text := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			_, name, _ := strings.Cut(text, " b/")
+			lines = map[int]bool{}
+			files[name] = lines
+		case strings.HasPrefix(text, "+++ "), strings.HasPrefix(text, "--- "):
+		case hunkHeaderRegexp.MatchString(text):
+			line, _ = strconv.Atoi(hunkHeaderRegexp.FindStringSubmatch(text)[1])
+		case lines == nil || line == 0:
+		case strings.HasPrefix(text, "+"), strings.HasPrefix(text, " "):
+			lines[line] = true
+			line++
+		}
+	}
+	return files
+}
+
+func printReview(cfg Config, target reviewTarget, review codeReview) {
+	fmt.Fprintf(os.Stdout, "\nReview of %s\n\n%s\n", target.Label, review.Summary)
+	if len(review.Comments) == 0 {
+		fmt.Fprintln(os.Stdout, "\nNo comments.")
+		return
+	}
+	color := map[string]string{severityBlocker: errorColor, severityMajor: errorColor, severityMinor: warnColor, severityNit: commentColor}
+	for _, comment := range review.Comments {
+		fmt.Fprintf(os.Stdout, "\n%s %s:%d\n", colorLabel("["+comment.Severity+"]", color[comment.Severity], cfg.ColorOutput), comment.File, comment.Line)
+		fmt.Fprintf(os.Stdout, "  %s\n", strings.ReplaceAll(strings.TrimSpace(comment.Comment), "\n", "\n  "))
+		if suggestion := strings.TrimSpace(comment.Suggestion); suggestion != "" {
+			fmt.Fprintf(os.Stdout, "  Suggestion: %s\n", strings.ReplaceAll(suggestion, "\n", "\n  "))
+		}
+	}
+}
+
+// postReview posts the comments to the pull request as one review. GitHub only
+// takes comments on lines in the diff; the rest go in the review body.
+func (s *Session) postReview(target reviewTarget, review codeReview) error {
+	token := githubToken()
+	if token == "" {
+		return errors.New("GITHUB_TOKEN (or GH_TOKEN) is not set")
+	}
+	if !s.confirm(fmt.Sprintf("Post this review with %d comment(s) to %s/%s#%d?", len(review.Comments), target.Owner, target.Repo, target.Number)) {
+		return errors.New("the user declined to post the review")
+	}
+	files := diffNewLines(target.Diff)
+	body := review.Summary
+	var inline []map[string]any
+	for _, comment := range review.Comments {
+		text := fmt.Sprintf("**%s**: %s", comment.Severity, strings.TrimSpace(comment.Comment))
+		if suggestion := strings.TrimSpace(comment.Suggestion); suggestion != "" {
+			text += "\n\nSuggestion: " + suggestion
+		}
+		if files[comment.File][comment.Line] {
+			inline = append(inline, map[string]any{"path": comment.File, "line": comment.Line, "side": "RIGHT", "body": text})
+			continue
+		}
+		body += fmt.Sprintf("\n\n`%s:%d` %s", comment.File, comment.Line, text)
+	}
+	payload := map[string]any{"commit_id": target.HeadSHA, "body": body, "event": "COMMENT", "comments": inline}
+	var posted struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := githubRequest(http.MethodPost, fmt.Sprintf("/repos/%s/%s/pulls/%d/reviews", target.Owner, target.Repo, target.Number), token, payload, &posted); err != nil {
+		return fmt.Errorf("could not post the review: %w", err)
+	}
+	s.audit.record(AuditEntry{Tool: "review", Command: "post review " + posted.HTMLURL})
+	debugf("review_posted pr=%d inline=%d in_body=%d", target.Number, len(inline), len(review.Comments)-len(inline))
+	fmt.Fprintf(os.Stderr, "Posted the review with %d inline comment(s): %s\n", len(inline), posted.HTMLURL)
+	return nil
+}
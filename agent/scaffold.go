@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	scaffoldNamePattern   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	scaffoldModulePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._~/-]*$`)
+	scaffoldNameInvalid   = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// scaffoldTemplate is a project skeleton for coder new. In file paths and
+// contents, {{name}} is the project name, {{module}} the Go module path, and
+// {{package}} the name as a Python package.
+type scaffoldTemplate struct {
+	Description string
+	Files       map[string]string
+}
+
+var scaffoldTemplates = map[string]scaffoldTemplate{
+	"go-cli": {
+		Description: "Go command-line tool with flag parsing and a test",
+		Files: map[string]string{
+			"go.mod":     "module {{module}}\n\ngo 1.22\n",
+			".gitignore": "/{{name}}\n",
+			"README.md":  "# {{name}}\n\n```sh\ngo run . -version\ngo test ./...\n```\n",
+			"main.go": `package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+var version = "dev"
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "{{name}}:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("{{name}}", flag.ContinueOnError)
+	showVersion := fs.Bool("version", false, "print the version and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *showVersion {
+		fmt.Println(version)
+		return nil
+	}
+	fmt.Println("hello from {{name}}")
+	return nil
+}
+`,
+			"main_test.go": `package main
+
+import "testing"
+
+func TestRun(t *testing.T) {
+	if err := run(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+		},
+	},
+	"go-http-service": {
+		Description: "Go HTTP service with a health check, graceful shutdown, and a Dockerfile",
+		Files: map[string]string{
+			"go.mod":     "module {{module}}\n\ngo 1.22\n",
+			".gitignore": "/{{name}}\n",
+			"README.md":  "# {{name}}\n\n```sh\ngo run .            # listens on :8080, or $PORT\ncurl localhost:8080/healthz\ngo test ./...\n```\n",
+			"main.go": `package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Printf("{{name}} listening on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
+`,
+			"handlers.go": `package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", handleHealth)
+	return mux
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+`,
+			"handlers_test.go": `package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+`,
+			"Dockerfile": `FROM golang:1.22 AS build
+WORKDIR /src
+COPY go.mod ./
+RUN go mod download
+COPY . .
+RUN CGO_ENABLED=0 go build -o /out/{{name}} .
+
+FROM gcr.io/distroless/static-debian12
+COPY --from=build /out/{{name}} /{{name}}
+EXPOSE 8080
+ENTRYPOINT ["/{{name}}"]
+`,
+		},
+	},
+	"python-pkg": {
+		Description: "Python package with a src layout, pyproject.toml, and pytest",
+		Files: map[string]string{
+			"pyproject.toml": `[build-system]
+requires = ["hatchling"]
+build-backend = "hatchling.build"
+
+[project]
+name = "{{name}}"
+version = "0.1.0"
+description = ""
+readme = "README.md"
+requires-python = ">=3.9"
+dependencies = []
+
+[project.optional-dependencies]
+dev = ["pytest"]
+
+[tool.pytest.ini_options]
+testpaths = ["tests"]
+pythonpath = ["src"]
+`,
+			".gitignore": "__pycache__/\n*.egg-info/\n.venv/\ndist/\nbuild/\n.pytest_cache/\n",
+			"README.md":  "# {{name}}\n\n```sh\npython -m venv .venv && . .venv/bin/activate\npip install -e '.[dev]'\npytest\n```\n",
+			"src/{{package}}/__init__.py": `"""{{name}}."""
+
+__version__ = "0.1.0"
+
+
+def greet(name: str) -> str:
+    return f"Hello, {name}!"
+`,
+			"tests/test_{{package}}.py": `from {{package}} import greet
+
+
+def test_greet():
+    assert greet("world") == "Hello, world!"
+`,
+		},
+	},
+}
+
+// runNew implements coder new: it writes a template's files into the
+// workspace, refusing to overwrite any, and with -p then runs the prompt as
+// one headless turn so the model can customize the result. It returns the
+// process exit code.
+func runNew() (int, error) {
+	// Accept flags after the template and name too, as in
+	// coder new go-cli mytool -p "...".
+	leading := 1
+	for leading < len(os.Args) && leading < 3 && !strings.HasPrefix(os.Args[leading], "-") {
+		leading++
+	}
+	os.Args = append(append([]string{os.Args[0]}, os.Args[leading:]...), os.Args[1:leading]...)
+	module := flag.String("module", "", "Go module path for the go templates (defaults to the project name)")
+	cfg, err := loadConfig()
+	if err != nil {
+		return 1, err
+	}
+	configureLogging(cfg.Verbose)
+	if flag.NArg() == 0 {
+		printScaffoldTemplates()
+		return 0, nil
+	}
+	if flag.NArg() > 2 {
+		return 1, errors.New("usage: coder new [-module path] [-p prompt] <template> [name]")
+	}
+	template, ok := scaffoldTemplates[flag.Arg(0)]
+	if !ok {
+		printScaffoldTemplates()
+		return 1, fmt.Errorf("unknown template %q", flag.Arg(0))
+	}
+	name := flag.Arg(1)
+	if name == "" {
+		if name, err = defaultScaffoldName(); err != nil {
+			return 1, err
+		}
+	}
+	if !scaffoldNamePattern.MatchString(name) {
+		return 1, fmt.Errorf("invalid project name %q; use letters, digits, '-', and '_', starting with a letter", name)
+	}
+	modulePath := strings.TrimSpace(*module)
+	if modulePath == "" {
+		modulePath = name
+	}
+	if !scaffoldModulePattern.MatchString(modulePath) {
+		return 1, fmt.Errorf("invalid module path %q", modulePath)
+	}
+
+	paths, err := writeScaffold(template, strings.NewReplacer(
+		"{{name}}", name,
+		"{{module}}", modulePath,
+		"{{package}}", strings.ToLower(strings.ReplaceAll(name, "-", "_")),
+	))
+	if err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(os.Stdout, "Created %s from %s (%d files)\n", name, flag.Arg(0), len(paths))
+	if cfg.Prompt == "" {
+		return 0, nil
+	}
+
+	// Hand the fresh project to the model to customize.
+	cfg.Headless = true
+	cfg.Prompt = fmt.Sprintf("The workspace was just scaffolded from the %s template (%s), creating %s. Customize it as follows, and keep its tests passing.\n\n%s",
+		flag.Arg(0), template.Description, strings.Join(paths, ", "), cfg.Prompt)
+	session := newSession(cfg)
+	session.input = bufio.NewScanner(strings.NewReader(""))
+	toolMap, anthropicTools, err := buildToolRegistry(registeredTools(session), cfg.Project.Permissions)
+	if err != nil {
+		return exitHeadlessError, err
+	}
+	provider := newProvider(cfg)
+	handleInterrupts(session)
+	code := runHeadless(cfg, session, provider, toolMap, anthropicTools, "")
+	session.printArtifacts(os.Stdout)
+	session.cleanup()
+	return code, nil
+}
+
+// writeScaffold writes a template's files with the placeholders filled in and
+// returns their paths. Nothing is written if any of them already exists.
+func writeScaffold(template scaffoldTemplate, fill *strings.Replacer) ([]string, error) {
+	files := make(map[string]string, len(template.Files))
+	var existing []string
+	for path, content := range template.Files {
+		path = fill.Replace(path)
+		files[path] = fill.Replace(content)
+		if _, err := os.Lstat(filepath.FromSlash(path)); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) > 0 {
+		sort.Strings(existing)
+		return nil, fmt.Errorf("refusing to overwrite existing files: %s", strings.Join(existing, ", "))
+	}
+	paths := sortedKeys(files)
+	for _, path := range paths {
+		target := filepath.FromSlash(path)
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+		if err := os.WriteFile(target, []byte(files[path]), 0o644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		fmt.Fprintf(os.Stdout, "  %s\n", path)
+	}
+	return paths, nil
+}
+
+// defaultScaffoldName derives a project name from the workspace directory.
+func defaultScaffoldName() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve working directory: %w", err)
+	}
+	name := strings.Trim(scaffoldNameInvalid.ReplaceAllString(strings.ToLower(filepath.Base(cwd)), "-"), "-_")
+	if !scaffoldNamePattern.MatchString(name) {
+		return "", fmt.Errorf("cannot derive a project name from %s; pass one after the template", filepath.Base(cwd))
+	}
+	return name, nil
+}
+
+func printScaffoldTemplates() {
+	fmt.Fprintln(os.Stdout, "usage: coder new [-module path] [-p prompt] <template> [name]\n\nTemplates:")
+	for _, name := range sortedKeys(scaffoldTemplates) {
+		fmt.Fprintf(os.Stdout, "  %-16s %s\n", name, scaffoldTemplates[name].Description)
+	}
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SchemaViolation is one input constraint a tool call broke. Field is a path
+// into the input such as "edits[2].path", empty for the input as a whole.
+type SchemaViolation struct {
+	Field      string `json:"field,omitempty"`
+	Constraint string `json:"constraint"`
+	Message    string `json:"message"`
+}
+
+// validateToolInput checks a tool call's input against the tool's declared
+// InputSchema and returns every violated constraint. Aliases the tool accepts
+// stand in for the field they name. Empty input counts as {}.
+func validateToolInput(tool Tool, input json.RawMessage) []SchemaViolation {
+	encoded, err := json.Marshal(tool.InputSchema)
+	if err != nil {
+		debugf("tool_schema_encode_failed tool_name=%q error=%q", tool.Name, err.Error())
+		return nil
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(encoded, &schema); err != nil {
+		return nil
+	}
+
+	raw := bytes.TrimSpace(input)
+	if len(raw) == 0 {
+		raw = []byte("{}")
+	}
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return []SchemaViolation{{Constraint: "json", Message: "input is not valid JSON: " + err.Error()}}
+	}
+	if obj, ok := value.(map[string]any); ok && len(tool.InputAliases) > 0 {
+		normalized := make(map[string]any, len(obj))
+		for name, v := range obj {
+			normalized[name] = v
+		}
+		for alias, field := range tool.InputAliases {
+			v, ok := normalized[alias]
+			if !ok {
+				continue
+			}
+			if _, has := normalized[field]; !has {
+				normalized[field] = v
+			}
+			delete(normalized, alias)
+		}
+		value = normalized
+	}
+
+	var violations []SchemaViolation
+	validateSchemaValue(schema, value, "", &violations)
+	return violations
+}
+
+// toolSchemaError is the validation error for a call that broke its schema.
+// The message lists the violations for people; the error's Violations field
+// carries them for the model's structured tool_result.
+func toolSchemaError(toolName string, violations []SchemaViolation) *ToolError {
+	parts := make([]string, len(violations))
+	for i, v := range violations {
+		parts[i] = v.Message
+		if v.Field != "" {
+			parts[i] = v.Field + ": " + v.Message
+		}
+	}
+	return &ToolError{
+		Code:       ToolErrorValidation,
+		Message:    fmt.Sprintf("invalid %s input: %s", toolName, strings.Join(parts, "; ")),
+		Violations: violations,
+	}
+}
+
+func validateSchemaValue(schema map[string]any, value any, field string, out *[]SchemaViolation) {
+	add := func(constraint, format string, args ...any) {
+		*out = append(*out, SchemaViolation{Field: field, Constraint: constraint, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		actual := jsonType(value)
+		matched := false
+		for _, want := range types {
+			if want == actual || (want == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			add("type", "expected %s, got %s", strings.Join(types, " or "), actual)
+			return
+		}
+	}
+
+	if options, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, option := range options {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			quoted := make([]string, len(options))
+			for i, option := range options {
+				encoded, _ := json.Marshal(option)
+				quoted[i] = string(encoded)
+			}
+			add("enum", "must be one of %s", strings.Join(quoted, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := len([]rune(v))
+		if limit, ok := schemaNumber(schema["minLength"]); ok && float64(length) < limit {
+			add("minLength", "must be at least %v characters", limit)
+		}
+		if limit, ok := schemaNumber(schema["maxLength"]); ok && float64(length) > limit {
+			add("maxLength", "must be at most %v characters", limit)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				add("pattern", "must match %s", pattern)
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if limit, ok := schemaNumber(schema["minimum"]); ok && n < limit {
+			add("minimum", "must be at least %v", limit)
+		}
+		if limit, ok := schemaNumber(schema["maximum"]); ok && n > limit {
+			add("maximum", "must be at most %v", limit)
+		}
+	case []any:
+		if limit, ok := schemaNumber(schema["minItems"]); ok && float64(len(v)) < limit {
+			add("minItems", "must have at least %v items", limit)
+		}
+		if limit, ok := schemaNumber(schema["maxItems"]); ok && float64(len(v)) > limit {
+			add("maxItems", "must have at most %v items", limit)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				validateSchemaValue(items, item, fmt.Sprintf("%s[%d]", field, i), out)
+			}
+		}
+	case map[string]any:
+		child := func(name string) string {
+			if field == "" {
+				return name
+			}
+			return field + "." + name
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, present := v[name]; !present {
+						*out = append(*out, SchemaViolation{Field: child(name), Constraint: "required", Message: "missing required field"})
+					}
+				}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if propSchema, ok := properties[name].(map[string]any); ok {
+				validateSchemaValue(propSchema, v[name], child(name), out)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					*out = append(*out, SchemaViolation{Field: child(name), Constraint: "additionalProperties", Message: "unknown field"})
+				}
+			case map[string]any:
+				validateSchemaValue(extra, v[name], child(name), out)
+			}
+		}
+	}
+}
+
+func schemaTypes(value any) []string {
+	switch t := value.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		var types []string
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// jsonType names the JSON Schema type of a value decoded with UseNumber.
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && !strings.ContainsAny(v.String(), ".eE") {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func schemaNumber(value any) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func jsonEqual(a, b any) bool {
+	ea, errA := json.Marshal(a)
+	eb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ea, eb)
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestValidateToolInput(t *testing.T) {
+	tool := Tool{
+		Name: "demo",
+		InputSchema: anthropic.ToolInputSchemaParam{
+			Properties: map[string]any{
+				"path":  map[string]any{"type": "string", "minLength": 1, "pattern": "^[^/]"},
+				"count": map[string]any{"type": "integer", "minimum": 1, "maximum": 10},
+				"ratio": map[string]any{"type": "number"},
+				"mode":  map[string]any{"type": "string", "enum": []string{"fast", "slow"}},
+				"tags":  map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "maxItems": 2},
+				"edits": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type":                 "object",
+						"properties":           map[string]any{"path": map[string]any{"type": "string"}},
+						"required":             []string{"path"},
+						"additionalProperties": false,
+					},
+				},
+			},
+			Required:    []string{"path"},
+			ExtraFields: map[string]any{"additionalProperties": false},
+		},
+		InputAliases: map[string]string{"file_path": "path"},
+	}
+
+	valid := []string{
+		`{"path": "a.go"}`,
+		`{"file_path": "a.go"}`,
+		`{"path": "a.go", "count": 10, "ratio": 2, "mode": "slow", "tags": ["x"], "edits": [{"path": "b.go"}]}`,
+		`{"path": "a.go", "ratio": 0.5}`,
+	}
+	for _, input := range valid {
+		if violations := validateToolInput(tool, json.RawMessage(input)); len(violations) > 0 {
+			t.Errorf("validateToolInput(%s) = %v, want no violations", input, violations)
+		}
+	}
+
+	invalid := []struct {
+		input string
+		want  []SchemaViolation
+	}{
+		{``, []SchemaViolation{{Field: "path", Constraint: "required", Message: "missing required field"}}},
+		{`{"path": 1}`, []SchemaViolation{{Field: "path", Constraint: "type", Message: "expected string, got integer"}}},
+		{`{"path": ""}`, []SchemaViolation{{Field: "path", Constraint: "minLength", Message: "must be at least 1 characters"}, {Field: "path", Constraint: "pattern", Message: "must match ^[^/]"}}},
+		{`{"path": "a", "count": 1.5}`, []SchemaViolation{{Field: "count", Constraint: "type", Message: "expected integer, got number"}}},
+		{`{"path": "a", "count": 11}`, []SchemaViolation{{Field: "count", Constraint: "maximum", Message: "must be at most 10"}}},
+		{`{"path": "a", "mode": "medium"}`, []SchemaViolation{{Field: "mode", Constraint: "enum", Message: `must be one of "fast", "slow"`}}},
+		{`{"path": "a", "tags": ["x", 2, "z"]}`, []SchemaViolation{{Field: "tags", Constraint: "maxItems", Message: "must have at most 2 items"}, {Field: "tags[1]", Constraint: "type", Message: "expected string, got integer"}}},
+		{`{"path": "a", "edits": [{"path": "b"}, {"file": "c"}]}`, []SchemaViolation{{Field: "edits[1].path", Constraint: "required", Message: "missing required field"}, {Field: "edits[1].file", Constraint: "additionalProperties", Message: "unknown field"}}},
+		{`{"path": "a", "extra": true}`, []SchemaViolation{{Field: "extra", Constraint: "additionalProperties", Message: "unknown field"}}},
+		{`[1]`, []SchemaViolation{{Constraint: "type", Message: "expected object, got array"}}},
+	}
+	for _, tc := range invalid {
+		got := validateToolInput(tool, json.RawMessage(tc.input))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("validateToolInput(%s) = %+v, want %+v", tc.input, got, tc.want)
+		}
+	}
+
+	if got := validateToolInput(tool, json.RawMessage(`{"path":`)); len(got) != 1 || got[0].Constraint != "json" {
+		t.Errorf("validateToolInput of broken JSON = %+v, want one json violation", got)
+	}
+}
+
+func TestToolSchemaError(t *testing.T) {
+	err := toolSchemaError("demo", []SchemaViolation{
+		{Constraint: "type", Message: "expected object, got array"},
+		{Field: "path", Constraint: "required", Message: "missing required field"},
+	})
+	if err.Code != ToolErrorValidation || len(err.Violations) != 2 {
+		t.Errorf("toolSchemaError = %+v, want a validation error carrying both violations", err)
+	}
+	want := "invalid demo input: expected object, got array; path: missing required field"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("toolSchemaError message = %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// scratchName is how the model names the session's scratch directory in
+	// file tool paths.
+	scratchName = "scratch"
+	// scratchDirName is the directory under .coder holding one scratch
+	// directory per running session.
+	scratchDirName = "scratch"
+	scratchEnvName = "CODER_SCRATCH"
+)
+
+// scratchFileTools are the built-in tools that only touch the paths named in
+// their input, so a call naming only scratch paths stays in scratch. Other
+// tools may have path fields too but act elsewhere, such as save_artifact or
+// library tools.
+var scratchFileTools = map[string]bool{
+	"write_file": true, "edit_file": true, "edit_files": true, "apply_edits": true,
+	"regex_replace": true, "insert_at_line": true, "replace_lines": true,
+	"delete_file": true, "delete_directory": true, "move_file": true,
+	nativeTextEditorName: true,
+}
+
+// workspaceHasScratch reports whether the workspace at root has its own
+// scratch file or directory, in which case no session scratch directory is
+// offered.
+func workspaceHasScratch(root string) bool {
+	_, err := os.Lstat(filepath.Join(root, scratchName))
+	return err == nil
+}
+
+// scratchDirFor returns where session id keeps its scratch directory, which
+// file tools reach as scratch/, or "" if it cannot have one. It lives under
+// .coder, so checkpoints, change summaries, and pull requests never include
+// it, and is created on first use. A workspace with a scratch entry of its
+// own keeps that name, and gets none.
+func scratchDirFor(root, id string) string {
+	if workspaceHasScratch(root) {
+		debugf("scratch_disabled reason=%q", "the workspace has its own "+scratchName)
+		return ""
+	}
+	return filepath.Join(root, coderDirName, scratchDirName, id)
+}
+
+func ensureScratchDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create the scratch directory: %w", err)
+	}
+	return nil
+}
+
+// removeScratch deletes the session's scratch directory and everything in
+// it, and the shared parent once no session is using it.
+func (s *Session) removeScratch() {
+	if s.scratch == "" {
+		return
+	}
+	if err := os.RemoveAll(s.scratch); err != nil {
+		debugf("scratch_remove_failed path=%q error=%q", s.scratch, err.Error())
+	}
+	os.Remove(filepath.Dir(s.scratch))
+	s.scratch = ""
+}
+
+// resolveScratchPath maps scratch and paths under scratch/, or absolute
+// paths inside the scratch directory, to the session's scratch directory.
+// ok is false for every other path.
+func (s *Session) resolveScratchPath(pathArg string) (abs, display string, ok bool, err error) {
+	if s.scratch == "" {
+		return "", "", false, nil
+	}
+	if filepath.IsAbs(pathArg) {
+		rel, relErr := filepath.Rel(s.scratch, filepath.Clean(pathArg))
+		if relErr != nil || pathEscapes(rel) {
+			return "", "", false, nil
+		}
+		pathArg = filepath.Join(scratchName, rel)
+	}
+	display = filepath.ToSlash(filepath.Clean(pathArg))
+	rest, found := strings.CutPrefix(display, scratchName)
+	if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", "", false, nil
+	}
+	if err := ensureScratchDir(s.scratch); err != nil {
+		return "", "", true, err
+	}
+	abs = filepath.Join(s.scratch, filepath.FromSlash(rest))
+	if err := s.checkSymlinkEscape(s.scratch, abs, display); err != nil {
+		return "", "", true, err
+	}
+	return abs, display, true, nil
+}
+
+// inScratch reports whether a workspace display path is in the scratch
+// directory.
+func (s *Session) inScratch(displayPath string) bool {
+	_, _, ok, _ := s.resolveScratchPath(displayPath)
+	return ok
+}
+
+// scratchOnlyCall reports whether tool is one of scratchFileTools and every
+// path its call names is in the scratch directory. Such calls skip approval
+// prompts and the work branch, since they cannot change the project.
+func (s *Session) scratchOnlyCall(tool string, input json.RawMessage) bool {
+	if !scratchFileTools[tool] {
+		return false
+	}
+	var fields struct {
+		Path        *string `json:"path"`
+		Source      *string `json:"source"`
+		Destination *string `json:"destination"`
+		Edits       []struct {
+			Path *string `json:"path"`
+		} `json:"edits"`
+	}
+	if err := json.Unmarshal(input, &fields); err != nil {
+		return false
+	}
+	paths := []*string{fields.Path, fields.Source, fields.Destination}
+	for _, edit := range fields.Edits {
+		paths = append(paths, edit.Path)
+	}
+	named := 0
+	for _, path := range paths {
+		if path == nil {
+			continue
+		}
+		if !s.inScratch(*path) {
+			return false
+		}
+		named++
+	}
+	return named > 0
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestScratchOnlyCall(t *testing.T) {
+	a, err := New(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	tests := []struct {
+		tool, input string
+		want        bool
+	}{
+		{"write_file", `{"path": "scratch/notes.txt", "content": "x"}`, true},
+		{"move_file", `{"source": "scratch/a.txt", "destination": "scratch/b.txt"}`, true},
+		{"apply_edits", `{"edits": [{"path": "scratch/a.py", "old_str": "a", "new_str": "b"}]}`, true},
+		{"move_file", `{"source": "scratch/a.txt", "destination": "main.go"}`, false},
+		{"apply_edits", `{"edits": [{"path": "scratch/a.py"}, {"path": "main.py"}]}`, false},
+		{"write_file", `{"content": "x"}`, false},
+		{"write_file", `{"path": "scratch/../main.go", "content": "x"}`, false},
+		// Tools that act outside the paths they name never count.
+		{"save_artifact", `{"path": "scratch/report.html", "name": "report.html"}`, false},
+		{"deploy", `{"path": "scratch/app"}`, false},
+		{"bash", `{"command": "rm -rf .", "path": "scratch"}`, false},
+	}
+	for _, tc := range tests {
+		if got := a.Session.scratchOnlyCall(tc.tool, json.RawMessage(tc.input)); got != tc.want {
+			t.Errorf("scratchOnlyCall(%s, %s) = %v, want %v", tc.tool, tc.input, got, tc.want)
+		}
+	}
+}
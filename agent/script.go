@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// scriptStep is one prompt of a -script file, run as its own turn, with an
+// optional command whose exit status decides whether the step succeeded.
+type scriptStep struct {
+	Prompt string `json:"prompt"`
+	Verify string `json:"verify,omitempty"`
+}
+
+// loadScript reads the steps of a -script file: JSON, as a list of steps or
+// {"steps": [...]}, or the subset of YAML that describes the same list.
+func loadScript(path string) ([]scriptStep, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	var steps []scriptStep
+	if filepath.Ext(path) == ".json" {
+		trimmed := strings.TrimSpace(string(data))
+		if strings.HasPrefix(trimmed, "[") {
+			err = json.Unmarshal(data, &steps)
+		} else {
+			var file struct {
+				Steps []scriptStep `json:"steps"`
+			}
+			err = json.Unmarshal(data, &file)
+			steps = file.Steps
+		}
+	} else {
+		steps, err = parseScriptYAML(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid script %s: %w", path, err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("invalid script %s: no steps", path)
+	}
+	for i := range steps {
+		steps[i].Prompt = strings.TrimSpace(steps[i].Prompt)
+		steps[i].Verify = strings.TrimSpace(steps[i].Verify)
+		if steps[i].Prompt == "" {
+			return nil, fmt.Errorf("invalid script %s: step %d has no prompt", path, i+1)
+		}
+	}
+	return steps, nil
+}
+
+// parseScriptYAML parses a YAML list of steps, optionally under a steps key:
+//
+//	steps:
+//	  - prompt: Bump the Go dependencies to their latest minor versions
+//	    verify: go build ./...
+//	  - prompt: |
+//	      Fix whatever the upgrade broke.
+//	      Keep the public API unchanged.
+//	    verify: go test ./...
+//	  - Add an entry for the upgrade to CHANGELOG.md
+//
+// Values may be plain, quoted, or | and > block scalars; a bare list item is
+// a prompt. Anything else, such as anchors or flow collections, is rejected.
+func parseScriptYAML(text string) ([]scriptStep, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var steps []scriptStep
+	itemIndent := -1
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.HasPrefix(line[indent:], "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", i+1)
+		}
+		if trimmed == "steps:" && len(steps) == 0 && itemIndent < 0 {
+			continue
+		}
+
+		fieldIndent := indent
+		if rest, ok := strings.CutPrefix(trimmed, "-"); ok && (rest == "" || rest[0] == ' ') {
+			if itemIndent >= 0 && indent != itemIndent {
+				return nil, fmt.Errorf("line %d: list items must line up", i+1)
+			}
+			itemIndent = indent
+			steps = append(steps, scriptStep{})
+			rest = strings.TrimLeft(rest, " ")
+			if rest == "" {
+				continue
+			}
+			fieldIndent = indent + len(trimmed) - len(rest)
+			trimmed = rest
+			if !looksLikeYAMLKey(rest) {
+				value, next, err := yamlValue(lines, i, rest, indent)
+				if err != nil {
+					return nil, err
+				}
+				steps[len(steps)-1].Prompt, i = value, next
+				continue
+			}
+		} else if len(steps) == 0 || indent <= itemIndent {
+			return nil, fmt.Errorf("line %d: expected a list item starting with \"- \"", i+1)
+		}
+
+		key, value, _ := strings.Cut(trimmed, ":")
+		value, next, err := yamlValue(lines, i, strings.TrimSpace(value), fieldIndent)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.TrimSpace(key) {
+		case "prompt":
+			steps[len(steps)-1].Prompt = value
+		case "verify":
+			steps[len(steps)-1].Verify = value
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q (expected prompt or verify)", i+1, strings.TrimSpace(key))
+		}
+		i = next
+	}
+	return steps, nil
+}
+
+func looksLikeYAMLKey(text string) bool {
+	key, _, ok := strings.Cut(text, ":")
+	return ok && key != "" && !strings.ContainsAny(key, " \"'")
+}
+
+// yamlValue decodes the scalar value starting on line i, reading the lines of
+// a block scalar that are indented past parentIndent. It returns the index of
+// the last line used.
+func yamlValue(lines []string, i int, value string, parentIndent int) (string, int, error) {
+	switch {
+	case value == "|" || value == "|-" || value == ">" || value == ">-":
+		var block []string
+		blockIndent := -1
+		last := i
+		for j := i + 1; j < len(lines); j++ {
+			line := lines[j]
+			if strings.TrimSpace(line) == "" {
+				block = append(block, "")
+				continue
+			}
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			if indent <= parentIndent {
+				break
+			}
+			if blockIndent < 0 {
+				blockIndent = indent
+			}
+			if indent < blockIndent {
+				return "", i, fmt.Errorf("line %d: block is indented less than its first line", j+1)
+			}
+			block = append(block, line[blockIndent:])
+			last = j
+		}
+		block = block[:last-i]
+		if value[0] == '>' {
+			return strings.Join(block, " "), last, nil
+		}
+		return strings.Join(block, "\n"), last, nil
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", i, fmt.Errorf("line %d: invalid quoted string %s", i+1, value)
+		}
+		return unquoted, i, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", i, fmt.Errorf("line %d: invalid quoted string %s", i+1, value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), i, nil
+	case strings.HasPrefix(value, "&"), strings.HasPrefix(value, "*"), strings.HasPrefix(value, "["), strings.HasPrefix(value, "{"):
+		return "", i, fmt.Errorf("line %d: anchors and flow collections are not supported; use plain or quoted strings", i+1)
+	}
+	if comment := strings.Index(value, " #"); comment >= 0 {
+		value = strings.TrimSpace(value[:comment])
+	}
+	return value, i, nil
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	maxSearchSessions         = 20
+	maxSearchSnippets         = 3
+	searchSnippetContextChars = 50
+)
+
+// sessionMatch is a saved session that matched a search, with a snippet for
+// each matching prompt, reply, or tool call.
+type sessionMatch struct {
+	record   SessionRecord
+	snippets []string
+	hits     int
+}
+
+// runSearch implements coder search: it lists the saved sessions whose
+// prompts, replies, or tool calls contain every word of the query.
+func runSearch(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `usage: coder search "query"`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return printSessionSearch(os.Stdout, Config{}.workspaceRoot(), strings.Join(fs.Args(), " "))
+}
+
+func searchCommand(s *Session, args string) error {
+	return printSessionSearch(s.out, s.root, args)
+}
+
+func printSessionSearch(w io.Writer, root, query string) error {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return errors.New(`usage: coder search "query" (or /search query in a session)`)
+	}
+	records, err := loadSessions(root)
+	if err != nil {
+		return err
+	}
+	matches := searchSessions(records, terms)
+	if len(matches) == 0 {
+		fmt.Fprintf(w, "No saved session mentions %q.\n", query)
+		return nil
+	}
+	for i, match := range matches {
+		if i == maxSearchSessions {
+			fmt.Fprintf(w, "... and %d more; narrow the query to see them\n", len(matches)-i)
+			break
+		}
+		fmt.Fprintf(w, "%s  %s  %s (%d match(es))\n", match.record.ID, match.record.Updated.Local().Format("2006-01-02 15:04"), match.record.Title, match.hits)
+		for _, snippet := range match.snippets {
+			fmt.Fprintf(w, "    %s\n", snippet)
+		}
+	}
+	fmt.Fprintln(w, "Resume one with /sessions resume <id> or coder -resume <id>.")
+	return nil
+}
+
+// searchSessions returns the sessions with a title, prompt, reply, or tool
+// call containing every term, those with the most matching messages first.
+func searchSessions(records []SessionRecord, terms []string) []sessionMatch {
+	var matches []sessionMatch
+	for _, record := range records {
+		match := sessionMatch{record: record}
+		if containsAllTerms(strings.ToLower(record.Title), terms) {
+			match.hits++
+		}
+		for _, msg := range record.History {
+			for _, part := range searchableText(msg) {
+				if !containsAllTerms(strings.ToLower(part.text), terms) {
+					continue
+				}
+				match.hits++
+				if len(match.snippets) < maxSearchSnippets {
+					match.snippets = append(match.snippets, part.label+": "+searchSnippet(part.text, terms[0]))
+				}
+			}
+		}
+		if match.hits > 0 {
+			matches = append(matches, match)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].hits > matches[j].hits })
+	return matches
+}
+
+type searchablePart struct {
+	label string
+	text  string
+}
+
+// searchableText returns the prompt or reply text of msg and its tool calls
+// with their inputs, which hold the file paths and commands. Tool results are
+// left out: they are mostly file contents and command output.
+func searchableText(msg anthropic.MessageParam) []searchablePart {
+	label := "reply"
+	if msg.Role == anthropic.MessageParamRoleUser {
+		label = "prompt"
+	}
+	var parts []searchablePart
+	for _, block := range msg.Content {
+		switch {
+		case block.OfText != nil:
+			parts = append(parts, searchablePart{label: label, text: block.OfText.Text})
+		case block.OfToolUse != nil:
+			input, _ := json.Marshal(block.OfToolUse.Input)
+			parts = append(parts, searchablePart{label: block.OfToolUse.Name, text: string(input)})
+		}
+	}
+	return parts
+}
+
+func containsAllTerms(text string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchSnippet returns the text around the first occurrence of term on one
+// line.
+func searchSnippet(text, term string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	at := strings.Index(strings.ToLower(text), term)
+	if at < 0 {
+		return previewText(text, 2*searchSnippetContextChars)
+	}
+	start, end := max(0, at-searchSnippetContextChars), min(len(text), at+len(term)+searchSnippetContextChars)
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	snippet := text[start:end]
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
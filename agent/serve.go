@@ -0,0 +1,513 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxServeRequestBytes = 1 << 20
+	// streamBufferEvents is how far an event stream may fall behind before the
+	// server drops it; the client reconnects with Last-Event-ID to catch up.
+	streamBufferEvents = 256
+	streamPingInterval = 15 * time.Second
+)
+
+// apiServer backs "coder serve". Each session gets its own workspace.
+type apiServer struct {
+	cfg        Config
+	apiKey     string
+	workspaces *workspaces
+
+	mu       sync.Mutex
+	sessions map[string]*apiSession
+}
+
+// workspaces creates per-session workspace directories under root. Each
+// session's agent works in its own directory through Config.Dir, so turns
+// from different sessions run at the same time.
+type workspaces struct {
+	root string
+	// source is the directory the server was started in, which new
+	// workspaces may be seeded from.
+	source string
+}
+
+// newWorkspaces prepares root, or a new temporary directory if root is empty.
+func newWorkspaces(root string) (*workspaces, error) {
+	source, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if root == "" {
+		root, err = os.MkdirTemp("", "coder-workspaces-")
+	} else {
+		root, err = filepath.Abs(root)
+		if err == nil {
+			err = os.MkdirAll(root, 0o755)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare workspaces directory: %w", err)
+	}
+	return &workspaces{root: root, source: source}, nil
+}
+
+// create makes a new workspace, seeded with a copy of the source directory if
+// copySource is set.
+func (w *workspaces) create(copySource bool) (string, error) {
+	if copySource && strings.HasPrefix(w.root, w.source+string(filepath.Separator)) {
+		return "", errors.New("cannot copy the workspace when -workspaces is inside it")
+	}
+	dir, err := os.MkdirTemp(w.root, "session-")
+	if err != nil {
+		return "", err
+	}
+	if copySource {
+		if err := copyTree(w.source, dir); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to copy workspace: %w", err)
+		}
+	}
+	return dir, nil
+}
+
+// newAgent creates an agent whose session lives in dir. Its terminal output
+// is dropped; clients follow the session through its events.
+func (w *workspaces) newAgent(cfg Config, dir string) (*Agent, error) {
+	cfg.Dir, cfg.Stdout = dir, io.Discard
+	return New(cfg)
+}
+
+type apiSession struct {
+	ID        string    `json:"id"`
+	Workspace string    `json:"workspace"`
+	Created   time.Time `json:"created"`
+
+	agent *Agent
+
+	mu   sync.Mutex
+	busy bool
+	// deleted is set once DELETE has removed the session, so a request
+	// that looked it up just before cannot start a turn in it.
+	deleted     bool
+	events      []Event
+	toolCalls   []ToolCallRecord
+	subscribers map[chan Event]struct{}
+}
+
+// ToolCallRecord is one tool call as listed by GET /sessions/{id}/tool-calls.
+type ToolCallRecord struct {
+	ID         string          `json:"id"`
+	Turn       int             `json:"turn"`
+	Tool       string          `json:"tool"`
+	Input      json.RawMessage `json:"input"`
+	Result     string          `json:"result,omitempty"`
+	IsError    bool            `json:"is_error"`
+	ErrorCode  string          `json:"error_code,omitempty"`
+	Finished   bool            `json:"finished"`
+	Started    time.Time       `json:"started"`
+	DurationMs int64           `json:"duration_ms"`
+}
+
+type createSessionRequest struct {
+	// CopyWorkspace seeds the session workspace with a copy of the directory
+	// coder serve was started in.
+	CopyWorkspace bool `json:"copy_workspace"`
+}
+
+type postMessageRequest struct {
+	Prompt string `json:"prompt"`
+	// Async returns 202 at once instead of waiting for the turn to finish.
+	Async bool `json:"async"`
+}
+
+type postMessageResponse struct {
+	Status string  `json:"status"`
+	Result *Result `json:"result,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// runServe implements "coder serve [flags]".
+func runServe() error {
+	addr := flag.String("addr", "127.0.0.1:8080", "Address to listen on")
+	apiKey := flag.String("api-key", "", "Key clients must send as \"Authorization: Bearer <key>\" (defaults to $CODER_API_KEY)")
+	workspacesDir := flag.String("workspaces", "", "Directory for per-session workspaces (defaults to a new temporary directory)")
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	configureLogging(cfg.Verbose)
+
+	key := strings.TrimSpace(*apiKey)
+	if key == "" {
+		key = strings.TrimSpace(os.Getenv("CODER_API_KEY"))
+	}
+	if key == "" {
+		return errors.New("coder serve requires -api-key or $CODER_API_KEY")
+	}
+	workspaces, err := newWorkspaces(strings.TrimSpace(*workspacesDir))
+	if err != nil {
+		return err
+	}
+
+	// The server has no terminal: replies are plain text and the memory
+	// notes in the system prompt come from each session's own workspace.
+	cfg.ColorOutput, cfg.Highlight, cfg.Markdown = false, false, false
+	cfg.SystemPrompt = ""
+	server := &apiServer{cfg: cfg, apiKey: key, workspaces: workspaces, sessions: make(map[string]*apiSession)}
+	if cfg.MetricsAddr != "" {
+		startMetricsServer(cfg.MetricsAddr)
+	}
+	fmt.Fprintf(os.Stdout, "Serving the coder API on http://%s (workspaces in %s)\n", *addr, workspaces.root)
+	httpServer := &http.Server{Addr: *addr, Handler: server.routes(), ReadHeaderTimeout: 10 * time.Second}
+	return httpServer.ListenAndServe()
+}
+
+func (a *apiServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("POST /sessions", a.createSession)
+	mux.HandleFunc("GET /sessions/{id}", a.getSession)
+	mux.HandleFunc("DELETE /sessions/{id}", a.deleteSession)
+	mux.HandleFunc("POST /sessions/{id}/messages", a.postMessage)
+	mux.HandleFunc("GET /sessions/{id}/events", a.listEvents)
+	mux.HandleFunc("GET /sessions/{id}/stream", a.streamEvents)
+	mux.HandleFunc("GET /sessions/{id}/tool-calls", a.listToolCalls)
+	return a.authenticate(mux)
+}
+
+func (a *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.apiKey)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *apiServer) createSession(w http.ResponseWriter, r *http.Request) {
+	var req createSessionRequest
+	if err := decodeAPIRequest(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	workspace, err := a.workspaces.create(req.CopyWorkspace)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	agent, err := a.workspaces.newAgent(a.cfg, workspace)
+	if err != nil {
+		os.RemoveAll(workspace)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	session := &apiSession{ID: agent.Session.ID, Workspace: workspace, Created: time.Now(), agent: agent, subscribers: make(map[chan Event]struct{})}
+	agent.Session.OnEvent = session.record
+
+	a.mu.Lock()
+	a.sessions[session.ID] = session
+	a.mu.Unlock()
+	debugf("serve_session_created session_id=%q workspace=%q", session.ID, workspace)
+	writeAPIJSON(w, http.StatusCreated, session)
+}
+
+func (a *apiServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	sessions := make([]*apiSession, 0, len(a.sessions))
+	for _, session := range a.sessions {
+		sessions = append(sessions, session)
+	}
+	a.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Created.Before(sessions[j].Created) })
+	writeAPIJSON(w, http.StatusOK, sessions)
+}
+
+func (a *apiServer) getSession(w http.ResponseWriter, r *http.Request) {
+	if session := a.lookup(w, r); session != nil {
+		writeAPIJSON(w, http.StatusOK, session)
+	}
+}
+
+func (a *apiServer) deleteSession(w http.ResponseWriter, r *http.Request) {
+	session := a.lookup(w, r)
+	if session == nil {
+		return
+	}
+	// Holding the session's lock from the busy check to the removal keeps a
+	// turn from starting in between.
+	session.mu.Lock()
+	if session.busy {
+		session.mu.Unlock()
+		writeAPIError(w, http.StatusConflict, "session is running a turn")
+		return
+	}
+	if session.deleted {
+		session.mu.Unlock()
+		writeAPIError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	session.deleted = true
+	a.mu.Lock()
+	delete(a.sessions, session.ID)
+	a.mu.Unlock()
+	for updates := range session.subscribers {
+		delete(session.subscribers, updates)
+		close(updates)
+	}
+	session.mu.Unlock()
+	session.agent.Close()
+	if err := os.RemoveAll(session.Workspace); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiServer) postMessage(w http.ResponseWriter, r *http.Request) {
+	session := a.lookup(w, r)
+	if session == nil {
+		return
+	}
+	var req postMessageRequest
+	if err := decodeAPIRequest(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prompt := strings.TrimSpace(req.Prompt)
+	if prompt == "" {
+		writeAPIError(w, http.StatusBadRequest, "prompt is required")
+		return
+	}
+	session.mu.Lock()
+	if session.deleted {
+		session.mu.Unlock()
+		writeAPIError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	if session.busy {
+		session.mu.Unlock()
+		writeAPIError(w, http.StatusConflict, "session is already running a turn")
+		return
+	}
+	session.busy = true
+	session.mu.Unlock()
+
+	run := func(ctx context.Context) postMessageResponse {
+		defer func() {
+			session.mu.Lock()
+			session.busy = false
+			session.mu.Unlock()
+		}()
+		result, err := session.agent.Run(ctx, prompt)
+		if err != nil {
+			return postMessageResponse{Status: "failed", Result: result, Error: err.Error()}
+		}
+		return postMessageResponse{Status: "done", Result: result}
+	}
+	if req.Async {
+		go run(context.Background())
+		writeAPIJSON(w, http.StatusAccepted, postMessageResponse{Status: "running"})
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, run(r.Context()))
+}
+
+// listEvents returns the session's events; ?after=n skips the first n, so a
+// client can poll for new ones.
+func (a *apiServer) listEvents(w http.ResponseWriter, r *http.Request) {
+	session := a.lookup(w, r)
+	if session == nil {
+		return
+	}
+	after := 0
+	if value := r.URL.Query().Get("after"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeAPIError(w, http.StatusBadRequest, "after must be a non-negative integer")
+			return
+		}
+		after = n
+	}
+	session.mu.Lock()
+	events := []Event{}
+	if after < len(session.events) {
+		events = append(events, session.events[after:]...)
+	}
+	session.mu.Unlock()
+	writeAPIJSON(w, http.StatusOK, events)
+}
+
+// streamEvents sends the session's events as server-sent events, starting
+// after ?after=n or the Last-Event-ID header and then live as they happen.
+// Each event's id is its position in the session, so a reconnecting client
+// resumes where it left off.
+func (a *apiServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	session := a.lookup(w, r)
+	if session == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "streaming is not supported by this connection")
+		return
+	}
+	from := r.URL.Query().Get("after")
+	if from == "" {
+		from = r.Header.Get("Last-Event-ID")
+	}
+	after := 0
+	if from != "" {
+		n, err := strconv.Atoi(from)
+		if err != nil || n < 0 {
+			writeAPIError(w, http.StatusBadRequest, "after must be a non-negative integer")
+			return
+		}
+		after = n
+	}
+
+	updates := make(chan Event, streamBufferEvents)
+	session.mu.Lock()
+	var backlog []Event
+	if after < len(session.events) {
+		backlog = append(backlog, session.events[after:]...)
+	}
+	next := min(after, len(session.events)) + 1
+	session.subscribers[updates] = struct{}{}
+	session.mu.Unlock()
+	defer session.unsubscribe(updates)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range backlog {
+		writeServerSentEvent(w, next, event)
+		next++
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case event, open := <-updates:
+			if !open {
+				return
+			}
+			writeServerSentEvent(w, next, event)
+			next++
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w io.Writer, id int, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event.Type, data)
+}
+
+func (a *apiServer) listToolCalls(w http.ResponseWriter, r *http.Request) {
+	session := a.lookup(w, r)
+	if session == nil {
+		return
+	}
+	session.mu.Lock()
+	calls := append([]ToolCallRecord{}, session.toolCalls...)
+	session.mu.Unlock()
+	writeAPIJSON(w, http.StatusOK, calls)
+}
+
+func (a *apiServer) lookup(w http.ResponseWriter, r *http.Request) *apiSession {
+	a.mu.Lock()
+	session := a.sessions[r.PathValue("id")]
+	a.mu.Unlock()
+	if session == nil {
+		writeAPIError(w, http.StatusNotFound, "no such session")
+	}
+	return session
+}
+
+// record keeps an event for the events and tool-calls endpoints and passes it
+// to open streams.
+func (s *apiSession) record(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	for updates := range s.subscribers {
+		select {
+		case updates <- event:
+		default:
+			delete(s.subscribers, updates)
+			close(updates)
+		}
+	}
+	switch event.Type {
+	case EventToolCall:
+		s.toolCalls = append(s.toolCalls, ToolCallRecord{ID: event.ToolID, Turn: event.Turn, Tool: event.Tool, Input: event.Input, Started: event.Time})
+	case EventToolResult:
+		for i := len(s.toolCalls) - 1; i >= 0; i-- {
+			if s.toolCalls[i].ID == event.ToolID {
+				s.toolCalls[i].Result = event.Text
+				s.toolCalls[i].IsError = event.IsError
+				s.toolCalls[i].ErrorCode = event.ErrorCode
+				s.toolCalls[i].Finished = true
+				s.toolCalls[i].DurationMs = event.DurationMs
+				break
+			}
+		}
+	}
+}
+
+func (s *apiSession) unsubscribe(updates chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[updates]; ok {
+		delete(s.subscribers, updates)
+		close(updates)
+	}
+}
+
+func decodeAPIRequest(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxServeRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		debugf("serve_write_failed error=%q", err.Error())
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+func TestServeDeleteSession(t *testing.T) {
+	workspaces, err := newWorkspaces(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &apiServer{apiKey: "key", workspaces: workspaces, sessions: make(map[string]*apiSession)}
+	handler := server.routes()
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer key")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send(http.MethodPost, "/sessions", "{}"); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /sessions = %d %s", rec.Code, rec.Body)
+	}
+	var session *apiSession
+	for _, s := range server.sessions {
+		session = s
+	}
+	if session.agent.Session.root != session.Workspace {
+		t.Errorf("session works in %q, want its workspace %q", session.agent.Session.root, session.Workspace)
+	}
+
+	session.busy = true
+	if rec := send(http.MethodDelete, "/sessions/"+session.ID, ""); rec.Code != http.StatusConflict {
+		t.Errorf("DELETE of a busy session = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	session.busy = false
+	if rec := send(http.MethodDelete, "/sessions/"+session.ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(session.Workspace); !os.IsNotExist(err) {
+		t.Errorf("the workspace of a deleted session still exists: %v", err)
+	}
+	if rec := send(http.MethodGet, "/sessions/"+session.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted session = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// A request that looked the session up before the delete finds it gone.
+	server.sessions[session.ID] = session
+	if rec := send(http.MethodPost, "/sessions/"+session.ID+"/messages", `{"prompt":"hi"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("POST to a deleted session = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// streamedReply writes a streamed Messages API response of text, sent in the
+// given pieces, followed by the tool calls in toolUses.
+func streamedReply(w http.ResponseWriter, pieces []string, toolUses ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	send := func(event string, data string) { fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data) }
+	send("message_start", `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"test","content":[],"stop_reason":null,"usage":{"input_tokens":10,"output_tokens":1}}}`)
+	send("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`)
+	for _, piece := range pieces {
+		text, _ := json.Marshal(piece)
+		send("content_block_delta", fmt.Sprintf(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":%s}}`, text))
+	}
+	send("content_block_stop", `{"type":"content_block_stop","index":0}`)
+	stopReason := "end_turn"
+	for i, name := range toolUses {
+		stopReason = "tool_use"
+		send("content_block_start", fmt.Sprintf(`{"type":"content_block_start","index":%d,"content_block":{"type":"tool_use","id":"toolu_%d","name":%q,"input":{}}}`, i+1, i+1, name))
+		send("content_block_delta", fmt.Sprintf(`{"type":"content_block_delta","index":%d,"delta":{"type":"input_json_delta","partial_json":"{}"}}`, i+1))
+		send("content_block_stop", fmt.Sprintf(`{"type":"content_block_stop","index":%d}`, i+1))
+	}
+	send("message_delta", fmt.Sprintf(`{"type":"message_delta","delta":{"stop_reason":%q},"usage":{"output_tokens":5}}`, stopReason))
+	send("message_stop", `{"type":"message_stop"}`)
+}
+
+func TestServeStreamsTextDeltas(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var params struct {
+			Stream bool `json:"stream"`
+		}
+		if err := json.Unmarshal(body, &params); err != nil || !params.Stream {
+			t.Errorf("request to %s did not ask to stream: %s", r.URL.Path, body)
+		}
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n == 1 {
+			streamedReply(w, []string{"Let me ", "look."}, "list_files")
+			return
+		}
+		streamedReply(w, []string{"Nothing ", "here ", "yet."})
+	}))
+	defer api.Close()
+
+	workspaces, err := newWorkspaces(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &apiServer{apiKey: "key", workspaces: workspaces, sessions: make(map[string]*apiSession)}
+	handler := server.routes()
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer key")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := send(http.MethodPost, "/sessions", "{}"); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /sessions = %d %s", rec.Code, rec.Body)
+	}
+	var session *apiSession
+	for _, s := range server.sessions {
+		session = s
+	}
+	client := anthropic.NewClient(option.WithAPIKey("test"), option.WithBaseURL(api.URL), option.WithMaxRetries(0))
+	session.agent.Provider = &anthropicProvider{client: &client}
+	session.agent.Session.titleGenerated = true
+
+	if rec := send(http.MethodPost, "/sessions/"+session.ID+"/messages", `{"prompt":"what is here?"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"done"`) {
+		t.Fatalf("POST /messages = %d %s", rec.Code, rec.Body)
+	}
+	rec := send(http.MethodGet, "/sessions/"+session.ID+"/events", "")
+	var events []Event
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatalf("GET /events: %v: %s", err, rec.Body)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	want := []string{
+		EventTextDelta, EventTextDelta, EventText, EventToolCall, EventToolResult,
+		EventTextDelta, EventTextDelta, EventTextDelta, EventText, EventUsage,
+	}
+	if strings.Join(types, " ") != strings.Join(want, " ") {
+		t.Fatalf("events = %v, want %v", types, want)
+	}
+	if events[0].Text != "Let me " || events[1].Text != "look." || events[2].Text != "Let me look." {
+		t.Errorf("first response events carry %q, %q, %q", events[0].Text, events[1].Text, events[2].Text)
+	}
+	if events[3].Tool != "list_files" || events[4].ToolID != events[3].ToolID {
+		t.Errorf("tool events = %+v, %+v", events[3], events[4])
+	}
+	if events[8].Text != "Nothing here yet." {
+		t.Errorf("final text = %q", events[8].Text)
+	}
+}
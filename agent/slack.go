@@ -0,0 +1,403 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	slackAPIURL          = "https://slack.com/api/"
+	slackApproveReaction = "white_check_mark"
+	slackDenyReaction    = "x"
+	slackApprovalTimeout = 10 * time.Minute
+	maxSlackMessageChars = 3_500
+	slackReconnectDelay  = 5 * time.Second
+)
+
+// slackBot backs "coder slack". Each Slack thread the bot is mentioned in is
+// one agent session with its own workspace.
+type slackBot struct {
+	cfg        Config
+	appToken   string
+	botToken   string
+	botUserID  string
+	workspaces *workspaces
+	copySource bool
+	// approvers are the Slack user IDs that may answer approvals; when empty,
+	// anyone may. Either way, the user whose message started the turn may not.
+	approvers map[string]bool
+	client    *http.Client
+
+	mu        sync.Mutex
+	threads   map[string]*slackThread
+	approvals map[string]*slackApproval
+}
+
+type slackThread struct {
+	channel string
+	ts      string
+	prompts chan slackPrompt
+	agent   *Agent
+	// requester is who sent the prompt of the turn in progress.
+	requester string
+}
+
+type slackPrompt struct {
+	user string
+	text string
+}
+
+// slackApproval is a question waiting for a reaction.
+type slackApproval struct {
+	answer    chan bool
+	requester string
+}
+
+type slackEnvelope struct {
+	Type       string `json:"type"`
+	EnvelopeID string `json:"envelope_id"`
+	Payload    struct {
+		Event slackEvent `json:"event"`
+	} `json:"payload"`
+}
+
+type slackEvent struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Channel  string `json:"channel"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	Reaction string `json:"reaction"`
+	Item     struct {
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	} `json:"item"`
+}
+
+// runSlack implements "coder slack [flags]".
+func runSlack() error {
+	workspacesDir := flag.String("workspaces", "", "Directory for per-thread workspaces (defaults to a new temporary directory)")
+	copySource := flag.Bool("copy-workspace", true, "Seed each thread's workspace with a copy of the current directory")
+	approvers := flag.String("approvers", "", "Comma-separated Slack user IDs that may approve tool calls (defaults to anyone but the user who asked)")
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	configureLogging(cfg.Verbose)
+
+	appToken := strings.TrimSpace(os.Getenv("SLACK_APP_TOKEN"))
+	botToken := strings.TrimSpace(os.Getenv("SLACK_BOT_TOKEN"))
+	if appToken == "" || botToken == "" {
+		return errors.New("coder slack requires SLACK_APP_TOKEN (xapp-...) and SLACK_BOT_TOKEN (xoxb-...)")
+	}
+	workspaces, err := newWorkspaces(strings.TrimSpace(*workspacesDir))
+	if err != nil {
+		return err
+	}
+
+	cfg.ColorOutput, cfg.Highlight, cfg.Markdown = false, false, false
+	cfg.SystemPrompt = ""
+	// Every tool that can change something needs an emoji approval unless
+	// the project config sets its permission.
+	cfg.Project.Permissions.askWrites = true
+
+	bot := &slackBot{
+		cfg:        cfg,
+		appToken:   appToken,
+		botToken:   botToken,
+		workspaces: workspaces,
+		copySource: *copySource,
+		approvers:  make(map[string]bool),
+		client:     &http.Client{Timeout: 30 * time.Second},
+		threads:    make(map[string]*slackThread),
+		approvals:  make(map[string]*slackApproval),
+	}
+	for _, user := range strings.Split(*approvers, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			bot.approvers[user] = true
+		}
+	}
+	var auth struct {
+		UserID string `json:"user_id"`
+	}
+	if err := bot.call(botToken, "auth.test", nil, &auth); err != nil {
+		return fmt.Errorf("slack auth.test failed: %w", err)
+	}
+	bot.botUserID = auth.UserID
+	fmt.Fprintf(os.Stdout, "Connected to Slack as <@%s> (workspaces in %s)\n", auth.UserID, workspaces.root)
+
+	for {
+		err := bot.listen(context.Background())
+		fmt.Fprintf(os.Stderr, "Slack connection lost: %v; reconnecting\n", err)
+		time.Sleep(slackReconnectDelay)
+	}
+}
+
+// listen opens one Socket Mode connection and handles envelopes until Slack
+// closes it.
+func (b *slackBot) listen(ctx context.Context) error {
+	var open struct {
+		URL string `json:"url"`
+	}
+	if err := b.call(b.appToken, "apps.connections.open", nil, &open); err != nil {
+		return err
+	}
+	conn, err := dialWebSocket(ctx, open.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	debugf("slack_connected")
+
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var envelope slackEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			debugf("slack_envelope_invalid error=%q", err.Error())
+			continue
+		}
+		if envelope.EnvelopeID != "" {
+			ack, _ := json.Marshal(map[string]string{"envelope_id": envelope.EnvelopeID})
+			if err := conn.WriteText(ack); err != nil {
+				return err
+			}
+		}
+		switch envelope.Type {
+		case "disconnect":
+			return errors.New("slack asked to reconnect")
+		case "events_api":
+			b.handleEvent(envelope.Payload.Event)
+		}
+	}
+}
+
+func (b *slackBot) handleEvent(event slackEvent) {
+	if event.BotID != "" || event.User == b.botUserID {
+		return
+	}
+	switch event.Type {
+	case "reaction_added":
+		b.mu.Lock()
+		approval, ok := b.approvals[event.Item.Channel+"/"+event.Item.TS]
+		b.mu.Unlock()
+		if !ok || !b.mayApprove(approval, event.User) {
+			return
+		}
+		switch event.Reaction {
+		case slackApproveReaction, "+1", "heavy_check_mark":
+			sendApproval(approval.answer, true)
+		case slackDenyReaction, "-1", "no_entry":
+			sendApproval(approval.answer, false)
+		}
+	case "app_mention", "message":
+		if event.Subtype == "" {
+			// Starting a session waits for the turn lock, which a turn
+			// awaiting an approval reaction holds; keep reading meanwhile.
+			go b.handleMessage(event)
+		}
+	}
+}
+
+// handleMessage routes a mention or thread reply to the thread's session,
+// starting one for a new thread.
+func (b *slackBot) handleMessage(event slackEvent) {
+	mention := "<@" + b.botUserID + ">"
+	root := event.ThreadTS
+	if root == "" {
+		root = event.TS
+	}
+	key := event.Channel + "/" + root
+	prompt := strings.TrimSpace(strings.ReplaceAll(event.Text, mention, ""))
+	// Mentions arrive as both app_mention and message events; take the
+	// app_mention one. Other thread replies continue a known session.
+	// Looking the thread up and registering a new one happen under one lock
+	// so two messages arriving together cannot both start a session.
+	b.mu.Lock()
+	thread := b.threads[key]
+	if prompt == "" || (event.Type == "message" && (thread == nil || strings.Contains(event.Text, mention))) {
+		b.mu.Unlock()
+		return
+	}
+	started := thread == nil
+	if started {
+		thread = &slackThread{channel: event.Channel, ts: root, prompts: make(chan slackPrompt, 8)}
+		b.threads[key] = thread
+	}
+	b.mu.Unlock()
+	if started {
+		if err := b.startThread(thread); err != nil {
+			b.mu.Lock()
+			delete(b.threads, key)
+			b.mu.Unlock()
+			b.post(event.Channel, root, "Could not start a session: "+err.Error())
+			return
+		}
+	}
+	select {
+	case thread.prompts <- slackPrompt{user: event.User, text: prompt}:
+	default:
+		b.post(event.Channel, root, "Still working on earlier messages in this thread; try again shortly.")
+	}
+}
+
+// mayApprove reports whether user's reaction answers approval: anyone but
+// the user who asked for the turn, and with -approvers only those users.
+func (b *slackBot) mayApprove(approval *slackApproval, user string) bool {
+	if user == "" || user == approval.requester {
+		return false
+	}
+	return len(b.approvers) == 0 || b.approvers[user]
+}
+
+func sendApproval(answer chan bool, approved bool) {
+	select {
+	case answer <- approved:
+	default:
+	}
+}
+
+// startThread creates the session for a newly registered thread and the
+// goroutine that runs its prompts in order. Prompts that arrive meanwhile
+// wait in the thread's channel.
+func (b *slackBot) startThread(thread *slackThread) error {
+	dir, err := b.workspaces.create(b.copySource)
+	if err != nil {
+		return err
+	}
+	agent, err := b.workspaces.newAgent(b.cfg, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	thread.agent = agent
+	agent.Session.OnEvent = func(event Event) { b.postEvent(thread, event) }
+	agent.Session.Approve = func(question string) bool { return b.askApproval(thread, question) }
+	debugf("slack_thread_started channel=%q ts=%q workspace=%q", thread.channel, thread.ts, dir)
+
+	go func() {
+		for prompt := range thread.prompts {
+			thread.requester = prompt.user
+			if _, err := agent.Run(context.Background(), prompt.text); err != nil {
+				b.post(thread.channel, thread.ts, "Turn failed: "+err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// postEvent mirrors tool activity and replies into the thread.
+func (b *slackBot) postEvent(thread *slackThread, event Event) {
+	switch event.Type {
+	case EventText:
+		b.post(thread.channel, thread.ts, event.Text)
+	case EventToolCall:
+		b.post(thread.channel, thread.ts, fmt.Sprintf(":hammer_and_wrench: `%s` %s", event.Tool, previewText(string(event.Input), 300)))
+	case EventToolResult:
+		if event.IsError {
+			b.post(thread.channel, thread.ts, fmt.Sprintf(":warning: `%s` failed: %s", event.Tool, previewText(event.Text, 500)))
+		}
+	case EventError:
+		b.post(thread.channel, thread.ts, ":warning: "+event.Text)
+	}
+}
+
+// askApproval posts question in the thread and waits for an approving or
+// denying reaction on it from someone mayApprove allows. No answer within
+// slackApprovalTimeout is a no.
+func (b *slackBot) askApproval(thread *slackThread, question string) bool {
+	who := "Someone other than <@" + thread.requester + ">"
+	if len(b.approvers) > 0 {
+		who = "An approver other than <@" + thread.requester + ">"
+	}
+	ts, err := b.post(thread.channel, thread.ts, fmt.Sprintf(":raised_hand: %s\n%s, react with :%s: to allow or :%s: to deny.", question, who, slackApproveReaction, slackDenyReaction))
+	if err != nil {
+		return false
+	}
+	key := thread.channel + "/" + ts
+	approval := &slackApproval{answer: make(chan bool, 1), requester: thread.requester}
+	b.mu.Lock()
+	b.approvals[key] = approval
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.approvals, key)
+		b.mu.Unlock()
+	}()
+	select {
+	case approved := <-approval.answer:
+		return approved
+	case <-time.After(slackApprovalTimeout):
+		b.post(thread.channel, thread.ts, "No answer; treating that as a no.")
+		return false
+	}
+}
+
+// post sends text as a reply in a thread and returns the new message's ts.
+func (b *slackBot) post(channel, threadTS, text string) (string, error) {
+	if len(text) > maxSlackMessageChars {
+		text = strings.ToValidUTF8(text[:maxSlackMessageChars], "") + "\n… (truncated)"
+	}
+	var reply struct {
+		TS string `json:"ts"`
+	}
+	err := b.call(b.botToken, "chat.postMessage", map[string]string{"channel": channel, "thread_ts": threadTS, "text": text}, &reply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Slack post failed: %v\n", err)
+	}
+	return reply.TS, err
+}
+
+// call invokes a Slack Web API method and decodes the response into out.
+func (b *slackBot) call(token, method string, payload any, out any) error {
+	body := []byte("{}")
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, slackAPIURL+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var data json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", method, err)
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	if !status.OK {
+		return fmt.Errorf("%s: %s", method, status.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlackMayApprove(t *testing.T) {
+	approval := &slackApproval{requester: "U1"}
+	open := &slackBot{}
+	if open.mayApprove(approval, "U1") {
+		t.Error("the user who asked approved their own request")
+	}
+	if !open.mayApprove(approval, "U2") {
+		t.Error("another user could not approve without -approvers")
+	}
+
+	listed := &slackBot{approvers: map[string]bool{"U1": true, "U3": true}}
+	if listed.mayApprove(approval, "U1") {
+		t.Error("an approver approved their own request")
+	}
+	if listed.mayApprove(approval, "U2") {
+		t.Error("a user outside -approvers approved")
+	}
+	if !listed.mayApprove(approval, "U3") {
+		t.Error("another approver could not approve")
+	}
+}
+
+func TestSlackConcurrentMentionsShareThread(t *testing.T) {
+	// The model endpoint fails every request, so each turn ends at once.
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no model here", http.StatusBadRequest)
+	}))
+	defer model.Close()
+	var posts sync.WaitGroup
+	posts.Add(2)
+	slack := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		if strings.Contains(string(body), "Turn failed") {
+			posts.Done()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`{"ok":true,"ts":"2.0"}`))}, nil
+	})
+
+	workspaces, err := newWorkspaces(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := &slackBot{
+		cfg:        Config{Provider: providerOllama, OllamaURL: model.URL, ModelID: "test"},
+		botUserID:  "UBOT",
+		workspaces: workspaces,
+		client:     &http.Client{Transport: slack},
+		threads:    make(map[string]*slackThread),
+		approvals:  make(map[string]*slackApproval),
+	}
+	var mentions sync.WaitGroup
+	for _, text := range []string{"<@UBOT> fix the build", "<@UBOT> and the tests"} {
+		mentions.Add(1)
+		go func() {
+			defer mentions.Done()
+			bot.handleMessage(slackEvent{Type: "app_mention", User: "U1", Channel: "C1", TS: "1.0", Text: text})
+		}()
+	}
+	mentions.Wait()
+
+	done := make(chan struct{})
+	go func() { posts.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the turns did not finish")
+	}
+	if len(bot.threads) != 1 {
+		t.Errorf("%d threads were started for one Slack thread", len(bot.threads))
+	}
+	if entries, _ := os.ReadDir(workspaces.root); len(entries) != 1 {
+		t.Errorf("%d workspaces were created for one Slack thread", len(entries))
+	}
+}
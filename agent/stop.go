@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stopConditionStopped is turnStats.Stopped for a turn a stop condition
+// ended.
+const stopConditionStopped = "stop_condition"
+
+// StopConfig holds declarative stop conditions for autonomous runs. They are
+// checked before each model request in the tool loop, and the first one met
+// ends the turn with an explanation. Zero values are unset.
+type StopConfig struct {
+	// MaxDuration is how long the session may run, such as "45m".
+	MaxDuration string `json:"max_duration,omitempty"`
+	// MaxCost is how many dollars the session may spend; -max-cost
+	// overrides it.
+	MaxCost float64 `json:"max_cost,omitempty"`
+	// MaxFilesChanged is how many distinct files the session's tools may
+	// write or delete.
+	MaxFilesChanged int `json:"max_files_changed,omitempty"`
+	// Paths are .coderignore-style patterns for files that need a person
+	// once the session has touched them, such as "migrations/" or
+	// ".github/workflows/".
+	Paths []string `json:"paths,omitempty"`
+}
+
+func (c StopConfig) validate() error {
+	if c.MaxDuration != "" {
+		if d, err := time.ParseDuration(c.MaxDuration); err != nil || d <= 0 {
+			return fmt.Errorf("stop.max_duration must be a duration such as \"45m\"")
+		}
+	}
+	if c.MaxCost < 0 || c.MaxFilesChanged < 0 {
+		return fmt.Errorf("stop limits must not be negative")
+	}
+	return nil
+}
+
+func parseStopPaths(patterns []string) *ignoreMatcher {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return parseIgnorePatterns(strings.Join(patterns, "\n"))
+}
+
+// stopCondition returns why the session must stop, or "" while none of its
+// stop conditions is met. The cost limit is checked with -max-cost.
+func (s *Session) stopCondition() string {
+	stop := s.cfg.Project.Stop
+	if stop.MaxDuration != "" {
+		limit, _ := time.ParseDuration(stop.MaxDuration)
+		if elapsed := time.Since(s.started); elapsed >= limit {
+			return fmt.Sprintf("the session has run for %s, reaching stop.max_duration of %s", elapsed.Round(time.Second), limit)
+		}
+	}
+	if stop.MaxFilesChanged > 0 && len(s.edited) >= stop.MaxFilesChanged {
+		return fmt.Sprintf("the session has changed %d files, reaching stop.max_files_changed of %d", len(s.edited), stop.MaxFilesChanged)
+	}
+	if s.stopPaths != nil {
+		var touched []string
+		for absFile := range s.edited {
+			if rel := workspaceRelative(s.root, absFile); s.stopPaths.Ignored(rel, false) {
+				touched = append(touched, rel)
+			}
+		}
+		if len(touched) > 0 {
+			sort.Strings(touched)
+			return fmt.Sprintf("the session changed %s, which matches stop.paths", touched[0])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package agent
+
+// stdoutColumns cannot ask the terminal for its width on this platform, so
+// terminalWidth falls back to $COLUMNS or its default.
+func stdoutColumns() (int, bool) {
+	return 0, false
+}
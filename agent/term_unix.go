@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package agent
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// stdoutColumns asks the terminal on stdout for its width.
+func stdoutColumns() (int, bool) {
+	var size struct{ Rows, Cols, X, Y uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&size)))
+	if errno != 0 || size.Cols == 0 {
+		return 0, false
+	}
+	return int(size.Cols), true
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"strings"
+	"time"
+)
+
+// defaultRequestTimeout bounds a model request when neither the project config
+// nor knownModels gives a timeout for the model.
+const defaultRequestTimeout = 120 * time.Second
+
+// requestTimeout returns how long a request to modelID may take when it allows
+// up to maxTokens output tokens. The base timeout comes from request_timeouts
+// in the project config, then knownModels, then defaultRequestTimeout. Replies
+// take longer the more they may generate, so the base grows in proportion once
+// maxTokens, which includes any extended thinking budget, is above
+// defaultMaxTokens.
+func requestTimeout(cfg Config, modelID string, maxTokens int64) time.Duration {
+	timeout := defaultRequestTimeout
+	if info, ok := lookupModel(modelID); ok && info.RequestTimeout > 0 {
+		timeout = info.RequestTimeout
+	}
+	best := ""
+	for prefix := range cfg.Project.RequestTimeouts {
+		if strings.HasPrefix(modelID, prefix) && len(prefix) >= len(best) {
+			best = prefix
+		}
+	}
+	if value, ok := cfg.Project.RequestTimeouts[best]; ok {
+		// Validated when the config was loaded.
+		timeout, _ = time.ParseDuration(value)
+	}
+	if maxTokens > defaultMaxTokens {
+		timeout = time.Duration(float64(timeout) * float64(maxTokens) / float64(defaultMaxTokens))
+	}
+	return timeout
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// titleModelID writes session titles for Anthropic sessions; other
+	// providers use the session's model.
+	titleModelID  = "claude-haiku-4-5"
+	titleTimeout  = 20 * time.Second
+	maxTitleChars = 80
+	titlePrompt   = "Write a title of 5 to 8 words for the conversation below, for a list of saved sessions. Reply with only the title."
+)
+
+// generateTitle replaces the session's title, the start of its first prompt,
+// with a short one written by a cheap model once the first exchange is done.
+// Failures keep the prompt-based title.
+func (s *Session) generateTitle() {
+	if s.turn != 1 || s.titleGenerated || s.provider == nil || s.lastResponse == "" {
+		return
+	}
+	if s.cfg.Project.SessionTitles != nil && !*s.cfg.Project.SessionTitles {
+		return
+	}
+	s.titleGenerated = true
+	modelID := s.cfg.ModelID
+	if s.cfg.Provider == providerAnthropic {
+		modelID = titleModelID
+	}
+	conversation := "Request:\n" + previewText(firstUserText(s.history), 2000) + "\n\nReply:\n" + previewText(s.lastResponse, 2000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), titleTimeout)
+	defer cancel()
+	start := time.Now()
+	message, _, err := s.provider.Send(ctx, ProviderRequest{
+		ModelID:      modelID,
+		SystemPrompt: "You write short, specific titles for coding sessions.",
+		History:      []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock(titlePrompt + "\n\n" + conversation))},
+	})
+	metrics.observeAPICall(modelID, time.Since(start), message, err)
+	if err != nil {
+		debugf("session_title_failed model_id=%q error=%q", modelID, err.Error())
+		return
+	}
+	text, _ := parseContent(message.Content)
+	title := cleanTitle(text)
+	if title == "" {
+		return
+	}
+	s.title = title
+	s.save(s.cfg.ModelID)
+	debugf("session_title session=%q title=%q", s.ID, title)
+}
+
+// cleanTitle keeps the first line of a model-written title without the
+// quotes, heading marks, or final period models tend to add.
+func cleanTitle(text string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	title = strings.TrimPrefix(strings.TrimSpace(title), "Title:")
+	title = strings.Trim(strings.TrimSpace(title), "\"'`*#. ")
+	return previewText(title, maxTitleChars)
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Tool error codes. Each failed tool call carries one in its tool_result so
+// the model, and the turn loop's retry heuristics, can tell kinds of failure
+// apart without parsing messages.
+const (
+	// ToolErrorValidation: the input was malformed or broke the schema.
+	ToolErrorValidation = "validation"
+	// ToolErrorNotFound: a file, tool, note, or piece of text did not exist.
+	ToolErrorNotFound = "not_found"
+	// ToolErrorPermission: configuration, the user, or a hook refused the call.
+	ToolErrorPermission = "permission"
+	// ToolErrorTimeout: the call ran out of time.
+	ToolErrorTimeout = "timeout"
+	// ToolErrorConflict: the workspace changed under the call.
+	ToolErrorConflict = "conflict"
+	// ToolErrorCancelled: the user interrupted the call.
+	ToolErrorCancelled = "cancelled"
+	// ToolErrorFailed: anything else.
+	ToolErrorFailed = "failed"
+)
+
+// ToolError is a tool failure with a code. Tools may return one, possibly
+// wrapped, to classify their failure; other errors are classified by
+// asToolError.
+type ToolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Violations lists the broken schema constraints of a validation error.
+	Violations []SchemaViolation `json:"violations,omitempty"`
+}
+
+func (e *ToolError) Error() string {
+	return e.Message
+}
+
+func newToolError(code, format string, args ...any) error {
+	return &ToolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// asToolError classifies a tool's error: by the ToolError it wraps if any,
+// then by well-known causes, and otherwise as ToolErrorFailed. The message is
+// always the full error text.
+func asToolError(err error) *ToolError {
+	result := &ToolError{Code: ToolErrorFailed, Message: err.Error()}
+	var toolErr *ToolError
+	switch {
+	case errors.As(err, &toolErr):
+		result.Code, result.Violations = toolErr.Code, toolErr.Violations
+	case errors.Is(err, os.ErrNotExist):
+		result.Code = ToolErrorNotFound
+	case errors.Is(err, os.ErrPermission):
+		result.Code = ToolErrorPermission
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		result.Code = ToolErrorTimeout
+	}
+	return result
+}
+
+// formatToolError is the tool_result content for a failed call.
+func formatToolError(toolErr *ToolError) string {
+	encoded, err := json.Marshal(map[string]any{"error": toolErr})
+	if err != nil {
+		return toolErr.Message
+	}
+	return string(encoded)
+}
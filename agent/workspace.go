@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	symlinkDenyEscape = "deny-escape"
+	symlinkAllow      = "allow"
+)
+
+// checkSymlinkEscape resolves symlinks along abs (for paths that do not exist
+// yet, along their deepest existing ancestor) and rejects the path if it ends
+// up outside root, unless the session's symlink policy allows it.
+func (s *Session) checkSymlinkEscape(root, abs, display string) error {
+	if s.symlinks == symlinkAllow {
+		return nil
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("failed to resolve workspace directory: %w", err)
+	}
+	real, err := evalExistingSymlinks(abs)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path %q: %w", display, err)
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		debugf("symlink_escape_blocked path=%q target=%q", display, real)
+		return newToolError(ToolErrorPermission, "path %s resolves through a symlink to %s, outside the current workspace", display, real)
+	}
+	return nil
+}
+
+func evalExistingSymlinks(abs string) (string, error) {
+	var rest []string
+	current := abs
+	for hops := 0; ; {
+		real, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// A dangling link would still be followed by a write, so resolve
+		// its target instead of its parent.
+		if info, lerr := os.Lstat(current); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			if hops++; hops > 40 {
+				return "", errors.New("too many levels of symbolic links")
+			}
+			target, err := os.Readlink(current)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(current), target)
+			}
+			current = target
+			continue
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return abs, nil
+		}
+		rest = append([]string{filepath.Base(current)}, rest...)
+		current = parent
+	}
+}
+
+// resolveToolPath maps a tool's path argument to an absolute path and the
+// path to show for it. Paths must be relative and inside the workspace, or
+// inside an added directory, where they may also be absolute; write
+// additionally requires the added directory to be writable.
+func (s *Session) resolveToolPath(pathArg string, write bool) (string, string, error) {
+	if abs, display, ok, err := s.resolveScratchPath(pathArg); ok {
+		return abs, display, err
+	}
+	abs := filepath.Clean(pathArg)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(s.root, abs)
+	}
+	rel, err := filepath.Rel(s.root, abs)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve relative path: %w", err)
+	}
+	display := filepath.ToSlash(rel)
+	if !filepath.IsAbs(pathArg) && !pathEscapes(rel) {
+		if err := s.checkSymlinkEscape(s.root, abs, display); err != nil {
+			return "", "", err
+		}
+		return abs, display, nil
+	}
+
+	for _, dir := range s.addedDirs {
+		inner, err := filepath.Rel(dir.Path, abs)
+		if err != nil || pathEscapes(inner) {
+			continue
+		}
+		if write && !dir.Write {
+			return "", "", newToolError(ToolErrorPermission, "%s is in %s, which was added read-only", display, dir.Path)
+		}
+		if err := s.checkSymlinkEscape(dir.Path, abs, display); err != nil {
+			return "", "", err
+		}
+		return abs, display, nil
+	}
+	if filepath.IsAbs(pathArg) {
+		return "", "", newToolError(ToolErrorPermission, "path must be relative to the current workspace")
+	}
+	return "", "", newToolError(ToolErrorPermission, "path escapes the current workspace")
+}
+
+func pathEscapes(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkAddedDirRoot rejects operations on an added directory itself, which
+// would otherwise escape the "not the workspace root" guards.
+func (s *Session) checkAddedDirRoot(abs, display string) error {
+	for _, dir := range s.addedDirs {
+		if abs == dir.Path {
+			return newToolError(ToolErrorPermission, "refusing to modify %s: it is an added directory root", display)
+		}
+	}
+	return nil
+}
+
+func (s *Session) resolveWorkspaceFileForWrite(pathArg string) (string, string, error) {
+	pathArg = strings.TrimSpace(pathArg)
+	if pathArg == "" {
+		return "", "", errors.New("path is required")
+	}
+	if filepath.Clean(pathArg) == "." {
+		return "", "", errors.New("path must point to a file")
+	}
+	abs, display, err := s.resolveToolPath(pathArg, true)
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.checkAddedDirRoot(abs, display); err != nil {
+		return "", "", err
+	}
+	return abs, display, nil
+}
+
+func (s *Session) resolveWorkspaceFile(pathArg string) (string, string, error) {
+	pathArg = strings.TrimSpace(pathArg)
+	if pathArg == "" {
+		return "", "", errors.New("path is required")
+	}
+	clean := filepath.Clean(pathArg)
+	if clean == "." {
+		return "", "", errors.New("path must point to a file")
+	}
+	abs, display, err := s.resolveToolPath(pathArg, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to access path %q: %w", clean, err)
+	}
+	if info.IsDir() {
+		return "", "", fmt.Errorf("path is a directory: %s", display)
+	}
+	return abs, display, nil
+}
+
+func (s *Session) resolveWorkspaceDir(pathArg string) (string, string, error) {
+	pathArg = strings.TrimSpace(pathArg)
+	if pathArg == "" {
+		pathArg = "."
+	}
+	clean := filepath.Clean(pathArg)
+	abs, display, err := s.resolveToolPath(pathArg, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to access path %q: %w", clean, err)
+	}
+	if !info.IsDir() {
+		return "", "", fmt.Errorf("path is not a directory: %s", display)
+	}
+	if display == "" {
+		display = "."
+	}
+	return abs, display, nil
+}
@@ -0,0 +1,52 @@
+package agent
+
+import "fmt"
+
+const (
+	// defaultMaxWriteBytes is the largest a write or edit may make a file
+	// when the project config does not set max_write_bytes.
+	defaultMaxWriteBytes = 1 << 20
+	// shrinkGuardMinBytes is the size below which an existing file may be
+	// rewritten to any size without asking.
+	shrinkGuardMinBytes = 1 << 10
+	// shrinkGuardRatio asks before write_file replaces a file with content
+	// under this fraction of its size, which usually means the model left
+	// part of it out.
+	shrinkGuardRatio = 0.25
+)
+
+// maxWriteBytes returns the project's max_write_bytes, or the default.
+func (s *Session) maxWriteBytes() int {
+	if s.cfg.Project.MaxWriteBytes > 0 {
+		return s.cfg.Project.MaxWriteBytes
+	}
+	return defaultMaxWriteBytes
+}
+
+// checkWriteSize refuses content that would grow a file past the size limit.
+// Files already over it can still be edited as long as they do not grow.
+func (s *Session) checkWriteSize(displayPath string, previousSize, size int) error {
+	limit := s.maxWriteBytes()
+	if size <= limit || size <= previousSize {
+		return nil
+	}
+	return newToolError(ToolErrorValidation, "refusing to write %d bytes to %s: the limit is %d bytes (max_write_bytes in the project config); split the content into several files or generate it with a command", size, displayPath, limit)
+}
+
+// checkShrink asks the user before write_file replaces an existing file with
+// content a small fraction of its size.
+func (s *Session) checkShrink(displayPath string, previousSize, size int) error {
+	if previousSize < shrinkGuardMinBytes || s.inScratch(displayPath) || float64(size) >= float64(previousSize)*shrinkGuardRatio {
+		return nil
+	}
+	question := fmt.Sprintf("write_file would shrink %s from %d to %d bytes. Allow?", displayPath, previousSize, size)
+	if !s.confirm(question) {
+		return newToolError(ToolErrorPermission, "the user declined shrinking %s from %d to %d bytes; write its complete content, or use edit_files to change part of it", displayPath, previousSize, size)
+	}
+	return nil
+}
+
+// byteDelta describes a change in size for write messages, e.g. "1204 bytes, -310".
+func byteDelta(before, after int) string {
+	return fmt.Sprintf("%d bytes, %+d", after, after-before)
+}
@@ -0,0 +1,513 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseYAML reads the first document of a YAML file into the values
+// encoding/json would produce: map[string]any, []any, string, float64 or
+// int64, bool, and nil. It covers what configuration files use: block and
+// flow collections, plain and quoted scalars, literal and folded block
+// scalars, comments, anchors, aliases, and merge keys. Tags are ignored.
+func parseYAML(text string) (any, error) {
+	p := &yamlParser{lines: strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), anchors: map[string]any{}}
+	// Skip a leading directive block and document marker.
+	for p.next(); p.pos < len(p.lines); p.next() {
+		line := strings.TrimSpace(p.lines[p.pos])
+		if !strings.HasPrefix(line, "%") && line != "---" {
+			if rest, ok := strings.CutPrefix(line, "--- "); ok {
+				p.lines[p.pos] = rest
+			}
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	value, err := p.block(p.indent())
+	if err != nil {
+		return nil, err
+	}
+	if p.next(); p.pos < len(p.lines) {
+		if line := strings.TrimSpace(p.lines[p.pos]); line != "---" && line != "..." {
+			return nil, p.errorf("unexpected %q", line)
+		}
+	}
+	return value, nil
+}
+
+type yamlParser struct {
+	lines   []string
+	pos     int
+	anchors map[string]any
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("yaml line %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// next moves to the next line with content, skipping blank and comment
+// lines.
+func (p *yamlParser) next() {
+	for p.pos < len(p.lines) {
+		line := strings.TrimSpace(p.lines[p.pos])
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *yamlParser) indent() int {
+	line := p.lines[p.pos]
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func (p *yamlParser) content() string {
+	return strings.TrimSpace(p.lines[p.pos])
+}
+
+// atEnd reports whether the block at indent is over: no more lines, a
+// shallower line, or a document marker.
+func (p *yamlParser) atEnd(indent int) bool {
+	p.next()
+	if p.pos >= len(p.lines) {
+		return true
+	}
+	line := p.lines[p.pos]
+	return p.indent() < indent || line == "---" || line == "..." || strings.HasPrefix(line, "--- ")
+}
+
+// block parses the sequence, mapping, or scalar starting at the current
+// line, whose indentation is indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	text := p.content()
+	if text == "-" || strings.HasPrefix(text, "- ") {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(text); ok {
+		return p.mapping(indent)
+	}
+	// A scalar or flow collection, possibly continued on deeper lines.
+	p.pos++
+	for !p.atEnd(indent + 1) {
+		text += " " + p.content()
+		p.pos++
+	}
+	return p.inline(text)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	items := []any{}
+	for !p.atEnd(indent) && p.indent() == indent {
+		text := p.content()
+		if text != "-" && !strings.HasPrefix(text, "- ") {
+			return nil, p.errorf("expected a list item, found %q", text)
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		var item any
+		var err error
+		switch {
+		case rest == "" || strings.HasPrefix(rest, "#"):
+			p.pos++
+			if !p.atEnd(indent+1) && p.indent() > indent {
+				item, err = p.block(p.indent())
+			}
+		default:
+			// The item's content starts a block of its own at its column, as
+			// in "- name: x" followed by "  image: y".
+			column := indent + len(text) - len(rest)
+			p.lines[p.pos] = strings.Repeat(" ", column) + rest
+			item, err = p.block(column)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for !p.atEnd(indent) && p.indent() == indent {
+		text := p.content()
+		rawKey, rest, ok := splitYAMLKey(text)
+		if !ok {
+			return nil, p.errorf("expected a key, found %q", text)
+		}
+		key, err := p.inline(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		rest = stripYAMLComment(rest)
+		anchor := ""
+		if name, after, ok := cutYAMLAnchor(rest); ok {
+			anchor, rest = name, after
+		}
+		rest = stripYAMLTag(rest)
+		var value any
+		switch {
+		case rest == "":
+			p.pos++
+			switch {
+			case p.atEnd(indent):
+			case p.indent() > indent:
+				value, err = p.block(p.indent())
+			case p.indent() == indent && (p.content() == "-" || strings.HasPrefix(p.content(), "- ")):
+				// Lists may sit at their key's indentation.
+				value, err = p.sequence(indent)
+			}
+		case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+			p.pos++
+			value = p.blockScalar(indent, rest)
+		default:
+			p.pos++
+			// Plain and flow values may continue on deeper lines.
+			for !strings.HasPrefix(rest, `"`) && !strings.HasPrefix(rest, "'") && !p.atEnd(indent+1) {
+				if _, _, isKey := splitYAMLKey(p.content()); isKey && !strings.HasPrefix(rest, "[") && !strings.HasPrefix(rest, "{") {
+					break
+				}
+				rest += " " + stripYAMLComment(p.content())
+				p.pos++
+			}
+			value, err = p.inline(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if anchor != "" {
+			p.anchors[anchor] = value
+		}
+		name := fmt.Sprint(key)
+		if key == nil {
+			name = "null"
+		}
+		if merged, ok := value.(map[string]any); ok && name == "<<" {
+			for k, v := range merged {
+				if _, exists := m[k]; !exists {
+					m[k] = v
+				}
+			}
+			continue
+		}
+		m[name] = value
+	}
+	return m, nil
+}
+
+// blockScalar reads a | or > scalar whose header is header, from the lines
+// indented deeper than indent.
+func (p *yamlParser) blockScalar(indent int, header string) string {
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if n <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = n
+		}
+		if n < blockIndent {
+			break
+		}
+		lines = append(lines, line[blockIndent:])
+	}
+	// Trailing blank lines belong to chomping, not to the next key.
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var text string
+	if strings.HasPrefix(header, "|") {
+		text = strings.Join(lines, "\n")
+	} else {
+		var b strings.Builder
+		for i, line := range lines {
+			switch {
+			case i == 0:
+			case line == "" || lines[i-1] == "" || strings.HasPrefix(line, " "):
+				b.WriteString("\n")
+			default:
+				b.WriteString(" ")
+			}
+			b.WriteString(line)
+		}
+		text = b.String()
+	}
+	switch {
+	case strings.Contains(header, "-"):
+		return text
+	case strings.Contains(header, "+"):
+		return text + "\n" + strings.Repeat("\n", trailing)
+	case text == "":
+		return ""
+	}
+	return text + "\n"
+}
+
+// inline parses a scalar, alias, or flow collection written on one line.
+func (p *yamlParser) inline(text string) (any, error) {
+	text = strings.TrimSpace(stripYAMLComment(text))
+	if name, rest, ok := cutYAMLAnchor(text); ok {
+		value, err := p.inline(rest)
+		p.anchors[name] = value
+		return value, err
+	}
+	text = stripYAMLTag(text)
+	if alias, ok := strings.CutPrefix(text, "*"); ok {
+		value, found := p.anchors[alias]
+		if !found {
+			return nil, p.errorf("unknown alias *%s", alias)
+		}
+		return value, nil
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		flow := &yamlFlow{text: text, parser: p}
+		value, err := flow.value()
+		if err != nil {
+			return nil, err
+		}
+		if flow.skipSpace(); flow.pos < len(flow.text) {
+			return nil, p.errorf("unexpected %q after a flow collection", flow.text[flow.pos:])
+		}
+		return value, nil
+	}
+	return parseYAMLScalar(text)
+}
+
+func parseYAMLScalar(text string) (any, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		if len(text) < 2 || !strings.HasSuffix(text, `"`) {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		// YAML double-quoted escapes are close enough to Go's.
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return strings.ReplaceAll(text[1:len(text)-1], `\"`, `"`), nil
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case ".inf", ".Inf", ".INF", "+.inf":
+		return math.Inf(1), nil
+	case "-.inf", "-.Inf", "-.INF":
+		return math.Inf(-1), nil
+	}
+	// A leading zero is decimal in YAML 1.2, not octal as ParseInt reads it;
+	// the float below gets those.
+	digits := strings.TrimLeft(text, "+-")
+	leadingZero := len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9'
+	if n, err := strconv.ParseInt(strings.ReplaceAll(text, "_", ""), 0, 64); err == nil && !leadingZero {
+		return n, nil
+	}
+	if strings.ContainsAny(text, "0123456789") {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	}
+	return text, nil
+}
+
+// splitYAMLKey splits a "key: value" line at its colon, outside quotes and
+// flow collections.
+func splitYAMLKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") || strings.HasPrefix(text, "#") {
+		return "", "", false
+	}
+	if strings.HasPrefix(text, "? ") {
+		return "", "", false
+	}
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == '#' && i > 0 && text[i-1] == ' ':
+			return "", "", false
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t'):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// stripYAMLComment removes a trailing # comment outside quotes.
+func stripYAMLComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" [{,:", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimSpace(text[:i])
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+func cutYAMLAnchor(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "&") {
+		return "", "", false
+	}
+	name, rest, _ := strings.Cut(text[1:], " ")
+	return name, strings.TrimSpace(rest), true
+}
+
+func stripYAMLTag(text string) string {
+	if !strings.HasPrefix(text, "!") {
+		return text
+	}
+	_, rest, _ := strings.Cut(text, " ")
+	return strings.TrimSpace(rest)
+}
+
+// yamlFlow parses a flow collection such as [a, b] or {k: v}.
+type yamlFlow struct {
+	text   string
+	pos    int
+	parser *yamlParser
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.pos < len(f.text) && (f.text[f.pos] == ' ' || f.text[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) value() (any, error) {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return nil, fmt.Errorf("unterminated flow collection %s", f.text)
+	}
+	switch f.text[f.pos] {
+	case '[':
+		f.pos++
+		items := []any{}
+		for {
+			f.skipSpace()
+			if f.pos < len(f.text) && f.text[f.pos] == ']' {
+				f.pos++
+				return items, nil
+			}
+			item, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.pos++
+		m := map[string]any{}
+		for {
+			f.skipSpace()
+			if f.pos < len(f.text) && f.text[f.pos] == '}' {
+				f.pos++
+				return m, nil
+			}
+			key, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+			var value any
+			if f.pos < len(f.text) && f.text[f.pos] == ':' {
+				f.pos++
+				if value, err = f.value(); err != nil {
+					return nil, err
+				}
+			}
+			m[fmt.Sprint(key)] = value
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f.scalar(false)
+}
+
+// separator consumes the comma after an item, leaving a closing bracket.
+func (f *yamlFlow) separator(closing byte) error {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return fmt.Errorf("unterminated flow collection %s", f.text)
+	}
+	switch f.text[f.pos] {
+	case ',':
+		f.pos++
+		return nil
+	case closing:
+		return nil
+	}
+	return fmt.Errorf("expected , or %c at %q", closing, f.text[f.pos:])
+}
+
+// scalar reads a flow scalar up to the next delimiter; a key also stops at
+// a colon.
+func (f *yamlFlow) scalar(key bool) (any, error) {
+	f.skipSpace()
+	start := f.pos
+	if f.pos < len(f.text) && (f.text[f.pos] == '"' || f.text[f.pos] == '\'') {
+		quote := f.text[f.pos]
+		for f.pos++; f.pos < len(f.text); f.pos++ {
+			if f.text[f.pos] == '\\' && quote == '"' {
+				f.pos++
+				continue
+			}
+			if f.text[f.pos] == quote {
+				if quote == '\'' && f.pos+1 < len(f.text) && f.text[f.pos+1] == '\'' {
+					f.pos++
+					continue
+				}
+				f.pos++
+				return parseYAMLScalar(f.text[start:f.pos])
+			}
+		}
+		return nil, fmt.Errorf("unterminated string in %s", f.text)
+	}
+	for f.pos < len(f.text) && !strings.ContainsRune(",]}", rune(f.text[f.pos])) {
+		if f.text[f.pos] == ':' && (key || f.pos+1 == len(f.text) || f.text[f.pos+1] == ' ') {
+			break
+		}
+		f.pos++
+	}
+	return f.parser.inline(f.text[start:f.pos])
+}
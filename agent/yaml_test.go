@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name, yaml, want string
+	}{
+		{"empty", "", `null`},
+		{"scalars", "s: text\nq: \"a\\tb\"\nsq: 'it''s'\nn: 42\nf: 1.5\nb: true\nz: ~\nhex: 0x1f\nver: 1.2.3\nzip: 01234",
+			`{"b":true,"f":1.5,"hex":31,"n":42,"q":"a\tb","s":"text","sq":"it's","ver":"1.2.3","z":null,"zip":1234}`},
+		{"nested", "server:\n  host: localhost\n  ports:\n    - 80\n    - 443\n", `{"server":{"host":"localhost","ports":[80,443]}}`},
+		{"sequence of mappings", "- name: a\n  value: 1\n- name: b\n  value: 2\n", `[{"name":"a","value":1},{"name":"b","value":2}]`},
+		{"flow collections", "list: [1, two, \"three\"]\nmap: {a: 1, b: [x, y]}\n", `{"list":[1,"two","three"],"map":{"a":1,"b":["x","y"]}}`},
+		{"comments", "# header\na: 1 # trailing\nb: \"# not a comment\"\n", `{"a":1,"b":"# not a comment"}`},
+		{"literal block", "script: |\n  echo one\n  echo two\nnext: x\n", `{"next":"x","script":"echo one\necho two\n"}`},
+		{"folded block", "text: >-\n  one\n  two\n", `{"text":"one two"}`},
+		{"anchors and merge", "base: &base\n  a: 1\n  b: 2\nchild:\n  <<: *base\n  b: 3\n", `{"base":{"a":1,"b":2},"child":{"a":1,"b":3}}`},
+		{"alias", "x: &v hello\ny: *v\n", `{"x":"hello","y":"hello"}`},
+		{"document marker", "---\na: 1\n...\n", `{"a":1}`},
+		{"tags ignored", "a: !!str 123\n", `{"a":123}`},
+		{"crlf", "a: 1\r\nb: 2\r\n", `{"a":1,"b":2}`},
+	}
+	for _, tc := range tests {
+		value, err := parseYAML(tc.yaml)
+		if err != nil {
+			t.Errorf("%s: parseYAML failed: %v", tc.name, err)
+			continue
+		}
+		got, err := json.Marshal(value)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: parseYAML = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	for _, text := range []string{
+		"a: \"unterminated\n",
+		"a: [1, 2\n",
+		"a: *missing\n",
+		"- a\nb: 1\n",
+	} {
+		if _, err := parseYAML(text); err == nil {
+			t.Errorf("parseYAML(%q) accepted invalid YAML", text)
+		}
+	}
+}